@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"customgemini/config"
+	"customgemini/proxy"
+
+	"google.golang.org/genai"
+)
+
+// CheckResult is one line of the -check report.
+type CheckResult struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// CheckReport is printed as JSON by -check.
+type CheckReport struct {
+	OK      bool            `json:"ok"`
+	Version string          `json:"version"`
+	Build   proxy.BuildInfo `json:"build"`
+	Checks  []CheckResult   `json:"checks"`
+}
+
+func (r *CheckReport) add(name string, err error, detail string) {
+	res := CheckResult{Name: name, OK: err == nil, Detail: detail}
+	if err != nil {
+		res.Detail = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, res)
+}
+
+// runSelfCheck validates the configuration and environment without starting
+// the server. It prints a JSON report to stdout and returns the exit code.
+func runSelfCheck(cfg config.Config, projectRoot, home string, cfgErr, projectErr error) int {
+	report := &CheckReport{OK: true, Version: proxy.Version, Build: proxy.Build()}
+
+	report.add("config", cfgErr, fmt.Sprintf("profile=%q tool_policy=%s", cfg.Profile, cfg.ToolPolicy))
+	report.add("project_config", projectErr, filepath.Join(projectRoot, config.ProjectFile))
+
+	if info, err := os.Stat(projectRoot); err != nil {
+		report.add("project_root", err, "")
+	} else if !info.IsDir() {
+		report.add("project_root", fmt.Errorf("%s is not a directory", projectRoot), "")
+	} else {
+		report.add("project_root", nil, projectRoot)
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(cfg.Index.Projects)) {
+		root := cfg.Index.Projects[name]
+		if info, err := os.Stat(root); err != nil {
+			report.add("index_project:"+name, err, "")
+		} else if !info.IsDir() {
+			report.add("index_project:"+name, fmt.Errorf("%s is not a directory", root), "")
+		} else {
+			report.add("index_project:"+name, nil, root)
+		}
+	}
+	if file := cfg.Index.File; file != "" && !strings.HasPrefix(file, "http://") && !strings.HasPrefix(file, "https://") {
+		_, err := os.Stat(file)
+		report.add("index_file", err, file)
+	}
+
+	logsDir := filepath.Join(home, "logs")
+	report.add("logs_dir", checkWritable(logsDir), logsDir)
+
+	if url := cfg.Store.RedisURL; url != "" {
+		store, err := proxy.NewRedisStore(context.Background(), url, cfg.Store.KeyPrefix)
+		if err == nil {
+			store.Close()
+		}
+		report.add("store", err, "redis")
+	}
+
+	checkUpstream(context.Background(), report, cfg)
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// checkWritable creates dir if needed and verifies a file can be written to it.
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// checkUpstream verifies the API key and that every configured model exists
+// and supports what the configuration asks of it.
+func checkUpstream(ctx context.Context, report *CheckReport, cfg config.Config) {
+	apiKey := loadAPIKey()
+	if apiKey == "" {
+		report.add("api_key", fmt.Errorf("GEMINI_API_KEY is not set"), "")
+		return
+	}
+	transport, err := proxy.UpstreamTransport(cfg.Upstream)
+	if err != nil {
+		report.add("upstream", err, "")
+		return
+	}
+	c, err := genai.NewClient(ctx, &genai.ClientConfig{APIKey: apiKey, HTTPClient: &http.Client{Transport: transport}})
+	if err != nil {
+		report.add("api_key", err, "")
+		return
+	}
+
+	available := make(map[string][]string)
+	for m, err := range c.Models.All(ctx) {
+		if err != nil {
+			report.add("api_key", fmt.Errorf("listing models: %w", err), "")
+			return
+		}
+		available[strings.TrimPrefix(m.Name, "models/")] = m.SupportedActions
+	}
+	report.add("api_key", nil, fmt.Sprintf("%d models visible", len(available)))
+
+	// Collect every model the config may route to
+	models := map[string]bool{cfg.Model: true}
+	for _, ep := range []string{config.EndpointWeb, config.EndpointOpenAI, config.EndpointGemini} {
+		m, _ := cfg.Endpoint(ep)
+		models[m] = true
+	}
+	for m := range models {
+		actions, ok := available[m]
+		switch {
+		case !ok:
+			report.add("model:"+m, fmt.Errorf("model %s not available for this API key", m), "")
+		case !hasAction(actions, "generateContent"):
+			report.add("model:"+m, fmt.Errorf("model %s does not support generateContent", m), "")
+		default:
+			report.add("model:"+m, nil, "")
+		}
+	}
+
+	if cfg.CacheID != "" {
+		cache, err := c.Caches.Get(ctx, cfg.CacheID, nil)
+		if err != nil {
+			report.add("cache", err, "")
+		} else if !strings.HasSuffix(cache.Model, "/"+cfg.Model) {
+			report.add("cache", fmt.Errorf("cache %s is bound to %s, not %s", cfg.CacheID, cache.Model, cfg.Model), "")
+		} else {
+			report.add("cache", nil, fmt.Sprintf("expires %s", cache.ExpireTime.Format("2006-01-02 15:04:05")))
+		}
+	} else if cfg.CachePath != "" {
+		if actions, ok := available[cfg.Model]; ok && !hasAction(actions, "createCachedContent") {
+			report.add("cache", fmt.Errorf("model %s does not support context caching", cfg.Model), "")
+		} else {
+			report.add("cache", nil, "model supports context caching")
+		}
+	}
+}
+
+func hasAction(actions []string, action string) bool {
+	for _, a := range actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
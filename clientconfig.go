@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"customgemini/config"
+)
+
+// mcpServerName is the name the MCP bridge is registered under in clients.
+const mcpServerName = "gemini-brain"
+
+// clients are the clients config-for knows.
+var clients = []string{"continue", "cursor", "claude-desktop", "zed"}
+
+// clientSettings is what a client needs to reach this proxy.
+type clientSettings struct {
+	baseURL string // The OpenAI-compatible base URL, ending in /v1
+	apiKey  string
+	model   string
+	mcpPath string // The MCP bridge's source, run with go run
+}
+
+// runConfigFor prints configuration for an IDE or desktop client, with the
+// base URL, model and MCP server of this proxy filled in:
+//
+//	gemini-proxy config-for zed
+//
+// The snippet goes to stdout and where to put it to stderr.
+func runConfigFor(args []string) int {
+	fs := commandFlags("config-for")
+	url := fs.String("url", "", "Address clients reach the proxy at; derived from -port by default")
+	key := fs.String("key", "not-needed", "API key for the client to send; the proxy does not check it, but keys UI settings and the editor selection by it")
+	client, args := verb(args)
+	env := loadEnvironment(fs, args)
+	if err := env.err(); err != nil {
+		return fail(err)
+	}
+	if client == "" {
+		client = fs.Arg(0)
+	}
+	base := *url
+	if base == "" {
+		base = proxyURL(env.cfg.Port)
+	}
+	model, _ := env.cfg.Endpoint(config.EndpointOpenAI)
+	c := clientSettings{
+		baseURL: strings.TrimSuffix(strings.TrimSuffix(base, "/"), "/v1") + "/v1",
+		apiKey:  *key,
+		model:   model,
+		mcpPath: filepath.Join(env.home, "cmd/mcp/main.go"),
+	}
+
+	// With -json, the settings themselves, for scripts that write the
+	// client's configuration their own way
+	if jsonOutput && slices.Contains(clients, client) {
+		return printJSON(map[string]any{
+			"client":   client,
+			"base_url": c.baseURL,
+			"api_key":  c.apiKey,
+			"model":    c.model,
+			"mcp_server": map[string]any{
+				"name": mcpServerName, "command": "go", "args": []string{"run", c.mcpPath},
+			},
+		})
+	}
+	switch client {
+	case "continue":
+		fmt.Fprintln(os.Stderr, "Add to ~/.continue/config.yaml:")
+		return printYAML(c.continueConfig())
+	case "cursor":
+		fmt.Fprintf(os.Stderr, "In Cursor Settings > Models, override the OpenAI base URL with %s, set the API key to %s and add the model %s.\nAdd to ~/.cursor/mcp.json:\n", c.baseURL, c.apiKey, c.model)
+		return printJSON(map[string]any{"mcpServers": c.mcpServers()})
+	case "claude-desktop":
+		fmt.Fprintln(os.Stderr, "Claude Desktop only uses the MCP bridge. Add to ~/Library/Application Support/Claude/claude_desktop_config.json:")
+		return printJSON(map[string]any{"mcpServers": c.mcpServers()})
+	case "zed":
+		fmt.Fprintf(os.Stderr, "Add to ~/.config/zed/settings.json, and enter %s as the OpenAI API key when Zed asks for it:\n", c.apiKey)
+		return printJSON(c.zedConfig())
+	default:
+		fs.Usage()
+		return 2
+	}
+}
+
+// proxyURL turns the listen address into a URL for clients on this
+// machine. An address on every interface is reached through localhost.
+func proxyURL(port string) string {
+	host, p, err := net.SplitHostPort(port)
+	if err != nil {
+		host, p = "", strings.TrimPrefix(port, ":")
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	return "http://" + net.JoinHostPort(host, p)
+}
+
+// mcpServers is the mcpServers stanza shared by Cursor and Claude Desktop.
+func (c clientSettings) mcpServers() map[string]any {
+	return map[string]any{
+		mcpServerName: map[string]any{"command": "go", "args": []string{"run", c.mcpPath}},
+	}
+}
+
+func (c clientSettings) continueConfig() any {
+	type model struct {
+		Name     string `yaml:"name"`
+		Provider string `yaml:"provider"`
+		Model    string `yaml:"model"`
+		APIBase  string `yaml:"apiBase"`
+		APIKey   string `yaml:"apiKey"`
+	}
+	type mcpServer struct {
+		Name    string   `yaml:"name"`
+		Command string   `yaml:"command"`
+		Args    []string `yaml:"args"`
+	}
+	return struct {
+		Name       string      `yaml:"name"`
+		Version    string      `yaml:"version"`
+		Schema     string      `yaml:"schema"`
+		Models     []model     `yaml:"models"`
+		MCPServers []mcpServer `yaml:"mcpServers"`
+	}{
+		Name:       "Gemini Proxy",
+		Version:    "1.0.0",
+		Schema:     "v1",
+		Models:     []model{{"Gemini", "openai", c.model, c.baseURL, c.apiKey}},
+		MCPServers: []mcpServer{{mcpServerName, "go", []string{"run", c.mcpPath}}},
+	}
+}
+
+func (c clientSettings) zedConfig() any {
+	return map[string]any{
+		"agent": map[string]any{
+			"default_model": map[string]any{"provider": "openai", "model": c.model},
+		},
+		"language_models": map[string]any{
+			"openai": map[string]any{
+				"api_url":          c.baseURL,
+				"available_models": []map[string]any{{"name": c.model, "max_tokens": 1048576}},
+			},
+		},
+		"context_servers": map[string]any{
+			mcpServerName: map[string]any{"source": "custom", "command": "go", "args": []string{"run", c.mcpPath}},
+		},
+	}
+}
+
+func printYAML(v any) int {
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(v); err != nil {
+		return fail(err)
+	}
+	return 0
+}
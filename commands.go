@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"customgemini/proxy"
+
+	"google.golang.org/genai"
+)
+
+// commandServer creates the proxy for a subcommand. Warnings and errors
+// are logged to stderr, or everything with log_level debug, leaving stdout
+// to the command's output.
+func (env *environment) commandServer(ctx context.Context) (*proxy.Server, error) {
+	if err := env.err(); err != nil {
+		return nil, err
+	}
+	level := slog.LevelWarn
+	if strings.EqualFold(env.cfg.LogLevel, "debug") {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	return env.newServer(ctx, logger)
+}
+
+// jsonOutput is set by the -json flag every subcommand takes.
+var jsonOutput bool
+
+// commandFlags returns the flag set of a subcommand, whose usage lists its
+// arguments before the server's flags.
+func commandFlags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("gemini-proxy "+name, flag.ExitOnError)
+	fs.Usage = func() {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "Usage: gemini-proxy %s %s\n\n%s.\n\nFlags:\n", name, c.args, c.help)
+		fs.PrintDefaults()
+	}
+	fs.BoolVar(&jsonOutput, "json", false, "Print the output as JSON, for scripts")
+	return fs
+}
+
+// verb splits the verb of a command such as cache or cost from the flags
+// after it, which the flag package would otherwise stop parsing at.
+func verb(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+	return "", args
+}
+
+func fail(err error) int {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	return 1
+}
+
+func printJSON(v any) int {
+	out, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Println(string(out))
+	return 0
+}
+
+// runCache builds, lists and deletes context caches:
+//
+//	gemini-proxy cache build [path]   build a cache of path (default -path, -cache, or .) and print it as JSON
+//	gemini-proxy cache list           list the caches of the API key; * marks the active one
+//	gemini-proxy cache delete <name>  delete a cache
+//
+// cache build is meant for CI: a server started with -cache-id and the
+// printed cache_id uses the cache without building one.
+func runCache(args []string) int {
+	ctx := context.Background()
+	fs := commandFlags("cache")
+	path := fs.String("path", "", "Project to build the cache of, as the path argument")
+	sub, args := verb(args)
+	env := loadEnvironment(fs, args)
+	if sub == "build" {
+		if fs.Arg(0) != "" {
+			*path = fs.Arg(0)
+		}
+		if *path != "" {
+			env.cfg.CachePath = *path
+			env.resolveProject()
+		}
+	}
+	srv, err := env.commandServer(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	switch sub {
+	case "build":
+		if srv.BuildCache(ctx) == "" {
+			return fail(fmt.Errorf("building the cache of %s failed", env.projectRoot))
+		}
+		printJSON(srv.ActiveCacheInfo(ctx))
+
+	case "list":
+		type cacheRow struct {
+			Name        string    `json:"name"`
+			DisplayName string    `json:"display_name"`
+			Model       string    `json:"model"`
+			Tokens      int32     `json:"tokens"`
+			Expires     time.Time `json:"expires"`
+			Active      bool      `json:"active"`
+		}
+		active, _ := srv.Cache()
+		rows := []cacheRow{}
+		for c, err := range srv.Client().Caches.All(ctx) {
+			if err != nil {
+				return fail(err)
+			}
+			row := cacheRow{Name: c.Name, DisplayName: c.DisplayName, Model: strings.TrimPrefix(c.Model, "models/"), Expires: c.ExpireTime, Active: c.Name == active}
+			if c.UsageMetadata != nil {
+				row.Tokens = c.UsageMetadata.TotalTokenCount
+			}
+			rows = append(rows, row)
+		}
+		if jsonOutput {
+			return printJSON(rows)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "\tNAME\tDISPLAY NAME\tMODEL\tTOKENS\tEXPIRES")
+		for _, r := range rows {
+			mark := ""
+			if r.Active {
+				mark = "*"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", mark, r.Name, r.DisplayName, r.Model, r.Tokens, r.Expires.Local().Format(time.DateTime))
+		}
+		tw.Flush()
+
+	case "delete":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			return 2
+		}
+		if err := srv.DeleteCache(ctx, fs.Arg(0)); err != nil {
+			return fail(err)
+		}
+		if jsonOutput {
+			return printJSON(map[string]string{"deleted": fs.Arg(0)})
+		}
+
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
+
+// runChat sends one message through the chat pipeline, tools and context
+// mode included, and prints the reply. A session only outlives the command
+// with a shared store (store.redis_url).
+func runChat(args []string) int {
+	ctx := context.Background()
+	fs := commandFlags("chat")
+	session := fs.String("session", "", "Session to continue; a new one by default")
+	contextMode := fs.String("context", "", "Context mode: cache, rag or none")
+	agentic := fs.Bool("agentic", false, "Let the model use the file tools")
+	srv, err := loadEnvironment(fs, args).commandServer(ctx)
+	if err != nil {
+		return fail(err)
+	}
+
+	message := strings.Join(fs.Args(), " ")
+	if message == "" || message == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fail(err)
+		}
+		message = string(data)
+	}
+	if strings.TrimSpace(message) == "" {
+		fs.Usage()
+		return 2
+	}
+	if *session == "" {
+		*session = "cli-" + time.Now().UTC().Format("20060102-150405")
+	}
+	resp, err := srv.Chat(ctx, proxy.ChatRequest{
+		SessionID:   *session,
+		Message:     message,
+		UseAgentic:  *agentic,
+		ContextMode: *contextMode,
+	})
+	if err != nil {
+		return fail(err)
+	}
+	if jsonOutput {
+		return printJSON(resp)
+	}
+	fmt.Println(resp.Text)
+	return 0
+}
+
+// runAsk answers one question for shell pipelines and git hooks. Only the
+// answer is printed; failures, including blocked, truncated and empty
+// replies, go to stderr with exit code 1. With -stdin, standard input is
+// sent after the question, or as the question when there is none:
+//
+//	git diff --cached | gemini-proxy ask -stdin "Write a commit message for this diff"
+func runAsk(args []string) int {
+	ctx := context.Background()
+	fs := commandFlags("ask")
+	stdin := fs.Bool("stdin", false, "Send standard input along with the question")
+	srv, err := loadEnvironment(fs, args).commandServer(ctx)
+	if err != nil {
+		return fail(err)
+	}
+
+	question := strings.Join(fs.Args(), " ")
+	if *stdin {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fail(err)
+		}
+		if question == "" {
+			question = string(data)
+		} else {
+			question += "\n\n" + string(data)
+		}
+	}
+	if strings.TrimSpace(question) == "" {
+		fs.Usage()
+		return 2
+	}
+	answer, err := srv.Ask(ctx, question)
+	if jsonOutput {
+		out := map[string]string{"answer": answer}
+		if err != nil {
+			out["error"] = err.Error()
+		}
+		printJSON(out)
+	} else if answer != "" {
+		fmt.Println(answer)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return 0
+}
+
+// runSessions exports a session's transcript and replays one against
+// another model:
+//
+//	gemini-proxy sessions dump <id> > review.json
+//	gemini-proxy sessions export -format html -o review.html <id>
+//	gemini-proxy sessions replay -model gemini-2.5-pro review.json
+//
+// A dump is the JSON of GET /sessions/<id>, so one saved from a running
+// server replays too. Replay sends the user messages in order to a new
+// session, so each reply follows the new model's own earlier replies, and
+// prints every reply next to the original. Images and tool results are not
+// replayed.
+func runSessions(args []string) int {
+	ctx := context.Background()
+	fs := commandFlags("sessions")
+	contextMode := fs.String("context", "", "Context mode of the replay: cache, rag or none")
+	agentic := fs.Bool("agentic", false, "Let the model use the file tools in the replay")
+	format := fs.String("format", proxy.ExportMarkdown, "Format of the export: markdown or html")
+	out := fs.String("o", "", "File to write the export to (default stdout)")
+	sub, args := verb(args)
+	env := loadEnvironment(fs, args)
+	if (sub != "dump" && sub != "export" && sub != "replay") || fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	srv, err := env.commandServer(ctx)
+	if err != nil {
+		return fail(err)
+	}
+
+	if sub == "dump" || sub == "export" {
+		t, err := srv.Transcript(ctx, fs.Arg(0))
+		if err != nil {
+			return fail(err)
+		}
+		if t == nil {
+			return fail(fmt.Errorf("session %s not found", fs.Arg(0)))
+		}
+		if sub == "dump" {
+			return printJSON(t)
+		}
+		doc, err := proxy.ExportTranscript(t, *format)
+		if err != nil {
+			return fail(err)
+		}
+		if *out == "" {
+			os.Stdout.Write(doc)
+			return 0
+		}
+		if err := os.WriteFile(*out, doc, 0o644); err != nil {
+			return fail(err)
+		}
+		return 0
+	}
+
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return fail(err)
+	}
+	var t proxy.SessionTranscript
+	if err := json.Unmarshal(data, &t); err != nil {
+		return fail(fmt.Errorf("reading %s: %w", fs.Arg(0), err))
+	}
+	type turn struct {
+		Message        string  `json:"message"`
+		Original       string  `json:"original"`
+		Reply          string  `json:"reply"`
+		PromptTokens   int     `json:"prompt_tokens"`
+		ResponseTokens int     `json:"response_tokens"`
+		Cost           float64 `json:"cost"`
+	}
+	var turns []turn
+	for _, m := range t.Messages {
+		switch {
+		case m.Role == "user" && m.Text != "":
+			turns = append(turns, turn{Message: m.Text})
+		case m.Role == "model" && m.Text != "" && len(turns) > 0:
+			last := &turns[len(turns)-1]
+			last.Original = strings.TrimSpace(last.Original + "\n\n" + m.Text)
+		}
+	}
+	if len(turns) == 0 {
+		return fail(fmt.Errorf("%s has no user messages to replay", fs.Arg(0)))
+	}
+
+	session := "replay-" + time.Now().UTC().Format("20060102-150405")
+	model := env.cfg.Model
+	for i := range turns {
+		tr := &turns[i]
+		resp, err := srv.Chat(ctx, proxy.ChatRequest{
+			SessionID:   session,
+			Model:       model,
+			Message:     tr.Message,
+			UseAgentic:  *agentic,
+			ContextMode: *contextMode,
+		})
+		if err != nil {
+			return fail(fmt.Errorf("message %d: %w", i+1, err))
+		}
+		tr.Reply, tr.PromptTokens, tr.ResponseTokens, tr.Cost = resp.Text, resp.PromptTokens, resp.ResponseTokens, resp.Cost
+		if !jsonOutput {
+			fmt.Printf("=== %d/%d ===\n%s\n\n--- original ---\n%s\n\n--- %s ---\n%s\n\n", i+1, len(turns), tr.Message, tr.Original, model, tr.Reply)
+		}
+	}
+	if jsonOutput {
+		printJSON(map[string]any{"session": session, "model": model, "replayed_from": t.Session.ID, "turns": turns})
+	}
+	return 0
+}
+
+// runModels lists the models available to the API key.
+func runModels(args []string) int {
+	ctx := context.Background()
+	srv, err := loadEnvironment(commandFlags("models"), args).commandServer(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	return listModels(ctx, srv)
+}
+
+func listModels(ctx context.Context, srv *proxy.Server) int {
+	var models []*genai.Model
+	for m, err := range srv.Client().Models.All(ctx) {
+		if err != nil {
+			return fail(err)
+		}
+		if !jsonOutput {
+			fmt.Printf("Model: %s\n", m.Name)
+		}
+		models = append(models, m)
+	}
+	if jsonOutput {
+		return printJSON(models)
+	}
+	return 0
+}
+
+// runCost prints the usage recorded in the session store between two
+// days, grouped by day, model or session, as a table or JSON. The memory
+// store starts empty, so this is only useful with a shared store
+// (store.redis_url).
+//
+//	gemini-proxy cost report -since 2024-06-01 -until 2024-06-30 -group-by model
+func runCost(args []string) int {
+	ctx := context.Background()
+	fs := commandFlags("cost")
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := fs.String("since", today.AddDate(0, 0, -6).Format(time.DateOnly), "First UTC day to report, as YYYY-MM-DD")
+	until := fs.String("until", today.Format(time.DateOnly), "Last UTC day to report, as YYYY-MM-DD")
+	groupBy := fs.String("group-by", proxy.GroupByDay, "Group by day, model or session")
+	sub, args := verb(args)
+	if sub != "" && sub != "report" {
+		fs.Usage()
+		return 2
+	}
+	env := loadEnvironment(fs, args)
+	from, err := time.Parse(time.DateOnly, *since)
+	if err != nil {
+		return fail(fmt.Errorf("-since: %w", err))
+	}
+	to, err := time.Parse(time.DateOnly, *until)
+	if err != nil {
+		return fail(fmt.Errorf("-until: %w", err))
+	}
+	srv, err := env.commandServer(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	if env.cfg.Store.RedisURL == "" {
+		fmt.Fprintln(os.Stderr, "Note: usage is kept in the server's memory; set store.redis_url to report it from the command line")
+	}
+	if from.Before(today.AddDate(0, 0, -proxy.UsageRetentionDays)) {
+		fmt.Fprintf(os.Stderr, "Note: the store keeps usage for %d days; earlier days are not reported\n", proxy.UsageRetentionDays)
+	}
+	report, err := srv.UsageReport(ctx, from, to, *groupBy)
+	if err != nil {
+		return fail(err)
+	}
+	if jsonOutput {
+		return printJSON(report)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if report.GroupBy == proxy.GroupBySession {
+		fmt.Fprintln(tw, "SESSION\tTITLE\tCOST (USD)")
+		for _, r := range report.Rows {
+			fmt.Fprintf(tw, "%s\t%s\t%.4f\n", r.Key, r.Title, r.Cost)
+		}
+		fmt.Fprintf(tw, "total\t\t%.4f\n", report.Total.Cost)
+		tw.Flush()
+		return 0
+	}
+	fmt.Fprintf(tw, "%s\tREQUESTS\tPROMPT TOKENS\tRESPONSE TOKENS\tTHINKING TOKENS\tCACHED TOKENS\tCOST (USD)\tCACHE SAVINGS\n", strings.ToUpper(report.GroupBy))
+	for _, r := range append(report.Rows, proxy.UsageRow{Key: "total", UsageTotals: report.Total}) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%.4f\t%.4f\n", r.Key, r.Requests, r.PromptTokens, r.ResponseTokens, r.ThinkingTokens, r.CachedTokens, r.Cost, r.CacheSavings)
+	}
+	tw.Flush()
+	return 0
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"customgemini/config"
+)
+
+// runCompletion prints a completion script for bash, zsh or fish, which
+// completes the commands, their verbs and their flags:
+//
+//	source <(gemini-proxy completion bash)
+//	gemini-proxy completion fish > ~/.config/fish/completions/gemini-proxy.fish
+//
+// The script completes the name the binary was run as.
+func runCompletion(args []string) int {
+	fs := commandFlags("completion")
+	fs.Parse(args)
+	name := filepath.Base(os.Args[0])
+	switch fs.Arg(0) {
+	case "bash":
+		fmt.Print(bashCompletion(name))
+	case "zsh":
+		fmt.Print(zshCompletion(name))
+	case "fish":
+		fmt.Print(fishCompletion(name))
+	default:
+		fs.Usage()
+		return 2
+	}
+	return 0
+}
+
+// commandNames lists the commands in the order printCommands shows them.
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// verbs returns the verbs a command takes first, read from its usage:
+// build, list and delete from "build [flags] [path] | list | delete <name>".
+func (c command) verbs() []string {
+	var verbs []string
+	for _, alt := range strings.Split(c.args, "|") {
+		if f := strings.Fields(alt); len(f) > 0 && !strings.HasPrefix(f[0], "[") && !strings.HasPrefix(f[0], "<") {
+			verbs = append(verbs, f[0])
+		}
+	}
+	return verbs
+}
+
+// serverFlags returns the names of the flags every command takes.
+func serverFlags() []string {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	config.Load(fs, nil)
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	return names
+}
+
+// completionFlags returns a command's flags, each with its dash. serve
+// has no -json.
+func completionFlags(name string, server []string) []string {
+	own := commands[name].flags
+	if name != "serve" {
+		own = append(own, "json")
+	}
+	var flags []string
+	for _, f := range slices.Concat(own, server) {
+		flags = append(flags, "-"+f)
+	}
+	return flags
+}
+
+func bashCompletion(name string) string {
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	server := serverFlags()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# bash completion for %s\n%s() {\n", name, fn)
+	b.WriteString("\tlocal cur=${COMP_WORDS[COMP_CWORD]} words\n")
+	fmt.Fprintf(&b, "\tif [ \"$COMP_CWORD\" -eq 1 ]; then\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\tfi\n", strings.Join(commandNames(), " "))
+	b.WriteString("\tcase ${COMP_WORDS[1]} in\n")
+	for _, cmd := range commandNames() {
+		words := commands[cmd].verbs()
+		if cmd != "completion" {
+			words = append(words, completionFlags(cmd, server)...)
+		}
+		fmt.Fprintf(&b, "\t%s) words=%q ;;\n", cmd, strings.Join(words, " "))
+	}
+	b.WriteString("\tesac\n\tCOMPREPLY=($(compgen -W \"$words\" -- \"$cur\"))\n}\n")
+	fmt.Fprintf(&b, "complete -o default -F %s %s\n", fn, name)
+	return b.String()
+}
+
+func zshCompletion(name string) string {
+	fn := "_" + strings.NewReplacer("-", "_", ".", "_").Replace(name)
+	server := serverFlags()
+	var b strings.Builder
+	fmt.Fprintf(&b, "#compdef %s\n\n%s() {\n", name, fn)
+	b.WriteString("\tlocal -a verbs flags\n")
+	fmt.Fprintf(&b, "\tif (( CURRENT == 2 )); then\n\t\tcompadd -- %s\n\t\treturn\n\tfi\n", strings.Join(commandNames(), " "))
+	b.WriteString("\tcase $words[2] in\n")
+	for _, cmd := range commandNames() {
+		var flags []string
+		if cmd != "completion" {
+			flags = completionFlags(cmd, server)
+		}
+		fmt.Fprintf(&b, "\t%s) verbs=(%s) flags=(%s) ;;\n", cmd, strings.Join(commands[cmd].verbs(), " "), strings.Join(flags, " "))
+	}
+	b.WriteString("\tesac\n")
+	b.WriteString("\tif [[ $PREFIX == -* ]]; then\n\t\tcompadd -- $flags\n\telif (( CURRENT == 3 )) && (( ${#verbs} )); then\n\t\tcompadd -- $verbs\n\telse\n\t\t_files\n\tfi\n}\n\n")
+	fmt.Fprintf(&b, "compdef %s %s\n", fn, name)
+	return b.String()
+}
+
+func fishCompletion(name string) string {
+	server := serverFlags()
+	var b strings.Builder
+	fmt.Fprintf(&b, "# fish completion for %s\n", name)
+	for _, cmd := range commandNames() {
+		c := commands[cmd]
+		fmt.Fprintf(&b, "complete -c %s -f -n __fish_use_subcommand -a %s -d %s\n", name, cmd, fishQuote(c.help))
+		cond := "__fish_seen_subcommand_from " + cmd
+		if verbs := c.verbs(); len(verbs) > 0 {
+			fmt.Fprintf(&b, "complete -c %s -f -n %s -a %s\n", name, fishQuote(cond), fishQuote(strings.Join(verbs, " ")))
+		}
+		if cmd == "completion" {
+			continue
+		}
+		for _, f := range completionFlags(cmd, server) {
+			fmt.Fprintf(&b, "complete -c %s -n %s -o %s\n", name, fishQuote(cond), strings.TrimPrefix(f, "-"))
+		}
+	}
+	return b.String()
+}
+
+// fishQuote quotes s for fish, in which only \ and ' are special inside
+// single quotes.
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
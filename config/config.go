@@ -0,0 +1,1033 @@
+// Package config resolves the proxy's runtime configuration.
+//
+// Settings are layered from the following sources, later ones winning:
+//
+//  1. built-in defaults
+//  2. the YAML config file (-config / GEMINI_PROXY_CONFIG)
+//  3. the selected profile (-profile / GEMINI_PROXY_PROFILE)
+//  4. GEMINI_PROXY_* environment variables
+//  5. command-line flags that were explicitly set
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+	"gopkg.in/yaml.v3"
+)
+
+// Built-in defaults
+const (
+	DefaultPort            = ":8080"
+	DefaultModel           = "gemini-3.0-flash"
+	DefaultTTLMinutes      = 120
+	DefaultMaxHistoryTurns = 8   // Safe limit to prevent API cache invalidation
+	DefaultRequestTimeout  = 300 // Seconds, covering the whole tool loop
+)
+
+// Config holds the effective runtime configuration.
+type Config struct {
+	Port             string `yaml:"port"`
+	Model            string `yaml:"model"`
+	CachePath        string `yaml:"cache_path"`
+	CacheID          string `yaml:"cache_id"`
+	CacheTTLMinutes  int    `yaml:"cache_ttl_minutes"`
+	MaxHistoryTurns  int    `yaml:"max_history_turns"`
+	RequestTimeout   int    `yaml:"request_timeout_seconds"` // 0 waits indefinitely
+	Debug            bool   `yaml:"debug"`
+	Dev              bool   `yaml:"dev"`                // Reload web/index.html from disk on every request
+	LogLevel         string `yaml:"log_level"`          // debug, info, warn or error
+	LogFormat        string `yaml:"log_format"`         // text or json
+	LogRetentionDays int    `yaml:"log_retention_days"` // 0 keeps logs forever
+	LogMaxSizeMB     int    `yaml:"log_max_size_mb"`    // 0 rotates daily only
+	AccessLog        string `yaml:"access_log"`         // "common" or "combined" writes logs/access_*.log; "" writes none
+
+	// Origins of the web pages allowed to call the proxy from a browser,
+	// as scheme://host[:port], or "*" for any
+	CORSOrigins    []string `yaml:"cors_origins,omitempty"`
+	DebugDumpLimit int      `yaml:"debug_dump_limit"` // Per-request dumps kept under logs/debug
+
+	// Generation and tool defaults, usually set through a profile
+	Temperature  float32           `yaml:"temperature"`
+	ToolPolicy   string            `yaml:"tool_policy"` // "none", "read-only" or "full"
+	Safety       map[string]string `yaml:"safety,omitempty"`
+	SystemPrompt string            `yaml:"system_prompt,omitempty"` // Replaces the built-in persona when set
+
+	// What a request's own system prompt does: "append" it to the
+	// configured one, "replace" it, or "ignore" it
+	SystemPromptPolicy string `yaml:"system_prompt_policy"`
+
+	// What becomes of the files written by a turn the proxy stopped in the
+	// middle of: "annotate" the session with them, or "rollback" the writes
+	// as well
+	CrashRecovery string `yaml:"crash_recovery"`
+
+	// What a reply without content becomes
+	EmptyReply EmptyReplyConfig `yaml:"empty_reply"`
+
+	// Files considered when building the context cache
+	Corpus CorpusConfig `yaml:"corpus"`
+
+	// Per-surface overrides keyed by "web", "openai" or "gemini"
+	Endpoints map[string]EndpointDefaults `yaml:"endpoints,omitempty"`
+
+	// OpenTelemetry export; tracing is off unless an endpoint is set
+	Tracing TracingConfig `yaml:"tracing"`
+
+	// Warning thresholds for runaway or unusually slow requests
+	Anomaly AnomalyConfig `yaml:"anomaly"`
+
+	// Admission control for requests that call Gemini
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+
+	// Exact-match cache for repeated upstream requests; off by default
+	ResponseCache ResponseCacheConfig `yaml:"response_cache"`
+
+	// Answers to questions close in meaning to one answered recently; off
+	// by default
+	Duplicates DuplicatesConfig `yaml:"duplicates"`
+
+	// Model that summarizes chat sessions; a cheap one does, as it reads
+	// only the conversation
+	SummaryModel string `yaml:"summary_model"`
+
+	// Connection settings for calls to the Gemini API
+	Upstream UpstreamConfig `yaml:"upstream"`
+
+	// Warm-up of the default model and its connection; off by default
+	Warmup WarmupConfig `yaml:"warmup"`
+
+	// Backoff for transient upstream failures (429, 5xx, network errors)
+	Retry RetryConfig `yaml:"retry"`
+
+	// Fail fast while the Gemini API keeps failing
+	Breaker BreakerConfig `yaml:"breaker"`
+
+	// Pacing of calls as a model's rate limit comes near
+	Quota QuotaConfig `yaml:"quota"`
+
+	// Recording of upstream responses, or replay from them; off by default
+	Replay ReplayConfig `yaml:"replay"`
+
+	// Where sessions, costs and the active cache live
+	Store StoreConfig `yaml:"store"`
+
+	// Limits for images and PDFs uploaded through the web UI
+	Uploads UploadConfig `yaml:"uploads"`
+
+	// How streamed text is batched into Server-Sent Events
+	Streaming StreamingConfig `yaml:"streaming"`
+
+	// Model and output directory for /images/generate
+	Images ImageConfig `yaml:"images"`
+
+	// Embeddings index for semantic search over the project
+	Index IndexConfig `yaml:"index"`
+
+	// Tenants of a shared proxy, keyed by name and selected by API key
+	Workspaces map[string]WorkspaceConfig `yaml:"workspaces,omitempty"`
+
+	// Recurring tasks the server runs, and the mail server cost reports
+	// are sent through
+	Jobs []JobConfig `yaml:"jobs,omitempty"`
+	SMTP SMTPConfig  `yaml:"smtp,omitempty"`
+
+	// Webhooks told about the files a turn's tools wrote
+	WriteHooks []WriteHookConfig `yaml:"write_hooks,omitempty"`
+
+	// Self-hosted forges /review may fetch diffs from, besides github.com
+	// and gitlab.com
+	Forges []ForgeConfig `yaml:"forges,omitempty"`
+
+	Profile  string             `yaml:"profile,omitempty"`
+	Profiles map[string]Profile `yaml:"profiles,omitempty"`
+
+	// given holds the YAML names of the top-level settings the file,
+	// profile, environment or flags set, whatever their value
+	given map[string]bool
+}
+
+// markGiven records that a layer set the top-level setting with the YAML
+// name key.
+func (c *Config) markGiven(key string) {
+	if c.given == nil {
+		c.given = map[string]bool{}
+	}
+	c.given[key] = true
+}
+
+// Given reports whether the file, profile, environment or flags set the
+// top-level setting with the YAML name key, even to its default.
+func (c *Config) Given(key string) bool {
+	return c.given[key]
+}
+
+// TracingConfig selects where spans are exported.
+type TracingConfig struct {
+	Endpoint    string            `yaml:"endpoint,omitempty"` // OTLP/HTTP URL, e.g. http://localhost:4318
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	ServiceName string            `yaml:"service_name"`
+	SampleRatio float64           `yaml:"sample_ratio"`
+}
+
+// EndpointDefaults overrides the global model and temperature for one API
+// surface when the client does not specify them.
+type EndpointDefaults struct {
+	Model          string   `yaml:"model,omitempty"`
+	Temperature    *float32 `yaml:"temperature,omitempty"`
+	TimeoutSeconds *int     `yaml:"timeout_seconds,omitempty"`
+	EmptyReply     string   `yaml:"empty_reply,omitempty"` // Overrides empty_reply.policy
+}
+
+// EmptyReplyConfig decides what a reply without text, tool calls or images
+// becomes. The "warn" policy puts a bracketed warning in its text, which
+// is what people read in the web UI. "reason" leaves the text empty, for
+// clients that would take the warning for the model's words. "retry" asks
+// the model once more, and "fallback" asks FallbackModel instead; a reply
+// that is still empty is then left empty. Every policy reports why the
+// reply was empty in a separate empty_reason field.
+type EmptyReplyConfig struct {
+	Policy        string `yaml:"policy"`
+	FallbackModel string `yaml:"fallback_model,omitempty"`
+}
+
+// API surfaces with independent defaults
+const (
+	EndpointWeb    = "web"    // Native /chat used by the web UI
+	EndpointOpenAI = "openai" // /v1/chat/completions
+	EndpointGemini = "gemini" // /v1beta passthrough
+)
+
+// Endpoint resolves the default model and temperature for a surface,
+// falling back to the global settings.
+func (c *Config) Endpoint(endpoint string) (model string, temperature float32) {
+	model, temperature = c.Model, c.Temperature
+	if ep, ok := c.Endpoints[endpoint]; ok {
+		if ep.Model != "" {
+			model = ep.Model
+		}
+		if ep.Temperature != nil {
+			temperature = *ep.Temperature
+		}
+	}
+	return model, temperature
+}
+
+// AnomalyConfig sets the limits beyond which a request is logged at warning
+// level. Zero disables a check.
+type AnomalyConfig struct {
+	SlowRequestSeconds int `yaml:"slow_request_seconds"`
+	MaxToolIterations  int `yaml:"max_tool_iterations"`
+	MaxResponseTokens  int `yaml:"max_response_tokens"`
+}
+
+// ConcurrencyConfig caps the generation requests served at once. Requests
+// beyond MaxInFlight wait in a queue of MaxQueue for up to
+// QueueTimeoutSeconds; when the queue is full they are rejected with 429.
+// MaxInFlight 0 disables the limit.
+type ConcurrencyConfig struct {
+	MaxInFlight         int `yaml:"max_in_flight"`
+	MaxQueue            int `yaml:"max_queue"`
+	QueueTimeoutSeconds int `yaml:"queue_timeout_seconds"`
+}
+
+// ResponseCacheConfig controls the response cache. Only non-streaming
+// generateContent calls are cached, keyed on the model and the full request
+// body. MaxEntries 0 means unbounded.
+type ResponseCacheConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	TTLSeconds int  `yaml:"ttl_seconds"`
+	MaxEntries int  `yaml:"max_entries"`
+}
+
+// DuplicatesConfig controls duplicate question detection. A question
+// whose embedding is at least Similarity close to one answered in the
+// last MaxAgeMinutes, by the same model against the same context cache,
+// gets that answer instead of a new one. MaxEntries caps the answers
+// kept.
+type DuplicatesConfig struct {
+	Enabled       bool    `yaml:"enabled"`
+	Similarity    float64 `yaml:"similarity"`
+	MaxAgeMinutes int     `yaml:"max_age_minutes"`
+	MaxEntries    int     `yaml:"max_entries"`
+}
+
+// UpstreamConfig tunes the HTTP client used for Gemini API calls. Timeouts
+// are in seconds; zero means no limit. Without ProxyURL the HTTPS_PROXY and
+// NO_PROXY environment variables apply.
+type UpstreamConfig struct {
+	ProxyURL                     string `yaml:"proxy_url,omitempty"`
+	DialTimeoutSeconds           int    `yaml:"dial_timeout_seconds"`
+	TLSHandshakeTimeoutSeconds   int    `yaml:"tls_handshake_timeout_seconds"`
+	ResponseHeaderTimeoutSeconds int    `yaml:"response_header_timeout_seconds"`
+	IdleConnTimeoutSeconds       int    `yaml:"idle_conn_timeout_seconds"`
+	MaxIdleConns                 int    `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost          int    `yaml:"max_idle_conns_per_host"`
+	DisableHTTP2                 bool   `yaml:"disable_http2"`
+}
+
+// WarmupConfig spares the first request after startup or a quiet spell
+// the cost of a new upstream connection. With Enabled, a one-token request
+// goes to the default model at startup, and whenever no call has gone
+// upstream for IntervalSeconds a model lookup, which is free, keeps the
+// connection open. IntervalSeconds 0 warms up at startup only.
+type WarmupConfig struct {
+	Enabled         bool `yaml:"enabled"`
+	IntervalSeconds int  `yaml:"interval_seconds"`
+}
+
+// RetryConfig sets how often a failed upstream call is attempted in total
+// and the bounds of the jittered exponential backoff between attempts.
+// MaxAttempts 1 disables retries.
+type RetryConfig struct {
+	MaxAttempts      int `yaml:"max_attempts"`
+	InitialBackoffMs int `yaml:"initial_backoff_ms"`
+	MaxBackoffMs     int `yaml:"max_backoff_ms"`
+}
+
+// BreakerConfig configures the upstream circuit breaker. After
+// FailureThreshold consecutive failed calls (0 disables the breaker),
+// requests fail at once with 503 for CooldownSeconds, after which one call
+// is let through to probe whether the API has recovered.
+type BreakerConfig struct {
+	FailureThreshold int `yaml:"failure_threshold"`
+	CooldownSeconds  int `yaml:"cooldown_seconds"`
+}
+
+// QuotaConfig paces upstream calls against the Gemini API's per-minute
+// request limits. A model's limit is taken from RequestsPerMinute, or
+// learned from the first 429 that states it. Once SlowdownAt of it has been
+// used in the last minute, calls are spaced out evenly, and when none is
+// left they wait for the window to free up, each for at most
+// MaxWaitSeconds (0 disables the pacing, but not the tracking).
+type QuotaConfig struct {
+	RequestsPerMinute map[string]int `yaml:"requests_per_minute,omitempty"` // By model
+	SlowdownAt        float64        `yaml:"slowdown_at"`
+	MaxWaitSeconds    int            `yaml:"max_wait_seconds"`
+}
+
+// StoreConfig selects the session store. With RedisURL set, replicas
+// sharing the same Redis and KeyPrefix share sessions, the cost total and
+// the active context cache; otherwise state is kept in memory.
+type StoreConfig struct {
+	RedisURL  string `yaml:"redis_url,omitempty"` // redis://[:password@]host:6379/0
+	KeyPrefix string `yaml:"key_prefix"`
+}
+
+// UploadConfig bounds the attachments held for web chat. Uploads live in
+// process memory and are dropped after TTLMinutes, except videos, which
+// are held by the Gemini Files API and may be up to MaxVideoMB.
+type UploadConfig struct {
+	MaxFileMB     int `yaml:"max_file_mb"`
+	MaxVideoMB    int `yaml:"max_video_mb"`
+	MaxPerSession int `yaml:"max_per_session"`
+	TTLMinutes    int `yaml:"ttl_minutes"`
+}
+
+// ReplayConfig records every Gemini API response to Dir, or answers from
+// those recordings without calling the API, for offline demos and
+// regression runs of the proxy itself. Both modes pin the temperature to 0
+// and the seed to Seed, so a recorded run can be repeated. Dir is relative
+// to the home directory unless absolute.
+type ReplayConfig struct {
+	Mode string `yaml:"mode,omitempty"` // "record" or "replay"; empty calls the API as usual
+	Dir  string `yaml:"dir"`
+	Seed int32  `yaml:"seed"`
+}
+
+// Replay modes
+const (
+	ReplayRecord = "record"
+	ReplayReplay = "replay"
+)
+
+// ImageConfig configures image generation. Model is used when a request
+// names none; "imagen-" models go through the Imagen API and others are
+// asked for an image response. OutputDir, relative to the home directory
+// unless absolute, receives images requested as files.
+type ImageConfig struct {
+	Model     string `yaml:"model"`
+	OutputDir string `yaml:"output_dir"`
+	MaxImages int    `yaml:"max_images"` // Per request
+}
+
+// IndexConfig configures the semantic search index. Project files selected
+// by the corpus filter are split into chunks of up to ChunkLines lines,
+// embedded with Model at Dimensions and stored under the home directory.
+// Chunking "syntax" splits code at top-level declarations and Markdown at
+// headings before falling back to runs of lines that share ChunkOverlap
+// lines; "lines" only uses the runs. With BuildOnStart the index is
+// brought up to date when the server starts; otherwise it is built on
+// request. Once built, the project is checked for changed files every
+// WatchSeconds (0 disables) and the index updated.
+//
+// TopK chunks are sent with each message of a chat in the "rag" context
+// mode. With Rerank, RerankCandidates chunks are retrieved first and
+// RerankModel picks the TopK from them; requests can override Rerank.
+//
+// Projects registers other project roots by name, such as sibling
+// services, which are indexed alongside the served project so searches can
+// span them.
+//
+// With Conversations, chat sessions in the session store are indexed too
+// and can be searched by meaning.
+//
+// File, a path or http(s) URL, is an index file exported with
+// -index-export, such as one built by CI. It is imported on startup when
+// it is newer than the served project's index.
+type IndexConfig struct {
+	Model        string `yaml:"model"`
+	Dimensions   int    `yaml:"dimensions"`
+	ChunkLines   int    `yaml:"chunk_lines"`
+	ChunkOverlap int    `yaml:"chunk_overlap"`
+	Chunking     string `yaml:"chunking"`
+	BuildOnStart bool   `yaml:"build_on_start"`
+	WatchSeconds int    `yaml:"watch_seconds"`
+	TopK         int    `yaml:"top_k"`
+
+	Rerank           bool   `yaml:"rerank"`
+	RerankModel      string `yaml:"rerank_model"`
+	RerankCandidates int    `yaml:"rerank_candidates"`
+
+	Projects map[string]string `yaml:"projects"`
+	File     string            `yaml:"file"`
+
+	Conversations bool `yaml:"conversations"`
+}
+
+// WorkspaceConfig is one tenant of a proxy that serves several developers
+// or projects. A request presenting one of Keys, as a bearer token, an
+// x-goog-api-key header or a key query parameter, runs in the workspace:
+// its file tools and attachments are confined to ProjectRoot, it uses
+// CacheID as its context cache, its sessions are kept apart from other
+// workspaces', and its tools follow ToolPolicy, or the global tool_policy
+// when that is empty. Once DailyBudgetUSD has been spent in a UTC day,
+// its generation requests are refused until the next; 0 sets no budget.
+type WorkspaceConfig struct {
+	Keys           []string `yaml:"keys"`
+	ProjectRoot    string   `yaml:"project_root"`
+	CacheID        string   `yaml:"cache_id,omitempty"`
+	ToolPolicy     string   `yaml:"tool_policy,omitempty"`
+	DailyBudgetUSD float64  `yaml:"daily_budget_usd,omitempty"`
+}
+
+// Formats of the access log
+const (
+	AccessLogCommon   = "common"   // Common Log Format
+	AccessLogCombined = "combined" // Combined Log Format, adding the referer and user agent
+)
+
+// Tasks a job can run
+const (
+	JobRebuildCache  = "rebuild_cache"  // Build a new context cache and delete the one it replaces
+	JobPruneSessions = "prune_sessions" // Delete sessions idle for MaxAgeDays
+	JobCostReport    = "cost_report"    // Send the previous UTC day's usage by model
+	JobRepoDigest    = "repo_digest"    // Send a summary of the commits since the last digest
+)
+
+// DefaultPruneDays is how long prune_sessions keeps idle sessions unless
+// max_age_days says otherwise.
+const DefaultPruneDays = 7
+
+// JobConfig is a task the server runs on Schedule, a cron expression in
+// the server's local time zone (see Schedule). A cost_report or
+// repo_digest is POSTed as JSON to Webhook and mailed to Email through
+// smtp; it needs at least one of them.
+type JobConfig struct {
+	Name       string   `yaml:"name"`
+	Schedule   string   `yaml:"schedule"`
+	Task       string   `yaml:"task"`
+	MaxAgeDays int      `yaml:"max_age_days,omitempty"` // prune_sessions; 0 is DefaultPruneDays
+	Webhook    string   `yaml:"webhook,omitempty"`
+	Email      []string `yaml:"email,omitempty"`
+	Paused     bool     `yaml:"paused,omitempty"` // Starts paused; /jobs can resume it
+}
+
+// SMTPConfig is the mail server job reports are sent through. Username
+// and Password, when set, authenticate with PLAIN auth.
+type SMTPConfig struct {
+	Addr     string `yaml:"addr,omitempty"` // host:port
+	From     string `yaml:"from,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// Formats of a write hook's body
+const (
+	WriteHookJSON  = "json"  // The event as JSON
+	WriteHookSlack = "slack" // A Slack incoming webhook message
+)
+
+// WriteHookConfig is a webhook POSTed to after a turn whose tools wrote
+// files. With Secret set, the body is signed with HMAC-SHA256 and the hex
+// digest sent as X-Signature-256: sha256=<digest>.
+type WriteHookConfig struct {
+	URL    string `yaml:"url"`
+	Format string `yaml:"format,omitempty"` // json (default) or slack
+	Secret string `yaml:"secret,omitempty"`
+}
+
+// Kinds of forge
+const (
+	ForgeGitHub = "github" // GitHub Enterprise, with its API under /api/v3
+	ForgeGitLab = "gitlab" // Self-managed GitLab, with its API under /api/v4
+)
+
+// ForgeConfig is a self-hosted forge whose pull or merge request URLs
+// /review accepts. Host is as it appears in those URLs, with any port.
+type ForgeConfig struct {
+	Host string `yaml:"host"`
+	Kind string `yaml:"kind"` // github or gitlab
+}
+
+// StreamingConfig batches streamed text: pending text is sent once FlushMs
+// have passed since it started collecting or once it reaches FlushBytes,
+// whichever comes first. FlushMs 0 sends every upstream chunk as it
+// arrives, and FlushBytes 0 sends on time alone. A stream idle for
+// KeepaliveSeconds, while waiting on the model or a tool, gets a keepalive
+// frame so proxies do not drop it; 0 disables keepalives. A /chat/stream
+// generation whose client disconnects keeps running for ResumeSeconds, and
+// its events stay buffered that long after it ends, so the client can
+// reconnect and resume; 0 cancels it as soon as the client goes.
+type StreamingConfig struct {
+	FlushMs          int `yaml:"flush_ms"`
+	FlushBytes       int `yaml:"flush_bytes"`
+	KeepaliveSeconds int `yaml:"keepalive_seconds"`
+	ResumeSeconds    int `yaml:"resume_seconds"`
+}
+
+// Timeout returns how long a request on the surface may run, including its
+// whole tool loop. Zero means no limit.
+func (c *Config) Timeout(endpoint string) time.Duration {
+	seconds := c.RequestTimeout
+	if ep, ok := c.Endpoints[endpoint]; ok && ep.TimeoutSeconds != nil {
+		seconds = *ep.TimeoutSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// EmptyReplyPolicy resolves the empty reply policy for a surface.
+func (c *Config) EmptyReplyPolicy(endpoint string) string {
+	if ep, ok := c.Endpoints[endpoint]; ok && ep.EmptyReply != "" {
+		return ep.EmptyReply
+	}
+	return c.EmptyReply.Policy
+}
+
+// Profile bundles settings for a common run mode. Empty fields leave the
+// base configuration untouched.
+type Profile struct {
+	Model       string            `yaml:"model,omitempty"`
+	CachePath   string            `yaml:"cache_path,omitempty"`
+	NoCache     bool              `yaml:"no_cache,omitempty"` // Force clean mode
+	ToolPolicy  string            `yaml:"tool_policy,omitempty"`
+	Temperature *float32          `yaml:"temperature,omitempty"`
+	Safety      map[string]string `yaml:"safety,omitempty"`
+}
+
+// Tool policies
+const (
+	ToolPolicyNone     = "none"
+	ToolPolicyReadOnly = "read-only"
+	ToolPolicyFull     = "full"
+)
+
+// System prompt policies
+const (
+	SystemPromptAppend  = "append"
+	SystemPromptReplace = "replace"
+	SystemPromptIgnore  = "ignore"
+)
+
+// Empty reply policies
+const (
+	EmptyReplyWarn     = "warn"
+	EmptyReplyReason   = "reason"
+	EmptyReplyRetry    = "retry"
+	EmptyReplyFallback = "fallback"
+)
+
+// Crash recovery modes
+const (
+	CrashRecoveryAnnotate = "annotate"
+	CrashRecoveryRollback = "rollback"
+)
+
+// builtinProfiles are available without any config file and can be
+// redefined under "profiles" in the config.
+var builtinProfiles = map[string]Profile{
+	"ide": {
+		ToolPolicy:  ToolPolicyReadOnly,
+		Temperature: genai.Ptr[float32](0.2),
+	},
+	"agent": {
+		ToolPolicy:  ToolPolicyFull,
+		Temperature: genai.Ptr[float32](0.2),
+	},
+	"demo": {
+		NoCache:     true,
+		ToolPolicy:  ToolPolicyNone,
+		Temperature: genai.Ptr[float32](0.8),
+		Safety: map[string]string{
+			"harassment": "BLOCK_MEDIUM_AND_ABOVE",
+			"hate":       "BLOCK_MEDIUM_AND_ABOVE",
+			"sexual":     "BLOCK_MEDIUM_AND_ABOVE",
+			"dangerous":  "BLOCK_MEDIUM_AND_ABOVE",
+		},
+	},
+}
+
+// Default returns the configuration used when nothing else is set.
+func Default() Config {
+	return Config{
+		Port:             DefaultPort,
+		Model:            DefaultModel,
+		CacheTTLMinutes:  DefaultTTLMinutes,
+		MaxHistoryTurns:  DefaultMaxHistoryTurns,
+		RequestTimeout:   DefaultRequestTimeout,
+		LogLevel:         "info",
+		LogFormat:        "text",
+		LogRetentionDays: 14,
+		LogMaxSizeMB:     100,
+		DebugDumpLimit:   50,
+		Temperature:      0.2,
+		ToolPolicy:       ToolPolicyFull,
+
+		SystemPromptPolicy: SystemPromptAppend,
+		CrashRecovery:      CrashRecoveryAnnotate,
+		EmptyReply:         EmptyReplyConfig{Policy: EmptyReplyWarn},
+		Anomaly: AnomalyConfig{
+			SlowRequestSeconds: 30,
+			MaxToolIterations:  10,
+			MaxResponseTokens:  8192,
+		},
+		Concurrency: ConcurrencyConfig{
+			MaxInFlight:         8,
+			MaxQueue:            32,
+			QueueTimeoutSeconds: 30,
+		},
+		ResponseCache: ResponseCacheConfig{
+			TTLSeconds: 600,
+			MaxEntries: 500,
+		},
+		Duplicates: DuplicatesConfig{
+			Similarity:    0.95,
+			MaxAgeMinutes: 24 * 60,
+			MaxEntries:    1000,
+		},
+		SummaryModel: "gemini-2.5-flash-lite",
+		Upstream: UpstreamConfig{
+			DialTimeoutSeconds:         30,
+			TLSHandshakeTimeoutSeconds: 10,
+			IdleConnTimeoutSeconds:     90,
+			MaxIdleConns:               100,
+			MaxIdleConnsPerHost:        16,
+		},
+		Warmup: WarmupConfig{
+			IntervalSeconds: 60,
+		},
+		Retry: RetryConfig{
+			MaxAttempts:      3,
+			InitialBackoffMs: 500,
+			MaxBackoffMs:     8000,
+		},
+		Breaker: BreakerConfig{
+			FailureThreshold: 5,
+			CooldownSeconds:  30,
+		},
+		Quota: QuotaConfig{
+			SlowdownAt:     0.8,
+			MaxWaitSeconds: 30,
+		},
+		Replay: ReplayConfig{
+			Dir:  "recordings",
+			Seed: 42,
+		},
+		Store: StoreConfig{
+			KeyPrefix: "gemini-proxy:",
+		},
+		Uploads: UploadConfig{
+			MaxFileMB:     20,
+			MaxVideoMB:    200,
+			MaxPerSession: 20,
+			TTLMinutes:    60,
+		},
+		Images: ImageConfig{
+			Model:     "gemini-2.5-flash-image",
+			OutputDir: "images",
+			MaxImages: 4,
+		},
+		Index: IndexConfig{
+			Model:        "gemini-embedding-001",
+			Dimensions:   768,
+			ChunkLines:   60,
+			ChunkOverlap: 15,
+			Chunking:     "syntax",
+			WatchSeconds: 30,
+			TopK:         8,
+
+			RerankModel:      "gemini-2.5-flash-lite",
+			RerankCandidates: 50,
+		},
+		Streaming: StreamingConfig{
+			FlushMs:          50,
+			FlushBytes:       1024,
+			KeepaliveSeconds: 15,
+			ResumeSeconds:    30,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "gemini-proxy",
+			SampleRatio: 1,
+		},
+		Corpus: CorpusConfig{
+			SkipDirs: []string{
+				".git", "node_modules", "venv", ".venv",
+				"dist", "build", ".next", ".DS_Store",
+				"target", "out", "images", "img",
+				"media", "photos", "videos",
+			},
+			BackupMarkers: []string{"backup", "bkup"},
+			Extensions:    []string{".md", ".txt", ".go", ".js", ".ts", ".json", ".lua", ".css", ".html"},
+		},
+	}
+}
+
+// loadFile reads a YAML config file on top of c.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	var keys map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+	for key := range keys {
+		c.markGiven(key)
+	}
+	return nil
+}
+
+// applyProfile overlays the named profile onto the config. Profiles defined
+// in the config file shadow the built-in ones of the same name.
+func (c *Config) ApplyProfile(name string) error {
+	p, ok := c.Profiles[name]
+	if !ok {
+		p, ok = builtinProfiles[name]
+	}
+	if !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	c.Profile = name
+	if p.Model != "" {
+		c.Model = p.Model
+		c.markGiven("model")
+	}
+	if p.CachePath != "" {
+		c.CachePath = p.CachePath
+	}
+	if p.NoCache {
+		c.CachePath = ""
+		c.CacheID = ""
+	}
+	if p.ToolPolicy != "" {
+		c.ToolPolicy = p.ToolPolicy
+		c.markGiven("tool_policy")
+	}
+	if p.Temperature != nil {
+		c.Temperature = *p.Temperature
+	}
+	if p.Safety != nil {
+		c.Safety = p.Safety
+	}
+	return c.Validate()
+}
+
+// Validate rejects values the server cannot act on.
+func (c *Config) Validate() error {
+	switch c.ToolPolicy {
+	case ToolPolicyNone, ToolPolicyReadOnly, ToolPolicyFull:
+	default:
+		return fmt.Errorf("invalid tool_policy %q (want none, read-only or full)", c.ToolPolicy)
+	}
+	switch c.SystemPromptPolicy {
+	case SystemPromptAppend, SystemPromptReplace, SystemPromptIgnore:
+	default:
+		return fmt.Errorf("invalid system_prompt_policy %q (want append, replace or ignore)", c.SystemPromptPolicy)
+	}
+	switch c.CrashRecovery {
+	case CrashRecoveryAnnotate, CrashRecoveryRollback:
+	default:
+		return fmt.Errorf("invalid crash_recovery %q (want annotate or rollback)", c.CrashRecovery)
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("invalid log_level %q (want debug, info, warn or error)", c.LogLevel)
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid log_format %q (want text or json)", c.LogFormat)
+	}
+	for _, o := range c.CORSOrigins {
+		if o != "*" && !strings.HasPrefix(o, "http://") && !strings.HasPrefix(o, "https://") {
+			return fmt.Errorf("invalid cors_origins entry %q (want an http or https origin, or *)", o)
+		}
+	}
+	switch c.AccessLog {
+	case "", AccessLogCommon, AccessLogCombined:
+	default:
+		return fmt.Errorf("invalid access_log %q (want common or combined)", c.AccessLog)
+	}
+	if c.LogRetentionDays < 0 || c.LogMaxSizeMB < 0 || c.DebugDumpLimit < 0 {
+		return fmt.Errorf("log_retention_days, log_max_size_mb and debug_dump_limit must not be negative")
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("invalid request_timeout_seconds %d", c.RequestTimeout)
+	}
+	if a := c.Anomaly; a.SlowRequestSeconds < 0 || a.MaxToolIterations < 0 || a.MaxResponseTokens < 0 {
+		return fmt.Errorf("anomaly thresholds must not be negative")
+	}
+	if cc := c.Concurrency; cc.MaxInFlight < 0 || cc.MaxQueue < 0 || cc.QueueTimeoutSeconds < 0 {
+		return fmt.Errorf("concurrency limits must not be negative")
+	}
+	if d := c.Duplicates; d.Similarity <= 0 || d.Similarity > 1 || d.MaxAgeMinutes <= 0 || d.MaxEntries <= 0 {
+		return fmt.Errorf("duplicates needs a similarity above 0 and at most 1, and a positive max_age_minutes and max_entries")
+	}
+	if rc := c.ResponseCache; rc.MaxEntries < 0 || (rc.Enabled && rc.TTLSeconds <= 0) {
+		return fmt.Errorf("response_cache needs a positive ttl_seconds and a non-negative max_entries")
+	}
+	if c.SummaryModel == "" {
+		return fmt.Errorf("summary_model must be set")
+	}
+	if u := c.Upstream; u.DialTimeoutSeconds < 0 || u.TLSHandshakeTimeoutSeconds < 0 || u.ResponseHeaderTimeoutSeconds < 0 ||
+		u.IdleConnTimeoutSeconds < 0 || u.MaxIdleConns < 0 || u.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("upstream timeouts and pool sizes must not be negative")
+	}
+	if w := c.Warmup; w.IntervalSeconds < 0 || (w.Enabled && c.Upstream.IdleConnTimeoutSeconds > 0 && w.IntervalSeconds >= c.Upstream.IdleConnTimeoutSeconds) {
+		return fmt.Errorf("warmup.interval_seconds must not be negative, and must be below upstream.idle_conn_timeout_seconds or idle connections close between pings")
+	}
+	if r := c.Retry; r.MaxAttempts < 1 || r.InitialBackoffMs < 0 || r.MaxBackoffMs < 0 {
+		return fmt.Errorf("retry.max_attempts must be at least 1 and backoffs must not be negative")
+	}
+	if b := c.Breaker; b.FailureThreshold < 0 || (b.FailureThreshold > 0 && b.CooldownSeconds <= 0) {
+		return fmt.Errorf("breaker.failure_threshold must not be negative, and cooldown_seconds must be positive")
+	}
+	if q := c.Quota; q.SlowdownAt <= 0 || q.SlowdownAt > 1 || q.MaxWaitSeconds < 0 {
+		return fmt.Errorf("quota.slowdown_at must be above 0 and at most 1, and max_wait_seconds must not be negative")
+	}
+	for model, n := range c.Quota.RequestsPerMinute {
+		if n <= 0 {
+			return fmt.Errorf("invalid quota.requests_per_minute %d for %s (want a positive limit)", n, model)
+		}
+	}
+	switch c.Replay.Mode {
+	case "", ReplayRecord, ReplayReplay:
+	default:
+		return fmt.Errorf("invalid replay.mode %q (want record, replay or empty)", c.Replay.Mode)
+	}
+	if c.Replay.Mode != "" && c.Replay.Dir == "" {
+		return fmt.Errorf("replay.dir must be set to %s", c.Replay.Mode)
+	}
+	if c.Images.Model == "" || c.Images.OutputDir == "" || c.Images.MaxImages <= 0 {
+		return fmt.Errorf("images.model, output_dir and max_images must be set")
+	}
+	if ix := c.Index; ix.Model == "" || ix.Dimensions <= 0 || ix.ChunkLines <= 0 || ix.TopK <= 0 {
+		return fmt.Errorf("index.model, dimensions, chunk_lines and top_k must be set")
+	}
+	if c.Index.WatchSeconds < 0 {
+		return fmt.Errorf("index.watch_seconds must not be negative")
+	}
+	if c.Index.RerankModel == "" || c.Index.RerankCandidates < c.Index.TopK {
+		return fmt.Errorf("index.rerank_model must be set and rerank_candidates at least top_k")
+	}
+	if c.Index.ChunkOverlap < 0 || c.Index.ChunkOverlap >= c.Index.ChunkLines {
+		return fmt.Errorf("index.chunk_overlap must be at least 0 and less than chunk_lines")
+	}
+	switch c.Index.Chunking {
+	case "syntax", "lines":
+	default:
+		return fmt.Errorf("invalid index.chunking %q: want syntax or lines", c.Index.Chunking)
+	}
+	for name, root := range c.Index.Projects {
+		if name == "" || name == "main" || name == "all" || strings.ContainsAny(name, ", /") {
+			return fmt.Errorf("invalid index.projects name %q: main and all are reserved, and names cannot contain commas, spaces or slashes", name)
+		}
+		if root == "" {
+			return fmt.Errorf("index.projects %s has no path", name)
+		}
+	}
+	if u := c.Uploads; u.MaxFileMB <= 0 || u.MaxVideoMB <= 0 || u.MaxPerSession <= 0 || u.TTLMinutes <= 0 {
+		return fmt.Errorf("uploads.max_file_mb, max_video_mb, max_per_session and ttl_minutes must be positive")
+	}
+	if st := c.Streaming; st.FlushMs < 0 || st.FlushBytes < 0 || st.KeepaliveSeconds < 0 || st.ResumeSeconds < 0 {
+		return fmt.Errorf("streaming.flush_ms, flush_bytes, keepalive_seconds and resume_seconds must not be negative")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("invalid tracing.sample_ratio %v (want 0 to 1)", c.Tracing.SampleRatio)
+	}
+	owners := map[string]string{}
+	for name, ws := range c.Workspaces {
+		if !validWorkspaceName(name) {
+			return fmt.Errorf("invalid workspace name %q (want letters, digits, '-', '_' or '.')", name)
+		}
+		if len(ws.Keys) == 0 || ws.ProjectRoot == "" {
+			return fmt.Errorf("workspace %s needs keys and a project_root", name)
+		}
+		for _, key := range ws.Keys {
+			if key == "" {
+				return fmt.Errorf("workspace %s has an empty key", name)
+			}
+			if other, dup := owners[key]; dup {
+				return fmt.Errorf("workspaces %s and %s share a key", other, name)
+			}
+			owners[key] = name
+		}
+		switch ws.ToolPolicy {
+		case "", ToolPolicyNone, ToolPolicyReadOnly, ToolPolicyFull:
+		default:
+			return fmt.Errorf("invalid tool_policy %q for workspace %s (want none, read-only or full)", ws.ToolPolicy, name)
+		}
+		if ws.DailyBudgetUSD < 0 {
+			return fmt.Errorf("workspace %s daily_budget_usd must not be negative", name)
+		}
+	}
+	jobs := map[string]bool{}
+	for _, j := range c.Jobs {
+		if !validWorkspaceName(j.Name) || jobs[j.Name] {
+			return fmt.Errorf("invalid job name %q: names must be unique and made of letters, digits, '-', '_' or '.'", j.Name)
+		}
+		jobs[j.Name] = true
+		if _, err := ParseSchedule(j.Schedule); err != nil {
+			return fmt.Errorf("job %s: %w", j.Name, err)
+		}
+		switch j.Task {
+		case JobRebuildCache, JobPruneSessions:
+		case JobCostReport, JobRepoDigest:
+			if j.Webhook == "" && len(j.Email) == 0 {
+				return fmt.Errorf("job %s: a %s needs a webhook or email", j.Name, j.Task)
+			}
+			if len(j.Email) > 0 && (c.SMTP.Addr == "" || c.SMTP.From == "") {
+				return fmt.Errorf("job %s: emailing a %s needs smtp.addr and smtp.from", j.Name, j.Task)
+			}
+		default:
+			return fmt.Errorf("invalid task %q for job %s (want rebuild_cache, prune_sessions, cost_report or repo_digest)", j.Task, j.Name)
+		}
+		if j.MaxAgeDays < 0 {
+			return fmt.Errorf("job %s: max_age_days must not be negative", j.Name)
+		}
+	}
+	for _, h := range c.WriteHooks {
+		if !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://") {
+			return fmt.Errorf("invalid write_hooks url %q (want an http or https URL)", h.URL)
+		}
+		switch h.Format {
+		case "", WriteHookJSON, WriteHookSlack:
+		default:
+			return fmt.Errorf("invalid write_hooks format %q (want json or slack)", h.Format)
+		}
+	}
+	for _, f := range c.Forges {
+		if f.Host == "" || strings.ContainsAny(f.Host, "/?#@") {
+			return fmt.Errorf("invalid forges host %q (want a host name, with an optional port)", f.Host)
+		}
+		if f.Kind != ForgeGitHub && f.Kind != ForgeGitLab {
+			return fmt.Errorf("invalid kind %q for forge %s (want github or gitlab)", f.Kind, f.Host)
+		}
+	}
+	policies := []string{c.EmptyReply.Policy}
+	for name, ep := range c.Endpoints {
+		switch name {
+		case EndpointWeb, EndpointOpenAI, EndpointGemini:
+		default:
+			return fmt.Errorf("unknown endpoint %q in endpoints (want web, openai or gemini)", name)
+		}
+		if ep.EmptyReply != "" {
+			policies = append(policies, ep.EmptyReply)
+		}
+	}
+	for _, p := range policies {
+		switch p {
+		case EmptyReplyWarn, EmptyReplyReason, EmptyReplyRetry:
+		case EmptyReplyFallback:
+			if c.EmptyReply.FallbackModel == "" {
+				return fmt.Errorf("empty_reply policy fallback needs empty_reply.fallback_model")
+			}
+		default:
+			return fmt.Errorf("invalid empty_reply policy %q (want warn, reason, retry or fallback)", p)
+		}
+	}
+	return nil
+}
+
+// validWorkspaceName reports whether name can prefix session IDs, which
+// are made of the same characters, and name a directory. Job names follow
+// the same rule.
+func validWorkspaceName(name string) bool {
+	if name == "" || name == "." || name == ".." || len(name) > 64 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// maskURL drops the path and query of a webhook URL, which often carry
+// its token.
+func maskURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || (u.Path == "" && u.RawQuery == "") {
+		return s
+	}
+	return u.Scheme + "://" + u.Host + "/..."
+}
+
+// String renders the config as YAML for the startup banner. Workspace keys
+// and other secrets are masked.
+func (c Config) String() string {
+	if len(c.Workspaces) > 0 {
+		masked := make(map[string]WorkspaceConfig, len(c.Workspaces))
+		for name, ws := range c.Workspaces {
+			ws.Keys = []string{fmt.Sprintf("(%d keys)", len(ws.Keys))}
+			masked[name] = ws
+		}
+		c.Workspaces = masked
+	}
+	if c.SMTP.Password != "" {
+		c.SMTP.Password = "(set)"
+	}
+	if len(c.WriteHooks) > 0 {
+		hooks := slices.Clone(c.WriteHooks)
+		for i := range hooks {
+			hooks[i].URL = maskURL(hooks[i].URL)
+			if hooks[i].Secret != "" {
+				hooks[i].Secret = "(set)"
+			}
+		}
+		c.WriteHooks = hooks
+	}
+	if len(c.Jobs) > 0 {
+		jobs := slices.Clone(c.Jobs)
+		for i := range jobs {
+			jobs[i].Webhook = maskURL(jobs[i].Webhook)
+		}
+		c.Jobs = jobs
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"path"
+	"strings"
+)
+
+// CorpusConfig controls which files are compiled into the context cache.
+// The skip_dirs and extensions lists replace the defaults; the extra_* lists
+// are appended to them.
+type CorpusConfig struct {
+	SkipDirs        []string `yaml:"skip_dirs"`
+	ExtraSkipDirs   []string `yaml:"extra_skip_dirs,omitempty"`
+	BackupMarkers   []string `yaml:"backup_markers"` // Name substrings marking backup files/dirs
+	Extensions      []string `yaml:"extensions"`
+	ExtraExtensions []string `yaml:"extra_extensions,omitempty"`
+
+	// Globs relative to the project root. Include adds files regardless of
+	// extension; Exclude removes files and directories.
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+}
+
+// CorpusFilter is the resolved, lookup-friendly form of CorpusConfig.
+type CorpusFilter struct {
+	skipDirs      map[string]bool
+	backupMarkers []string
+	extensions    map[string]bool
+	include       []string
+	exclude       []string
+}
+
+// Filter resolves the corpus settings into lookup sets.
+func (c CorpusConfig) Filter() CorpusFilter {
+	f := CorpusFilter{
+		skipDirs:   make(map[string]bool),
+		extensions: make(map[string]bool),
+		include:    c.Include,
+		exclude:    c.Exclude,
+	}
+	for _, m := range c.BackupMarkers {
+		f.backupMarkers = append(f.backupMarkers, strings.ToLower(m))
+	}
+	for _, d := range append(append([]string{}, c.SkipDirs...), c.ExtraSkipDirs...) {
+		f.skipDirs[d] = true
+	}
+	for _, e := range append(append([]string{}, c.Extensions...), c.ExtraExtensions...) {
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		f.extensions[strings.ToLower(e)] = true
+	}
+	return f
+}
+
+// SkipDir reports whether a directory is excluded by name.
+func (f CorpusFilter) SkipDir(name string) bool {
+	return f.skipDirs[name]
+}
+
+// Allowed reports whether a file extension is included in the corpus.
+func (f CorpusFilter) Allowed(ext string) bool {
+	return f.extensions[strings.ToLower(ext)]
+}
+
+// IsBackup reports whether a file or directory name looks like a backup.
+func (f CorpusFilter) IsBackup(name string) bool {
+	nameLower := strings.ToLower(name)
+	for _, m := range f.backupMarkers {
+		if strings.Contains(nameLower, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Included reports whether a file, given by its slash-separated path
+// relative to the project root, belongs in the corpus.
+func (f CorpusFilter) Included(rel string) bool {
+	if f.Excluded(rel) {
+		return false
+	}
+	return f.Allowed(path.Ext(rel)) || matchAny(f.include, rel)
+}
+
+// Excluded reports whether a relative path matches an exclude glob.
+func (f CorpusFilter) Excluded(rel string) bool {
+	return matchAny(f.exclude, rel)
+}
+
+// matchAny matches rel against globs. Patterns without a slash match the base
+// name; a trailing "/**" matches everything below a directory.
+func matchAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "/**"); ok {
+			if rel == prefix || strings.HasPrefix(rel, prefix+"/") {
+				return true
+			}
+			continue
+		}
+		target := rel
+		if !strings.Contains(p, "/") {
+			target = path.Base(rel)
+		}
+		if ok, _ := path.Match(p, target); ok {
+			return true
+		}
+	}
+	return false
+}
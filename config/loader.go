@@ -0,0 +1,332 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Actions are one-shot command-line switches that are not part of the
+// persistent configuration.
+type Actions struct {
+	ListModels  bool
+	Check       bool
+	Version     bool
+	IndexExport string // Path to write the built semantic index to
+}
+
+// setting binds one flag to its environment variable and config field.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	bool  bool
+	set   func(c *Config, v string) error
+}
+
+// key returns the YAML name of the setting, as Config.Given takes it.
+func (s setting) key() string {
+	return strings.ReplaceAll(s.flag, "-", "_")
+}
+
+// EnvName returns the environment variable equivalent of a flag name,
+// e.g. "cache-ttl" -> "GEMINI_PROXY_CACHE_TTL".
+func EnvName(flagName string) string {
+	return "GEMINI_PROXY_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func newSetting(name, usage string, set func(c *Config, v string) error) setting {
+	return setting{flag: name, env: EnvName(name), usage: usage, set: set}
+}
+
+func newBoolSetting(name, usage string, set func(c *Config, b bool)) setting {
+	s := newSetting(name, usage, func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		set(c, b)
+		return nil
+	})
+	s.bool = true
+	return s
+}
+
+func parseInt(v string, dst *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*dst = n
+	return nil
+}
+
+// settings lists every configurable flag. "config" and "profile" are handled
+// specially by Load because they select other sources.
+var settings = []setting{
+	newSetting("port", "Port to run the server on", func(c *Config, v string) error {
+		c.Port = v
+		return nil
+	}),
+	newSetting("model", "Gemini model to use", func(c *Config, v string) error {
+		c.Model = v
+		return nil
+	}),
+	newSetting("cache", "Path to build context cache from (enables caching mode)", func(c *Config, v string) error {
+		c.CachePath = v
+		return nil
+	}),
+	newSetting("cache-id", "Existing Cache ID to use directly", func(c *Config, v string) error {
+		c.CacheID = v
+		return nil
+	}),
+	newSetting("cache-ttl", "Context cache TTL in minutes", func(c *Config, v string) error {
+		return parseInt(v, &c.CacheTTLMinutes)
+	}),
+	newSetting("history-turns", "Maximum chat history turns sent upstream", func(c *Config, v string) error {
+		return parseInt(v, &c.MaxHistoryTurns)
+	}),
+	newSetting("request-timeout", "Seconds a request and its tool loop may run (0 disables)", func(c *Config, v string) error {
+		return parseInt(v, &c.RequestTimeout)
+	}),
+	newSetting("temperature", "Default sampling temperature", func(c *Config, v string) error {
+		f, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return err
+		}
+		c.Temperature = float32(f)
+		return nil
+	}),
+	newSetting("tool-policy", "Agentic tool policy: none, read-only or full", func(c *Config, v string) error {
+		c.ToolPolicy = v
+		return nil
+	}),
+	newSetting("system-prompt-policy", "What a request's own system prompt does: append, replace or ignore", func(c *Config, v string) error {
+		c.SystemPromptPolicy = v
+		return nil
+	}),
+	newSetting("crash-recovery", "What becomes of the file writes of a turn interrupted by a crash: annotate or rollback", func(c *Config, v string) error {
+		c.CrashRecovery = v
+		return nil
+	}),
+	newSetting("empty-reply", "What a reply without content becomes: warn, reason, retry or fallback", func(c *Config, v string) error {
+		c.EmptyReply.Policy = v
+		return nil
+	}),
+	newSetting("log-level", "Log level: debug, info, warn or error", func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}),
+	newSetting("log-format", "Log format: text or json", func(c *Config, v string) error {
+		c.LogFormat = v
+		return nil
+	}),
+	newSetting("log-retention-days", "Delete rotated logs older than this many days (0 keeps all)", func(c *Config, v string) error {
+		return parseInt(v, &c.LogRetentionDays)
+	}),
+	newSetting("log-max-size", "Rotate the log file after this many MB (0 rotates daily only)", func(c *Config, v string) error {
+		return parseInt(v, &c.LogMaxSizeMB)
+	}),
+	newSetting("access-log", "Write an HTTP access log under logs/: common or combined", func(c *Config, v string) error {
+		c.AccessLog = v
+		return nil
+	}),
+	newSetting("cors-origins", "Origins allowed to call the proxy from a browser, separated by commas (* for any)", func(c *Config, v string) error {
+		c.CORSOrigins = nil
+		for o := range strings.SplitSeq(v, ",") {
+			if o = strings.TrimSpace(o); o != "" {
+				c.CORSOrigins = append(c.CORSOrigins, o)
+			}
+		}
+		return nil
+	}),
+	newSetting("otlp-endpoint", "OTLP/HTTP endpoint for trace export (enables tracing)", func(c *Config, v string) error {
+		c.Tracing.Endpoint = v
+		return nil
+	}),
+	newSetting("slow-request", "Log requests slower than this many seconds as warnings (0 disables)", func(c *Config, v string) error {
+		return parseInt(v, &c.Anomaly.SlowRequestSeconds)
+	}),
+	newSetting("max-concurrent", "Generation requests served at once; more are queued (0 disables)", func(c *Config, v string) error {
+		return parseInt(v, &c.Concurrency.MaxInFlight)
+	}),
+	newSetting("max-queue", "Requests allowed to wait for a slot before returning 429", func(c *Config, v string) error {
+		return parseInt(v, &c.Concurrency.MaxQueue)
+	}),
+	newSetting("redis-url", "Share sessions, costs and the active cache through Redis (redis://host:6379/0)", func(c *Config, v string) error {
+		c.Store.RedisURL = v
+		return nil
+	}),
+	newSetting("retry-attempts", "Attempts per upstream call on 429, 5xx or network errors (1 disables retries)", func(c *Config, v string) error {
+		return parseInt(v, &c.Retry.MaxAttempts)
+	}),
+	newSetting("breaker-threshold", "Consecutive upstream failures that open the circuit breaker (0 disables it)", func(c *Config, v string) error {
+		return parseInt(v, &c.Breaker.FailureThreshold)
+	}),
+	newSetting("quota-max-wait", "Longest an upstream call is held back as a rate limit comes near, in seconds (0 disables pacing)", func(c *Config, v string) error {
+		return parseInt(v, &c.Quota.MaxWaitSeconds)
+	}),
+	newBoolSetting("warmup", "Warm up the default model at startup and keep the upstream connection open", func(c *Config, b bool) {
+		c.Warmup.Enabled = b
+	}),
+	newSetting("upstream-proxy", "HTTP(S) proxy URL for Gemini API calls (default: HTTPS_PROXY)", func(c *Config, v string) error {
+		c.Upstream.ProxyURL = v
+		return nil
+	}),
+	newSetting("stream-flush-ms", "Batch streamed text for up to this many milliseconds per event (0 sends each chunk)", func(c *Config, v string) error {
+		return parseInt(v, &c.Streaming.FlushMs)
+	}),
+	newSetting("stream-keepalive", "Seconds a stream may sit idle before a keepalive frame is sent (0 disables)", func(c *Config, v string) error {
+		return parseInt(v, &c.Streaming.KeepaliveSeconds)
+	}),
+	newSetting("stream-resume-seconds", "Seconds a dropped /chat/stream keeps generating and stays resumable (0 cancels on disconnect)", func(c *Config, v string) error {
+		return parseInt(v, &c.Streaming.ResumeSeconds)
+	}),
+	newSetting("summary-model", "Model that summarizes chat sessions for /sessions/<id>/summarize", func(c *Config, v string) error {
+		c.SummaryModel = v
+		return nil
+	}),
+	newSetting("image-model", "Default model for /images/generate (gemini-*-image or imagen-*)", func(c *Config, v string) error {
+		c.Images.Model = v
+		return nil
+	}),
+	newSetting("image-dir", "Directory for generated image files, relative to the home directory", func(c *Config, v string) error {
+		c.Images.OutputDir = v
+		return nil
+	}),
+	newBoolSetting("index", "Build or update the semantic search index on startup", func(c *Config, b bool) {
+		c.Index.BuildOnStart = b
+	}),
+	newBoolSetting("rerank", "Rerank retrieved chunks with a Gemini model before the best are used", func(c *Config, b bool) {
+		c.Index.Rerank = b
+	}),
+	newSetting("rerank-model", "Model that reranks retrieved chunks", func(c *Config, v string) error {
+		c.Index.RerankModel = v
+		return nil
+	}),
+	newSetting("index-projects", "Other projects to index for cross-project search, as name=path pairs separated by commas", func(c *Config, v string) error {
+		c.Index.Projects = map[string]string{}
+		for pair := range strings.SplitSeq(v, ",") {
+			name, root, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				return fmt.Errorf("want name=path, got %q", pair)
+			}
+			c.Index.Projects[name] = root
+		}
+		return nil
+	}),
+	newBoolSetting("index-conversations", "Index chat sessions so past conversations can be searched", func(c *Config, b bool) {
+		c.Index.Conversations = b
+	}),
+	newSetting("index-file", "Index file or URL to import the semantic index from on startup, when it is newer", func(c *Config, v string) error {
+		c.Index.File = v
+		return nil
+	}),
+	newSetting("index-watch-seconds", "Seconds between checks for project changes to update the semantic index with (0 disables)", func(c *Config, v string) error {
+		return parseInt(v, &c.Index.WatchSeconds)
+	}),
+	newSetting("record", "Record every Gemini API response to this directory, with temperature and seed pinned", func(c *Config, v string) error {
+		c.Replay.Mode, c.Replay.Dir = ReplayRecord, v
+		return nil
+	}),
+	newSetting("replay", "Answer from the recordings in this directory instead of calling the Gemini API", func(c *Config, v string) error {
+		c.Replay.Mode, c.Replay.Dir = ReplayReplay, v
+		return nil
+	}),
+	newBoolSetting("response-cache", "Serve repeated identical upstream requests from a local cache", func(c *Config, b bool) {
+		c.ResponseCache.Enabled = b
+	}),
+	newBoolSetting("duplicates", "Answer questions close to one answered recently with that answer", func(c *Config, b bool) {
+		c.Duplicates.Enabled = b
+	}),
+	newBoolSetting("dev", "Reload the web UI template from web/index.html on every request", func(c *Config, b bool) {
+		c.Dev = b
+	}),
+	newBoolSetting("debug", "Start with every debug switch on: request and response dumps, tool arguments in the log and upstream captures", func(c *Config, b bool) {
+		c.Debug = b
+	}),
+}
+
+// Load registers all flags on fs, parses args and resolves the effective
+// configuration. Actions are returned even when the configuration is invalid
+// so that -version and -check still work.
+func Load(fs *flag.FlagSet, args []string) (Config, Actions, error) {
+	var actions Actions
+	configPath := fs.String("config", "", "Path to YAML config file (env GEMINI_PROXY_CONFIG)")
+	profile := fs.String("profile", "", "Named profile to apply: ide, agent, demo or one defined in the config (env GEMINI_PROXY_PROFILE)")
+
+	// Flag values are recorded and applied last so they override everything
+	type flagValue struct {
+		s setting
+		v string
+	}
+	var explicit []flagValue
+	for _, s := range settings {
+		s := s
+		usage := fmt.Sprintf("%s (env %s)", s.usage, s.env)
+		record := func(v string) error {
+			explicit = append(explicit, flagValue{s, v})
+			return nil
+		}
+		if s.bool {
+			fs.BoolFunc(s.flag, usage, func(v string) error { return record(v) })
+		} else {
+			fs.Func(s.flag, usage, record)
+		}
+	}
+	fs.BoolVar(&actions.ListModels, "list-models", envBool("list-models"), "List available models and exit (env GEMINI_PROXY_LIST_MODELS)")
+	fs.BoolVar(&actions.Check, "check", envBool("check"), "Validate config, API key, model and directories, print a JSON report and exit (env GEMINI_PROXY_CHECK)")
+	fs.StringVar(&actions.IndexExport, "index-export", os.Getenv(EnvName("index-export")), "Build the semantic index, write it to this file for -index-file and exit (env GEMINI_PROXY_INDEX_EXPORT)")
+	fs.BoolVar(&actions.Version, "version", false, "Show the version, commit and build date, and exit")
+	if err := fs.Parse(args); err != nil {
+		return Default(), actions, err
+	}
+
+	cfg := Default()
+	path := *configPath
+	if path == "" {
+		path = os.Getenv("GEMINI_PROXY_CONFIG")
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return cfg, actions, err
+		}
+	}
+
+	// The profile completes the file layer, so the environment overrides it
+	if v := os.Getenv("GEMINI_PROXY_PROFILE"); v != "" {
+		cfg.Profile = v
+	}
+	if *profile != "" {
+		cfg.Profile = *profile
+	}
+	if cfg.Profile != "" {
+		if err := cfg.ApplyProfile(cfg.Profile); err != nil {
+			return cfg, actions, err
+		}
+	}
+
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != "" {
+			if err := s.set(&cfg, v); err != nil {
+				return cfg, actions, fmt.Errorf("%s: %w", s.env, err)
+			}
+			cfg.markGiven(s.key())
+		}
+	}
+
+	for _, fv := range explicit {
+		if err := fv.s.set(&cfg, fv.v); err != nil {
+			return cfg, actions, fmt.Errorf("-%s: %w", fv.s.flag, err)
+		}
+		cfg.markGiven(fv.s.key())
+	}
+	return cfg, actions, cfg.Validate()
+}
+
+func envBool(flagName string) bool {
+	b, _ := strconv.ParseBool(os.Getenv(EnvName(flagName)))
+	return b
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ProjectFile is the name of the per-repository config looked up in the
+// project root.
+const ProjectFile = ".gemini-proxy.yaml"
+
+// ProjectConfig is the subset of settings a repository may declare for
+// itself in .gemini-proxy.yaml.
+type ProjectConfig struct {
+	SystemPrompt string   `yaml:"system_prompt"`
+	Include      []string `yaml:"include"`
+	Exclude      []string `yaml:"exclude"`
+	ToolPolicy   string   `yaml:"tool_policy"`
+	Model        string   `yaml:"model"`
+}
+
+// LoadProject reads root/.gemini-proxy.yaml. It returns nil without error
+// when the file does not exist.
+func LoadProject(root string) (*ProjectConfig, error) {
+	p := filepath.Join(root, ProjectFile)
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read project config: %w", err)
+	}
+	var pc ProjectConfig
+	if err := yaml.Unmarshal(data, &pc); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", p, err)
+	}
+	return &pc, nil
+}
+
+// MergeProject layers a project config underneath c: project values only
+// fill settings the config file, profile, environment and flags left
+// unset, even ones they set to the default, while include/exclude globs
+// are added to the corpus filters.
+func (c *Config) MergeProject(p *ProjectConfig) error {
+	if p == nil {
+		return nil
+	}
+	if p.SystemPrompt != "" && !c.Given("system_prompt") {
+		c.SystemPrompt = p.SystemPrompt
+	}
+	if p.ToolPolicy != "" && !c.Given("tool_policy") {
+		c.ToolPolicy = p.ToolPolicy
+	}
+	if p.Model != "" && !c.Given("model") {
+		c.Model = p.Model
+	}
+	c.Corpus.Include = append(c.Corpus.Include, p.Include...)
+	c.Corpus.Exclude = append(c.Corpus.Exclude, p.Exclude...)
+	return c.Validate()
+}
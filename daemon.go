@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The daemon started by start -daemon records its process ID in pidFile
+// under the server home, and writes what it prints, including fatal errors
+// from before logging is set up, to daemonLog there.
+const (
+	pidFile   = "gemini-proxy.pid"
+	daemonLog = "logs/daemon.out"
+)
+
+// readPID returns the process ID recorded under home, or 0 if there is none.
+func readPID(home string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(home, pidFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", pidFile, err)
+	}
+	return pid, nil
+}
+
+// runningPID returns the process ID of the daemon if it is running. A
+// pidfile left by a daemon that died is removed.
+func runningPID(home string) (int, error) {
+	pid, err := readPID(home)
+	if err != nil || pid == 0 {
+		return 0, err
+	}
+	if !processAlive(pid) {
+		os.Remove(filepath.Join(home, pidFile))
+		return 0, nil
+	}
+	return pid, nil
+}
+
+// runStart runs the server, in the background with -daemon. The daemon is
+// the same binary running serve with the other arguments, detached from the
+// terminal.
+func runStart(args []string) int {
+	fs := commandFlags("start")
+	daemon := fs.Bool("daemon", false, "Run the server in the background")
+	env := loadEnvironment(fs, args)
+	var serveArgs []string
+	for _, a := range args {
+		// -daemon and -json belong to start; serve does not take them
+		if name, _, _ := strings.Cut(strings.TrimLeft(a, "-"), "="); strings.HasPrefix(a, "-") && (name == "daemon" || name == "json") {
+			continue
+		}
+		serveArgs = append(serveArgs, a)
+	}
+	if !*daemon {
+		return serve(serveArgs)
+	}
+	if err := env.err(); err != nil {
+		return fail(err)
+	}
+	if pid, err := runningPID(env.home); err != nil {
+		return fail(err)
+	} else if pid != 0 {
+		return fail(fmt.Errorf("the proxy is already running (pid %d)", pid))
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fail(err)
+	}
+	logPath := filepath.Join(env.home, daemonLog)
+	if err := os.MkdirAll(filepath.Dir(logPath), 0o755); err != nil {
+		return fail(err)
+	}
+	out, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fail(err)
+	}
+	defer out.Close()
+
+	cmd := exec.Command(exe, append([]string{"serve"}, serveArgs...)...)
+	cmd.Dir = env.home
+	cmd.Stdout, cmd.Stderr = out, out
+	if err := detach(cmd); err != nil {
+		return fail(err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fail(err)
+	}
+	pid := cmd.Process.Pid
+	if err := os.WriteFile(filepath.Join(env.home, pidFile), []byte(strconv.Itoa(pid)+"\n"), 0o644); err != nil {
+		cmd.Process.Kill()
+		return fail(err)
+	}
+
+	// Most startup failures, such as a missing API key or a port in use,
+	// end the process at once
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	select {
+	case err := <-exited:
+		os.Remove(filepath.Join(env.home, pidFile))
+		return fail(fmt.Errorf("the proxy exited at startup (%v); see %s", err, logPath))
+	case <-time.After(time.Second):
+	}
+	if jsonOutput {
+		return printJSON(map[string]any{"pid": pid, "url": proxyURL(env.cfg.Port), "output": logPath})
+	}
+	fmt.Printf("Proxy started (pid %d) on %s, output in %s\n", pid, proxyURL(env.cfg.Port), logPath)
+	return 0
+}
+
+// runStop stops the daemon and waits for it to exit.
+func runStop(args []string) int {
+	env := loadEnvironment(commandFlags("stop"), args)
+	pid, err := runningPID(env.home)
+	if err != nil {
+		return fail(err)
+	}
+	if pid == 0 {
+		if jsonOutput {
+			return printJSON(map[string]any{"stopped": false})
+		}
+		fmt.Println("The proxy is not running")
+		return 0
+	}
+	if err := terminate(pid); err != nil {
+		return fail(fmt.Errorf("stopping pid %d: %w", pid, err))
+	}
+	for deadline := time.Now().Add(10 * time.Second); processAlive(pid); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			return fail(fmt.Errorf("pid %d is still running after 10s", pid))
+		}
+	}
+	os.Remove(filepath.Join(env.home, pidFile))
+	if jsonOutput {
+		return printJSON(map[string]any{"stopped": true, "pid": pid})
+	}
+	fmt.Printf("Proxy stopped (pid %d)\n", pid)
+	return 0
+}
+
+// runStatus reports whether the daemon is running and, if it answers on
+// the configured port, its mode and cache. It exits with 1 when the proxy
+// is not running, as init scripts expect, and 0 otherwise.
+func runStatus(args []string) int {
+	env := loadEnvironment(commandFlags("status"), args)
+	pid, err := runningPID(env.home)
+	if err != nil {
+		return fail(err)
+	}
+	if pid == 0 {
+		if jsonOutput {
+			printJSON(map[string]any{"running": false})
+		} else {
+			fmt.Println("The proxy is not running")
+		}
+		return 1
+	}
+	url := proxyURL(env.cfg.Port)
+	st, err := fetchStatus(url)
+	if jsonOutput {
+		out := map[string]any{"running": true, "pid": pid, "url": url, "status": st}
+		if err != nil {
+			out["error"] = err.Error()
+		}
+		return printJSON(out)
+	}
+	fmt.Printf("The proxy is running (pid %d) on %s\n", pid, url)
+	if err != nil {
+		fmt.Printf("It does not answer yet: %v\n", err)
+		return 0
+	}
+	if st.CacheID == "" {
+		st.CacheID = "none"
+	}
+	fmt.Printf("Mode: %s\nCache: %s\nSessions: %d\nTotal cost: $%.4f\n", st.Mode, st.CacheID, st.Sessions, st.Cost)
+	return 0
+}
+
+// daemonStatus is the part of the daemon's GET /status that status prints.
+type daemonStatus struct {
+	Mode     string  `json:"mode"`
+	CacheID  string  `json:"cache_id"`
+	Sessions int     `json:"sessions"`
+	Cost     float64 `json:"total_cost"`
+}
+
+// fetchStatus asks the proxy at url for its status.
+func fetchStatus(url string) (*daemonStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var st daemonStatus
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, fmt.Errorf("reading its status: %w", err)
+	}
+	return &st, nil
+}
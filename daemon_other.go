@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errNoDaemon = errors.New("running in the background needs a Unix system; use a service manager instead")
+
+func detach(cmd *exec.Cmd) error { return errNoDaemon }
+
+func processAlive(pid int) bool { return false }
+
+func terminate(pid int) error { return errNoDaemon }
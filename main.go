@@ -1,1774 +1,289 @@
+// Command gemini-proxy runs the Gemini context caching proxy. Its
+// subcommands script the same configuration without a server: building and
+// listing caches, one-off chats and questions, model lists, cost reports
+// and client configuration. All server state lives in package proxy; this
+// file only wires configuration, logging and tracing together and starts
+// the listener.
 package main
 
 import (
-	"bytes"
 	"context"
-	"embed"
-	"encoding/base64"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"html/template"
-	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
-	"time"
 
-	"google.golang.org/genai"
+	"customgemini/config"
+	"customgemini/proxy"
 )
 
-//go:embed web/index.html
-var indexHTML string
-
-//go:embed web/assets/*
-var assetsFS embed.FS
-
-// --- CONFIGURATION ---
-const (
-	Version         = "1.2.1"
-	DefaultPort     = ":8080"
-	DefaultModel    = "gemini-3.0-flash"
-	WorkDir         = "."
-	HistoryPath     = ".history"
-	TTLMinutes      = 120
-	MaxFileBytes    = 256 * 1024 // 256KB cap per file
-	MaxTotalChars   = 4000000    // ~1M token safety cap
-	MaxHistoryTurns = 8          // Safe limit to prevent API cache invalidation
-)
-
-// --- GLOBAL STATE ---
-var (
-	ctx    = context.Background()
-	client *genai.Client
-
-	sessions = make(map[string][]*genai.Content)
-	mu       sync.Mutex
-
-	totalCost   float64
-	cacheName   string
-	cacheModel  string
-	projectRoot string // Absolute path to the directory being served/cached
-	serverHome  string // Absolute path to the directory where main.go lives
-	serverPort  string
-	debugMode   bool
-	logFile     *os.File
-	logMu       sync.Mutex
-)
-
-var modelCosts = map[string]struct{ In, Out float64 }{
-	"gemini-1.5-flash":                    {0.075, 0.30},
-	"gemini-1.5-flash-8b":                 {0.0375, 0.15},
-	"gemini-1.5-pro":                      {1.25, 5.00},
-	"gemini-2.0-flash":                    {0.10, 0.40},
-	"gemini-2.0-flash-exp":                {0.00, 0.00},
-	"gemini-2.0-flash-lite-preview-02-05": {0.075, 0.30},
-	"gemini-exp-1206":                     {0.00, 0.00},
-	"gemini-2.0-pro-exp-02-05":            {0.00, 0.00},
-	"gemini-2.5-flash":                    {0.075, 0.30}, // Added pricing for gemini-2.5-flash
+// command is a gemini-proxy subcommand. Every command accepts the server's
+// flags, followed by its own arguments.
+type command struct {
+	args  string // Arguments, for usage and the verbs to complete
+	help  string
+	flags []string // Its own flags, besides the server's and -json, to complete
+	run   func(args []string) int
 }
 
-type ChatRequest struct {
-	SessionID      string                 `json:"session_id"`
-	Model          string                 `json:"model"`
-	Message        string                 `json:"message"`
-	CacheID        string                 `json:"cache_id"`      // Optional override
-	UseSearch      bool                   `json:"use_search"`    // Enable Google Search grounding
-	UseAgentic     bool                   `json:"use_agentic"`   // Enable file tools (write_file, etc.)
-	Images         []string               `json:"images"`        // Base64 encoded images from frontend
-	Temperature    *float32               `json:"temperature"`   // Optional temperature override
-	SafetySettings map[string]string      `json:"safety_settings"` // Optional safety settings override
-}
-
-type ChatResponse struct {
-	Text           string      `json:"text"`
-	Images         []ImageData `json:"images,omitempty"`
-	ToolCalls      []string    `json:"tool_calls,omitempty"`
-	PromptTokens   int         `json:"prompt_tokens"`
-	ResponseTokens int         `json:"response_tokens"`
-	TotalTokens    int         `json:"total_tokens"`
-	Cost           float64     `json:"cost"`              // Alias for frontend
-	RequestCost    float64     `json:"request_cost_brl"`  // Legacy field
-	TotalCost      float64     `json:"session_total_brl"`
-}
-
-type ImageData struct {
-	MimeType string `json:"mime_type"`
-	Data     string `json:"data"` // base64 encoded
-}
-
-// TemplateData holds data for HTML template rendering
-type TemplateData struct {
-	CacheName  string
-	CacheModel string
-	ServerPort string
-	MCPPath    string
-}
-
-// --- LOGGING ---
-
-func logMsg(format string, args ...any) {
-	timestamp := time.Now().Format("2006-01-02 15:04:05")
-	msg := fmt.Sprintf("[%s] %s", timestamp, fmt.Sprintf(format, args...))
-	fmt.Println(msg)
-
-	logMu.Lock()
-	defer logMu.Unlock()
-	if logFile != nil {
-		logFile.WriteString(msg + "\n")
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"serve":      {"[flags]", "Run the proxy server (the default)", nil, serve},
+		"cache":      {"build [flags] [path] | list | delete <name>", "Build (printing it as JSON), list or delete context caches", []string{"path"}, runCache},
+		"chat":       {"[flags] <message>", "Send one message and print the reply; the message is read from stdin when omitted", []string{"session", "context", "agentic"}, runChat},
+		"ask":        {"[flags] [-stdin] <question>", "Answer one question with the active cache and print only the answer", []string{"stdin"}, runAsk},
+		"sessions":   {"dump|export <id> | replay <file>", "Print a session's transcript as JSON, export it as Markdown or HTML, or replay one against -model", []string{"context", "agentic", "format", "o"}, runSessions},
+		"models":     {"[flags]", "List the models available to the API key", nil, runModels},
+		"cost":       {"report [flags]", "Print usage and cost by day, model or session", []string{"since", "until", "group-by"}, runCost},
+		"start":      {"[-daemon] [flags]", "Run the server, in the background with -daemon", []string{"daemon"}, runStart},
+		"stop":       {"[flags]", "Stop the server started with start -daemon", nil, runStop},
+		"status":     {"[flags]", "Report whether the background server is running", nil, runStatus},
+		"config-for": {"continue|cursor|claude-desktop|zed [flags]", "Print client configuration for this proxy", []string{"url", "key"}, runConfigFor},
+		"completion": {"bash|zsh|fish", "Print a shell completion script", nil, runCompletion},
 	}
 }
 
-func initLogging() {
-	// Create logs directory
-	logsDir := filepath.Join(serverHome, "logs")
-	os.MkdirAll(logsDir, 0755)
-
-	// Open daily log file
-	dateStr := time.Now().Format("2006-01-02")
-	logPath := filepath.Join(logsDir, fmt.Sprintf("server_%s.log", dateStr))
-	var err error
-	logFile, err = os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Warning: Could not open log file: %v", err)
+func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+		printCommands()
+		os.Exit(2)
 	}
+	os.Exit(cmd.run(args))
 }
 
-func writeDebugResponse(content string) {
-	if !debugMode {
-		return
+func printCommands() {
+	fmt.Fprintf(os.Stderr, "Usage: gemini-proxy [command] [arguments]\n\nCommands:\n")
+	for _, name := range []string{"serve", "start", "stop", "status", "cache", "chat", "ask", "sessions", "models", "cost", "config-for", "completion"} {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-10s %-44s %s\n", name, c.args, c.help)
 	}
-	debugPath := filepath.Join(serverHome, "debug_last_response.txt")
-	os.WriteFile(debugPath, []byte(content), 0644)
+	fmt.Fprintf(os.Stderr, "\nRun gemini-proxy <command> -h for the flags.\n")
 }
 
-func main() {
-	port := flag.String("port", DefaultPort, "Port to run the server on")
-	cachePath := flag.String("cache", "", "Path to build context cache from (enables caching mode)")
-	modelName := flag.String("model", DefaultModel, "Gemini model to use")
-	cacheIDFlag := flag.String("cache-id", "", "Existing Cache ID to use directly")
-	listModelsCmd := flag.Bool("list-models", false, "List available models and exit")
-	debugFlag := flag.Bool("debug", false, "Enable debug mode (saves responses to file)")
-	versionFlag := flag.Bool("version", false, "Show version and exit")
-	flag.Parse()
+// environment is the configuration a command runs with.
+type environment struct {
+	cfg         config.Config
+	actions     config.Actions
+	home        string
+	projectRoot string
+	projectCfg  *config.ProjectConfig
 
-	if *versionFlag {
-		fmt.Printf("Gemini Context Caching Proxy v%s\n", Version)
-		os.Exit(0)
-	}
+	cfgErr, projectErr error
+}
 
-	serverPort = *port
-	debugMode = *debugFlag
+// loadEnvironment parses args with the server's flags registered on fs and
+// resolves the configuration: flags over environment over config file,
+// with the project's own .gemini-proxy.yaml beneath them all. Errors are
+// kept rather than fatal, so that -check can report them.
+func loadEnvironment(fs *flag.FlagSet, args []string) *environment {
+	env := &environment{}
+	env.cfg, env.actions, env.cfgErr = config.Load(fs, args)
 
-	// Capture serverHome (where the executable/source is)
-	// --- LINTER FIX START ---
+	// Capture home (where the executable/source is)
 	wd, err := os.Getwd()
 	if err != nil {
 		log.Fatalf("Could not get current working directory: %v", err)
 	}
-	serverHome = wd
-	// --- LINTER FIX END ---
-
-	// Initialize logging
-	initLogging()
+	env.home = wd
+	env.resolveProject()
+	return env
+}
 
-	// Determine project root and cache mode
-	if *cachePath != "" {
-		// Cache mode: use specified path or current directory
-		path := *cachePath
-		if path == "." || path == "" {
-			path = wd
-		}
+// resolveProject sets the project root from CachePath, or the working
+// directory, and layers the repository's .gemini-proxy.yaml under the
+// configuration.
+func (env *environment) resolveProject() {
+	env.projectRoot = env.home
+	if path := env.cfg.CachePath; path != "" && path != "." {
 		absPath, err := filepath.Abs(path)
 		if err != nil {
 			log.Fatalf("Could not resolve absolute path: %v", err)
 		}
-		projectRoot = absPath
-	} else {
-		// Clean mode (default): use current working directory
-		projectRoot = wd
-	}
-
-	logMsg("--- Antigravity Brain Server ---")
-	logMsg("--- Mode: %s ---", func() string {
-		if *cacheIDFlag != "" {
-			return "EXPLICIT CACHE"
-		} else if *cachePath != "" {
-			return "CACHE BUILD"
-		}
-		return "CLEAN (Stateless)"
-	}())
-	logMsg("--- Project Root: %s ---", projectRoot)
-	logMsg("--- Server Home: %s ---", serverHome)
-
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
-		// Try loading from .env file
-		if data, err := os.ReadFile(".env"); err == nil {
-			lines := strings.Split(string(data), "\n")
-			for _, line := range lines {
-				if strings.HasPrefix(line, "GEMINI_API_KEY=") {
-					apiKey = strings.TrimPrefix(line, "GEMINI_API_KEY=")
-					os.Setenv("GEMINI_API_KEY", apiKey)
-					break
-				}
-			}
-		}
-	}
-	if apiKey == "" {
-		log.Fatal("FATAL: GEMINI_API_KEY is not set.")
+		env.projectRoot = absPath
 	}
-
-	client, err = genai.NewClient(ctx, &genai.ClientConfig{
-		APIKey: apiKey,
-	})
-	if err != nil {
-		log.Fatal(err)
+	env.projectCfg, env.projectErr = config.LoadProject(env.projectRoot)
+	if env.projectErr == nil {
+		env.projectErr = env.cfg.MergeProject(env.projectCfg)
 	}
-
-	if *listModelsCmd {
-		ListModels(client)
-		return
-	}
-
-	// Cache setup based on mode
-	if *cacheIDFlag != "" {
-		// Explicit cache ID provided
-		cacheName = *cacheIDFlag
-		cacheModel = *modelName
-		logMsg("--- Using Explicit Cache ID: %s ---", cacheName)
-	} else if *cachePath != "" {
-		// Build new cache from path
-		logMsg("--- Building Context Cache for: %s ---", projectRoot)
-		cacheName = BuildAndGetCache(client, projectRoot, *modelName)
-		if cacheName != "" {
-			os.Setenv("GEMINI_CACHE", cacheName)
-			logMsg("--- Exported Environment Variable: GEMINI_CACHE=%s ---", cacheName)
-		}
-	} else {
-		// Clean mode - no cache
-		cacheModel = *modelName
-		logMsg("--- Running in Clean Mode (no cache) ---")
-	}
-
-	// 3. START SERVER
-	// Core endpoints
-	http.HandleFunc("/chat", handleChat)
-	http.HandleFunc("/reset", handleReset)
-	http.HandleFunc("/files", handleFiles)
-	http.HandleFunc("/models", handleModels)
-	http.HandleFunc("/status", handleStatus)
-
-	// Official Gemini API compatibility (for IDE SDKs)
-	http.HandleFunc("/v1beta/models/", handleOfficialAPI)
-
-	// OpenAI API compatibility (for tools expecting OpenAI)
-	http.HandleFunc("/v1/models", handleOpenAIModels)
-	http.HandleFunc("/v1/chat/completions", handleOpenAIChat)
-
-	// Static assets and root
-	http.HandleFunc("/assets/", handleAssets)
-	http.HandleFunc("/", handleRoot)
-
-	fmt.Printf("--- Server Running on %s ---\n", serverPort)
-	if cacheName != "" {
-		fmt.Printf("--- Cache Active: %s ---\n", cacheName)
-	}
-	log.Fatal(http.ListenAndServe(serverPort, nil))
 }
 
-// --- CORE LOGIC ---
-
-func BuildAndGetCache(client *genai.Client, path, model string) string {
-	var contentBuilder strings.Builder
-
-	// Ingest history relative to project root
-	historyPath := filepath.Join(projectRoot, HistoryPath)
-	if hist, err := os.ReadFile(historyPath); err == nil {
-		contentBuilder.WriteString("\n=== PROJECT HISTORY LOG ===\n")
-		contentBuilder.Write(hist)
+// err returns the first configuration error.
+func (env *environment) err() error {
+	if env.cfgErr != nil {
+		return fmt.Errorf("config error: %w", env.cfgErr)
 	}
-
-	fileCount := 0
-	filepath.WalkDir(projectRoot, func(p string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		nameLower := strings.ToLower(d.Name())
-		isBackup := strings.Contains(nameLower, "backup") || strings.Contains(nameLower, "bkup")
-
-		if d.IsDir() {
-			skipDirs := map[string]bool{
-				".git": true, "node_modules": true, "venv": true, ".venv": true,
-				"dist": true, "build": true, ".next": true, ".DS_Store": true,
-				"target": true, "out": true, "images": true, "img": true,
-				"media": true, "photos": true, "videos": true,
-			}
-			if skipDirs[d.Name()] || isBackup {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		if isBackup {
-			return nil
-		}
-
-		ext := filepath.Ext(p)
-		// Explicitly allowed text/code formats. Note: .py is moved to restricted if it was there (it wasn't).
-		allowed := map[string]bool{".md": true, ".txt": true, ".go": true, ".js": true, ".ts": true, ".json": true, ".lua": true, ".css": true, ".html": true}
-
-		if allowed[ext] {
-			if contentBuilder.Len() > MaxTotalChars {
-				return filepath.SkipAll
-			}
-
-			info, err := d.Info()
-			if err == nil && info.Size() > MaxFileBytes {
-				// Skip files that are too large (minified bundles, large data)
-				return nil
-			}
-
-			if data, err := os.ReadFile(p); err == nil {
-				// Simple binary detection: check first 1KB for null bytes
-				isBinary := false
-				checkSize := len(data)
-				if checkSize > 1024 {
-					checkSize = 1024
-				}
-				for i := 0; i < checkSize; i++ {
-					if data[i] == 0 {
-						isBinary = true
-						break
-					}
-				}
-
-				if !isBinary {
-					contentBuilder.WriteString(fmt.Sprintf("\n\n--- FILE: %s ---\n", p))
-					contentBuilder.Write(data)
-					fileCount++
-				}
-			}
-		}
-		return nil
-	})
-
-	fmt.Printf("Compiled %d files. Checking size...\n", fileCount)
-
-	if contentBuilder.Len() < 32768 {
-		fmt.Printf("--- Content size (%d bytes) is below Google's 32k token threshold. Adding padding to enable caching... ---\n", contentBuilder.Len())
-		// Pad with a neutral comment to reach the threshold
-		padding := strings.Repeat("\n// CACHE_PADDING_TOKEN_REDUNDANCY_FOR_COST_SAVINGS_PROTOCOL\n", (33000-contentBuilder.Len())/60)
-		contentBuilder.WriteString(padding)
+	if env.projectErr != nil {
+		return fmt.Errorf("project config error: %w", env.projectErr)
 	}
+	return nil
+}
 
-	fmt.Println("Uploading to Google Context Cache...")
-
-	// Define tools for agentic mode (included in cache for future use)
-	fileTools := []*genai.FunctionDeclaration{
-		{
-			Name:        "write_file",
-			Description: "Write or create a file with the specified content",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
-					"path":    {Type: genai.TypeString, Description: "Relative path to the file"},
-					"content": {Type: genai.TypeString, Description: "Content to write to the file"},
-				},
-				Required: []string{"path", "content"},
-			},
-		},
-		{
-			Name:        "list_files",
-			Description: "List files in the current directory or subdirectory",
-			Parameters:  &genai.Schema{Type: genai.TypeObject, Properties: map[string]*genai.Schema{"path": {Type: genai.TypeString, Description: "Relative path to list (use '.' for current)"}}},
-		},
-		{
-			Name:        "read_file",
-			Description: "Read the contents of a specific file",
-			Parameters: &genai.Schema{
-				Type:       genai.TypeObject,
-				Properties: map[string]*genai.Schema{"path": {Type: genai.TypeString, Description: "Relative path to the file"}},
-				Required:   []string{"path"},
-			},
-		},
+// newServer creates the proxy for a command, logging to logger.
+func (env *environment) newServer(ctx context.Context, logger *slog.Logger) (*proxy.Server, error) {
+	apiKey := loadAPIKey()
+	if apiKey == "" && env.cfg.Replay.Mode == config.ReplayReplay {
+		apiKey = "replay" // Never sent anywhere
 	}
-
-	// Create the cached content using new SDK API
-	cache, err := client.Caches.Create(ctx, "models/"+model, &genai.CreateCachedContentConfig{
-		DisplayName: "Unified_Project_Brain",
-		SystemInstruction: &genai.Content{
-			Parts: []*genai.Part{
-				{Text: "You are Antigravity Brain, a powerful project assistant. You have access to the project's history and source code via your context cache. Always identify as Antigravity Brain / Gemini."},
-			},
-			Role: "user",
-		},
-		Contents: []*genai.Content{
-			{
-				Parts: []*genai.Part{
-					{Text: contentBuilder.String()},
-				},
-				Role: "user",
-			},
-		},
-		Tools: []*genai.Tool{
-			{FunctionDeclarations: fileTools},
-			// Note: Google Search cannot be combined with FunctionDeclarations in cached content
-			// Users should disable Google Search when using cached content with agentic mode
+	if apiKey == "" {
+		return nil, fmt.Errorf("GEMINI_API_KEY is not set")
+	}
+	return proxy.New(ctx, proxy.Options{
+		Config:      env.cfg,
+		APIKey:      apiKey,
+		Logger:      logger,
+		ProjectRoot: env.projectRoot,
+		Home:        env.home,
+		CorpusProgress: func(p proxy.CorpusProgress) {
+			logger.Debug("corpus file added", "path", p.Path, "files", p.Files, "bytes", p.Bytes)
 		},
-		TTL: time.Duration(TTLMinutes) * time.Minute,
 	})
-	if err != nil {
-		log.Printf("Cache Creation Failed (likely model unsupported or size limit): %v", err)
-		return ""
-	}
-
-	cacheModel = model
-	return cache.Name
 }
 
-// --- HANDLERS ---
-
-func handleOfficialAPI(w http.ResponseWriter, r *http.Request) {
-	// Check if this is a streaming request
-	if strings.Contains(r.URL.Path, ":streamGenerateContent") {
-		handleStream(w, r)
-		return
-	}
-	handleChat(w, r)
-}
-
-// --- STATUS ENDPOINT ---
-func handleStatus(w http.ResponseWriter, r *http.Request) {
-	mode := "CLEAN"
-	if cacheName != "" {
-		mode = "CACHED"
-	}
-
-	status := map[string]any{
-		"mode":         mode,
-		"cache_id":     cacheName,
-		"cache_model":  cacheModel,
-		"project_root": projectRoot,
-		"server_port":  serverPort,
-		"debug_mode":   debugMode,
-		"total_cost":   totalCost,
-		"sessions":     len(sessions),
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(status)
-}
-
-// --- OPENAI COMPATIBILITY ---
-
-type OpenAIChatRequest struct {
-	Model    string `json:"model"`
-	Messages []struct {
-		Role    string `json:"role"`
-		Content string `json:"content"`
-	} `json:"messages"`
-	Stream bool `json:"stream"`
-}
-
-type OpenAIChatResponse struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	Model   string `json:"model"`
-	Choices []struct {
-		Index   int `json:"index"`
-		Message struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		} `json:"message"`
-		FinishReason string `json:"finish_reason"`
-	} `json:"choices"`
-	Usage struct {
-		PromptTokens     int `json:"prompt_tokens"`
-		CompletionTokens int `json:"completion_tokens"`
-		TotalTokens      int `json:"total_tokens"`
-	} `json:"usage"`
-}
-
-func handleOpenAIModels(w http.ResponseWriter, r *http.Request) {
-	// Return actual Gemini models (excluding experimental)
-	// Users can select any model from this list in Continue.dev
-	var modelList []map[string]any
-
-	// Fetch real models from Gemini API
-	for m, err := range client.Models.All(ctx) {
-		if err != nil {
-			break
-		}
-		// Check if model supports generateContent
-		supportsGenerate := false
-		for _, action := range m.SupportedActions {
-			if action == "generateContent" {
-				supportsGenerate = true
-				break
-			}
-		}
-
-		if supportsGenerate {
-			geminiID := strings.TrimPrefix(m.Name, "models/")
-
-			// Skip banned experimental models
-			if strings.Contains(geminiID, "image-generation") ||
-				strings.Contains(geminiID, "-exp") ||
-				strings.Contains(geminiID, "experimental") ||
-				strings.Contains(geminiID, "2.0-flash-exp") ||
-				strings.Contains(geminiID, "2.0-pro-exp") {
-				continue
-			}
-
-			// Return actual Gemini model ID - Continue.dev will show these in dropdown
-			modelList = append(modelList, map[string]any{
-				"id":       geminiID,
-				"object":   "model",
-				"created":  time.Now().Unix(),
-				"owned_by": "gemini-proxy",
-			})
-		}
-	}
-
-	// Fallback if no models found
-	if len(modelList) == 0 {
-		defaultModel := cacheModel
-		if defaultModel == "" {
-			defaultModel = DefaultModel
-		}
-		modelList = []map[string]any{
-			{
-				"id":       defaultModel,
-				"object":   "model",
-				"created":  time.Now().Unix(),
-				"owned_by": "gemini-proxy",
-			},
-		}
-	}
-
-	response := map[string]any{
-		"object": "list",
-		"data":   modelList,
-	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-func handleOpenAIChat(w http.ResponseWriter, r *http.Request) {
-	var req OpenAIChatRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", 400)
-		return
-	}
-
-	// Extract last user message
-	userMsg := ""
-	for _, msg := range req.Messages {
-		if msg.Role == "user" {
-			userMsg = msg.Content
-		}
-	}
-
-	if req.Stream {
-		handleOpenAIStream(w, r, userMsg, req.Model)
-		return
-	}
-
-	// Use model directly if it's a valid Gemini model ID, otherwise use cached/default
-	model := req.Model
-
-	// Check if it's a Gemini model ID and not banned
-	if strings.HasPrefix(model, "gemini-") {
-		// Block experimental models
-		if strings.Contains(model, "-exp") ||
-			strings.Contains(model, "experimental") ||
-			strings.Contains(model, "2.0-flash-exp") ||
-			strings.Contains(model, "2.0-pro-exp") {
-			http.Error(w, "Experimental models are not allowed", 400)
-			return
-		}
-		// Use the specified Gemini model
-	} else {
-		// Not a Gemini model ID (e.g., "gpt-4"), use cached model or default
-		model = cacheModel
-		if model == "" {
-			model = DefaultModel
-		}
-	}
-
-	logMsg(">>> OpenAI /v1/chat/completions | Model: %s | Agentic: true | Msg: %.50s...", model, userMsg)
-
-	// Create chat request
-	chatReq := ChatRequest{
-		SessionID: "openai-compat",
-		Model:     model,
-		Message:   userMsg,
-	}
-
-	// Get history
-	mu.Lock()
-	history := sessions[chatReq.SessionID]
-	mu.Unlock()
-
-	config := &genai.GenerateContentConfig{
-		SafetySettings: []*genai.SafetySetting{
-			{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockThresholdBlockNone},
-			{Category: genai.HarmCategoryHateSpeech, Threshold: genai.HarmBlockThresholdBlockNone},
-			{Category: genai.HarmCategorySexuallyExplicit, Threshold: genai.HarmBlockThresholdBlockNone},
-			{Category: genai.HarmCategoryDangerousContent, Threshold: genai.HarmBlockThresholdBlockNone},
-		},
-	}
-
-	// Enable agentic tools for OpenAI endpoint (always enabled)
-	fileTools := []*genai.FunctionDeclaration{
-		{
-			Name:        "write_file",
-			Description: "Write or create a file with the specified content",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
-					"path":    {Type: genai.TypeString, Description: "Relative path to the file"},
-					"content": {Type: genai.TypeString, Description: "Content to write to the file"},
-				},
-				Required: []string{"path", "content"},
-			},
-		},
-		{
-			Name:        "list_files",
-			Description: "List files in the current directory or subdirectory",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
-					"path": {Type: genai.TypeString, Description: "Relative path to list (use '.' for current)"},
-				},
-			},
-		},
-		{
-			Name:        "read_file",
-			Description: "Read the contents of a specific file",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
-					"path": {Type: genai.TypeString, Description: "Relative path to the file"},
-				},
-				Required: []string{"path"},
-			},
-		},
+// serve runs the proxy server. The one-shot flags -version, -check,
+// -list-models and -index-export predate the subcommands and still work.
+func serve(args []string) int {
+	ctx := context.Background()
+	fs := flag.NewFlagSet("gemini-proxy", flag.ExitOnError)
+	fs.Usage = func() {
+		printCommands()
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	env := loadEnvironment(fs, args)
+	cfg, actions := env.cfg, env.actions
+
+	if actions.Version {
+		fmt.Printf("Gemini Context Caching Proxy v%s\n", proxy.Build())
+		return 0
 	}
-
-	// --- NOTE: This comment might be outdated. Gemini API supports CachedContent with Tools.
-	// --- If you want caching for OpenAI compatibility, you'd need to add:
-	// if cacheName != "" {
-	//     config.CachedContent = cacheName
-	// }
-	config.Tools = []*genai.Tool{
-		{FunctionDeclarations: fileTools},
+	if actions.Check {
+		return runSelfCheck(cfg, env.projectRoot, env.home, env.cfgErr, env.projectErr)
 	}
-
-	chat, err := client.Chats.Create(ctx, model, config, history)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
+	if err := env.err(); err != nil {
+		log.Fatal(err)
 	}
 
-	// Handle tool calls in a loop (similar to handleChat)
-	var responseText string
-	res, err := chat.SendMessage(ctx, genai.Part{Text: userMsg})
+	// Initialize logging
+	logger := proxy.NewLogger(cfg, env.home)
+	slog.SetDefault(logger)
+	shutdownTracing, err := proxy.InitTracing(ctx, cfg.Tracing)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	for {
-		funcCalls := res.FunctionCalls()
-		if len(funcCalls) == 0 {
-			responseText = res.Text()
-			break
-		}
-
-		// Execute function calls
-		var funcResponses []genai.Part
-		for _, funcCall := range funcCalls {
-			var funcResult map[string]any
-			args := funcCall.Args
-
-			// --- LINTER FIX START ---
-			if funcCall.Name == "list_files" {
-				p, ok := args["path"].(string)
-				if !ok {
-					funcResult = map[string]any{"error": "invalid 'path' argument for list_files"}
-				} else {
-					funcResult = toolListFiles(p)
-				}
-			} else if funcCall.Name == "read_file" {
-				p, ok := args["path"].(string)
-				if !ok {
-					funcResult = map[string]any{"error": "invalid 'path' argument for read_file"}
-				} else {
-					funcResult = toolReadFile(p)
-				}
-			} else if funcCall.Name == "write_file" {
-				p, okP := args["path"].(string)
-				c, okC := args["content"].(string)
-				if !okP {
-					funcResult = map[string]any{"error": "invalid 'path' argument for write_file"}
-				} else if !okC {
-					funcResult = map[string]any{"error": "invalid 'content' argument for write_file"}
-				} else {
-					funcResult = toolWriteFile(p, c)
-				}
-			} else {
-				funcResult = map[string]any{"error": "unknown tool"}
-			}
-			// --- LINTER FIX END ---
-
-			funcResponses = append(funcResponses, genai.Part{
-				FunctionResponse: &genai.FunctionResponse{
-					Name:     funcCall.Name,
-					Response: funcResult,
-				},
-			})
-		}
-
-		res, err = chat.SendMessage(ctx, funcResponses...)
-		if err != nil {
-			responseText = "Error after tool execution: " + err.Error()
-			break
-		}
-	}
-
-	writeDebugResponse(responseText)
-
-	// Store history
-	mu.Lock()
-	sessions[chatReq.SessionID] = chat.History(false)
-	mu.Unlock()
-
-	// Build OpenAI response
-	response := OpenAIChatResponse{
-		ID:      "chatcmpl-" + fmt.Sprintf("%d", time.Now().UnixNano()),
-		Object:  "chat.completion",
-		Created: time.Now().Unix(),
-		Model:   model,
-	}
-	response.Choices = []struct {
-		Index   int `json:"index"`
-		Message struct {
-			Role    string `json:"role"`
-			Content string `json:"content"`
-		} `json:"message"`
-		FinishReason string `json:"finish_reason"`
-	}{
-		{
-			Index: 0,
-			Message: struct {
-				Role    string `json:"role"`
-				Content string `json:"content"`
-			}{Role: "assistant", Content: responseText},
-			FinishReason: "stop",
-		},
-	}
-
-	if res.UsageMetadata != nil {
-		response.Usage.PromptTokens = int(res.UsageMetadata.PromptTokenCount)
-		response.Usage.CompletionTokens = int(res.UsageMetadata.CandidatesTokenCount)
-		response.Usage.TotalTokens = int(res.UsageMetadata.TotalTokenCount)
-	}
-
-	logMsg("<<< OpenAI | Tokens: %din/%dout | Resp: %.50s...", response.Usage.PromptTokens, response.Usage.CompletionTokens, responseText)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-func handleOpenAIStream(w http.ResponseWriter, r *http.Request, userMsg, reqModel string) {
-	// Use model directly if it's a valid Gemini model ID, otherwise use cached/default
-	model := reqModel
-
-	// Check if it's a Gemini model ID and not banned
-	if strings.HasPrefix(model, "gemini-") {
-		// Block experimental models
-		if strings.Contains(model, "-exp") ||
-			strings.Contains(model, "experimental") ||
-			strings.Contains(model, "2.0-flash-exp") ||
-			strings.Contains(model, "2.0-pro-exp") {
-			fmt.Fprintf(w, "data: {\"error\": \"Experimental models are not allowed\"}\n\n")
-			return
-		}
-		// Use the specified Gemini model
-	} else {
-		// Not a Gemini model ID (e.g., "gpt-4"), use cached model or default
-		model = cacheModel
-		if model == "" {
-			model = DefaultModel
-		}
-	}
-
-	logMsg(">>> OpenAI Stream | Model: %s | Agentic: true | Msg: %.50s...", model, userMsg)
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", 500)
-		return
-	}
-
-	config := &genai.GenerateContentConfig{
-		SafetySettings: []*genai.SafetySetting{
-			{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockThresholdBlockNone},
-			{Category: genai.HarmCategoryHateSpeech, Threshold: genai.HarmBlockThresholdBlockNone},
-			{Category: genai.HarmCategorySexuallyExplicit, Threshold: genai.HarmBlockThresholdBlockNone},
-			{Category: genai.HarmCategoryDangerousContent, Threshold: genai.HarmBlockThresholdBlockNone},
-		},
-	}
-
-	// Enable agentic tools for OpenAI endpoint (always enabled)
-	fileTools := []*genai.FunctionDeclaration{
-		{
-			Name:        "write_file",
-			Description: "Write or create a file with the specified content",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
-					"path":    {Type: genai.TypeString, Description: "Relative path to the file"},
-					"content": {Type: genai.TypeString, Description: "Content to write to the file"},
-				},
-				Required: []string{"path", "content"},
-			},
-		},
-		{
-			Name:        "list_files",
-			Description: "List files in the current directory or subdirectory",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
-					"path": {Type: genai.TypeString, Description: "Relative path to list (use '.' for current)"},
-				},
-			},
-		},
-		{
-			Name:        "read_file",
-			Description: "Read the contents of a specific file",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
-					"path": {Type: genai.TypeString, Description: "Relative path to the file"},
-				},
-				Required: []string{"path"},
-			},
-		},
+		log.Fatalf("tracing: %v", err)
 	}
 
-	// --- NOTE: This comment might be outdated. Gemini API supports CachedContent with Tools.
-	// --- If you want caching for OpenAI compatibility, you'd need to add:
-	// if cacheName != "" {
-	//     config.CachedContent = cacheName
-	// }
-	config.Tools = []*genai.Tool{
-		{FunctionDeclarations: fileTools},
-	}
-
-	mu.Lock()
-	history := sessions["openai-stream"]
-	mu.Unlock()
-
-	chat, err := client.Chats.Create(ctx, model, config, history)
+	build := proxy.Build()
+	fmt.Printf("--- Antigravity Brain Server v%s ---\n", build)
+	fmt.Printf("--- Effective Config ---\n%s\n", cfg)
+	mode := "CLEAN"
+	if cfg.CacheID != "" {
+		mode = "EXPLICIT_CACHE"
+	} else if cfg.CachePath != "" {
+		mode = "CACHE_BUILD"
+	}
+	logger.Info("server starting",
+		"version", build.Version,
+		"commit", build.Commit,
+		"build_date", build.BuildDate,
+		"mode", mode,
+		"project_root", env.projectRoot,
+		"server_home", env.home,
+		"profile", cfg.Profile,
+		"tool_policy", cfg.ToolPolicy,
+	)
+	if cfg.Tracing.Endpoint != "" {
+		logger.Info("tracing enabled", "endpoint", cfg.Tracing.Endpoint, "sample_ratio", cfg.Tracing.SampleRatio)
+	}
+	if cfg.Replay.Mode != "" {
+		logger.Info("upstream replay mode", "mode", cfg.Replay.Mode, "dir", cfg.Replay.Dir, "seed", cfg.Replay.Seed)
+	}
+	if env.projectCfg != nil {
+		logger.Info("project config loaded", "path", filepath.Join(env.projectRoot, config.ProjectFile))
+	}
+
+	srv, err := env.newServer(ctx, logger)
 	if err != nil {
-		fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
-		flusher.Flush()
-		return
-	}
-
-	// For tool-enabled chats, use non-streaming to handle function calls properly
-	// Then stream the final response
-	fullResponse := ""
-	currentMsg := userMsg
-
-	for {
-		// Use non-streaming to detect function calls
-		res, err := chat.SendMessage(ctx, genai.Part{Text: currentMsg})
-		if err != nil {
-			fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
-			flusher.Flush()
-			return
-		}
-
-		// Check for function calls
-		funcCalls := res.FunctionCalls()
-		if len(funcCalls) > 0 {
-			// Send function call notification in OpenAI format
-			for _, funcCall := range funcCalls {
-				chunk := map[string]any{
-					"id":      "chatcmpl-" + fmt.Sprintf("%d", time.Now().UnixNano()),
-					"object":  "chat.completion.chunk",
-					"created": time.Now().Unix(),
-					"model":   model,
-					"choices": []map[string]any{
-						{
-							"index": 0,
-							"delta": map[string]any{
-								"role": "assistant",
-								"tool_calls": []map[string]any{
-									{
-										"id":   funcCall.Name + "-" + fmt.Sprintf("%d", time.Now().UnixNano()),
-										"type": "function",
-										"function": map[string]any{
-											"name":      funcCall.Name,
-											"arguments": funcCall.Args,
-										},
-									},
-								},
-							},
-							"finish_reason": "tool_calls",
-						},
-					},
-				}
-				// --- LINTER FIX START ---
-				data, err := json.Marshal(chunk)
-				if err != nil {
-					logMsg("Error marshalling OpenAI stream chunk: %v", err)
-				} else {
-					fmt.Fprintf(w, "data: %s\n\n", data)
-					flusher.Flush()
-				}
-				// --- LINTER FIX END ---
-			}
-
-			// Execute function calls
-			var funcResponses []genai.Part
-			for _, funcCall := range funcCalls {
-				var funcResult map[string]any
-				args := funcCall.Args
-
-				// --- LINTER FIX START ---
-				if funcCall.Name == "list_files" {
-					p, ok := args["path"].(string)
-					if !ok {
-						funcResult = map[string]any{"error": "invalid 'path' argument for list_files"}
-					} else {
-						funcResult = toolListFiles(p)
-					}
-				} else if funcCall.Name == "read_file" {
-					p, ok := args["path"].(string)
-					if !ok {
-						funcResult = map[string]any{"error": "invalid 'path' argument for read_file"}
-					} else {
-						funcResult = toolReadFile(p)
-					}
-				} else if funcCall.Name == "write_file" {
-					p, okP := args["path"].(string)
-					c, okC := args["content"].(string)
-					if !okP {
-						funcResult = map[string]any{"error": "invalid 'path' argument for write_file"}
-					} else if !okC {
-						funcResult = map[string]any{"error": "invalid 'content' argument for write_file"}
-					} else {
-						funcResult = toolWriteFile(p, c)
-					}
-				} else {
-					funcResult = map[string]any{"error": "unknown tool"}
-				}
-				// --- LINTER FIX END ---
-
-				funcResponses = append(funcResponses, genai.Part{
-					FunctionResponse: &genai.FunctionResponse{
-						Name:     funcCall.Name,
-						Response: funcResult,
-					},
-				})
-			}
-
-			// Continue with function responses
-			currentMsg = ""
-			res, err = chat.SendMessage(ctx, funcResponses...)
-			if err != nil {
-				fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
-				flusher.Flush()
-				return
-			}
-			continue
-		}
-
-		// No function calls, stream the text response
-		responseText := res.Text()
-		fullResponse = responseText
-
-		// Stream the response character by character for real-time effect
-		for _, char := range responseText {
-			chunk := map[string]any{
-				"id":      "chatcmpl-" + fmt.Sprintf("%d", time.Now().UnixNano()),
-				"object":  "chat.completion.chunk",
-				"created": time.Now().Unix(),
-				"model":   model,
-				"choices": []map[string]any{
-					{
-						"index": 0,
-						"delta": map[string]string{
-							"content": string(char),
-						},
-						"finish_reason": nil,
-					},
-				},
-			}
-			// --- LINTER FIX START ---
-			data, err := json.Marshal(chunk)
-			if err != nil {
-				logMsg("Error marshalling OpenAI stream chunk: %v", err)
-			} else {
-				fmt.Fprintf(w, "data: %s\n\n", data)
-				flusher.Flush()
-			}
-			// --- LINTER FIX END ---
-
-		}
-		break
-	}
-
-	// Send final chunk
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
-
-	writeDebugResponse(fullResponse)
-
-	mu.Lock()
-	sessions["openai-stream"] = chat.History(false)
-	mu.Unlock()
-
-	logMsg("<<< OpenAI Stream Complete | Resp: %.50s...", fullResponse)
-}
-
-// --- GEMINI STREAMING ---
-
-func handleStream(w http.ResponseWriter, r *http.Request) {
-	var reqBody struct {
-		Contents      []map[string]any `json:"contents"`
-		CachedContent string           `json:"cachedContent"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid request", 400)
-		return
+		log.Fatal("FATAL: ", err)
 	}
 
-	// Extract user message from contents
-	userMsg := ""
-	for _, content := range reqBody.Contents {
-		if role, ok := content["role"].(string); ok && role == "user" {
-			if parts, ok := content["parts"].([]any); ok && len(parts) > 0 {
-				if part, ok := parts[0].(map[string]any); ok {
-					if text, ok := part["text"].(string); ok {
-						userMsg = text
-					}
-				}
-			}
-		}
+	if actions.ListModels {
+		return listModels(ctx, srv)
 	}
-
-	// Extract model from URL
-	path := r.URL.Path
-	model := DefaultModel
-	if strings.Contains(path, "/models/") {
-		parts := strings.Split(path, "/models/")
-		if len(parts) > 1 {
-			modelPart := strings.Split(parts[1], ":")[0]
-			if modelPart != "" {
-				model = modelPart
-			}
-		}
-	}
-
-	logMsg(">>> Gemini Stream | Model: %s | Msg: %.50s...", model, userMsg)
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming not supported", 500)
-		return
-	}
-
-	config := &genai.GenerateContentConfig{
-		SafetySettings: []*genai.SafetySetting{
-			{Category: genai.HarmCategoryHarassment, Threshold: genai.HarmBlockThresholdBlockNone},
-			{Category: genai.HarmCategoryHateSpeech, Threshold: genai.HarmBlockThresholdBlockNone},
-			{Category: genai.HarmCategorySexuallyExplicit, Threshold: genai.HarmBlockThresholdBlockNone},
-			{Category: genai.HarmCategoryDangerousContent, Threshold: genai.HarmBlockThresholdBlockNone},
-		},
-	}
-
-	activeCID := reqBody.CachedContent
-	if activeCID == "" {
-		activeCID = cacheName
-	}
-	if activeCID != "" {
-		config.CachedContent = activeCID
-	}
-
-	chat, err := client.Chats.Create(ctx, model, config, nil)
-	if err != nil {
-		fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
-		flusher.Flush()
-		return
-	}
-
-	// Use streaming with Go 1.23+ range over iterator
-	fullResponse := ""
-
-	for resp, err := range chat.SendMessageStream(ctx, genai.Part{Text: userMsg}) {
-		if err != nil {
-			fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
-			flusher.Flush()
-			break
-		}
-
-		text := resp.Text()
-		fullResponse += text
-
-		// Send in Gemini format
-		chunk := map[string]any{
-			"candidates": []map[string]any{
-				{
-					"content": map[string]any{
-						"parts": []map[string]string{{"text": text}},
-						"role":  "model",
-					},
-				},
-			},
-		}
-		// --- LINTER FIX START ---
-		data, err := json.Marshal(chunk)
+	if actions.IndexExport != "" {
+		st, err := srv.ExportIndex(ctx, actions.IndexExport)
 		if err != nil {
-			logMsg("Error marshalling Gemini stream chunk: %v", err)
-		} else {
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
+			log.Fatalf("Exporting semantic index: %v", err)
 		}
-		// --- LINTER FIX END ---
-	}
-
-	writeDebugResponse(fullResponse)
-	logMsg("<<< Gemini Stream Complete | Resp: %.50s...", fullResponse)
-}
-
-func handleAssets(w http.ResponseWriter, r *http.Request) {
-	// Strip the leading "/" to get the path relative to the embed
-	path := strings.TrimPrefix(r.URL.Path, "/")
-
-	// Read from embedded filesystem
-	data, err := assetsFS.ReadFile("web/" + path)
-	if err != nil {
-		http.NotFound(w, r)
-		return
-	}
-
-	// Set content type based on extension
-	ext := filepath.Ext(path)
-	switch ext {
-	case ".js":
-		w.Header().Set("Content-Type", "application/javascript")
-	case ".css":
-		w.Header().Set("Content-Type", "text/css")
-	default:
-		w.Header().Set("Content-Type", "application/octet-stream")
-	}
-
-	w.Write(data)
-}
-
-func handleRoot(w http.ResponseWriter, r *http.Request) {
-	// Parse the embedded template
-	tmpl, err := template.New("index").Parse(indexHTML)
-	if err != nil {
-		http.Error(w, "Template parsing error: "+err.Error(), 500)
-		return
-	}
-
-	// Prepare template data
-	data := TemplateData{
-		CacheName:  cacheName,
-		CacheModel: cacheModel,
-		ServerPort: serverPort,
-		MCPPath:    filepath.Join(serverHome, "cmd/mcp/main.go"),
-	}
-
-	// Execute template to buffer first to catch errors
-	var buf bytes.Buffer
-	if err := tmpl.Execute(&buf, data); err != nil {
-		http.Error(w, "Template execution error: "+err.Error(), 500)
-		return
-	}
-
-	w.Header().Set("Content-Type", "text/html")
-	w.Write(buf.Bytes())
-}
-
-func handleFiles(w http.ResponseWriter, r *http.Request) {
-	// Support ?path= query for subdirectories
-	subPath := r.URL.Query().Get("path")
-	targetDir := projectRoot
-	if subPath != "" {
-		// Sanitize path to prevent directory traversal
-		cleanPath := filepath.Join(projectRoot, filepath.Clean(subPath))
-		if !strings.HasPrefix(cleanPath, projectRoot) {
-			http.Error(w, "Access denied", 403)
-			return
-		}
-		targetDir = cleanPath
-	}
-
-	entries, err := os.ReadDir(targetDir)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	var files []string
-	for _, e := range entries {
-		name := e.Name()
-		// Skip hidden files and common non-essential directories
-		if strings.HasPrefix(name, ".") {
-			continue
-		}
-		if e.IsDir() {
-			// Skip common large directories
-			skip := map[string]bool{
-				"node_modules": true, "vendor": true, ".git": true,
-				"dist": true, "build": true, ".next": true, "target": true,
-				"__pycache__": true, "venv": true, ".venv": true,
-			}
-			if skip[name] {
-				continue
-			}
-			name += "/"
-		}
-		files = append(files, name)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{"files": files})
-}
-
-// buildSafetySettings creates safety settings from request or uses defaults
-func buildSafetySettings(settings map[string]string) []*genai.SafetySetting {
-	// Helper to convert string threshold to genai constant
-	getThreshold := func(level string) genai.HarmBlockThreshold {
-		switch level {
-		case "BLOCK_NONE":
-			return genai.HarmBlockThresholdBlockNone
-		case "BLOCK_ONLY_HIGH":
-			return genai.HarmBlockThresholdBlockOnlyHigh
-		case "BLOCK_MEDIUM_AND_ABOVE":
-			return genai.HarmBlockThresholdBlockMediumAndAbove
-		case "BLOCK_LOW_AND_ABOVE":
-			return genai.HarmBlockThresholdBlockLowAndAbove
-		default:
-			return genai.HarmBlockThresholdBlockNone // Default to most permissive
-		}
-	}
-	
-	// Default: BLOCK_NONE for all categories (for coding assistant use case)
-	harassmentThreshold := genai.HarmBlockThresholdBlockNone
-	hateThreshold := genai.HarmBlockThresholdBlockNone
-	sexualThreshold := genai.HarmBlockThresholdBlockNone
-	dangerousThreshold := genai.HarmBlockThresholdBlockNone
-	
-	// Override with request settings if provided
-	if settings != nil {
-		if val, ok := settings["harassment"]; ok {
-			harassmentThreshold = getThreshold(val)
-		}
-		if val, ok := settings["hate"]; ok {
-			hateThreshold = getThreshold(val)
-		}
-		if val, ok := settings["sexual"]; ok {
-			sexualThreshold = getThreshold(val)
-		}
-		if val, ok := settings["dangerous"]; ok {
-			dangerousThreshold = getThreshold(val)
-		}
-	}
-	
-	return []*genai.SafetySetting{
-		{Category: genai.HarmCategoryHarassment, Threshold: harassmentThreshold},
-		{Category: genai.HarmCategoryHateSpeech, Threshold: hateThreshold},
-		{Category: genai.HarmCategorySexuallyExplicit, Threshold: sexualThreshold},
-		{Category: genai.HarmCategoryDangerousContent, Threshold: dangerousThreshold},
-	}
-}
-
-func handleChat(w http.ResponseWriter, r *http.Request) {
-	var req ChatRequest
-	if r.Method == http.MethodPost {
-		json.NewDecoder(r.Body).Decode(&req)
-	}
-
-	if req.Model == "" {
-		req.Model = DefaultModel
-	}
-	if req.SessionID == "" {
-		req.SessionID = "default"
-	}
-
-	msgPreview := req.Message
-	if len(msgPreview) > 50 {
-		msgPreview = msgPreview[:50] + "..."
-	}
-	logMsg(">>> /chat | Model: %s | Session: %s | Search: %v | Msg: %s", req.Model, req.SessionID, req.UseSearch, msgPreview)
-
-	mu.Lock()
-	history := sessions[req.SessionID]
-	mu.Unlock()
-
-	// --- FIX: Truncate history to prevent cache invalidation ---
-	if len(history) > MaxHistoryTurns {
-		truncatedCount := len(history) - MaxHistoryTurns
-		history = history[len(history)-MaxHistoryTurns:]
-		logMsg("[OPTIMIZATION] Chat history truncated by %d turns (keeping last %d) to ensure cache effectiveness.", truncatedCount, MaxHistoryTurns)
+		fmt.Printf("Exported %d files, %d chunks (%d embedded) to %s\n", st.Files, st.Chunks, st.Embedded, actions.IndexExport)
+		return 0
 	}
-	// --- END FIX ---
 
-	activeCID := ""
-	if req.CacheID != "" {
-		activeCID = req.CacheID
-	} else if cacheName != "" {
-		isImageModel := strings.Contains(req.Model, "image")
-		// We will now attempt to use the cache unless an image model is selected.
-		if !isImageModel {
-			activeCID = cacheName
+	// Cache setup based on mode
+	if cfg.CacheID != "" {
+		logger.Info("using explicit cache", "cache_id", cfg.CacheID)
+	} else if cfg.CachePath != "" {
+		// Build new cache from path
+		logger.Info("building context cache", "project_root", env.projectRoot, "model", cfg.Model)
+		if cacheName := srv.BuildCache(ctx); cacheName != "" {
+			os.Setenv("GEMINI_CACHE", cacheName)
+			logger.Info("exported environment variable", "GEMINI_CACHE", cacheName)
 		}
-	}
-
-	// Build config with optional overrides from request
-	temperature := float32(0.2)
-	if req.Temperature != nil {
-		temperature = *req.Temperature
-	}
-	
-	config := &genai.GenerateContentConfig{
-		Temperature:    genai.Ptr[float32](temperature),
-		SafetySettings: buildSafetySettings(req.SafetySettings),
-	}
-
-	// Apply cached content if available and not an image model
-	if activeCID != "" {
-		config.CachedContent = activeCID
-		// Note: When using cached content, ALL tools must be defined in the cache
-		// We cannot add any additional tools (including Google Search) dynamically
-		// The cache already includes file tools, so agentic mode will work
 	} else {
-		// No cache - define tools dynamically
-		var tools []*genai.Tool
-		if req.UseSearch {
-			tools = append(tools, &genai.Tool{GoogleSearch: &genai.GoogleSearch{}})
-		}
-
-		if req.UseAgentic {
-			fileTools := []*genai.FunctionDeclaration{
-				{
-					Name:        "write_file",
-					Description: "Write or create a file with the specified content",
-					Parameters: &genai.Schema{
-						Type: genai.TypeObject,
-						Properties: map[string]*genai.Schema{
-							"path":    {Type: genai.TypeString, Description: "Relative path to the file"},
-							"content": {Type: genai.TypeString, Description: "Content to write to the file"},
-						},
-						Required: []string{"path", "content"},
-					},
-				},
-				// Always include list_files and read_file when agentic mode is on
-				{
-					Name:        "list_files",
-					Description: "List files in the current directory or subdirectory",
-					Parameters:  &genai.Schema{Type: genai.TypeObject, Properties: map[string]*genai.Schema{"path": {Type: genai.TypeString, Description: "Relative path to list (use '.' for current)"}}},
-				},
-				{
-					Name:        "read_file",
-					Description: "Read the contents of a specific file",
-					Parameters: &genai.Schema{
-						Type:       genai.TypeObject,
-						Properties: map[string]*genai.Schema{"path": {Type: genai.TypeString, Description: "Relative path to the file"}},
-						Required:   []string{"path"},
-					},
-				},
-			}
-			tools = append(tools, &genai.Tool{FunctionDeclarations: fileTools})
-		}
-
-		if len(tools) > 0 {
-			config.Tools = tools
-		}
-	}
-
-	chat, err := client.Chats.Create(ctx, req.Model, config, history)
-	if err != nil {
-		http.Error(w, "Failed to create chat: "+err.Error(), 500)
-		return
-	}
-
-	finalResponse := ""
-	var toolLogs []string
-	var images []ImageData
-	var requestCost float64
-	var promptToks, respToks, totalToks int
-
-	if req.Message == "" {
-		req.Message = "Hello"
-	}
-
-	fmt.Printf("[DEBUG] Sending Message: Model=%s, CacheID=%s, HistoryCount=%d, Images=%d\n", req.Model, activeCID, len(history), len(req.Images))
-
-	var messageParts []genai.Part
-	if req.Message != "" {
-		messageParts = append(messageParts, genai.Part{Text: req.Message})
-	}
-	for _, imgData := range req.Images {
-		if strings.HasPrefix(imgData, "data:") {
-			dataParts := strings.Split(imgData, ",")
-			if len(dataParts) == 2 {
-				header, dataStr := dataParts[0], dataParts[1]
-				mimeType := "image/png"
-				if strings.Contains(header, "image/") {
-					mimeParts := strings.Split(header, ";")
-					if len(mimeParts) > 0 {
-						mimeType = strings.TrimPrefix(mimeParts[0], "data:")
-					}
-				}
-				imgBytes, err := base64.StdEncoding.DecodeString(dataStr)
-				if err == nil {
-					imgPart := genai.Part{InlineData: &genai.Blob{MIMEType: mimeType, Data: imgBytes}}
-					messageParts = append(messageParts, imgPart)
-				}
-			}
-		}
-	}
-	if len(messageParts) == 0 {
-		messageParts = []genai.Part{{Text: "Hello"}}
+		logger.Info("running in clean mode (no cache)")
 	}
 
-	res, err := chat.SendMessage(ctx, messageParts...)
-	if err != nil {
-		http.Error(w, err.Error(), 500)
-		return
-	}
-
-	if res.UsageMetadata != nil {
-		promptToks = int(res.UsageMetadata.PromptTokenCount)
-		respToks = int(res.UsageMetadata.CandidatesTokenCount)
-		totalToks = int(res.UsageMetadata.TotalTokenCount)
-		cachedToks := int(res.UsageMetadata.CachedContentTokenCount)
-		fmt.Printf("[DEBUG] Token Breakdown: Prompt=%d, Cached=%d, Response=%d, Total=%d\n", 
-			promptToks, cachedToks, respToks, totalToks)
-		
-		// Calculate what Google will ACTUALLY charge
-		nonCachedPrompt := promptToks - cachedToks
-		costCached := (float64(cachedToks) / 1000000.0) * 0.075 * 0.1  // 90% discount
-		costFresh := (float64(nonCachedPrompt) / 1000000.0) * 0.075
-		costOutput := (float64(respToks) / 1000000.0) * 0.30
-		totalCharge := costCached + costFresh + costOutput
-		fmt.Printf("[DEBUG] Cost Breakdown: Cached=$%.6f + Fresh=$%.6f + Output=$%.6f = TOTAL=$%.6f\n",
-			costCached, costFresh, costOutput, totalCharge)
-	}
-	if len(res.Candidates) > 0 {
-		fmt.Printf("[DEBUG] FinishReason: %s\n", res.Candidates[0].FinishReason)
+	if n := srv.RecoverTurns(ctx); n > 0 {
+		logger.Warn("recovered turns interrupted by a previous run", "turns", n, "crash_recovery", cfg.CrashRecovery)
 	}
-	fmt.Printf("[DEBUG] Initial Response: Candidates=%d, Tokens=%d\n", len(res.Candidates), totalToks)
 
-	for {
-		requestCost += calculateCost(req.Model, res)
-		if len(res.Candidates) == 0 || res.Candidates[0].Content == nil {
-			break
-		}
-		funcCalls := res.FunctionCalls()
-		if len(funcCalls) > 0 {
-			fmt.Printf("[DEBUG] Function Calls Detected: %d tool(s) requested by model\n", len(funcCalls))
-			var funcResponses []genai.Part
-			for _, funcCall := range funcCalls {
-				toolName := funcCall.Name
-				fmt.Printf("[DEBUG] Executing Tool: %s\n", toolName)
-				toolLogs = append(toolLogs, fmt.Sprintf("Executed: %s", toolName))
-				var funcResult map[string]any
-				args := funcCall.Args
-				// --- LINTER FIX START ---
-				if toolName == "list_files" {
-					p, ok := args["path"].(string)
-					if !ok {
-						funcResult = map[string]any{"error": "invalid 'path' argument for list_files"}
-					} else {
-						funcResult = toolListFiles(p)
-					}
-				} else if toolName == "read_file" {
-					p, ok := args["path"].(string)
-					if !ok {
-						funcResult = map[string]any{"error": "invalid 'path' argument for read_file"}
-					} else {
-						funcResult = toolReadFile(p)
-					}
-				} else if toolName == "write_file" {
-					p, okP := args["path"].(string)
-					c, okC := args["content"].(string)
-					if !okP {
-						funcResult = map[string]any{"error": "invalid 'path' argument for write_file"}
-					} else if !okC {
-						funcResult = map[string]any{"error": "invalid 'content' argument for write_file"}
-					} else {
-						funcResult = toolWriteFile(p, c)
-					}
-				} else {
-					funcResult = map[string]any{"error": "unknown tool"}
-				}
-				// --- LINTER FIX END ---
-				funcResponses = append(funcResponses, genai.Part{FunctionResponse: &genai.FunctionResponse{Name: toolName, Response: funcResult}})
-			}
-			res, err = chat.SendMessage(ctx, funcResponses...)
-			if err != nil {
-				finalResponse = "Error after tool execution: " + err.Error()
-				break
-			}
-			if res.UsageMetadata != nil {
-				respToks += int(res.UsageMetadata.CandidatesTokenCount)
-				totalToks = int(res.UsageMetadata.TotalTokenCount)
-			}
-			fmt.Printf("[DEBUG] Tool Return: Candidates=%d, totalToks=%d\n", len(res.Candidates), totalToks)
-			continue
-		}
-		finalResponse = res.Text()
-		if len(res.Candidates) > 0 && res.Candidates[0].Content != nil {
-			for _, part := range res.Candidates[0].Content.Parts {
-				if part.InlineData != nil && part.InlineData.Data != nil {
-					images = append(images, ImageData{MimeType: part.InlineData.MIMEType, Data: base64.StdEncoding.EncodeToString(part.InlineData.Data)})
-				}
+	if cfg.Index.BuildOnStart {
+		go func() {
+			if err := srv.BuildIndex(ctx); err != nil {
+				logger.Error("building semantic index", "error", err)
 			}
-		}
-		break
-	}
-
-	finalResponse = strings.TrimSpace(finalResponse)
-	if finalResponse == "" && len(toolLogs) == 0 && len(images) == 0 {
-		finalResponse = "[System Warning: Model returned empty content. This may be a safety block or API glitch.]"
-	} else if finalResponse == "" && len(toolLogs) > 0 {
-		finalResponse = fmt.Sprintf("[Executed %d tool(s) but model provided no summary.]", len(toolLogs))
-	} else if finalResponse == "" && len(images) > 0 {
-		finalResponse = fmt.Sprintf("[Generated %d image(s)]", len(images))
-	}
-
-	mu.Lock()
-	sessions[req.SessionID] = chat.History(false)
-	totalCost += requestCost
-	mu.Unlock()
-
-	respPreview := finalResponse
-	if len(respPreview) > 50 {
-		respPreview = respPreview[:50] + "..."
-	}
-	toolSummary := ""
-	if len(toolLogs) > 0 {
-		toolSummary = fmt.Sprintf(" [Tools: %v]", toolLogs)
-	}
-	logMsg("<<< /chat | Tokens: %din/%dout (%d total) | Tools: %d | Images: %d | Cost: $%.6f%s | Resp: %s",
-		promptToks, respToks, totalToks, len(toolLogs), len(images), requestCost, toolSummary, strings.ReplaceAll(respPreview, "\n", " "))
-
-	writeDebugResponse(finalResponse)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(ChatResponse{
-		Text:           finalResponse,
-		Images:         images,
-		ToolCalls:      toolLogs,
-		PromptTokens:   promptToks,
-		ResponseTokens: respToks,
-		TotalTokens:    totalToks,
-		Cost:           requestCost,
-		RequestCost:    requestCost, // Legacy field
-		TotalCost:      totalCost,
-	})
-}
-
-func toolListFiles(relPath string) map[string]any {
-	if relPath == "" {
-		relPath = "."
-	}
-	// Always stay within projectRoot
-	cleanPath := filepath.Join(projectRoot, filepath.Clean(relPath))
-	if !strings.HasPrefix(cleanPath, projectRoot) {
-		return map[string]any{"error": "Access denied: outside project root"}
-	}
-
-	entries, err := os.ReadDir(cleanPath)
-	if err != nil {
-		return map[string]any{"error": err.Error()}
-	}
-	var files []string
-	for _, e := range entries {
-		name := e.Name()
-		if e.IsDir() {
-			name += "/"
-		}
-		files = append(files, name)
-	}
-	return map[string]any{"files": files}
-}
-
-func toolReadFile(relPath string) map[string]any {
-	// Always stay within projectRoot
-	cleanPath := filepath.Join(projectRoot, filepath.Clean(relPath))
-	if !strings.HasPrefix(cleanPath, projectRoot) {
-		return map[string]any{"error": "Access denied: outside project root"}
-	}
-
-	info, err := os.Stat(cleanPath)
-	if err != nil {
-		return map[string]any{"error": err.Error()}
-	}
-	if info.Size() > 1000000 { // 1MB limit for tools
-		return map[string]any{"error": "File too large"}
-	}
-	content, err := os.ReadFile(cleanPath)
-	if err != nil {
-		return map[string]any{"error": err.Error()}
-	}
-	return map[string]any{"content": string(content)}
-}
-
-func toolWriteFile(relPath, content string) map[string]any {
-	// Always stay within projectRoot
-	cleanPath := filepath.Join(projectRoot, filepath.Clean(relPath))
-	if !strings.HasPrefix(cleanPath, projectRoot) {
-		return map[string]any{"error": "Access denied: outside project root"}
-	}
-
-	// Create parent directories if needed
-	dir := filepath.Dir(cleanPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return map[string]any{"error": "Failed to create directory: " + err.Error()}
-	}
-
-	if err := os.WriteFile(cleanPath, []byte(content), 0644); err != nil {
-		return map[string]any{"error": err.Error()}
+		}()
 	}
-
-	logMsg("[TOOL] write_file: %s (%d bytes)", relPath, len(content))
-	return map[string]any{"status": "OK", "path": relPath, "bytes_written": len(content)}
-}
-
-func handleReset(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	sessions = make(map[string][]*genai.Content)
-	mu.Unlock()
-	fmt.Fprint(w, "All sessions cleared.")
-}
-
-func calculateCost(modelName string, resp *genai.GenerateContentResponse) float64 {
-	var rates struct{ In, Out float64 }
-	found := false
-	for modelKey, r := range modelCosts {
-		if modelName == modelKey || strings.HasPrefix(modelName, modelKey) {
-			rates = r
-			found = true
-			break
-		}
-	}
-
-	if !found || (rates.In == 0 && rates.Out == 0) {
-		return 0
-	}
-	if resp.UsageMetadata == nil {
-		return 0
-	}
-
-	// Calculate input cost with proper cached content pricing
-	// Cached tokens are 90% cheaper (1/10th the normal rate)
-	cachedTokens := int64(resp.UsageMetadata.CachedContentTokenCount)
-	totalPromptTokens := int64(resp.UsageMetadata.PromptTokenCount)
-	nonCachedTokens := totalPromptTokens - cachedTokens
-
-	// Non-cached tokens at full rate
-	inCost := (float64(nonCachedTokens) / 1000000.0) * rates.In
-	// Cached tokens at 10% of the rate (90% discount)
-	if cachedTokens > 0 {
-		inCost += (float64(cachedTokens) / 1000000.0) * (rates.In * 0.1)
+	if cfg.Index.WatchSeconds > 0 {
+		go srv.WatchIndex(ctx)
 	}
+	go srv.RunJobs(ctx)
+	go srv.KeepWarm(ctx)
 
-	// Output cost is always full rate
-	outCost := (float64(resp.UsageMetadata.CandidatesTokenCount) / 1000000.0) * rates.Out
-	return inCost + outCost
+	cacheName, _ := srv.Cache()
+	logger.Info("server running", "addr", cfg.Port, "cache_id", cacheName)
+	err = http.ListenAndServe(cfg.Port, srv)
+	shutdownTracing(context.Background())
+	log.Fatal(err)
+	return 1
 }
 
-func handleModels(w http.ResponseWriter, r *http.Request) {
-	type ModelData struct {
-		ID   string `json:"id"`
-		Name string `json:"name"`
-		Cost string `json:"cost"`
-	}
-
-	var models []ModelData
-
-	// Use the new iterator API
-	for m, err := range client.Models.All(ctx) {
-		if err != nil {
-			break
-		}
-		// Check if model supports generateContent by looking at SupportedActions
-		supportsGenerate := false
-		for _, action := range m.SupportedActions {
-			if action == "generateContent" {
-				supportsGenerate = true
-				break
-			}
-		}
-
-		if supportsGenerate {
-			id := strings.TrimPrefix(m.Name, "models/")
-
-			// Skip problematic experimental models
-			if strings.Contains(id, "image-generation") ||
-				strings.Contains(id, "-exp") ||
-				strings.Contains(id, "experimental") ||
-				strings.Contains(id, "2.0-flash-exp") ||
-				strings.Contains(id, "2.0-pro-exp") {
-				continue
-			}
-
-			costStr := "Price: Variable"
-
-			// Try exact match or prefix match for pricing
-			for modelKey, rates := range modelCosts {
-				if id == modelKey || strings.HasPrefix(id, modelKey) {
-					if rates.In == 0 && rates.Out == 0 {
-						costStr = "Price: Free (Beta)"
-					} else {
-						costStr = fmt.Sprintf("$%.2f/1M tokens", rates.In)
-					}
+// loadAPIKey reads GEMINI_API_KEY from the environment, falling back to a
+// .env file in the working directory.
+func loadAPIKey() string {
+	apiKey := os.Getenv("GEMINI_API_KEY")
+	if apiKey == "" {
+		// Try loading from .env file
+		if data, err := os.ReadFile(".env"); err == nil {
+			lines := strings.Split(string(data), "\n")
+			for _, line := range lines {
+				if strings.HasPrefix(line, "GEMINI_API_KEY=") {
+					apiKey = strings.TrimPrefix(line, "GEMINI_API_KEY=")
+					os.Setenv("GEMINI_API_KEY", apiKey)
 					break
 				}
 			}
-
-			models = append(models, ModelData{
-				ID:   id,
-				Name: id,
-				Cost: costStr,
-			})
-		}
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]any{"models": models})
-}
-
-func ListModels(client *genai.Client) {
-	for m, err := range client.Models.All(ctx) {
-		if err != nil {
-			log.Fatal(err)
 		}
-		fmt.Printf("Model: %s\n", m.Name)
 	}
+	return apiKey
 }
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"customgemini/config"
+)
+
+// withAccessLog writes a line per request to the access log, in the
+// Common or Combined Log Format with the latency in milliseconds added
+// at the end, once the response is done. The user field is the ID of the
+// API key the request presented (see accessKeyID).
+func (s *Server) withAccessLog(next http.Handler) http.Handler {
+	if s.accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() { io.WriteString(s.accessLog, s.accessLine(r, rec, start, time.Since(start))) }()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+func (s *Server) accessLine(r *http.Request, rec *statusRecorder, start time.Time, latency time.Duration) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	size := "-"
+	if rec.bytes > 0 {
+		size = strconv.FormatInt(rec.bytes, 10)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %s %d %s", orDash(host), s.accessKeyID(r), start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+redactedURI(r)+" "+r.Proto), rec.code(), size)
+	if s.cfg.AccessLog == config.AccessLogCombined {
+		line += fmt.Sprintf(" %s %s", strconv.Quote(orDash(r.Referer())), strconv.Quote(orDash(r.UserAgent())))
+	}
+	return line + fmt.Sprintf(" %d\n", latency.Milliseconds())
+}
+
+// accessKeyID identifies the API key of a request without revealing it:
+// its hash, as settings are keyed by, after the name of the workspace it
+// selects. Requests without a key are "-".
+func (s *Server) accessKeyID(r *http.Request) string {
+	key := requestAPIKey(r)
+	if key == "" {
+		return "-"
+	}
+	id := settingsKey(r)
+	if ws := s.workspaces[key]; ws != nil {
+		id = ws.name + ":" + id
+	}
+	return id
+}
+
+// redactedURI is the request's URI with the value of a key parameter, an
+// API key, left out.
+func redactedURI(r *http.Request) string {
+	uri := r.URL.RequestURI()
+	if !r.URL.Query().Has("key") {
+		return uri
+	}
+	path, query, _ := strings.Cut(uri, "?")
+	params := strings.Split(query, "&")
+	for i, p := range params {
+		if name, _, _ := strings.Cut(p, "="); name == "key" {
+			params[i] = "key=REDACTED"
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ToolActivity is one tool execution in the /activity feed.
+type ToolActivity struct {
+	ID        uint64       `json:"id"`
+	Time      time.Time    `json:"time"`
+	RequestID string       `json:"request_id,omitempty"`
+	Endpoint  string       `json:"endpoint,omitempty"` // web, openai or gemini
+	Session   string       `json:"session,omitempty"`  // Web chat session, if any
+	Tool      string       `json:"tool"`
+	Path      string       `json:"path,omitempty"`
+	Bytes     int          `json:"bytes,omitempty"` // Read or written
+	Diff      *DiffSummary `json:"diff,omitempty"`  // write_file only
+	Error     string       `json:"error,omitempty"`
+	LatencyMs int64        `json:"latency_ms"`
+}
+
+// DiffSummary counts the lines a write changed. Lines are compared as
+// multisets, so a moved line counts as unchanged.
+type DiffSummary struct {
+	Created bool `json:"created,omitempty"`
+	Added   int  `json:"added"`
+	Removed int  `json:"removed"`
+}
+
+// diffSummary compares the old and new contents of a file.
+func diffSummary(old, new string, created bool) *DiffSummary {
+	d := &DiffSummary{Created: created}
+	counts := map[string]int{}
+	if old != "" {
+		for _, line := range strings.Split(old, "\n") {
+			counts[line]++
+		}
+	}
+	if new != "" {
+		for _, line := range strings.Split(new, "\n") {
+			if counts[line] > 0 {
+				counts[line]--
+			} else {
+				d.Added++
+			}
+		}
+	}
+	for _, n := range counts {
+		d.Removed += n
+	}
+	return d
+}
+
+func endpointFrom(ctx context.Context) string {
+	e, _ := ctx.Value(endpointKey).(string)
+	return e
+}
+
+// recordActivity publishes a tool execution to the activity feed.
+func (s *Server) recordActivity(ctx context.Context, a ToolActivity) {
+	a.ID = s.activitySeq.Add(1)
+	a.Time = time.Now().UTC()
+	a.RequestID = requestIDFrom(ctx)
+	a.Endpoint = endpointFrom(ctx)
+	a.Session = sessionFrom(ctx)
+	line, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	s.activity.publish(line)
+}
+
+// activityFilter selects feed entries by session and tool, and skips
+// entries a reconnecting client has already seen.
+type activityFilter struct {
+	session, tool string
+	after         uint64
+}
+
+func newActivityFilter(r *http.Request) activityFilter {
+	q := r.URL.Query()
+	f := activityFilter{session: q.Get("session"), tool: q.Get("tool")}
+	f.after, _ = strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	return f
+}
+
+func (f activityFilter) match(line []byte) (ToolActivity, bool) {
+	var a ToolActivity
+	if json.Unmarshal(line, &a) != nil {
+		return a, false
+	}
+	return a, a.ID > f.after && (f.session == "" || a.Session == f.session) && (f.tool == "" || a.Tool == f.tool)
+}
+
+// handleActivity lists recent tool executions, newest first. Query
+// parameters: session, tool and limit (default 50).
+func (s *Server) handleActivity(w http.ResponseWriter, r *http.Request) {
+	filter := newActivityFilter(r)
+	limit := 50
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	recent := s.activity.recent()
+	list := []ToolActivity{}
+	for i := len(recent) - 1; i >= 0 && len(list) < limit; i-- {
+		if a, ok := filter.match(recent[i]); ok {
+			list = append(list, a)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"activity": list})
+}
+
+// handleActivityStream sends tool executions as Server-Sent Events, after
+// replaying up to ?backlog= recent ones (default 20). Each event carries
+// the entry ID, so a reconnecting EventSource resumes without repeats.
+func (s *Server) handleActivityStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	filter := newActivityFilter(r)
+	if filter.after > s.activitySeq.Load() {
+		// The server restarted since the client's last event
+		filter.after = 0
+	}
+	backlog := 20
+	if n, err := strconv.Atoi(r.URL.Query().Get("backlog")); err == nil && n >= 0 {
+		backlog = n
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch, recent := s.activity.subscribe()
+	defer s.activity.unsubscribe(ch)
+
+	var replay []ToolActivity
+	var lines [][]byte
+	for _, line := range recent {
+		if a, ok := filter.match(line); ok {
+			replay = append(replay, a)
+			lines = append(lines, line)
+		}
+	}
+	if len(replay) > backlog {
+		replay, lines = replay[len(replay)-backlog:], lines[len(lines)-backlog:]
+	}
+	for i, a := range replay {
+		fmt.Fprintf(w, "id: %d\ndata: %s\n\n", a.ID, lines[i])
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line := <-ch:
+			if a, ok := filter.match(line); ok {
+				fmt.Fprintf(w, "id: %d\ndata: %s\n\n", a.ID, line)
+				flusher.Flush()
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
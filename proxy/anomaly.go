@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// withSlowRequestLog warns about requests that take longer than the
+// configured threshold, including their latency breakdown. Long-lived log
+// streams are exempt.
+func (s *Server) withSlowRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		limit := time.Duration(s.cfg.Anomaly.SlowRequestSeconds) * time.Second
+		// Streams and long polls are meant to stay open
+		longLived := r.URL.Path == "/logs/stream" || r.URL.Path == "/activity/stream" || strings.HasPrefix(r.URL.Path, "/chat/stream/") || r.URL.Query().Get("wait") != ""
+		if limit <= 0 || longLived {
+			return
+		}
+		tm := timerFrom(r.Context()).Timings()
+		if tm == nil || time.Duration(tm.TotalMs)*time.Millisecond < limit {
+			return
+		}
+		s.requestLogger(r.Context()).Warn("slow request",
+			"anomaly", "slow_request",
+			"endpoint", r.URL.Path,
+			"threshold_s", s.cfg.Anomaly.SlowRequestSeconds,
+			"timings", tm,
+		)
+	})
+}
+
+// checkUpstreamAnomalies is called after every upstream call. It warns once
+// per request when the tool loop runs past the iteration limit and for each
+// response larger than the token limit.
+func (s *Server) checkUpstreamAnomalies(ctx context.Context, model string, calls int, res *genai.GenerateContentResponse) {
+	lg := s.requestLogger(ctx)
+	// The first call answers the user; each further call is a tool-loop turn.
+	if limit := s.cfg.Anomaly.MaxToolIterations; limit > 0 && calls-1 == limit+1 {
+		lg.Warn("tool loop exceeded iteration limit",
+			"anomaly", "tool_loop",
+			"model", model,
+			"iterations", calls-1,
+			"threshold", limit,
+		)
+	}
+	if limit := s.cfg.Anomaly.MaxResponseTokens; limit > 0 && res != nil && res.UsageMetadata != nil {
+		if n := int(res.UsageMetadata.CandidatesTokenCount); n > limit {
+			lg.Warn("response exceeded token limit",
+				"anomaly", "response_tokens",
+				"model", model,
+				"response_tokens", n,
+				"threshold", limit,
+			)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// CompactMessage is a transcript message as /api/v2 sends it: text and
+// tool names only, with images counted rather than included.
+type CompactMessage struct {
+	ID     string   `json:"id"`   // Cursor for this message
+	Role   string   `json:"role"` // "user", "model" or "tool"
+	Text   string   `json:"text,omitempty"`
+	Tools  []string `json:"tools,omitempty"` // Tools called, or answered for role "tool"
+	Images int      `json:"images,omitempty"`
+}
+
+// MessagePage is one page of a session's messages, oldest first.
+type MessagePage struct {
+	Session  string           `json:"session"`
+	Messages []CompactMessage `json:"messages"`
+	HasMore  bool             `json:"has_more"` // More messages lie beyond the page in the direction asked
+	Reset    bool             `json:"reset"`    // The cursor is gone; this is the latest page and the client should resync
+	Total    int              `json:"total"`
+}
+
+const (
+	v2PageSize    = 20
+	v2MaxPageSize = 200
+	v2MaxWait     = 60 * time.Second
+)
+
+// compactTranscript converts a history into compact messages. A message's
+// ID hashes it together with the message before it, so IDs stay the same
+// when old turns are truncated from the front of the history.
+func compactTranscript(history []*genai.Content) []CompactMessage {
+	msgs := []CompactMessage{}
+	var prev []byte
+	for _, c := range history {
+		if c == nil {
+			continue
+		}
+		data, _ := json.Marshal(c)
+		h := sha256.New()
+		h.Write(prev)
+		h.Write([]byte{0})
+		h.Write(data)
+		prev = data
+
+		t := transcript([]*genai.Content{c})[0]
+		m := CompactMessage{ID: hex.EncodeToString(h.Sum(nil)[:8]), Role: t.Role, Text: t.Text, Images: len(t.Images)}
+		for _, tc := range t.ToolCalls {
+			m.Tools = append(m.Tools, tc.Name)
+		}
+		for _, tr := range t.ToolResults {
+			m.Tools = append(m.Tools, tr.Name)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// lastIndex returns the index of the message with the given ID, searching
+// from the end, or -1.
+func lastIndex(msgs []CompactMessage, id string) int {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// page slices msgs by cursor: after a message, before one, or the latest
+// page when neither is given or the cursor is no longer in the history.
+func page(msgs []CompactMessage, after, before string, limit int) (out []CompactMessage, hasMore, reset bool) {
+	switch {
+	case after != "":
+		if i := lastIndex(msgs, after); i >= 0 {
+			end := min(i+1+limit, len(msgs))
+			return msgs[i+1 : end], end < len(msgs), false
+		}
+		reset = true
+	case before != "":
+		if i := lastIndex(msgs, before); i >= 0 {
+			start := max(i-limit, 0)
+			return msgs[start:i], start > 0, false
+		}
+		reset = true
+	}
+	start := max(len(msgs)-limit, 0)
+	return msgs[start:], start > 0, reset
+}
+
+// writeCompact writes v as JSON with an ETag, answering 304 when the client
+// already has it, and gzips it when the client accepts that.
+func writeCompact(w http.ResponseWriter, r *http.Request, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Vary", "Accept-Encoding")
+	if status == http.StatusOK && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(body) > 1024 && acceptsGzip(r) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// handleAPIv2 serves a compact chat API for thin clients such as phones on
+// a slow link. Messages are addressed by opaque IDs that double as cursors:
+//
+//	GET  /api/v2/sessions                 sessions, most recent first (?since=RFC 3339 time for changes only)
+//	GET  /api/v2/sessions/<id>/messages   latest page; ?before=<msg> pages back, ?after=<msg> fetches
+//	                                      newer ones and with ?wait=<seconds> waits for them; ?limit=
+//	POST /api/v2/sessions/<id>/messages   send {"text", "model", "agentic", "search", "attachments"};
+//	                                      returns the messages the turn added
+//
+// GET responses carry an ETag and honor If-None-Match.
+func (s *Server) handleAPIv2(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v2/sessions")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		s.handleV2Sessions(w, r)
+		return
+	case rest == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	if !strings.HasPrefix(rest, "/") || action != "messages" {
+		http.NotFound(w, r)
+		return
+	}
+	if !validRequestID(id) {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		s.handleV2Messages(w, r, id)
+	case http.MethodPost:
+		s.withUpstreamLimit(func(w http.ResponseWriter, r *http.Request) { s.handleV2Send(w, r, id) })(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleV2Sessions(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "Invalid since: want an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+	list, err := s.sessions(r.Context()).ListSessions(r.Context())
+	if err != nil {
+		http.Error(w, "Listing sessions: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	sessions := []SessionInfo{}
+	for _, info := range list {
+		if info.Updated.After(since) {
+			sessions = append(sessions, info)
+		}
+	}
+	sortSessions(sessions)
+	writeCompact(w, r, http.StatusOK, map[string]any{"sessions": sessions})
+}
+
+func (s *Server) handleV2Messages(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	limit := v2PageSize
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = min(n, v2MaxPageSize)
+	}
+	var wait time.Duration
+	if n, err := strconv.Atoi(q.Get("wait")); err == nil && n > 0 && q.Get("after") != "" {
+		wait = min(time.Duration(n)*time.Second, v2MaxWait)
+	}
+
+	// Long polling checks the store once a second, which works the same
+	// for the memory store and replicas sharing Redis.
+	deadline := time.Now().Add(wait)
+	for {
+		history, err := s.sessions(ctx).History(ctx, id)
+		if err != nil {
+			http.Error(w, "Loading session: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		msgs := compactTranscript(history)
+		out, hasMore, reset := page(msgs, q.Get("after"), q.Get("before"), limit)
+		if len(out) > 0 || reset || !time.Now().Before(deadline) {
+			writeCompact(w, r, http.StatusOK, MessagePage{Session: id, Messages: out, HasMore: hasMore, Reset: reset, Total: len(msgs)})
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *Server) handleV2Send(w http.ResponseWriter, r *http.Request, id string) {
+	var body struct {
+		Text        string           `json:"text"`
+		Model       string           `json:"model"`
+		Agentic     bool             `json:"agentic"`
+		Search      bool             `json:"search"`
+		Attachments []ChatAttachment `json:"attachments"`
+		ContextMode string           `json:"context_mode"`
+		Rerank      *bool            `json:"rerank"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || strings.TrimSpace(body.Text) == "" {
+		http.Error(w, "Invalid request: text is required", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	history, err := s.sessions(ctx).History(ctx, id)
+	if err != nil {
+		http.Error(w, "Loading session: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	before := compactTranscript(history)
+	last := ""
+	if len(before) > 0 {
+		last = before[len(before)-1].ID
+	}
+
+	resp, status, err := s.runChat(ctx, r.URL.Path, &ChatRequest{
+		SessionID:   id,
+		Model:       body.Model,
+		Message:     body.Text,
+		UseAgentic:  body.Agentic,
+		UseSearch:   body.Search,
+		Attachments: body.Attachments,
+		ContextMode: body.ContextMode,
+		Rerank:      body.Rerank,
+
+		selectionKey: settingsKey(r),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	history, err = s.sessions(ctx).History(ctx, id)
+	if err != nil {
+		http.Error(w, "Loading session: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	msgs := compactTranscript(history)
+	added, _, reset := page(msgs, last, "", len(msgs))
+	if last == "" {
+		added, reset = msgs, false
+	}
+	out := map[string]any{
+		"messages":      added,
+		"reset":         reset,
+		"cost":          resp.Cost,
+		"finish_reason": resp.FinishReason,
+	}
+	if len(resp.Warnings) > 0 {
+		out["warnings"] = resp.Warnings
+	}
+	if resp.EmptyReason != "" {
+		out["empty_reason"] = resp.EmptyReason
+	}
+	writeCompact(w, r, http.StatusOK, out)
+}
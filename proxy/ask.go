@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"customgemini/config"
+)
+
+// askSession is the session ask usage is recorded under. Its history is
+// never saved.
+const askSession = "ask"
+
+// Ask answers a single question for scripts: the question is sent with
+// the active context cache, or when the store has none, with the newest
+// unexpired cache this proxy built for the model. Nothing is saved to a
+// session. A reply that was blocked, cut off or empty is an error; the
+// text returned alongside is whatever the model produced.
+func (s *Server) Ask(ctx context.Context, question string) (string, error) {
+	req := ChatRequest{SessionID: askSession, Message: question, ephemeral: true}
+	if name, _ := s.Cache(); name == "" {
+		model, _ := s.cfg.Endpoint(config.EndpointWeb)
+		req.CacheID = s.latestCache(ctx, model)
+	}
+	resp, err := s.Chat(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if warning := resp.Warning(); warning != "" {
+		text := resp.Text
+		if text == warning {
+			text = ""
+		}
+		return text, errors.New(strings.Trim(warning, "[]"))
+	}
+	if resp.EmptyReason == emptyNoContent {
+		return "", errors.New(strings.Trim(emptyReplyWarning, "[]"))
+	}
+	return resp.Text, nil
+}
+
+// latestCache returns the newest unexpired context cache built by this
+// proxy for model, or "" if there is none or the caches cannot be listed.
+func (s *Server) latestCache(ctx context.Context, model string) string {
+	var name string
+	var newest time.Time
+	for c, err := range s.client.Caches.All(ctx) {
+		if err != nil {
+			s.logger.Warn("listing context caches", "error", err)
+			return ""
+		}
+		if c.DisplayName != s.ownCacheName() || !strings.HasSuffix(c.Model, "/"+model) || c.ExpireTime.Before(time.Now()) {
+			continue
+		}
+		if c.CreateTime.After(newest) {
+			name, newest = c.Name, c.CreateTime
+		}
+	}
+	return name
+}
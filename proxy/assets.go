@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"customgemini/web"
+)
+
+// assetMaxAge is how long browsers may reuse an asset before revalidating
+// it with its ETag. Asset names are not fingerprinted, so this stays short
+// enough for an upgraded binary to be picked up the same day.
+const assetMaxAge = "public, max-age=3600"
+
+// Types missing from Go's built-in table on some platforms
+func init() {
+	for ext, typ := range map[string]string{
+		".woff":        "font/woff",
+		".woff2":       "font/woff2",
+		".ttf":         "font/ttf",
+		".ico":         "image/x-icon",
+		".webmanifest": "application/manifest+json",
+	} {
+		mime.AddExtensionType(ext, typ)
+	}
+}
+
+// asset is one embedded file prepared for serving: its content type, a
+// content-hash ETag and, for compressible types, a gzipped copy.
+type asset struct {
+	contentType string
+	etag        string
+	data        []byte
+	gzip        []byte
+}
+
+// loadAssets reads every embedded asset once at startup, so requests are
+// served from memory without re-reading or re-compressing.
+func loadAssets() (map[string]*asset, error) {
+	assets := make(map[string]*asset)
+	err := fs.WalkDir(web.Assets, "assets", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := web.Assets.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		a := &asset{
+			contentType: mime.TypeByExtension(path.Ext(p)),
+			etag:        `"` + hex.EncodeToString(sum[:8]) + `"`,
+			data:        data,
+		}
+		if a.contentType == "" {
+			a.contentType = "application/octet-stream"
+		}
+		if compressible(a.contentType) {
+			var buf bytes.Buffer
+			zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+			zw.Write(data)
+			zw.Close()
+			if buf.Len() < len(data) {
+				a.gzip = buf.Bytes()
+			}
+		}
+		assets["/"+p] = a
+		return nil
+	})
+	return assets, err
+}
+
+func compressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.Contains(contentType, "javascript") ||
+		strings.Contains(contentType, "json") ||
+		strings.Contains(contentType, "svg") ||
+		strings.Contains(contentType, "xml")
+}
+
+func (s *Server) handleAssets(w http.ResponseWriter, r *http.Request) {
+	a, ok := s.assets[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", a.contentType)
+	h.Set("Cache-Control", assetMaxAge)
+	h.Set("Vary", "Accept-Encoding")
+	body, etag := a.data, a.etag
+	if a.gzip != nil && acceptsGzip(r) {
+		body = a.gzip
+		etag = strings.TrimSuffix(a.etag, `"`) + `-gz"`
+		h.Set("Content-Encoding", "gzip")
+	}
+	h.Set("ETag", etag)
+	// ServeContent answers If-None-Match and Range from the ETag above
+	http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(body))
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, q, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.TrimSpace(q) != "q=0" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// audioPrompt is sent with audio that arrives without a message, such as a
+// voice note.
+const audioPrompt = "This is a voice note. Transcribe it, then answer what it says or asks, using the project context you have."
+
+// audioFormats maps OpenAI input_audio formats to the MIME types Gemini
+// accepts.
+var audioFormats = map[string]string{
+	"wav":  "audio/wav",
+	"mp3":  "audio/mp3",
+	"aiff": "audio/aiff",
+	"aac":  "audio/aac",
+	"ogg":  "audio/ogg",
+	"flac": "audio/flac",
+}
+
+// sniffAudio detects the audio formats Gemini accepts from their headers,
+// which http.DetectContentType misses or names differently. It returns ""
+// for anything else.
+func sniffAudio(data []byte) string {
+	switch {
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WAVE":
+		return "audio/wav"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("FORM")) && (string(data[8:12]) == "AIFF" || string(data[8:12]) == "AIFC"):
+		return "audio/aiff"
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return "audio/ogg"
+	case bytes.HasPrefix(data, []byte("fLaC")):
+		return "audio/flac"
+	case bytes.HasPrefix(data, []byte("ID3")):
+		return "audio/mp3"
+	case len(data) >= 2 && data[0] == 0xFF && data[1]&0xF6 == 0xF0:
+		// ADTS frame sync with layer 0
+		return "audio/aac"
+	case len(data) >= 2 && data[0] == 0xFF && data[1]&0xE0 == 0xE0 && data[1]&0x06 != 0:
+		// MPEG audio frame sync without an ID3 tag
+		return "audio/mp3"
+	}
+	return ""
+}
+
+// hasAudio reports whether any part is inline audio.
+func hasAudio(parts []genai.Part) bool {
+	for _, p := range parts {
+		if p.InlineData != nil && strings.HasPrefix(p.InlineData.MIMEType, "audio/") {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsMedia reports whether a model takes audio and video input. Gemini
+// chat models do; image generation, Gemma and embedding models do not.
+func acceptsMedia(model string) bool {
+	return strings.HasPrefix(model, "gemini-") &&
+		!strings.Contains(model, "-image") &&
+		!strings.Contains(model, "embedding")
+}
+
+// OpenAIContent is a message's content, which OpenAI clients send either as
+// a string or as a list of parts. Text parts are joined into Text, and
+// input_audio parts become inline audio for Gemini.
+type OpenAIContent struct {
+	Text  string
+	Audio []genai.Part
+}
+
+func (c *OpenAIContent) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &c.Text); err == nil {
+		return nil
+	}
+	var parts []struct {
+		Type       string `json:"type"`
+		Text       string `json:"text"`
+		InputAudio struct {
+			Data   string `json:"data"`
+			Format string `json:"format"`
+		} `json:"input_audio"`
+	}
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or a list of parts")
+	}
+	var text []string
+	for _, p := range parts {
+		switch p.Type {
+		case "text":
+			text = append(text, p.Text)
+		case "input_audio":
+			mimeType, ok := audioFormats[p.InputAudio.Format]
+			if !ok {
+				return fmt.Errorf("unsupported audio format %q", p.InputAudio.Format)
+			}
+			audio, err := base64.StdEncoding.DecodeString(p.InputAudio.Data)
+			if err != nil {
+				return fmt.Errorf("input_audio data is not valid base64")
+			}
+			c.Audio = append(c.Audio, genai.Part{InlineData: &genai.Blob{MIMEType: mimeType, Data: audio}})
+		default:
+			return fmt.Errorf("unsupported content part type %q", p.Type)
+		}
+	}
+	c.Text = strings.Join(text, "\n")
+	return nil
+}
+
+// audioSize returns the bytes of inline audio in parts.
+func audioSize(parts []genai.Part) int {
+	n := 0
+	for _, p := range parts {
+		if p.InlineData != nil {
+			n += len(p.InlineData.Data)
+		}
+	}
+	return n
+}
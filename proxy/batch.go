@@ -0,0 +1,484 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"customgemini/config"
+)
+
+// Batch states
+const (
+	batchQueued    = "queued"
+	batchRunning   = "running"
+	batchDone      = "done"
+	batchCancelled = "cancelled"
+	batchFailed    = "failed" // Stopped early, as when the workspace's budget ran out
+)
+
+const (
+	maxBatchPrompts  = 1000
+	maxBatchBytes    = 32 << 20
+	batchConcurrency = 2              // Prompts of one batch generating at once
+	batchRetention   = 24 * time.Hour // How long a finished batch's results are kept
+)
+
+// errBatchCancelled is the cause of a batch cancelled through the API.
+var errBatchCancelled = errors.New("batch cancelled")
+
+// BatchPrompt is one prompt of a batch: a native chat request with an ID
+// to find its result by, or just the message as a JSON string. The
+// session ID is ignored; batch prompts are answered without history.
+type BatchPrompt struct {
+	ID string `json:"id,omitempty"` // Defaults to the prompt's position, from 1
+	ChatRequest
+}
+
+func (p *BatchPrompt) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &p.Message)
+	}
+	type plain BatchPrompt
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// BatchRequest is the JSON body of POST /batch. Its model, system prompt
+// and context mode apply to the prompts that do not set their own.
+type BatchRequest struct {
+	Model        string        `json:"model,omitempty"`
+	SystemPrompt string        `json:"system_prompt,omitempty"`
+	ContextMode  string        `json:"context_mode,omitempty"`
+	Prompts      []BatchPrompt `json:"prompts"`
+}
+
+// BatchResult is one line of a batch's results.
+type BatchResult struct {
+	ID             string          `json:"id"`
+	Text           string          `json:"text,omitempty"`
+	Structured     json.RawMessage `json:"structured,omitempty"`
+	Model          string          `json:"model"`
+	PromptTokens   int             `json:"prompt_tokens,omitempty"`
+	ResponseTokens int             `json:"response_tokens,omitempty"`
+	Cost           float64         `json:"cost"`
+	FinishReason   string          `json:"finish_reason,omitempty"`
+	Error          string          `json:"error,omitempty"`
+}
+
+// BatchStatus is a batch's progress.
+type BatchStatus struct {
+	ID        string     `json:"id"`
+	Status    string     `json:"status"`
+	Total     int        `json:"total"`
+	Completed int        `json:"completed"` // Answered or failed
+	Failed    int        `json:"failed"`
+	Cost      float64    `json:"cost"`
+	Created   time.Time  `json:"created"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"` // Why a failed batch stopped
+}
+
+type batch struct {
+	id        string
+	workspace string // Empty outside a workspace
+	created   time.Time
+	prompts   []BatchPrompt
+	cancel    context.CancelCauseFunc
+
+	// Guarded by batchTable.mu
+	status            string
+	started, finished time.Time
+	results           []*BatchResult // By prompt; nil until answered
+	completed, failed int
+	cost              float64
+	err               string
+}
+
+// batchTable holds the batches of the last batchRetention in memory. A
+// restart loses them, along with any still running.
+type batchTable struct {
+	mu      sync.Mutex
+	batches []*batch
+}
+
+func (t *batchTable) add(b *batch) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cutoff := time.Now().Add(-batchRetention)
+	t.batches = slices.DeleteFunc(t.batches, func(b *batch) bool {
+		return !b.finished.IsZero() && b.finished.Before(cutoff)
+	})
+	t.batches = append(t.batches, b)
+}
+
+func (t *batchTable) remove(b *batch) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.batches = slices.DeleteFunc(t.batches, func(x *batch) bool { return x == b })
+}
+
+// find returns the batch with the ID in the request's workspace.
+func (t *batchTable) find(ctx context.Context, id string) *batch {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.batches {
+		if b.id == id && b.workspace == workspaceName(ctx) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (t *batchTable) status(b *batch) BatchStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := BatchStatus{
+		ID:        b.id,
+		Status:    b.status,
+		Total:     len(b.prompts),
+		Completed: b.completed,
+		Failed:    b.failed,
+		Cost:      b.cost,
+		Created:   b.created,
+		Error:     b.err,
+	}
+	if started := b.started; !started.IsZero() {
+		st.Started = &started
+	}
+	if finished := b.finished; !finished.IsZero() {
+		st.Finished = &finished
+	}
+	return st
+}
+
+// list returns the request's workspace's batches, newest first.
+func (t *batchTable) list(ctx context.Context) []BatchStatus {
+	t.mu.Lock()
+	var own []*batch
+	for _, b := range t.batches {
+		if b.workspace == workspaceName(ctx) {
+			own = append(own, b)
+		}
+	}
+	t.mu.Unlock()
+	list := make([]BatchStatus, 0, len(own))
+	for i := len(own) - 1; i >= 0; i-- {
+		list = append(list, t.status(own[i]))
+	}
+	return list
+}
+
+func workspaceName(ctx context.Context) string {
+	if ws := workspaceFrom(ctx); ws != nil {
+		return ws.name
+	}
+	return ""
+}
+
+// handleBatch takes prompts to answer in the background and reports on
+// them.
+//
+//	GET    /batch              the request's batches, newest first
+//	POST   /batch              submit prompts, as JSON or JSONL
+//	GET    /batch/{id}         progress
+//	GET    /batch/{id}/results the answers so far, as JSONL
+//	POST   /batch/{id}/cancel  stop answering
+//	DELETE /batch/{id}         cancel and forget it
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	writeJSON := func(status int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/batch")
+	if rest == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(http.StatusOK, map[string]any{"batches": s.batches.list(r.Context())})
+		case http.MethodPost:
+			st, status, err := s.submitBatch(w, r)
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			writeJSON(http.StatusAccepted, st)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	b := s.batches.find(r.Context(), id)
+	if !strings.HasPrefix(rest, "/") || b == nil {
+		http.Error(w, "No batch with this ID", http.StatusNotFound)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(http.StatusOK, s.batches.status(b))
+	case action == "" && r.Method == http.MethodDelete:
+		b.cancel(errBatchCancelled)
+		s.batches.remove(b)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "results" && r.Method == http.MethodGet:
+		s.batches.mu.Lock()
+		results := slices.Clone(b.results)
+		s.batches.mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="batch-%s.jsonl"`, b.id))
+		enc := json.NewEncoder(w)
+		for _, res := range results {
+			if res != nil {
+				enc.Encode(res)
+			}
+		}
+	case action == "cancel" && r.Method == http.MethodPost:
+		if st := s.batches.status(b); st.Finished != nil {
+			http.Error(w, "The batch has finished", http.StatusConflict)
+			return
+		}
+		b.cancel(errBatchCancelled)
+		s.requestLogger(r.Context()).Info("batch cancel requested", "batch", b.id)
+		writeJSON(http.StatusOK, s.batches.status(b))
+	case action == "" || action == "results" || action == "cancel":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// submitBatch reads a batch's prompts and starts answering them. A JSON
+// body is a BatchRequest. A JSONL body, or a JSONL file uploaded as the
+// multipart field "file", holds one prompt per line, with the batch's
+// model, system prompt and context mode in the query string.
+func (s *Server) submitBatch(w http.ResponseWriter, r *http.Request) (BatchStatus, int, error) {
+	if err := s.checkBudget(r.Context()); err != nil {
+		return BatchStatus{}, http.StatusTooManyRequests, err
+	}
+	body := http.MaxBytesReader(w, r.Body, maxBatchBytes)
+	q := r.URL.Query()
+	req := BatchRequest{Model: q.Get("model"), SystemPrompt: q.Get("system_prompt"), ContextMode: q.Get("context_mode")}
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "", "application/json":
+		err = json.NewDecoder(body).Decode(&req)
+	case "application/jsonl", "application/x-ndjson", "application/x-jsonlines":
+		req.Prompts, err = readBatchJSONL(body)
+	case "multipart/form-data":
+		r.Body = body
+		f, _, ferr := r.FormFile("file")
+		if ferr != nil {
+			return BatchStatus{}, http.StatusBadRequest, fmt.Errorf("expected a JSONL file in the field \"file\": %w", ferr)
+		}
+		defer f.Close()
+		req.Prompts, err = readBatchJSONL(f)
+	default:
+		return BatchStatus{}, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %s: want application/json or application/jsonl", mediaType)
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return BatchStatus{}, http.StatusRequestEntityTooLarge, fmt.Errorf("the batch is over %d bytes", maxBatchBytes)
+		}
+		return BatchStatus{}, http.StatusBadRequest, fmt.Errorf("reading the prompts: %w", err)
+	}
+	switch n := len(req.Prompts); {
+	case n == 0:
+		return BatchStatus{}, http.StatusBadRequest, errors.New("no prompts")
+	case n > maxBatchPrompts:
+		return BatchStatus{}, http.StatusRequestEntityTooLarge, fmt.Errorf("%d prompts; a batch takes at most %d", n, maxBatchPrompts)
+	}
+	seen := make(map[string]bool, len(req.Prompts))
+	for i := range req.Prompts {
+		p := &req.Prompts[i]
+		if p.ID == "" {
+			p.ID = strconv.Itoa(i + 1)
+		}
+		if seen[p.ID] {
+			return BatchStatus{}, http.StatusBadRequest, fmt.Errorf("prompt ID %q is used twice", p.ID)
+		}
+		seen[p.ID] = true
+		if strings.TrimSpace(p.Message) == "" {
+			return BatchStatus{}, http.StatusBadRequest, fmt.Errorf("prompt %s has no message", p.ID)
+		}
+		if p.Model == "" {
+			p.Model = req.Model
+		}
+		if p.SystemPrompt == "" {
+			p.SystemPrompt = req.SystemPrompt
+		}
+		if p.ContextMode == "" {
+			p.ContextMode = req.ContextMode
+		}
+	}
+
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(r.Context()))
+	b := &batch{
+		id:        newRequestID(),
+		workspace: workspaceName(ctx),
+		created:   time.Now().UTC(),
+		prompts:   req.Prompts,
+		cancel:    cancel,
+		status:    batchQueued,
+		results:   make([]*BatchResult, len(req.Prompts)),
+	}
+	s.batches.add(b)
+	s.requestLogger(ctx).Info("batch submitted", "batch", b.id, "prompts", len(b.prompts))
+	go s.runBatch(ctx, b)
+	return s.batches.status(b), http.StatusAccepted, nil
+}
+
+// readBatchJSONL reads one prompt per line, skipping blank lines.
+func readBatchJSONL(r io.Reader) ([]BatchPrompt, error) {
+	var prompts []BatchPrompt
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64<<10), maxBatchBytes)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		var p BatchPrompt
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		prompts = append(prompts, p)
+	}
+	return prompts, sc.Err()
+}
+
+// runBatch answers b's prompts, batchConcurrency at a time, until they are
+// all answered or the batch is cancelled.
+func (s *Server) runBatch(ctx context.Context, b *batch) {
+	defer b.cancel(nil)
+	s.batches.mu.Lock()
+	b.status, b.started = batchRunning, time.Now().UTC()
+	s.batches.mu.Unlock()
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(batchConcurrency, len(b.prompts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				s.runBatchPrompt(ctx, b, i)
+			}
+		}()
+	}
+feed:
+	for i := range b.prompts {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	s.batches.mu.Lock()
+	b.finished = time.Now().UTC()
+	switch cause := context.Cause(ctx); {
+	case cause == nil:
+		b.status = batchDone
+	case errors.Is(cause, errBatchCancelled):
+		b.status = batchCancelled
+	default:
+		b.status, b.err = batchFailed, cause.Error()
+	}
+	status, completed, failed, cost := b.status, b.completed, b.failed, b.cost
+	s.batches.mu.Unlock()
+	s.requestLogger(ctx).Info("batch finished", "batch", b.id, "status", status, "completed", completed, "failed", failed, "cost", cost)
+}
+
+// runBatchPrompt answers prompt i of b. It first waits for the model's
+// rate limit to have headroom, for the circuit breaker to close and for a
+// slot in the limiter, so the batch gives way to interactive requests. A
+// workspace out of budget stops the batch.
+func (s *Server) runBatchPrompt(ctx context.Context, b *batch, i int) {
+	p := b.prompts[i]
+	req := p.ChatRequest
+	if req.Model == "" {
+		req.Model, _ = s.cfg.Endpoint(config.EndpointWeb)
+	}
+	for {
+		if err := s.checkBudget(ctx); err != nil {
+			b.cancel(err)
+			return
+		}
+		wait := s.quota.headroom(req.Model, time.Now())
+		if s.breaker.check() != nil {
+			wait = max(wait, shedRetryAfter*time.Second)
+		}
+		if wait <= 0 {
+			break
+		}
+		if !sleepCtx(ctx, wait) {
+			return
+		}
+	}
+	release, err := s.limiter.acquire(ctx)
+	for err != nil {
+		if !sleepCtx(ctx, shedRetryAfter*time.Second) {
+			return
+		}
+		release, err = s.limiter.acquire(ctx)
+	}
+	defer release()
+
+	// Each prompt is logged and timed as a request of its own
+	ctx = context.WithValue(ctx, requestIDKey, fmt.Sprintf("%s-%d", b.id, i+1))
+	ctx = context.WithValue(ctx, requestTimerKey, &requestTimer{received: time.Now()})
+	req.SessionID = "batch-" + b.id
+	req.ephemeral = true
+	res := &BatchResult{ID: p.ID}
+	resp, _, err := s.runChat(ctx, "/batch", &req)
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	res.Model = req.Model
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Text = resp.Text
+		res.Structured = resp.Structured
+		res.PromptTokens = resp.PromptTokens
+		res.ResponseTokens = resp.ResponseTokens
+		res.Cost = resp.Cost
+		res.FinishReason = resp.FinishReason
+	}
+
+	s.batches.mu.Lock()
+	defer s.batches.mu.Unlock()
+	b.results[i] = res
+	b.completed++
+	if res.Error != "" {
+		b.failed++
+	}
+	b.cost += res.Cost
+}
+
+// sleepCtx sleeps for d and reports whether ctx was still live throughout.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"customgemini/config"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"    // Calls go through
+	breakerOpen     = "open"      // Calls fail at once until the cooldown ends
+	breakerHalfOpen = "half-open" // One call probes the API; the rest fail
+)
+
+// circuitOpenError fails an upstream call while the breaker is open.
+type circuitOpenError struct {
+	failures   int
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("Gemini API unavailable: circuit breaker open after %d consecutive failures, retry in %ds", e.failures, retryAfterSeconds(e.retryAfter))
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return max(int((d+time.Second-1)/time.Second), 1)
+}
+
+// BreakerStatus is the circuit breaker's state, reported by /status and
+// with every request it rejects.
+type BreakerStatus struct {
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAfterSeconds   int        `json:"retry_after_seconds,omitempty"` // Until the next probe
+	Opens               uint64     `json:"opens"`                         // Times the breaker has opened
+}
+
+// breaker stops calls to the Gemini API after consecutive failures, so an
+// outage fails requests at once instead of each waiting out its retries
+// and timeout. Once the cooldown has passed, a single call probes the API:
+// success closes the breaker and failure opens it for another cooldown. A
+// nil breaker lets everything through.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool // The half-open probe is in flight
+	opens    uint64
+}
+
+func newBreaker(cfg config.BreakerConfig) *breaker {
+	if cfg.FailureThreshold <= 0 {
+		return nil
+	}
+	return &breaker{
+		threshold: cfg.FailureThreshold,
+		cooldown:  time.Duration(cfg.CooldownSeconds) * time.Second,
+		state:     breakerClosed,
+	}
+}
+
+// check fails while the breaker is open and its cooldown has not passed,
+// without taking the probe, for rejecting requests before they start.
+func (b *breaker) check() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if left := time.Until(b.openedAt.Add(b.cooldown)); b.state == breakerOpen && left > 0 {
+		return &circuitOpenError{b.failures, left}
+	}
+	return nil
+}
+
+// allow admits an upstream call. probe reports that the call is the
+// half-open probe, whose outcome decides the breaker's state.
+func (b *breaker) allow() (probe bool, err error) {
+	if b == nil {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return false, nil
+	case breakerOpen:
+		if left := time.Until(b.openedAt.Add(b.cooldown)); left > 0 {
+			return false, &circuitOpenError{b.failures, left}
+		}
+		b.state = breakerHalfOpen
+	}
+	if b.probing {
+		return false, &circuitOpenError{b.failures, time.Second}
+	}
+	b.probing = true
+	return true, nil
+}
+
+// record counts the outcome of a call allow admitted, and reports whether
+// it opened or closed the breaker.
+func (b *breaker) record(probe, failed bool) (opened, closed bool) {
+	if b == nil {
+		return false, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if !failed {
+		closed = b.state != breakerClosed
+		b.state, b.failures = breakerClosed, 0
+		return false, closed
+	}
+	b.failures++
+	if (b.state == breakerHalfOpen && probe) || (b.state == breakerClosed && b.failures >= b.threshold) {
+		b.state, b.openedAt = breakerOpen, time.Now()
+		b.opens++
+		return true, false
+	}
+	return false, false
+}
+
+// abandon gives up the probe of a call that ended without an outcome,
+// because its client went away.
+func (b *breaker) abandon(probe bool) {
+	if b == nil || !probe {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *breaker) status() BreakerStatus {
+	if b == nil {
+		return BreakerStatus{State: breakerClosed}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStatus{State: b.state, ConsecutiveFailures: b.failures, Opens: b.opens}
+	if b.state != breakerClosed {
+		opened := b.openedAt
+		st.OpenedAt = &opened
+		st.RetryAfterSeconds = retryAfterSeconds(time.Until(b.openedAt.Add(b.cooldown)))
+	}
+	return st
+}
+
+// breakerTransport passes upstream calls through the circuit breaker. It
+// sits above the retries, so a call counts as failed only once they are
+// spent, and below the response cache, which still answers while the
+// breaker is open. Network errors, 429 and 5xx are failures; any other
+// response shows the API is up.
+type breakerTransport struct {
+	s    *Server
+	base http.RoundTripper
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := t.s.breaker
+	probe, err := b.allow()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if req.Context().Err() != nil {
+		b.abandon(probe)
+		return resp, err
+	}
+	failed := err != nil || retryable(resp.StatusCode)
+	opened, closed := b.record(probe, failed)
+	switch {
+	case opened:
+		st := b.status()
+		t.s.requestLogger(req.Context()).Error("circuit breaker opened",
+			"consecutive_failures", st.ConsecutiveFailures,
+			"cooldown_seconds", t.s.cfg.Breaker.CooldownSeconds,
+		)
+	case closed:
+		t.s.requestLogger(req.Context()).Info("circuit breaker closed")
+	}
+	return resp, err
+}
+
+// writeCircuitOpen rejects a request with 503 while the breaker is open,
+// with Retry-After and the breaker's status.
+func writeCircuitOpen(w http.ResponseWriter, err error, st BreakerStatus) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(st.RetryAfterSeconds, 1)))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]any{"error": err.Error(), "breaker": st})
+}
@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// CacheManifest summarizes what BuildCache put in a context cache.
+type CacheManifest struct {
+	Cache       string         `json:"cache"` // Cache name the manifest belongs to
+	Model       string         `json:"model"`
+	Built       time.Time      `json:"built"`
+	Files       int            `json:"files"`
+	Bytes       int64          `json:"bytes"`       // Corpus size, headers included
+	Tokens      int32          `json:"tokens"`      // Counted before upload, excluding padding
+	Padded      bool           `json:"padded"`      // Padding was added to reach the caching minimum
+	Extensions  map[string]int `json:"extensions"`  // Files by extension, "" for none
+	Directories map[string]int `json:"directories"` // Files by top-level directory, "." for the root
+}
+
+// add counts one corpus file by extension and top-level directory.
+func (m *CacheManifest) add(rel string) {
+	m.Extensions[strings.TrimPrefix(path.Ext(rel), ".")]++
+	dir, _, found := strings.Cut(rel, "/")
+	if !found {
+		dir = "."
+	}
+	m.Directories[dir]++
+}
+
+// cacheDisplayName marks the context caches this proxy builds. Each
+// server adds its instance ID, so that proxies sharing an API key can tell
+// their own caches apart; see Server.ownCacheName.
+const cacheDisplayName = "Unified_Project_Brain"
+
+// ownCacheName is the display name of the caches this server builds.
+func (s *Server) ownCacheName() string {
+	return cacheDisplayName + "@" + s.instanceID
+}
+
+// loadInstanceID reads the ID of this server from the home directory,
+// creating it on first start, so that it survives restarts. When it
+// cannot be saved, the ID lasts until the process exits.
+func (s *Server) loadInstanceID() {
+	path := filepath.Join(s.home, "instance_id")
+	if data, err := os.ReadFile(path); err == nil && validRequestID(strings.TrimSpace(string(data))) {
+		s.instanceID = strings.TrimSpace(string(data))
+		return
+	}
+	s.instanceID = newRequestID()
+	if err := os.WriteFile(path, []byte(s.instanceID+"\n"), 0o644); err != nil {
+		s.logger.Warn("saving instance ID; caches built now will not be recognized after a restart", "error", err)
+	}
+}
+
+// --- CORE LOGIC ---
+
+// BuildCache compiles the project files into a Gemini context cache for the
+// configured model and makes it the active cache. It returns the cache name,
+// or "" when creation failed (the server then runs uncached).
+func (s *Server) BuildCache(ctx context.Context) string {
+	model := s.cfg.Model
+	manifest := CacheManifest{Model: model, Extensions: map[string]int{}, Directories: map[string]int{}}
+
+	// The builder is the only copy of the corpus: files are streamed into it
+	// through pooled buffers and its String() does not copy.
+	var contentBuilder strings.Builder
+	stats, err := s.WriteCorpus(&contentBuilder, func(p CorpusProgress) {
+		manifest.add(p.Path)
+		if s.corpusProgress != nil {
+			s.corpusProgress(p)
+		}
+	})
+	if err != nil {
+		s.logger.Warn("walking project for corpus", "error", err)
+	}
+	manifest.Files, manifest.Bytes = stats.Files, stats.Bytes
+	s.logger.Info("compiled corpus", "files", stats.Files, "bytes", stats.Bytes)
+
+	count, err := s.client.Models.CountTokens(ctx, model, genai.Text(contentBuilder.String()), nil)
+	if err != nil {
+		s.logger.Warn("counting corpus tokens", "error", err)
+	} else {
+		manifest.Tokens = count.TotalTokens
+		s.logger.Info("counted corpus tokens", "tokens", count.TotalTokens)
+	}
+
+	if contentBuilder.Len() < 32768 {
+		manifest.Padded = true
+		s.logger.Info("corpus below Google's 32k token threshold, adding padding to enable caching", "bytes", contentBuilder.Len())
+		// Pad with a neutral comment to reach the threshold
+		for range (33000 - contentBuilder.Len()) / 60 {
+			contentBuilder.WriteString("\n// CACHE_PADDING_TOKEN_REDUNDANCY_FOR_COST_SAVINGS_PROTOCOL\n")
+		}
+	}
+
+	s.logger.Info("uploading to Google context cache")
+
+	// Define tools for agentic mode (included in cache for future use)
+	var tools []*genai.Tool
+	if fileTools := s.fileToolDeclarations(ctx); len(fileTools) > 0 {
+		tools = append(tools, &genai.Tool{FunctionDeclarations: fileTools})
+		// Note: Google Search cannot be combined with FunctionDeclarations in cached content
+		// Users should disable Google Search when using cached content with agentic mode
+	}
+
+	// Held until the cache is active, so DELETE /caches cannot take it for
+	// an orphan in between
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+
+	// Create the cached content using new SDK API
+	cache, err := s.client.Caches.Create(ctx, "models/"+model, &genai.CreateCachedContentConfig{
+		DisplayName: s.ownCacheName(),
+		SystemInstruction: &genai.Content{
+			Parts: []*genai.Part{
+				{Text: s.cacheSystemPrompt()},
+			},
+			Role: "user",
+		},
+		Contents: []*genai.Content{
+			{
+				Parts: []*genai.Part{
+					{Text: contentBuilder.String()},
+				},
+				Role: "user",
+			},
+		},
+		Tools: tools,
+		TTL:   time.Duration(s.cfg.CacheTTLMinutes) * time.Minute,
+	})
+	if err != nil {
+		s.logger.Error("cache creation failed (likely model unsupported or size limit)", "error", err)
+		return ""
+	}
+
+	if err := s.store.SetActiveCache(ctx, cache.Name, model); err != nil {
+		s.logger.Error("publishing active cache", "cache_id", cache.Name, "error", err)
+	}
+	manifest.Cache, manifest.Built = cache.Name, time.Now().UTC()
+	if err := s.store.SetCacheManifest(ctx, manifest); err != nil {
+		s.logger.Warn("saving cache manifest", "cache_id", cache.Name, "error", err)
+	}
+	return cache.Name
+}
+
+// DeleteCache deletes a context cache from the Gemini API. If it is the
+// active cache, the server goes back to running uncached.
+func (s *Server) DeleteCache(ctx context.Context, name string) error {
+	if _, err := s.client.Caches.Delete(ctx, name, nil); err != nil {
+		return err
+	}
+	if active, _ := s.Cache(); active == name {
+		return s.store.SetActiveCache(ctx, "", "")
+	}
+	return nil
+}
+
+// cacheSystemPrompt returns the configured system prompt, or the built-in
+// Antigravity Brain persona when none is set.
+func (s *Server) cacheSystemPrompt() string {
+	if s.cfg.SystemPrompt != "" {
+		return s.cfg.SystemPrompt
+	}
+	return "You are Antigravity Brain, a powerful project assistant. You have access to the project's history and source code via your context cache. Always identify as Antigravity Brain / Gemini."
+}
+
+// CacheInfo is the /cache/info response. Expiry and token count come from
+// the Gemini API when it can be reached, and otherwise from the manifest.
+type CacheInfo struct {
+	Active      bool           `json:"active"`
+	CacheID     string         `json:"cache_id,omitempty"`
+	Model       string         `json:"model"`
+	DisplayName string         `json:"display_name,omitempty"`
+	Created     time.Time      `json:"created,omitzero"`
+	Expires     time.Time      `json:"expires,omitzero"`
+	ExpiresIn   int64          `json:"expires_in_seconds"` // 0 once expired or unknown
+	Expired     bool           `json:"expired"`
+	Tokens      int32          `json:"tokens"`
+	Manifest    *CacheManifest `json:"manifest,omitempty"` // Only for caches built by this proxy
+	Error       string         `json:"error,omitempty"`    // Why the cache could not be looked up
+}
+
+func (s *Server) handleCacheInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.ActiveCacheInfo(r.Context()))
+}
+
+// ActiveCacheInfo describes the active context cache, as GET /cache/info
+// reports it.
+func (s *Server) ActiveCacheInfo(ctx context.Context) CacheInfo {
+	name, model := s.cacheFor(ctx)
+	info := CacheInfo{Active: name != "", CacheID: name, Model: model}
+	if name != "" {
+		manifest, err := s.sessions(ctx).CacheManifest(ctx)
+		if err != nil {
+			s.requestLogger(ctx).Warn("reading cache manifest", "error", err)
+		}
+		if manifest != nil && manifest.Cache == name {
+			info.Manifest = manifest
+			info.Created, info.Tokens = manifest.Built, manifest.Tokens
+			info.Expires = manifest.Built.Add(time.Duration(s.cfg.CacheTTLMinutes) * time.Minute)
+		}
+
+		cache, err := s.client.Caches.Get(ctx, name, nil)
+		var apiErr genai.APIError
+		switch {
+		case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+			info.Expired = true
+		case err != nil:
+			info.Error = err.Error()
+		default:
+			info.DisplayName = cache.DisplayName
+			info.Model = strings.TrimPrefix(cache.Model, "models/")
+			info.Created, info.Expires = cache.CreateTime, cache.ExpireTime
+			if cache.UsageMetadata != nil && cache.UsageMetadata.TotalTokenCount > 0 {
+				info.Tokens = cache.UsageMetadata.TotalTokenCount
+			}
+		}
+		if !info.Expires.IsZero() {
+			info.ExpiresIn = int64(time.Until(info.Expires).Seconds())
+			if info.ExpiresIn <= 0 {
+				info.ExpiresIn, info.Expired = 0, true
+			}
+		}
+	}
+	return info
+}
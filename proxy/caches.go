@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// CacheSummary is a context cache of the configured API key, as GET
+// /caches lists it. ActiveIn names where the cache is in use: "server" for
+// the server's own project and workspace names for the others. Proxy marks
+// the caches of any proxy, Own those of this server; other proxies sharing
+// the key keep their active caches in stores this server cannot see. A
+// cache this server built that is in use nowhere is orphaned and only
+// costs storage until it expires.
+type CacheSummary struct {
+	Name        string    `json:"name"`
+	DisplayName string    `json:"display_name,omitempty"`
+	Model       string    `json:"model"`
+	Tokens      int32     `json:"tokens"`
+	Created     time.Time `json:"created,omitzero"`
+	Updated     time.Time `json:"updated,omitzero"`
+	Expires     time.Time `json:"expires,omitzero"`
+	ActiveIn    []string  `json:"active_in,omitempty"`
+	Proxy       bool      `json:"proxy"` // Built by a gemini-proxy
+	Own         bool      `json:"own"`   // Built by this server
+	Orphaned    bool      `json:"orphaned"`
+}
+
+// activeCaches maps the caches in use to where they are used, as in
+// CacheSummary.ActiveIn. Workspaces use the cache their configuration
+// names.
+func (s *Server) activeCaches(ctx context.Context) map[string][]string {
+	active := map[string][]string{}
+	if name, _, err := s.store.ActiveCache(ctx); err == nil && name != "" {
+		active[name] = append(active[name], "server")
+	}
+	seen := map[*workspace]bool{}
+	for _, ws := range s.workspaces {
+		if seen[ws] {
+			continue
+		}
+		seen[ws] = true
+		if name, _, err := ws.store.ActiveCache(ctx); err == nil && name != "" {
+			active[name] = append(active[name], ws.name)
+		}
+	}
+	for _, where := range active {
+		slices.Sort(where)
+	}
+	return active
+}
+
+func (s *Server) cacheSummary(c *genai.CachedContent, active map[string][]string) CacheSummary {
+	sum := CacheSummary{
+		Name:        c.Name,
+		DisplayName: c.DisplayName,
+		Model:       strings.TrimPrefix(c.Model, "models/"),
+		Created:     c.CreateTime,
+		Updated:     c.UpdateTime,
+		Expires:     c.ExpireTime,
+		ActiveIn:    active[c.Name],
+		Proxy:       strings.HasPrefix(c.DisplayName, cacheDisplayName),
+		Own:         c.DisplayName == s.ownCacheName(),
+	}
+	if c.UsageMetadata != nil {
+		sum.Tokens = c.UsageMetadata.TotalTokenCount
+	}
+	sum.Orphaned = sum.Own && len(sum.ActiveIn) == 0
+	return sum
+}
+
+// ListCaches returns the context caches of the configured API key, newest
+// first.
+func (s *Server) ListCaches(ctx context.Context) ([]CacheSummary, error) {
+	active := s.activeCaches(ctx)
+	list := []CacheSummary{}
+	for c, err := range s.client.Caches.All(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s.cacheSummary(c, active))
+	}
+	slices.SortFunc(list, func(a, b CacheSummary) int { return b.Created.Compare(a.Created) })
+	return list, nil
+}
+
+// handleCaches manages the context caches of the configured API key,
+// including those other tools or earlier runs left behind:
+//
+//	GET    /caches         list caches, newest first; ?orphaned=true for orphans only
+//	POST   /caches         build a cache of the project and make it active, deleting the one it replaces
+//	DELETE /caches         delete every orphaned cache of this server
+//	GET    /caches/<name>  one cache, with its manifest when this proxy built it
+//	PATCH  /caches/<name>  extend its life by {"ttl_minutes"} from now
+//	DELETE /caches/<name>  delete it; the server runs uncached if it was its cache
+//
+// <name> is the cache's full name or just its ID.
+func (s *Server) handleCaches(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := strings.TrimPrefix(r.URL.Path, "/caches/")
+	if id == r.URL.Path {
+		id = ""
+	}
+	name := id
+	if name != "" && !strings.HasPrefix(name, "cachedContents/") {
+		name = "cachedContents/" + name
+	}
+	if id != "" && !validRequestID(strings.TrimPrefix(name, "cachedContents/")) {
+		http.Error(w, "Invalid cache name", http.StatusBadRequest)
+		return
+	}
+	writeJSON := func(status int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	cacheError := func(err error) {
+		var apiErr genai.APIError
+		if errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusForbidden) {
+			http.Error(w, "Cache not found", http.StatusNotFound)
+			return
+		}
+		if ctx.Err() != nil {
+			http.Error(w, abortError(ctx, err).Error(), upstreamStatus(ctx, err))
+			return
+		}
+		http.Error(w, "Gemini API: "+err.Error(), http.StatusBadGateway)
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		list, err := s.ListCaches(ctx)
+		if err != nil {
+			cacheError(err)
+			return
+		}
+		if r.URL.Query().Get("orphaned") == "true" {
+			list = slices.DeleteFunc(list, func(c CacheSummary) bool { return !c.Orphaned })
+		}
+		writeJSON(http.StatusOK, map[string]any{"caches": list})
+
+	case id == "" && r.Method == http.MethodPost:
+		s.withUpstreamLimit(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := s.rebuildCache(r.Context()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			writeJSON(http.StatusCreated, s.ActiveCacheInfo(r.Context()))
+		})(w, r)
+
+	case id == "" && r.Method == http.MethodDelete:
+		s.cacheMu.Lock()
+		defer s.cacheMu.Unlock()
+		list, err := s.ListCaches(ctx)
+		if err != nil {
+			cacheError(err)
+			return
+		}
+		deleted := []string{}
+		for _, c := range list {
+			if !c.Orphaned {
+				continue
+			}
+			if _, err := s.client.Caches.Delete(ctx, c.Name, nil); err != nil {
+				s.requestLogger(ctx).Warn("deleting orphaned cache", "cache_id", c.Name, "error", err)
+				continue
+			}
+			deleted = append(deleted, c.Name)
+		}
+		s.requestLogger(ctx).Info("orphaned caches deleted", "count", len(deleted))
+		writeJSON(http.StatusOK, map[string]any{"deleted": deleted})
+
+	case id != "" && r.Method == http.MethodGet:
+		c, err := s.client.Caches.Get(ctx, name, nil)
+		if err != nil {
+			cacheError(err)
+			return
+		}
+		resp := struct {
+			CacheSummary
+			Manifest *CacheManifest `json:"manifest,omitempty"`
+		}{CacheSummary: s.cacheSummary(c, s.activeCaches(ctx))}
+		if m, err := s.store.CacheManifest(ctx); err == nil && m != nil && m.Cache == c.Name {
+			resp.Manifest = m
+		}
+		writeJSON(http.StatusOK, resp)
+
+	case id != "" && r.Method == http.MethodPatch:
+		var req struct {
+			TTLMinutes int `json:"ttl_minutes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TTLMinutes <= 0 {
+			http.Error(w, "Invalid request: ttl_minutes must be above zero", http.StatusBadRequest)
+			return
+		}
+		c, err := s.client.Caches.Update(ctx, name, &genai.UpdateCachedContentConfig{TTL: time.Duration(req.TTLMinutes) * time.Minute})
+		if err != nil {
+			cacheError(err)
+			return
+		}
+		s.requestLogger(ctx).Info("cache extended", "cache_id", name, "expires", c.ExpireTime)
+		writeJSON(http.StatusOK, s.cacheSummary(c, s.activeCaches(ctx)))
+
+	case id != "" && r.Method == http.MethodDelete:
+		if err := s.DeleteCache(ctx, name); err != nil {
+			cacheError(err)
+			return
+		}
+		s.requestLogger(ctx).Info("cache deleted", "cache_id", name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Capture is one sanitized upstream HTTP exchange as stored on disk.
+type Capture struct {
+	RequestID string          `json:"request_id"`
+	Time      time.Time       `json:"time"`
+	LatencyMs int64           `json:"latency_ms"`
+	Method    string          `json:"method"`
+	URL       string          `json:"url"`
+	Headers   http.Header     `json:"headers"`
+	Request   json.RawMessage `json:"request,omitempty"`
+	Status    int             `json:"status"`
+	Response  json.RawMessage `json:"response,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// CaptureSummary is the index entry returned by GET /debug/captures.
+type CaptureSummary struct {
+	Name      string    `json:"name"`
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+	URL       string    `json:"url"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+}
+
+func (s *Server) capturesDir() string {
+	return filepath.Join(s.home, "logs", "captures")
+}
+
+// captureTransport records the exact payloads sent to and received from the
+// Gemini API while the upstream_payloads switch is on.
+type captureTransport struct {
+	s    *Server
+	base http.RoundTripper
+}
+
+func (t *captureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.s.debug.upstreamPayloads.Load() {
+		return t.base.RoundTrip(req)
+	}
+	c := &Capture{
+		RequestID: req.Header.Get("X-Request-ID"),
+		Time:      time.Now(),
+		Method:    req.Method,
+		URL:       sanitizeURL(req),
+		Headers:   sanitizeHeaders(req.Header),
+	}
+	if c.RequestID == "" {
+		c.RequestID = requestIDFrom(req.Context())
+	}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		c.Request = sanitizeBody(body)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		c.LatencyMs = time.Since(c.Time).Milliseconds()
+		c.Error = err.Error()
+		t.s.saveCapture(c)
+		return nil, err
+	}
+	c.Status = resp.StatusCode
+	// Streamed responses are recorded once the caller finishes reading them.
+	resp.Body = &captureBody{ReadCloser: resp.Body, capture: c, save: t.s.saveCapture}
+	return resp, nil
+}
+
+// captureBody tees a response body and saves the capture on Close.
+type captureBody struct {
+	io.ReadCloser
+	capture *Capture
+	save    func(*Capture)
+	buf     bytes.Buffer
+	once    sync.Once
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	b.finish()
+	return b.ReadCloser.Close()
+}
+
+func (b *captureBody) finish() {
+	b.once.Do(func() {
+		b.capture.LatencyMs = time.Since(b.capture.Time).Milliseconds()
+		b.capture.Response = sanitizeBody(b.buf.Bytes())
+		b.save(b.capture)
+	})
+}
+
+// sensitiveHeaders are never written to disk.
+var sensitiveHeaders = []string{"X-Goog-Api-Key", "Authorization", "Cookie"}
+
+func sanitizeHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, k := range sensitiveHeaders {
+		if out.Get(k) != "" {
+			out.Set(k, "REDACTED")
+		}
+	}
+	return out
+}
+
+func sanitizeURL(req *http.Request) string {
+	u := *req.URL
+	q := u.Query()
+	if q.Has("key") {
+		q.Set("key", "REDACTED")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// sanitizeBody returns body as JSON with inline binary data elided. SSE
+// streams and other non-JSON bodies are stored as a JSON string.
+func sanitizeBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		data, _ := json.Marshal(string(body))
+		return data
+	}
+	elideInlineData(v)
+	data, _ := json.Marshal(v)
+	return data
+}
+
+func elideInlineData(v any) {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			if k == "inlineData" || k == "inline_data" {
+				if blob, ok := child.(map[string]any); ok {
+					if s, ok := blob["data"].(string); ok {
+						blob["data"] = fmt.Sprintf("<%d base64 bytes elided>", len(s))
+					}
+				}
+				continue
+			}
+			elideInlineData(child)
+		}
+	case []any:
+		for _, child := range t {
+			elideInlineData(child)
+		}
+	}
+}
+
+func (s *Server) saveCapture(c *Capture) {
+	dir := s.capturesDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		s.logger.Warn("creating capture dir", "error", err)
+		return
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		s.logger.Warn("encoding capture", "error", err)
+		return
+	}
+	name := fmt.Sprintf("%s_%s_%d.json", c.Time.Format("20060102-150405.000"), c.RequestID, s.captureSeq.Add(1))
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		s.logger.Warn("writing capture", "request_id", c.RequestID, "error", err)
+		return
+	}
+	pruneDebugDumps(dir, "*.json", s.cfg.DebugDumpLimit)
+}
+
+// handleDebugCapture reports (GET) or sets (POST {"enabled": bool}) whether
+// upstream exchanges are captured. It predates /debug/config, and sets the
+// response dumps along with the captures as it always has.
+func (s *Server) handleDebugCapture(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			http.Error(w, `Body must be {"enabled": true|false}`, http.StatusBadRequest)
+			return
+		}
+		s.debug.upstreamPayloads.Store(*req.Enabled)
+		s.debug.dumpResponses.Store(*req.Enabled)
+		s.requestLogger(r.Context()).Info("capture toggled", "enabled", *req.Enabled)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"enabled": s.debug.upstreamPayloads.Load(), "dir": s.capturesDir()})
+}
+
+// handleDebugCaptures lists recent captures, newest first, and serves a
+// single capture at /debug/captures/<name>. ?request_id= filters the index.
+func (s *Server) handleDebugCaptures(w http.ResponseWriter, r *http.Request) {
+	dir := s.capturesDir()
+	if name := strings.TrimPrefix(r.URL.Path, "/debug/captures/"); name != "" && name != r.URL.Path {
+		if name != filepath.Base(name) || !strings.HasSuffix(name, ".json") {
+			http.Error(w, "Invalid capture name", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		http.ServeFile(w, r, filepath.Join(dir, name))
+		return
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	filter := r.URL.Query().Get("request_id")
+	list := []CaptureSummary{}
+	for _, m := range matches {
+		data, err := os.ReadFile(m)
+		if err != nil {
+			continue
+		}
+		var c Capture
+		if json.Unmarshal(data, &c) != nil || (filter != "" && c.RequestID != filter) {
+			continue
+		}
+		list = append(list, CaptureSummary{
+			Name:      filepath.Base(m),
+			RequestID: c.RequestID,
+			Time:      c.Time,
+			URL:       c.URL,
+			Status:    c.Status,
+			Bytes:     int64(len(data)),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"enabled": s.debug.upstreamPayloads.Load(), "captures": list})
+}
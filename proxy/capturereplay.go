@@ -0,0 +1,312 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// maxDiffCells bounds the work of diffing two answers line by line. Longer
+// answers are shown as entirely removed and added.
+const maxDiffCells = 4 << 20
+
+// ReplayRequest is the optional body of POST /debug/replay/<capture>.
+type ReplayRequest struct {
+	Model string `json:"model,omitempty"` // Default: the captured model
+}
+
+// ReplayAnswer is one answer to a replayed request.
+type ReplayAnswer struct {
+	Model     string     `json:"model"`
+	Status    int        `json:"status"`
+	Text      string     `json:"text"`
+	ToolCalls []string   `json:"tool_calls,omitempty"` // name(args)
+	Finish    FinishInfo `json:"finish"`
+	Tokens    int32      `json:"tokens,omitempty"`
+	LatencyMs int64      `json:"latency_ms"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// ReplayResponse sets the captured answer beside the answer the request
+// gets now. Diff lists the lines of both texts, prefixed "-" when only the
+// original has them, "+" when only the replay does and " " when both do.
+type ReplayResponse struct {
+	Capture  string       `json:"capture"`
+	Original ReplayAnswer `json:"original"`
+	Replay   ReplayAnswer `json:"replay"`
+	Same     bool         `json:"same"` // Same text and tool calls
+	Diff     string       `json:"diff,omitempty"`
+	Cost     float64      `json:"cost"`
+}
+
+// handleDebugReplay serves POST /debug/replay/<capture>.
+func (s *Server) handleDebugReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := s.endpointContext(r.Context(), config.EndpointWeb)
+	defer cancel()
+	var req ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, status, err := s.replayCapture(ctx, strings.TrimPrefix(r.URL.Path, "/debug/replay/"), req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// replayCapture sends a captured generateContent request to the Gemini
+// API again, to req.Model if set, and compares the answer with the
+// captured one. The request is sent as captured, except that streamed
+// requests are replayed unstreamed and the response cache is skipped. On
+// failure it also returns the HTTP status to report.
+func (s *Server) replayCapture(ctx context.Context, name string, req ReplayRequest) (*ReplayResponse, int, error) {
+	if !strings.HasSuffix(name, ".json") {
+		name += ".json"
+	}
+	if name != filepath.Base(name) || name == ".json" {
+		return nil, http.StatusBadRequest, errors.New("invalid capture name")
+	}
+	data, err := os.ReadFile(filepath.Join(s.capturesDir(), name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, http.StatusNotFound, errors.New("capture not found")
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	var c Capture
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("decoding capture: %w", err)
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("capture URL: %w", err)
+	}
+	version, call, _ := strings.Cut(u.Path, "/models/")
+	model, method, _ := strings.Cut(call, ":")
+	if c.Method != http.MethodPost || model == "" || (method != "generateContent" && method != "streamGenerateContent") ||
+		len(c.Request) == 0 || c.Request[0] != '{' {
+		return nil, http.StatusBadRequest, errors.New("only generateContent captures can be replayed")
+	}
+	if bytes.Contains(c.Request, []byte("base64 bytes elided>")) {
+		return nil, http.StatusBadRequest, errors.New("the capture's inline data was elided, so it cannot be replayed")
+	}
+	var body struct {
+		CachedContent string `json:"cachedContent"`
+	}
+	json.Unmarshal(c.Request, &body)
+	resp := &ReplayResponse{Capture: name, Original: capturedAnswer(&c, model)}
+	if req.Model != "" && req.Model != model {
+		if ok, reason := s.models.allowed(req.Model); !ok {
+			return nil, http.StatusForbidden, errors.New(reason)
+		}
+		if body.CachedContent != "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("the capture uses context cache %s, which only %s can read", body.CachedContent, model)
+		}
+		model = req.Model
+	}
+	resp.Replay, resp.Cost = s.reissue(ctx, version, model, c.Request)
+	if ctx.Err() != nil {
+		return nil, upstreamStatus(ctx, ctx.Err()), abortError(ctx, ctx.Err())
+	}
+	resp.Same = resp.Original.Error == "" && resp.Replay.Error == "" &&
+		resp.Original.Text == resp.Replay.Text && strings.Join(resp.Original.ToolCalls, "\n") == strings.Join(resp.Replay.ToolCalls, "\n")
+	if resp.Original.Text != resp.Replay.Text {
+		resp.Diff = lineDiff(resp.Original.Text, resp.Replay.Text)
+	}
+	s.requestLogger(ctx).Info("capture replayed",
+		"capture", name,
+		"original_request_id", c.RequestID,
+		"model", model,
+		"status", resp.Replay.Status,
+		"same", resp.Same,
+		"cost", resp.Cost,
+	)
+	return resp, http.StatusOK, nil
+}
+
+// reissue posts a request body to generateContent of model and sums up
+// the answer. A failed call is reported in the answer.
+func (s *Server) reissue(ctx context.Context, version, model string, body []byte) (ReplayAnswer, float64) {
+	a := ReplayAnswer{Model: model}
+	cc := s.client.ClientConfig()
+	endpoint := strings.TrimSuffix(cc.HTTPOptions.BaseURL, "/") + version + "/models/" + url.PathEscape(model) + ":generateContent"
+	// Captures are stored indented
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, body); err != nil {
+		a.Error = err.Error()
+		return a, 0
+	}
+	hreq, err := http.NewRequestWithContext(context.WithValue(ctx, noResponseCacheKey, true), http.MethodPost, endpoint, &compact)
+	if err != nil {
+		a.Error = err.Error()
+		return a, 0
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("X-Request-ID", requestIDFrom(ctx))
+	if cc.APIKey != "" {
+		hreq.Header.Set("X-Goog-Api-Key", cc.APIKey)
+	}
+	client := cc.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	start := time.Now()
+	hresp, err := client.Do(hreq)
+	if err != nil {
+		a.Error = err.Error()
+		return a, 0
+	}
+	defer hresp.Body.Close()
+	data, err := io.ReadAll(hresp.Body)
+	a.Status, a.LatencyMs = hresp.StatusCode, time.Since(start).Milliseconds()
+	if err != nil {
+		a.Error = err.Error()
+		return a, 0
+	}
+	if hresp.StatusCode != http.StatusOK {
+		a.Error = preview(strings.TrimSpace(string(data)), 2000)
+		return a, 0
+	}
+	var res genai.GenerateContentResponse
+	if err := json.Unmarshal(data, &res); err != nil {
+		a.Error = "decoding response: " + err.Error()
+		return a, 0
+	}
+	summarizeAnswer(&a, []*genai.GenerateContentResponse{&res})
+	s.recordUsage(ctx, model, &res)
+	cost := calculateCost(model, &res)
+	if _, err := s.sessions(ctx).AddCost(context.WithoutCancel(ctx), cost); err != nil {
+		s.requestLogger(ctx).Error("recording cost", "error", err)
+	}
+	return a, cost
+}
+
+// capturedAnswer sums up the response of a capture, which is a JSON
+// object, or a string holding the server-sent events of a stream.
+func capturedAnswer(c *Capture, model string) ReplayAnswer {
+	a := ReplayAnswer{Model: model, Status: c.Status, LatencyMs: c.LatencyMs, Error: c.Error}
+	if a.Error != "" {
+		return a
+	}
+	if c.Status != http.StatusOK {
+		a.Error = preview(strings.TrimSpace(string(c.Response)), 2000)
+		return a
+	}
+	var chunks []*genai.GenerateContentResponse
+	var events string
+	if err := json.Unmarshal(c.Response, &events); err == nil {
+		sc := bufio.NewScanner(strings.NewReader(events))
+		sc.Buffer(nil, len(events)+1)
+		for sc.Scan() {
+			line, ok := strings.CutPrefix(sc.Text(), "data:")
+			if !ok {
+				continue
+			}
+			var res genai.GenerateContentResponse
+			if json.Unmarshal([]byte(strings.TrimSpace(line)), &res) == nil {
+				chunks = append(chunks, &res)
+			}
+		}
+	} else {
+		var res genai.GenerateContentResponse
+		if err := json.Unmarshal(c.Response, &res); err == nil {
+			chunks = append(chunks, &res)
+		}
+	}
+	summarizeAnswer(&a, chunks)
+	return a
+}
+
+// summarizeAnswer fills in a from the chunks of one answer, taking the
+// text and tool calls of the first candidate. Thoughts are left out.
+func summarizeAnswer(a *ReplayAnswer, chunks []*genai.GenerateContentResponse) {
+	var text strings.Builder
+	for _, res := range chunks {
+		if res.UsageMetadata != nil {
+			a.Tokens = res.UsageMetadata.TotalTokenCount
+		}
+		if info := finishInfo(res); info.FinishReason != "" || info.BlockReason != "" {
+			a.Finish = info
+		}
+		if len(res.Candidates) == 0 || res.Candidates[0].Content == nil {
+			continue
+		}
+		for _, p := range res.Candidates[0].Content.Parts {
+			switch {
+			case p == nil || p.Thought:
+			case p.FunctionCall != nil:
+				args, _ := json.Marshal(p.FunctionCall.Args)
+				a.ToolCalls = append(a.ToolCalls, fmt.Sprintf("%s(%s)", p.FunctionCall.Name, args))
+			default:
+				text.WriteString(p.Text)
+			}
+		}
+	}
+	a.Text = text.String()
+}
+
+// lineDiff lists the lines of old and new along their longest common
+// subsequence, marking those only old has with "-" and those only new has
+// with "+".
+func lineDiff(old, new string) string {
+	a, b := strings.Split(old, "\n"), strings.Split(new, "\n")
+	var out strings.Builder
+	if len(a)*len(b) > maxDiffCells {
+		for _, l := range a {
+			out.WriteString("-" + l + "\n")
+		}
+		for _, l := range b {
+			out.WriteString("+" + l + "\n")
+		}
+		return out.String()
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			out.WriteString(" " + a[i] + "\n")
+			i, j = i+1, j+1
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("-" + a[i] + "\n")
+			i++
+		default:
+			out.WriteString("+" + b[j] + "\n")
+			j++
+		}
+	}
+	return out.String()
+}
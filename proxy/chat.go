@@ -0,0 +1,615 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+type ChatRequest struct {
+	SessionID      string            `json:"session_id"`
+	Model          string            `json:"model"`
+	Message        string            `json:"message"`
+	CacheID        string            `json:"cache_id"`        // Optional override
+	UseSearch      bool              `json:"use_search"`      // Enable Google Search grounding
+	UseAgentic     bool              `json:"use_agentic"`     // Enable file tools (write_file, etc.)
+	Images         []string          `json:"images"`          // Base64 encoded images from frontend
+	Attachments    []ChatAttachment  `json:"attachments"`     // /upload IDs, or project paths and base64 files for this turn only
+	Temperature    *float32          `json:"temperature"`     // Optional temperature override
+	SafetySettings map[string]string `json:"safety_settings"` // Optional safety settings override
+	ContextMode    string            `json:"context_mode"`    // "cache" (default), "rag" or "none"
+	Rerank         *bool             `json:"rerank"`          // Rerank retrieved chunks; defaults to index.rerank
+	SystemPrompt   string            `json:"system_prompt"`   // Combined with the configured one per system_prompt_policy
+	Fresh          bool              `json:"fresh"`           // Ask the model even when a recent answer to a similar question exists
+
+	// Structured output: a JSON Schema the reply must follow, and
+	// "application/json" (implied by a schema) or "text/x.enum"
+	ResponseSchema   json.RawMessage `json:"response_schema,omitempty"`
+	ResponseMIMEType string          `json:"response_mime_type,omitempty"`
+
+	// Thinking: the token budget (-1 lets the model decide, 0 turns it
+	// off), and whether to return summaries of the model's thoughts
+	ThinkingBudget  *int32 `json:"thinking_budget,omitempty"`
+	IncludeThoughts bool   `json:"include_thoughts,omitempty"`
+
+	// Generation settings; unset ones keep the model's defaults
+	MaxOutputTokens *int32   `json:"max_output_tokens,omitempty"`
+	StopSequences   []string `json:"stop_sequences,omitempty"`
+	TopP            *float32 `json:"top_p,omitempty"`
+	TopK            *float32 `json:"top_k,omitempty"`
+	Seed            *int32   `json:"seed,omitempty"`
+	CandidateCount  *int32   `json:"candidate_count,omitempty"` // Above 1, every reply comes back in candidates
+
+	turnOnly     map[*genai.Blob]string       // Attachments left out of the saved history
+	config       *genai.GenerateContentConfig // As the chat was created with, to recreate it with less history
+	selectionKey string                       // Key of the editor selection to send ahead of the message
+	ephemeral    bool                         // Neither load nor save the session's history
+}
+
+type ChatResponse struct {
+	Text           string      `json:"text"`
+	Images         []ImageData `json:"images,omitempty"`
+	ToolCalls      []string    `json:"tool_calls,omitempty"`
+	PromptTokens   int         `json:"prompt_tokens"`
+	ResponseTokens int         `json:"response_tokens"`
+	TotalTokens    int         `json:"total_tokens"`
+	Cost           float64     `json:"cost"`             // Alias for frontend
+	RequestCost    float64     `json:"request_cost_brl"` // Legacy field
+	TotalCost      float64     `json:"session_total_brl"`
+	Timings        *Timings    `json:"timings,omitempty"`
+	FinishInfo                 // Why the model stopped, with any safety flags
+
+	Structured json.RawMessage `json:"structured,omitempty"` // The reply as JSON, for response_mime_type application/json
+
+	Thoughts       string `json:"thoughts,omitempty"`        // Thought summaries, with include_thoughts
+	ThinkingTokens int    `json:"thinking_tokens,omitempty"` // Billed as output, apart from response_tokens
+
+	Candidates []string `json:"candidates,omitempty"` // Every reply's text, with candidate_count; text is the first
+
+	Grounding *Grounding `json:"grounding,omitempty"` // The web pages behind a reply, with use_search
+
+	HistoryDropped int `json:"history_dropped,omitempty"` // Oldest session messages dropped to fit the context window
+
+	Warnings []ToolWarning `json:"warnings,omitempty"` // Tool calls that failed; the model was told and carried on
+
+	EmptyReason string `json:"empty_reason,omitempty"` // Why the model replied with nothing, if it did
+
+	Duplicate *DuplicateAnswer `json:"duplicate,omitempty"` // Set when the text is a recent answer to a similar question
+}
+
+type ImageData struct {
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"` // base64 encoded
+}
+
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	var req ChatRequest
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+	req.selectionKey = settingsKey(r)
+	resp, status, err := s.runChat(r.Context(), r.URL.Path, &req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	setServerTiming(w, resp.Timings)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Chat answers a native chat request as POST /chat does, for callers
+// without an HTTP request such as the command line.
+func (s *Server) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	resp, _, err := s.runChat(ctx, "/chat", &req)
+	return resp, err
+}
+
+// emptyReplyWarning stands in for a reply without text, tool calls or
+// images that the finish details do not explain.
+const emptyReplyWarning = "[System Warning: Model returned empty content. This may be a safety block or API glitch.]"
+
+// runChat answers a native chat request, running tool calls until the
+// model replies, and saves the session. path is the URL path it arrived
+// on. On failure it also returns the HTTP status to report.
+func (s *Server) runChat(ctx context.Context, path string, req *ChatRequest) (*ChatResponse, int, error) {
+	lg := s.requestLogger(ctx)
+	rctx, span := tracer.Start(ctx, "chat")
+	defer span.End()
+	// Requests proxied through /v1beta share this handler with the web UI
+	endpoint := config.EndpointWeb
+	if strings.HasPrefix(path, "/v1beta/") {
+		endpoint = config.EndpointGemini
+	}
+	ctx, cancel := s.endpointContext(rctx, endpoint)
+	defer cancel()
+
+	defaultModel, temperature := s.cfg.Endpoint(endpoint)
+	if req.Model == "" {
+		req.Model = defaultModel
+	} else if ok, reason := s.models.allowed(req.Model); !ok && req.Model != defaultModel {
+		return nil, http.StatusForbidden, errors.New(reason)
+	}
+	if req.SessionID == "" {
+		req.SessionID = "default"
+	}
+
+	start := time.Now()
+	lg.Info("chat request", "endpoint", path, "model", req.Model, "session", req.SessionID, "search", req.UseSearch, "agentic", req.UseAgentic, "msg", preview(req.Message, 50))
+
+	ctx = withSession(ctx, req.SessionID)
+	dup := s.checkDuplicate(ctx, req)
+	if found, score := dup.match(); found != nil {
+		totalCost, err := s.sessions(ctx).TotalCost(ctx)
+		if err != nil {
+			lg.Warn("reading total cost", "error", err)
+		}
+		return &ChatResponse{
+			Text:       found.answer,
+			TotalCost:  totalCost,
+			Timings:    timerFrom(ctx).Timings(),
+			FinishInfo: FinishInfo{FinishReason: string(genai.FinishReasonStop)},
+			Duplicate:  s.answerDuplicate(ctx, req, found, score),
+		}, http.StatusOK, nil
+	}
+	journaled := req.SessionID
+	if req.ephemeral {
+		journaled = ""
+	}
+	ctx, endTurn := s.beginTurn(ctx, journaled, req.Message)
+	defer endTurn()
+	chat, messageParts, status, err := s.prepareChat(ctx, req, temperature)
+	if err != nil {
+		return nil, status, err
+	}
+
+	finalResponse := ""
+	var toolLogs []string
+	var images []ImageData
+	var requestCost float64
+	var promptToks, respToks, totalToks, thinkToks int
+	var thoughts strings.Builder
+	var warnings []ToolWarning
+
+	res, chat, model, dropped, err := s.sendAnswered(ctx, chat, req.Model, req.config, messageParts...)
+	req.Model = model
+	if err != nil {
+		s.logAbort(ctx, "upstream")
+		return nil, upstreamStatus(ctx, err), abortError(ctx, err)
+	}
+
+	if res.UsageMetadata != nil {
+		promptToks = int(res.UsageMetadata.PromptTokenCount)
+		respToks = int(res.UsageMetadata.CandidatesTokenCount)
+		totalToks = int(res.UsageMetadata.TotalTokenCount)
+		cachedToks := int(res.UsageMetadata.CachedContentTokenCount)
+		lg.Debug("token breakdown", "prompt", promptToks, "cached", cachedToks, "response", respToks, "total", totalToks)
+
+		// Calculate what Google will ACTUALLY charge
+		nonCachedPrompt := promptToks - cachedToks
+		costCached := (float64(cachedToks) / 1000000.0) * 0.075 * 0.1 // 90% discount
+		costFresh := (float64(nonCachedPrompt) / 1000000.0) * 0.075
+		costOutput := (float64(respToks) / 1000000.0) * 0.30
+		totalCharge := costCached + costFresh + costOutput
+		lg.Debug("cost breakdown", "cached", costCached, "fresh", costFresh, "output", costOutput, "total", totalCharge)
+	}
+	if len(res.Candidates) > 0 {
+		lg.Debug("finish reason", "reason", res.Candidates[0].FinishReason)
+	}
+	lg.Debug("initial response", "candidates", len(res.Candidates), "tokens", totalToks)
+
+	for {
+		requestCost += calculateCost(req.Model, res)
+		thinkToks += thinkingTokens(res)
+		thoughts.WriteString(thoughtText(res))
+		if len(res.Candidates) == 0 || res.Candidates[0].Content == nil {
+			break
+		}
+		funcCalls := res.FunctionCalls()
+		if len(funcCalls) > 0 {
+			lg.Debug("function calls detected", "count", len(funcCalls))
+			var funcResponses []genai.Part
+			for _, funcCall := range funcCalls {
+				toolName := funcCall.Name
+				toolLogs = append(toolLogs, fmt.Sprintf("Executed: %s", toolName))
+				funcResult := s.executeTool(ctx, toolName, funcCall.Args)
+				if w, failed := toolWarning(toolName, funcCall.Args, funcResult); failed {
+					warnings = append(warnings, w)
+				}
+				funcResponses = append(funcResponses, genai.Part{FunctionResponse: functionResponse(req.Model, funcCall, funcResult)})
+			}
+			var n int
+			res, chat, req.Model, n, err = s.sendAnswered(ctx, chat, req.Model, req.config, funcResponses...)
+			dropped += n
+			if err != nil && ctx.Err() != nil {
+				s.logAbort(ctx, "tool loop")
+				return nil, upstreamStatus(ctx, err), abortError(ctx, err)
+			}
+			if err != nil {
+				finalResponse = "Error after tool execution: " + err.Error()
+				break
+			}
+			if res.UsageMetadata != nil {
+				respToks += int(res.UsageMetadata.CandidatesTokenCount)
+				totalToks = int(res.UsageMetadata.TotalTokenCount)
+			}
+			lg.Debug("tool return", "candidates", len(res.Candidates), "tokens", totalToks)
+			continue
+		}
+		finalResponse = res.Text()
+		if len(res.Candidates) > 0 && res.Candidates[0].Content != nil {
+			for _, part := range res.Candidates[0].Content.Parts {
+				if part.InlineData != nil && part.InlineData.Data != nil {
+					images = append(images, ImageData{MimeType: part.InlineData.MIMEType, Data: base64.StdEncoding.EncodeToString(part.InlineData.Data)})
+				}
+			}
+		}
+		break
+	}
+
+	finish := finishInfo(res)
+	finalResponse = strings.TrimSpace(finalResponse)
+	var structured json.RawMessage
+	var structuredErr error
+	if req.ResponseMIMEType == mimeJSON {
+		structured, structuredErr = structuredReply(finalResponse, finish)
+	}
+	var empty string
+	if finalResponse == "" && len(images) == 0 {
+		empty = emptyReason(finish, len(toolLogs))
+		if s.warnEmpty(ctx) {
+			finalResponse = emptyWarning(finish, len(toolLogs))
+		}
+	} else if finalResponse == "" && len(images) > 0 {
+		finalResponse = fmt.Sprintf("[Generated %d image(s)]", len(images))
+	}
+
+	if !req.ephemeral {
+		if err := s.sessions(ctx).SetHistory(ctx, req.SessionID, withoutTurnOnly(chat.History(false), req.turnOnly)); err != nil {
+			lg.Error("saving session", "session", req.SessionID, "error", err)
+		}
+	}
+	totalCost, err := s.sessions(ctx).AddCost(ctx, requestCost)
+	if err != nil {
+		lg.Error("recording cost", "error", err)
+	}
+
+	timings := timerFrom(ctx).Timings()
+
+	lg.Info("chat response",
+		"endpoint", path,
+		"model", req.Model,
+		"session", req.SessionID,
+		"prompt_tokens", promptToks,
+		"response_tokens", respToks,
+		"thinking_tokens", thinkToks,
+		"total_tokens", totalToks,
+		"tools", toolLogs,
+		"images", len(images),
+		"cost", requestCost,
+		"finish_reason", finish.FinishReason,
+		"block_reason", finish.BlockReason,
+		"latency_ms", time.Since(start).Milliseconds(),
+		"timings", timings,
+		"resp", preview(finalResponse, 50),
+	)
+
+	s.writeDebugResponse(ctx, finalResponse)
+	if structuredErr != nil {
+		lg.Warn("structured reply rejected", "session", req.SessionID, "error", structuredErr)
+		return nil, http.StatusBadGateway, structuredErr
+	}
+	if finish.FinishReason == string(genai.FinishReasonStop) && empty == "" && len(toolLogs) == 0 && len(images) == 0 {
+		dup.record(finalResponse, req.SessionID)
+	}
+
+	return &ChatResponse{
+		Text:           finalResponse,
+		Images:         images,
+		ToolCalls:      toolLogs,
+		PromptTokens:   promptToks,
+		ResponseTokens: respToks,
+		TotalTokens:    totalToks,
+		Cost:           requestCost,
+		RequestCost:    requestCost, // Legacy field
+		TotalCost:      totalCost,
+		Timings:        timings,
+		FinishInfo:     finish,
+		Structured:     structured,
+		Thoughts:       strings.TrimSpace(thoughts.String()),
+		ThinkingTokens: thinkToks,
+		Candidates:     candidateTexts(res),
+		Grounding:      newGrounding(groundingMetadata(res), finalResponse),
+		HistoryDropped: dropped,
+		Warnings:       warnings,
+		EmptyReason:    empty,
+	}, http.StatusOK, nil
+}
+
+// trimHistory keeps the last MaxHistoryTurns turns of a session, so a long
+// conversation does not outgrow what the context cache saves.
+func (s *Server) trimHistory(ctx context.Context, session string, history []*genai.Content) []*genai.Content {
+	if len(history) <= s.cfg.MaxHistoryTurns {
+		return history
+	}
+	dropped := len(history) - s.cfg.MaxHistoryTurns
+	s.requestLogger(ctx).Debug("chat history truncated to ensure cache effectiveness", "session", session, "dropped_turns", dropped, "kept_turns", s.cfg.MaxHistoryTurns)
+	return history[dropped:]
+}
+
+// prepareChat resolves a native chat request against its session history,
+// the active cache and the request overrides, and returns the chat with
+// the parts to send. On failure it also returns the HTTP status to report.
+func (s *Server) prepareChat(ctx context.Context, req *ChatRequest, temperature float32) (*genai.Chat, []genai.Part, int, error) {
+	lg := s.requestLogger(ctx)
+	var history []*genai.Content
+	var err error
+	if !req.ephemeral {
+		history, err = s.sessions(ctx).History(ctx, req.SessionID)
+	}
+	if err != nil {
+		lg.Error("loading session", "session", req.SessionID, "error", err)
+		return nil, nil, http.StatusServiceUnavailable, fmt.Errorf("session store unavailable: %w", err)
+	}
+
+	history = s.trimHistory(ctx, req.SessionID, history)
+
+	if !validContextMode(req.ContextMode) {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("invalid context_mode %q: want cache, rag or none", req.ContextMode)
+	}
+	if err := checkCacheID(ctx, req.CacheID); err != nil {
+		return nil, nil, http.StatusForbidden, err
+	}
+	activeCID := ""
+	switch {
+	case req.ContextMode == ContextRAG, req.ContextMode == ContextNone:
+		// Retrieved chunks replace the cache, and none sends no project context
+	case req.CacheID != "":
+		activeCID = req.CacheID
+	default:
+		// We will now attempt to use the cache unless an image model is selected.
+		if cacheName, _ := s.cacheFor(ctx); cacheName != "" && !strings.Contains(req.Model, "image") {
+			activeCID = cacheName
+		}
+	}
+
+	// A request's system prompt can only replace the cache's instruction
+	// by going without the cache, and is otherwise sent along with it
+	var cachedPrompt string
+	if activeCID != "" && req.SystemPrompt != "" {
+		switch s.cfg.SystemPromptPolicy {
+		case config.SystemPromptReplace:
+			lg.Debug("request system prompt replaces the cached one, sending uncached", "cache_id", activeCID)
+			activeCID = ""
+		case config.SystemPromptAppend:
+			cachedPrompt = req.SystemPrompt
+		}
+	}
+
+	// Build config with optional overrides from request
+	if req.Temperature != nil {
+		temperature = *req.Temperature
+	}
+
+	config := &genai.GenerateContentConfig{
+		Temperature:    genai.Ptr[float32](temperature),
+		SafetySettings: s.buildSafetySettings(req.SafetySettings),
+	}
+
+	// Apply cached content if available and not an image model
+	if activeCID != "" {
+		config.CachedContent = activeCID
+		// Note: When using cached content, ALL tools must be defined in the cache
+		// We cannot add any additional tools (including Google Search) dynamically
+		// The cache already includes file tools, so agentic mode will work
+	} else {
+		// No cache - define tools dynamically
+		var tools []*genai.Tool
+		if req.UseSearch {
+			tools = append(tools, &genai.Tool{GoogleSearch: &genai.GoogleSearch{}})
+		}
+
+		if req.UseAgentic {
+			if fileTools := s.fileToolDeclarations(ctx); len(fileTools) > 0 {
+				tools = append(tools, &genai.Tool{FunctionDeclarations: fileTools})
+			}
+		}
+
+		if len(tools) > 0 {
+			config.Tools = tools
+		}
+	}
+
+	if err := applyResponseFormat(req, config); err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	if err := applyGeneration(req, config); err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	if config.ThinkingConfig, err = thinkingConfig(req.ThinkingBudget, req.IncludeThoughts); err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+
+	s.applySystemPrompt(config, req.SystemPrompt)
+	tagUpstream(ctx, config)
+	req.config = config
+	chat, err := s.client.Chats.Create(ctx, req.Model, config, history)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, fmt.Errorf("failed to create chat: %w", err)
+	}
+
+	attachments, turnOnly, err := s.attachmentParts(ctx, req.SessionID, req.Attachments)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+	if (hasAudio(attachments) || hasVideo(attachments)) && !acceptsMedia(req.Model) {
+		return nil, nil, http.StatusBadRequest, fmt.Errorf("model %s does not accept audio or video", req.Model)
+	}
+
+	switch {
+	case req.Message != "":
+	case hasVideo(attachments):
+		req.Message = videoPrompt
+	case hasAudio(attachments):
+		req.Message = audioPrompt
+	default:
+		req.Message = "Hello"
+	}
+
+	lg.Debug("sending message", "model", req.Model, "context_mode", req.ContextMode, "cache_id", activeCID, "history", len(history), "images", len(req.Images), "attachments", len(attachments))
+
+	var messageParts []genai.Part
+	if req.Message != "" {
+		messageParts = append(messageParts, genai.Part{Text: req.Message})
+	}
+	for _, imgData := range req.Images {
+		if strings.HasPrefix(imgData, "data:") {
+			dataParts := strings.Split(imgData, ",")
+			if len(dataParts) == 2 {
+				header, dataStr := dataParts[0], dataParts[1]
+				mimeType := "image/png"
+				if strings.Contains(header, "image/") {
+					mimeParts := strings.Split(header, ";")
+					if len(mimeParts) > 0 {
+						mimeType = strings.TrimPrefix(mimeParts[0], "data:")
+					}
+				}
+				imgBytes, err := base64.StdEncoding.DecodeString(dataStr)
+				if err == nil {
+					imgPart := genai.Part{InlineData: &genai.Blob{MIMEType: mimeType, Data: imgBytes}}
+					messageParts = append(messageParts, imgPart)
+				}
+			}
+		}
+	}
+	messageParts = append(messageParts, attachments...)
+	req.turnOnly = turnOnly
+	if len(messageParts) == 0 {
+		messageParts = []genai.Part{{Text: "Hello"}}
+	}
+	if req.selectionKey != "" {
+		selection, selTurnOnly := s.selectionContext(ctx, req.selectionKey)
+		messageParts = append(selection, messageParts...)
+		if req.turnOnly == nil {
+			req.turnOnly = selTurnOnly
+		} else {
+			maps.Copy(req.turnOnly, selTurnOnly)
+		}
+	}
+	if req.ContextMode == ContextRAG {
+		retrieved, ragTurnOnly, status, err := s.retrievalContext(ctx, req.Message, s.rerankFor(req.Rerank))
+		if err != nil {
+			return nil, nil, status, err
+		}
+		messageParts = append(retrieved, messageParts...)
+		if req.turnOnly == nil {
+			req.turnOnly = ragTurnOnly
+		} else {
+			maps.Copy(req.turnOnly, ragTurnOnly)
+		}
+	}
+	if cachedPrompt != "" {
+		prompt, promptTurnOnly := systemPromptContext(cachedPrompt)
+		messageParts = append(prompt, messageParts...)
+		if req.turnOnly == nil {
+			req.turnOnly = promptTurnOnly
+		} else {
+			maps.Copy(req.turnOnly, promptTurnOnly)
+		}
+	}
+
+	return chat, messageParts, 0, nil
+}
+
+// buildSafetySettings creates safety settings from request or uses configured defaults
+func (s *Server) buildSafetySettings(settings map[string]string) []*genai.SafetySetting {
+	// Helper to convert string threshold to genai constant
+	getThreshold := func(level string) genai.HarmBlockThreshold {
+		switch level {
+		case "BLOCK_NONE":
+			return genai.HarmBlockThresholdBlockNone
+		case "BLOCK_ONLY_HIGH":
+			return genai.HarmBlockThresholdBlockOnlyHigh
+		case "BLOCK_MEDIUM_AND_ABOVE":
+			return genai.HarmBlockThresholdBlockMediumAndAbove
+		case "BLOCK_LOW_AND_ABOVE":
+			return genai.HarmBlockThresholdBlockLowAndAbove
+		default:
+			return genai.HarmBlockThresholdBlockNone // Default to most permissive
+		}
+	}
+
+	// Default: BLOCK_NONE for all categories (for coding assistant use case)
+	harassmentThreshold := genai.HarmBlockThresholdBlockNone
+	hateThreshold := genai.HarmBlockThresholdBlockNone
+	sexualThreshold := genai.HarmBlockThresholdBlockNone
+	dangerousThreshold := genai.HarmBlockThresholdBlockNone
+
+	// Apply configured defaults, then request settings on top
+	merged := make(map[string]string, len(s.cfg.Safety)+len(settings))
+	for k, v := range s.cfg.Safety {
+		merged[k] = v
+	}
+	for k, v := range settings {
+		merged[k] = v
+	}
+	if val, ok := merged["harassment"]; ok {
+		harassmentThreshold = getThreshold(val)
+	}
+	if val, ok := merged["hate"]; ok {
+		hateThreshold = getThreshold(val)
+	}
+	if val, ok := merged["sexual"]; ok {
+		sexualThreshold = getThreshold(val)
+	}
+	if val, ok := merged["dangerous"]; ok {
+		dangerousThreshold = getThreshold(val)
+	}
+
+	return []*genai.SafetySetting{
+		{Category: genai.HarmCategoryHarassment, Threshold: harassmentThreshold},
+		{Category: genai.HarmCategoryHateSpeech, Threshold: hateThreshold},
+		{Category: genai.HarmCategorySexuallyExplicit, Threshold: sexualThreshold},
+		{Category: genai.HarmCategoryDangerousContent, Threshold: dangerousThreshold},
+	}
+}
+
+// applySystemPrompt sets the system instruction on requests that do not
+// use a context cache (cached content carries its own instruction): the
+// configured system prompt, with the request's own, if any, per the system
+// prompt policy.
+func (s *Server) applySystemPrompt(config *genai.GenerateContentConfig, prompt string) {
+	if text := s.systemPrompt(prompt); config.CachedContent == "" && text != "" {
+		config.SystemInstruction = &genai.Content{Parts: []*genai.Part{{Text: text}}, Role: "user"}
+	}
+}
+
+// systemPrompt combines the configured system prompt with a request's own.
+func (s *Server) systemPrompt(prompt string) string {
+	switch {
+	case prompt == "" || s.cfg.SystemPromptPolicy == config.SystemPromptIgnore:
+		return s.cfg.SystemPrompt
+	case s.cfg.SystemPromptPolicy == config.SystemPromptReplace || s.cfg.SystemPrompt == "":
+		return prompt
+	}
+	return s.cfg.SystemPrompt + "\n\n" + prompt
+}
+
+// systemPromptContext returns a request's own system prompt as a turn-only
+// part to send ahead of the message, for cached requests. A request cannot
+// change the instruction cached content carries, so the prompt goes along
+// with it instead.
+func systemPromptContext(prompt string) ([]genai.Part, map[*genai.Blob]string) {
+	blob := &genai.Blob{MIMEType: "text/plain", Data: []byte("Instructions from the client for this conversation, in addition to your system instructions:\n\n" + prompt)}
+	return []genai.Part{{InlineData: blob}}, map[*genai.Blob]string{blob: "client system prompt"}
+}
@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// ChatStreamDone is the last event of /chat/stream: usage, cost and why the
+// model stopped. The text itself has arrived in the delta events.
+type ChatStreamDone struct {
+	ToolCalls      []string      `json:"tool_calls,omitempty"`
+	PromptTokens   int           `json:"prompt_tokens"`
+	ResponseTokens int           `json:"response_tokens"`
+	ThinkingTokens int           `json:"thinking_tokens,omitempty"`
+	TotalTokens    int           `json:"total_tokens"`
+	Grounding      *Grounding    `json:"grounding,omitempty"` // Offsets are into the text of all the deltas
+	HistoryDropped int           `json:"history_dropped,omitempty"`
+	Warnings       []ToolWarning `json:"warnings,omitempty"`
+	EmptyReason    string        `json:"empty_reason,omitempty"`
+	Cost           float64       `json:"cost"`
+	RequestCost    float64       `json:"request_cost_brl"` // Same names as ChatResponse
+	TotalCost      float64       `json:"session_total_brl"`
+	Timings        *Timings      `json:"timings,omitempty"`
+	FinishInfo
+
+	Duplicate *DuplicateAnswer `json:"duplicate,omitempty"` // Set when the deltas are a recent answer to a similar question
+}
+
+// sseWriter emits named Server-Sent Events with JSON payloads to a
+// resumable stream. Text deltas are batched by a coalescer; any other event
+// first sends the pending text.
+type sseWriter struct {
+	out  *resumableStream
+	text *coalescer
+}
+
+func (s *Server) newSSEWriter(out *resumableStream) *sseWriter {
+	e := &sseWriter{out: out}
+	e.text = s.newCoalescer(func(t string) { e.write("delta", map[string]string{"text": t}) })
+	return e
+}
+
+func (e *sseWriter) write(event string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	e.out.publish(event, data)
+}
+
+func (e *sseWriter) send(event string, v any) {
+	e.text.do(func() { e.write(event, v) })
+}
+
+// delta queues generated text for a delta event.
+func (e *sseWriter) delta(text string) {
+	e.text.add(text)
+}
+
+// handleChatStream is the streaming variant of /chat used by the web UI. It
+// takes the same ChatRequest and emits these events:
+//
+//	delta  {"text": "..."}                 generated text as it arrives
+//	image  {"mime_type": "...", "data": ""} generated images
+//	tool   {"name": "...", "args": {...}}  a tool call about to run
+//	usage  {"prompt_tokens": ..., ...}     tokens and cost after each model call
+//	done   ChatStreamDone                  final usage, cost and finish reason
+//	error  {"error": "..."}
+//
+// Each event carries an ID, and the response's X-Stream-ID header names
+// the stream. A client whose connection drops can resume it from
+// GET /chat/stream/<id> with Last-Event-ID; generation is cancelled only
+// when no client has reconnected within the resume grace period.
+func (s *Server) handleChatStream(w http.ResponseWriter, r *http.Request) {
+	lg := s.requestLogger(r.Context())
+	rctx, span := tracer.Start(r.Context(), "chat.stream")
+	defer span.End()
+	ctx, cancel := s.endpointContext(context.WithoutCancel(rctx), config.EndpointWeb)
+	defer cancel()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.selectionKey = settingsKey(r)
+	defaultModel, temperature := s.cfg.Endpoint(config.EndpointWeb)
+	if req.Model == "" {
+		req.Model = defaultModel
+	} else if ok, reason := s.models.allowed(req.Model); !ok && req.Model != defaultModel {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+	if req.SessionID == "" {
+		req.SessionID = "default"
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	start := time.Now()
+	lg.Info("chat stream request", "endpoint", r.URL.Path, "model", req.Model, "session", req.SessionID, "search", req.UseSearch, "agentic", req.UseAgentic, "msg", preview(req.Message, 50))
+
+	if req.CandidateCount != nil && *req.CandidateCount > 1 {
+		http.Error(w, "candidate_count above 1 is not supported when streaming; use /chat", http.StatusBadRequest)
+		return
+	}
+
+	ctx = withSession(ctx, req.SessionID)
+	dup := s.checkDuplicate(ctx, &req)
+	found, score := dup.match()
+	ctx, endTurn := s.beginTurn(ctx, req.SessionID, req.Message)
+	defer endTurn()
+	var chat *genai.Chat
+	var parts []genai.Part
+	if found == nil {
+		var status int
+		var err error
+		if chat, parts, status, err = s.prepareChat(ctx, &req, temperature); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	// Generation runs apart from this connection, so a client that drops
+	// can resume the stream from GET /chat/stream/<id>
+	id := newRequestID()
+	grace := time.Duration(s.cfg.Streaming.ResumeSeconds) * time.Second
+	st := s.streams.open(id, grace, cancel)
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer s.streams.expire(id, grace)
+		defer st.end()
+		events := s.newSSEWriter(st)
+		defer events.text.flush()
+		if found != nil {
+			s.streamDuplicate(ctx, events, &req, found, score)
+			return
+		}
+		s.streamChat(ctx, events, &req, chat, parts, start, dup)
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set(StreamHeader, id)
+	st.serve(r.Context(), w, flusher, 0, time.Duration(s.cfg.Streaming.KeepaliveSeconds)*time.Second)
+	st.detach()
+	<-finished
+}
+
+// streamDuplicate publishes a recent answer to a similar question as the
+// reply to a /chat/stream request.
+func (s *Server) streamDuplicate(ctx context.Context, events *sseWriter, req *ChatRequest, found *answeredQuestion, score float64) {
+	duplicate := s.answerDuplicate(ctx, req, found, score)
+	events.delta(found.answer)
+	totalCost, err := s.sessions(ctx).TotalCost(ctx)
+	if err != nil {
+		s.requestLogger(ctx).Warn("reading total cost", "error", err)
+	}
+	events.send("done", ChatStreamDone{
+		TotalCost:  totalCost,
+		Timings:    timerFrom(ctx).Timings(),
+		FinishInfo: FinishInfo{FinishReason: string(genai.FinishReasonStop)},
+		Duplicate:  duplicate,
+	})
+}
+
+// streamChat runs the model and tool loop of a /chat/stream request,
+// publishing its events. A complete answer joins the duplicate index
+// through dup.
+func (s *Server) streamChat(ctx context.Context, events *sseWriter, req *ChatRequest, chat *genai.Chat, parts []genai.Part, start time.Time, dup *duplicateCheck) {
+	lg := s.requestLogger(ctx)
+	var (
+		text                          responsePreview
+		toolLogs                      []string
+		images                        int
+		requestCost                   float64
+		promptToks, respToks, totalTk int
+		thinkToks                     int
+		last                          *genai.GenerateContentResponse
+		grounding                     *genai.GroundingMetadata
+		dropped, sheds                int
+		warnings                      []ToolWarning
+		retried                       bool
+	)
+	for {
+		var calls []*genai.FunctionCall
+		last = nil
+		shed, answered := false, false
+		for res, err := range s.sendMessageStream(ctx, chat, req.Model, parts...) {
+			// A request too long for the context window fails before
+			// anything streams, and is sent again with less history
+			if err != nil && last == nil && sheds < maxContextRetries && contextTooLong(err) {
+				if next, n := s.shedChat(ctx, chat, req.Model, req.config); next != nil {
+					chat, dropped, shed = next, dropped+n, true
+					sheds++
+					break
+				}
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					// The partial reply is billed; the session is left as it was
+					requestCost += calculateCost(req.Model, last)
+					s.logAbort(ctx, "stream", "cost", requestCost, "bytes", text.total)
+					s.addAbortedCost(ctx, requestCost)
+				} else {
+					lg.Error("chat stream failed", "error", err)
+				}
+				events.send("error", map[string]string{"error": abortError(ctx, err).Error()})
+				return
+			}
+			last = res
+			if md := groundingMetadata(res); md != nil {
+				grounding = md
+			}
+			if t := thoughtText(res); t != "" {
+				events.send("thought", map[string]string{"text": t})
+			}
+			if t := res.Text(); t != "" {
+				text.WriteString(t)
+				events.delta(t)
+				answered = true
+			}
+			if len(res.Candidates) > 0 && res.Candidates[0].Content != nil {
+				for _, part := range res.Candidates[0].Content.Parts {
+					if part.InlineData != nil && part.InlineData.Data != nil {
+						images++
+						answered = true
+						events.send("image", ImageData{MimeType: part.InlineData.MIMEType, Data: base64.StdEncoding.EncodeToString(part.InlineData.Data)})
+					}
+				}
+			}
+			calls = append(calls, res.FunctionCalls()...)
+		}
+		if shed {
+			continue
+		}
+
+		requestCost += calculateCost(req.Model, last)
+		if last != nil && last.UsageMetadata != nil {
+			if promptToks == 0 {
+				promptToks = int(last.UsageMetadata.PromptTokenCount)
+			}
+			respToks += int(last.UsageMetadata.CandidatesTokenCount)
+			totalTk = int(last.UsageMetadata.TotalTokenCount)
+		}
+		thinkToks += thinkingTokens(last)
+		events.send("usage", map[string]any{
+			"prompt_tokens":   promptToks,
+			"response_tokens": respToks,
+			"thinking_tokens": thinkToks,
+			"total_tokens":    totalTk,
+			"cost":            requestCost,
+		})
+
+		// An empty reply is asked again once, if the policy says so;
+		// nothing of it was streamed
+		if len(calls) == 0 && !answered && !retried && (last == nil || last.PromptFeedback == nil || last.PromptFeedback.BlockReason == "") {
+			if next, model := s.retryChat(ctx, chat, req.Model, req.config); next != nil {
+				chat, req.Model, retried = next, model, true
+				continue
+			}
+		}
+		if len(calls) == 0 {
+			break
+		}
+		parts = parts[:0]
+		for _, call := range calls {
+			events.send("tool", map[string]any{"name": call.Name, "args": call.Args})
+			toolLogs = append(toolLogs, fmt.Sprintf("Executed: %s", call.Name))
+			result := s.executeTool(ctx, call.Name, call.Args)
+			if w, failed := toolWarning(call.Name, call.Args, result); failed {
+				warnings = append(warnings, w)
+			}
+			parts = append(parts, genai.Part{FunctionResponse: functionResponse(req.Model, call, result)})
+		}
+		if ctx.Err() != nil {
+			s.logAbort(ctx, "tool loop", "cost", requestCost, "bytes", text.total)
+			s.addAbortedCost(ctx, requestCost)
+			events.send("error", map[string]string{"error": abortError(ctx, ctx.Err()).Error()})
+			return
+		}
+	}
+
+	finish := finishInfo(last)
+	var empty string
+	if strings.TrimSpace(text.String()) == "" && images == 0 {
+		empty = emptyReason(finish, len(toolLogs))
+		if s.warnEmpty(ctx) {
+			warning := emptyWarning(finish, len(toolLogs))
+			text.WriteString(warning)
+			events.delta(warning)
+		}
+	}
+
+	if err := s.sessions(ctx).SetHistory(ctx, req.SessionID, withoutTurnOnly(chat.History(false), req.turnOnly)); err != nil {
+		lg.Error("saving session", "session", req.SessionID, "error", err)
+	}
+	totalCost, err := s.sessions(ctx).AddCost(ctx, requestCost)
+	if err != nil {
+		lg.Error("recording cost", "error", err)
+	}
+
+	timings := timerFrom(ctx).Timings()
+	lg.Info("chat stream complete",
+		"endpoint", "/chat/stream",
+		"model", req.Model,
+		"session", req.SessionID,
+		"prompt_tokens", promptToks,
+		"response_tokens", respToks,
+		"thinking_tokens", thinkToks,
+		"total_tokens", totalTk,
+		"tools", toolLogs,
+		"images", images,
+		"cost", requestCost,
+		"finish_reason", finish.FinishReason,
+		"block_reason", finish.BlockReason,
+		"latency_ms", time.Since(start).Milliseconds(),
+		"timings", timings,
+		"bytes", text.total,
+		"resp", preview(text.String(), 50),
+	)
+	s.writeDebugResponse(ctx, text.String())
+	if finish.FinishReason == string(genai.FinishReasonStop) && empty == "" && len(toolLogs) == 0 && images == 0 && text.total == text.buf.Len() {
+		dup.record(text.String(), req.SessionID)
+	}
+
+	events.send("done", ChatStreamDone{
+		ToolCalls:      toolLogs,
+		PromptTokens:   promptToks,
+		ResponseTokens: respToks,
+		ThinkingTokens: thinkToks,
+		TotalTokens:    totalTk,
+		Grounding:      newGrounding(grounding, text.String()),
+		HistoryDropped: dropped,
+		Warnings:       warnings,
+		EmptyReason:    empty,
+		Cost:           requestCost,
+		RequestCost:    requestCost,
+		TotalCost:      totalCost,
+		Timings:        timings,
+		FinishInfo:     finish,
+	})
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"regexp"
+	"strings"
+
+	"customgemini/config"
+)
+
+// Chunking strategies for the semantic index.
+const (
+	ChunkBySyntax = "syntax" // Split at declarations and headings, then by lines
+	ChunkByLines  = "lines"  // Fixed-size runs of lines only
+)
+
+// definitionLine matches a top-level function, class or type definition in
+// the common languages, when it starts at column 0.
+var definitionLine = regexp.MustCompile(`^(export\s+)?(default\s+)?(pub(\([a-z]+\))?\s+)?(async\s+)?(local\s+)?((def|class|function|func|fn|interface|type|struct|enum|impl|trait|module|object)\b|const\s+\w+\s*=\s*(async\s+)?(\(|function\b))`)
+
+// lineRange is a section of a file, as 0-based line indexes [start, end).
+type lineRange struct{ start, end int }
+
+// chunkFile splits a file into chunks for the index. With the syntax
+// strategy, sections start at Go declarations (found with go/parser), at
+// Markdown headings, or at top-level definitions in other languages, and
+// small neighboring sections are merged up to ChunkLines. Sections longer
+// than that, and files without any, are split into runs of ChunkLines
+// lines overlapping by ChunkOverlap. Each chunk starts with the path and
+// line range, which gives the embedding the file's context.
+func chunkFile(rel, content string, cfg config.IndexConfig) []indexChunk {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	var starts []int
+	if cfg.Chunking == ChunkBySyntax {
+		switch ext := strings.ToLower(path.Ext(rel)); ext {
+		case ".go":
+			starts = goSections(rel, content)
+		case ".md", ".markdown":
+			starts = markdownSections(lines)
+		default:
+			starts = definitionSections(lines)
+		}
+	}
+
+	var chunks []indexChunk
+	for _, r := range mergeSections(sections(starts, len(lines)), cfg.ChunkLines) {
+		for _, w := range lineWindows(r, cfg.ChunkLines, cfg.ChunkOverlap) {
+			body := strings.Join(lines[w.start:w.end], "\n")
+			if strings.TrimSpace(body) == "" {
+				continue
+			}
+			text := fmt.Sprintf("File: %s (lines %d-%d)\n%s", rel, w.start+1, w.end, body)
+			if len(text) > maxChunkChars {
+				text = text[:maxChunkChars]
+			}
+			chunks = append(chunks, indexChunk{StartLine: w.start + 1, EndLine: w.end, Text: text})
+		}
+	}
+	return chunks
+}
+
+// sections turns the lines sections start at into ranges covering all n
+// lines.
+func sections(starts []int, n int) []lineRange {
+	var out []lineRange
+	prev := 0
+	for _, s := range starts {
+		if s > prev && s < n {
+			out = append(out, lineRange{prev, s})
+			prev = s
+		}
+	}
+	return append(out, lineRange{prev, n})
+}
+
+// mergeSections joins neighboring sections while the result stays within
+// size lines, so a file of short functions is not embedded one line at a
+// time.
+func mergeSections(in []lineRange, size int) []lineRange {
+	var out []lineRange
+	for _, r := range in {
+		if n := len(out); n > 0 && r.end-out[n-1].start <= size {
+			out[n-1].end = r.end
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// lineWindows splits r into runs of size lines, each sharing overlap lines
+// with the one before.
+func lineWindows(r lineRange, size, overlap int) []lineRange {
+	if r.end-r.start <= size {
+		return []lineRange{r}
+	}
+	step := max(size-overlap, 1)
+	var out []lineRange
+	for start := r.start; ; start += step {
+		end := min(start+size, r.end)
+		out = append(out, lineRange{start, end})
+		if end == r.end {
+			return out
+		}
+	}
+}
+
+// goSections returns the lines Go top-level declarations start at,
+// including their doc comments. Files that do not parse are split like
+// other code.
+func goSections(rel, content string) []int {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, rel, content, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return definitionSections(strings.Split(content, "\n"))
+	}
+	var starts []int
+	for _, decl := range f.Decls {
+		pos := decl.Pos()
+		if doc := declDoc(decl); doc != nil {
+			pos = doc.Pos()
+		}
+		starts = append(starts, fset.Position(pos).Line-1)
+	}
+	return starts
+}
+
+func declDoc(decl ast.Decl) *ast.CommentGroup {
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		return d.Doc
+	case *ast.GenDecl:
+		return d.Doc
+	}
+	return nil
+}
+
+// markdownSections returns the lines of Markdown headings, ignoring lines
+// inside fenced code blocks.
+func markdownSections(lines []string) []int {
+	var starts []int
+	fenced := false
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			fenced = !fenced
+			continue
+		}
+		level := len(line) - len(strings.TrimLeft(line, "#"))
+		if !fenced && level >= 1 && level <= 6 && (level == len(line) || line[level] == ' ') {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
+
+// definitionSections returns the lines of top-level definitions, moved up
+// over the comments and decorators directly above them.
+func definitionSections(lines []string) []int {
+	var starts []int
+	for i, line := range lines {
+		if !definitionLine.MatchString(line) {
+			continue
+		}
+		start := i
+		for start > 0 && isPreamble(lines[start-1]) {
+			start--
+		}
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// isPreamble reports whether a line is a comment or decorator that belongs
+// to the definition below it.
+func isPreamble(line string) bool {
+	t := strings.TrimSpace(line)
+	for _, p := range []string{"//", "#", "--", "/*", "*", "@"} {
+		if strings.HasPrefix(t, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// compareSession is the session compare usage is recorded under. Its
+// history is never saved.
+const compareSession = "compare"
+
+// maxCompareVariants caps the replies one comparison asks for at once.
+const maxCompareVariants = 6
+
+// CompareVariant is one way of answering a compared message: a model, a
+// system prompt, a temperature, or any mix of them. Unset fields keep the
+// endpoint's defaults.
+type CompareVariant struct {
+	Label        string   `json:"label,omitempty"` // Defaults to the model, or "A", "B", ... when models repeat
+	Model        string   `json:"model,omitempty"`
+	SystemPrompt string   `json:"system_prompt,omitempty"`
+	Temperature  *float32 `json:"temperature,omitempty"`
+}
+
+// CompareRequest is the body of POST /compare. Models is shorthand for
+// one variant per model.
+type CompareRequest struct {
+	Message     string           `json:"message"`
+	Models      []string         `json:"models,omitempty"`
+	Variants    []CompareVariant `json:"variants,omitempty"`
+	ContextMode string           `json:"context_mode,omitempty"`
+}
+
+// CompareResult is one variant's reply, with what it cost and how long it
+// took. A variant that failed has only its error.
+type CompareResult struct {
+	CompareVariant
+	Text           string   `json:"text"`
+	PromptTokens   int      `json:"prompt_tokens"`
+	ResponseTokens int      `json:"response_tokens"`
+	ThinkingTokens int      `json:"thinking_tokens,omitempty"`
+	Cost           float64  `json:"cost"`
+	LatencyMs      int64    `json:"latency_ms"`
+	Timings        *Timings `json:"timings,omitempty"`
+	FinishReason   string   `json:"finish_reason,omitempty"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// CompareResponse is every variant's reply, in the order they were asked
+// for.
+type CompareResponse struct {
+	Results []CompareResult `json:"results"`
+	Cost    float64         `json:"cost"`
+}
+
+func (s *Server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req CompareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := s.Compare(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// Compare asks every variant of req for a reply to its message, all at
+// once and without session history. A variant that fails does not fail
+// the others; the error is the request's own.
+func (s *Server) Compare(ctx context.Context, req CompareRequest) (*CompareResponse, error) {
+	variants := req.Variants
+	for _, m := range req.Models {
+		variants = append(variants, CompareVariant{Model: m})
+	}
+	switch {
+	case req.Message == "":
+		return nil, errors.New("message is required")
+	case len(variants) < 2:
+		return nil, errors.New("compare needs at least two models or variants")
+	case len(variants) > maxCompareVariants:
+		return nil, fmt.Errorf("%d variants; compare takes at most %d", len(variants), maxCompareVariants)
+	}
+	labelVariants(variants)
+
+	s.requestLogger(ctx).Info("compare request", "variants", len(variants), "msg", preview(req.Message, 50))
+	results := make([]CompareResult, len(variants))
+	var wg sync.WaitGroup
+	for i, v := range variants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = s.compareVariant(ctx, req, v)
+		}()
+	}
+	wg.Wait()
+
+	resp := &CompareResponse{Results: results}
+	for _, res := range results {
+		resp.Cost += res.Cost
+	}
+	return resp, nil
+}
+
+// labelVariants names the variants without a label after their model,
+// or by letter when that would not tell them apart.
+func labelVariants(variants []CompareVariant) {
+	models := map[string]int{}
+	for _, v := range variants {
+		models[v.Model]++
+	}
+	for i := range variants {
+		v := &variants[i]
+		switch {
+		case v.Label != "":
+		case v.Model != "" && models[v.Model] == 1:
+			v.Label = v.Model
+		case i < 26:
+			v.Label = string(rune('A' + i))
+		default:
+			v.Label = strconv.Itoa(i + 1)
+		}
+	}
+}
+
+// compareVariant asks one variant for its reply. It is timed on its own,
+// as the variants run side by side.
+func (s *Server) compareVariant(ctx context.Context, req CompareRequest, v CompareVariant) CompareResult {
+	ctx = context.WithValue(ctx, requestTimerKey, &requestTimer{received: time.Now()})
+	chatReq := &ChatRequest{
+		SessionID:    compareSession,
+		Model:        v.Model,
+		Message:      req.Message,
+		SystemPrompt: v.SystemPrompt,
+		Temperature:  v.Temperature,
+		ContextMode:  req.ContextMode,
+		ephemeral:    true,
+	}
+	start := time.Now()
+	resp, _, err := s.runChat(ctx, "/compare", chatReq)
+	v.Model = chatReq.Model
+	res := CompareResult{CompareVariant: v, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.Text = resp.Text
+	res.PromptTokens = resp.PromptTokens
+	res.ResponseTokens = resp.ResponseTokens
+	res.ThinkingTokens = resp.ThinkingTokens
+	res.Cost = resp.Cost
+	res.Timings = resp.Timings
+	res.FinishReason = resp.FinishReason
+	return res
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// maxContextRetries bounds how often a request rejected for exceeding the
+// model's context window is sent again with less history.
+const maxContextRetries = 3
+
+// contextTooLong reports whether err is the API rejecting a request for
+// exceeding the model's context window.
+func contextTooLong(err error) bool {
+	var apiErr genai.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusBadRequest {
+		return false
+	}
+	msg := strings.ToLower(apiErr.Message)
+	return strings.Contains(msg, "context window") ||
+		(strings.Contains(msg, "token") && strings.Contains(msg, "exceeds the maximum"))
+}
+
+// shedHistory drops about the older half of history and returns the rest
+// with the number of contents dropped. The rest starts at a message from
+// the user, so no tool call is parted from its response; dropping all of
+// it is fine unless it ends in a tool call still being answered. It drops
+// nothing when there is no such place to start.
+func shedHistory(history []*genai.Content) ([]*genai.Content, int) {
+	userMessage := func(c *genai.Content) bool {
+		return c != nil && c.Role == genai.RoleUser && !slices.ContainsFunc(c.Parts, func(p *genai.Part) bool {
+			return p != nil && p.FunctionResponse != nil
+		})
+	}
+	canStart := func(i int) bool {
+		if i == len(history) {
+			last := history[i-1]
+			return last == nil || !slices.ContainsFunc(last.Parts, func(p *genai.Part) bool { return p != nil && p.FunctionCall != nil })
+		}
+		return userMessage(history[i])
+	}
+	mid := (len(history) + 1) / 2
+	for i := mid; i > 0 && i <= len(history); i++ {
+		if canStart(i) {
+			return history[i:], i
+		}
+	}
+	for i := mid - 1; i > 0; i-- {
+		if canStart(i) {
+			return history[i:], i
+		}
+	}
+	return history, 0
+}
+
+// shedChat recreates chat with the older half of its history dropped, for
+// a request too long for the context window, and returns it with the
+// number of contents dropped. It returns nil when nothing can be dropped.
+func (s *Server) shedChat(ctx context.Context, chat *genai.Chat, model string, config *genai.GenerateContentConfig) (*genai.Chat, int) {
+	kept, dropped := shedHistory(chat.History(false))
+	if dropped == 0 {
+		return nil, 0
+	}
+	next, err := s.client.Chats.Create(ctx, model, config, kept)
+	if err != nil {
+		return nil, 0
+	}
+	s.requestLogger(ctx).Warn("context window exceeded, dropping history", "model", model, "dropped", dropped, "kept", len(kept))
+	return next, dropped
+}
+
+// sendFitting sends parts on chat as sendMessage does, but when the API
+// rejects the request as too long for the model's context window it drops
+// the older half of the history and sends again, up to maxContextRetries
+// times. It returns the chat to carry on with, which the session is saved
+// from, and the number of history contents dropped.
+func (s *Server) sendFitting(ctx context.Context, chat *genai.Chat, model string, config *genai.GenerateContentConfig, parts ...genai.Part) (*genai.GenerateContentResponse, *genai.Chat, int, error) {
+	dropped := 0
+	for attempt := 0; ; attempt++ {
+		res, err := s.sendMessage(ctx, chat, model, parts...)
+		if err == nil || attempt == maxContextRetries || !contextTooLong(err) {
+			return res, chat, dropped, err
+		}
+		next, n := s.shedChat(ctx, chat, model, config)
+		if next == nil {
+			return res, chat, dropped, err
+		}
+		chat, dropped = next, dropped+n
+	}
+}
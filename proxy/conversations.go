@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// conversationsIndex names the index of past chat sessions.
+const conversationsIndex = "conversations"
+
+var errNoConversations = errors.New("no conversations have been indexed yet")
+
+// ConversationHit is an exchange of a past session matching a search.
+type ConversationHit struct {
+	Session   string    `json:"session"`
+	StartTurn int       `json:"start_turn"` // 1-based, as in the session's transcript
+	EndTurn   int       `json:"end_turn"`
+	Updated   time.Time `json:"updated"` // When the session was last updated
+	Score     float64   `json:"score"`
+	Text      string    `json:"text"`
+}
+
+// conversationChunks splits a session into exchanges: each user message
+// with the model's replies up to the next one. Tool calls, tool results
+// and thoughts are left out, so an exchange reads as the conversation did.
+// The header names the session by its title and the day it started, which
+// do not change as it grows, so earlier exchanges keep their embeddings.
+func conversationChunks(info SessionInfo, history []*genai.Content) []indexChunk {
+	header := fmt.Sprintf("Conversation %q, started %s\n", info.Title, info.Created.Format(time.DateOnly))
+	var chunks []indexChunk
+	var b strings.Builder
+	start := 0
+	flush := func(end int) {
+		if b.Len() > 0 {
+			text := header + b.String()
+			if len(text) > maxChunkChars {
+				text = text[:maxChunkChars]
+			}
+			chunks = append(chunks, indexChunk{StartLine: start + 1, EndLine: end, Text: text})
+		}
+		b.Reset()
+	}
+	for i, c := range history {
+		if c == nil {
+			continue
+		}
+		text := contentText(c)
+		if text == "" {
+			continue
+		}
+		if c.Role == genai.RoleUser {
+			flush(i)
+			start = i
+			fmt.Fprintf(&b, "User: %s\n", text)
+		} else if b.Len() > 0 {
+			fmt.Fprintf(&b, "Assistant: %s\n", text)
+		}
+	}
+	flush(len(history))
+	return chunks
+}
+
+// contentText joins the text parts of a turn, without thoughts.
+func contentText(c *genai.Content) string {
+	var text []string
+	for _, p := range c.Parts {
+		if p != nil && !p.Thought && p.Text != "" {
+			text = append(text, p.Text)
+		}
+	}
+	return strings.TrimSpace(strings.Join(text, ""))
+}
+
+// updateConversationIndex brings the index of past conversations in line
+// with the session store. Sessions that have not been updated since they
+// were indexed are skipped, and exchanges already embedded keep their
+// vectors, so only new exchanges are embedded. Sessions no longer in the
+// store are dropped. If an update is already running, this returns at
+// once and searches use the index as it is.
+func (s *Server) updateConversationIndex(ctx context.Context) error {
+	ix := s.conversations
+	ix.mu.Lock()
+	if ix.building {
+		ix.mu.Unlock()
+		return nil
+	}
+	ix.building = true
+	old := ix.data.Files
+	ix.mu.Unlock()
+	defer func() {
+		ix.mu.Lock()
+		ix.building = false
+		ix.mu.Unlock()
+	}()
+
+	list, err := s.store.ListSessions(ctx)
+	if err != nil {
+		return err
+	}
+	files := map[string]indexedFile{}
+	var pending []*indexChunk
+	changed := len(list) != len(old)
+	for _, info := range list {
+		prev, known := old[info.ID]
+		if known && prev.ModTime.Equal(info.Updated) && prev.Size == int64(info.Messages) {
+			files[info.ID] = prev
+			continue
+		}
+		changed = true
+		history, err := s.store.History(ctx, info.ID)
+		if err != nil {
+			return fmt.Errorf("reading session %s: %w", info.ID, err)
+		}
+		vectors := map[string][]float32{}
+		for _, c := range prev.Chunks {
+			vectors[c.Text] = c.Vector
+		}
+		f := indexedFile{ModTime: info.Updated, Size: int64(info.Messages), Chunks: conversationChunks(info, history)}
+		for i := range f.Chunks {
+			if v, ok := vectors[f.Chunks[i].Text]; ok {
+				f.Chunks[i].Vector = v
+			} else {
+				pending = append(pending, &f.Chunks[i])
+			}
+		}
+		files[info.ID] = f
+	}
+	if !changed {
+		return nil
+	}
+
+	texts := make([]string, len(pending))
+	for i, c := range pending {
+		texts[i] = c.Text
+	}
+	vectors, err := s.embed(ctx, texts, "RETRIEVAL_DOCUMENT")
+	if err != nil {
+		return fmt.Errorf("embedding %d exchanges: %w", len(texts), err)
+	}
+	for i, c := range pending {
+		c.Vector = vectors[i]
+	}
+
+	ix.mu.Lock()
+	ix.data.Files = files
+	ix.data.Built = time.Now().UTC()
+	ix.mu.Unlock()
+	if err := ix.save(); err != nil {
+		return fmt.Errorf("saving the conversation index: %w", err)
+	}
+	s.requestLogger(ctx).Debug("conversation index updated", "sessions", len(files), "embedded", len(pending))
+	return nil
+}
+
+// SearchConversations returns the k exchanges of past sessions closest in
+// meaning to query, after bringing the index up to date. If the update
+// fails, the index is searched as it was.
+func (s *Server) SearchConversations(ctx context.Context, query string, k int) ([]ConversationHit, error) {
+	if err := s.updateConversationIndex(ctx); err != nil {
+		s.requestLogger(ctx).Warn("updating conversation index", "error", err)
+	}
+	if s.conversations.status().Chunks == 0 {
+		return nil, errNoConversations
+	}
+	hits, err := s.searchIndexes(ctx, query, k, []*vectorIndex{s.conversations})
+	if err != nil {
+		return nil, err
+	}
+	s.conversations.mu.RLock()
+	defer s.conversations.mu.RUnlock()
+	out := make([]ConversationHit, len(hits))
+	for i, h := range hits {
+		out[i] = ConversationHit{
+			Session:   h.Path,
+			StartTurn: h.StartLine,
+			EndTurn:   h.EndLine,
+			Updated:   s.conversations.data.Files[h.Path].ModTime,
+			Score:     h.Score,
+			Text:      h.Text,
+		}
+	}
+	return out, nil
+}
+
+func (s *Server) toolSearchConversations(ctx context.Context, query string, k int) map[string]any {
+	hits, err := s.SearchConversations(ctx, query, searchHits(k))
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	return map[string]any{"query": query, "results": hits}
+}
+
+// handleConversationSearch searches past chat sessions.
+//
+//	GET /index/conversations?q=...&k=8
+func (s *Server) handleConversationSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.conversations == nil {
+		http.Error(w, "Conversation search is disabled; enable it with -index-conversations", http.StatusNotFound)
+		return
+	}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	k := 0
+	if v := r.URL.Query().Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "k must be a positive number", http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+	hits, err := s.SearchConversations(r.Context(), q, searchHits(k))
+	if errors.Is(err, errNoConversations) {
+		http.Error(w, "No conversations have been indexed yet", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Searching conversations: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"query": q, "results": hits})
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"customgemini/config"
+)
+
+// CorpusProgress reports a corpus build after each file is added.
+type CorpusProgress struct {
+	Files int    // Files written so far
+	Bytes int64  // Bytes written so far, headers included
+	Path  string // File just added
+}
+
+// copyBufs recycles the buffers files are streamed through.
+var copyBufs = sync.Pool{New: func() any { b := make([]byte, 32*1024); return &b }}
+
+// corpusWriter counts what is streamed to w so the build can stop at
+// MaxTotalChars without holding a second copy of the corpus.
+type corpusWriter struct {
+	w     io.Writer
+	n     int64
+	files int
+}
+
+func (c *corpusWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// addFile streams one file into the corpus under a header. Files whose
+// first 1KB contains a NUL byte are treated as binary and skipped.
+func (c *corpusWriter) addFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bufp := copyBufs.Get().(*[]byte)
+	defer copyBufs.Put(bufp)
+	buf := *bufp
+
+	head, err := io.ReadFull(f, buf[:1024])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if bytes.IndexByte(buf[:head], 0) >= 0 {
+		return nil
+	}
+
+	if _, err := fmt.Fprintf(c, "\n\n--- FILE: %s ---\n", path); err != nil {
+		return err
+	}
+	if _, err := c.Write(buf[:head]); err != nil {
+		return err
+	}
+	// Hiding the file's WriteTo makes CopyBuffer use buf, where it would
+	// otherwise allocate a buffer of its own for every file
+	if _, err := io.CopyBuffer(c, struct{ io.Reader }{f}, buf); err != nil {
+		return err
+	}
+	c.files++
+	return nil
+}
+
+// WriteCorpus streams the project history and every file selected by the
+// corpus filter to w, stopping once MaxTotalChars is exceeded. progress, if
+// not nil, is called after each file. It returns the final totals.
+func (s *Server) WriteCorpus(w io.Writer, progress func(CorpusProgress)) (CorpusProgress, error) {
+	c := &corpusWriter{w: w}
+
+	// Ingest history relative to project root
+	historyPath := filepath.Join(s.projectRoot, HistoryPath)
+	if hist, err := os.Open(historyPath); err == nil {
+		io.WriteString(c, "\n=== PROJECT HISTORY LOG ===\n")
+		_, err = io.Copy(c, hist)
+		hist.Close()
+		if err != nil {
+			return CorpusProgress{Bytes: c.n}, err
+		}
+	}
+
+	filter := s.cfg.Corpus.Filter()
+	err := filepath.WalkDir(s.projectRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.projectRoot, p)
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if rel != "." && !corpusDir(filter, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !corpusFile(filter, rel, 0) {
+			return nil
+		}
+		if c.n > MaxTotalChars {
+			return filepath.SkipAll
+		}
+		info, err := d.Info()
+		if err == nil && !corpusFile(filter, rel, info.Size()) {
+			// Skip files that are too large (minified bundles, large data)
+			return nil
+		}
+
+		files := c.files
+		if err := c.addFile(p); err != nil {
+			// Unreadable files are skipped
+			return nil
+		}
+		if progress != nil && c.files > files {
+			progress(CorpusProgress{Files: c.files, Bytes: c.n, Path: rel})
+		}
+		return nil
+	})
+	return CorpusProgress{Files: c.files, Bytes: c.n}, err
+}
+
+// corpusDir reports whether the corpus walk descends into the directory rel.
+func corpusDir(filter config.CorpusFilter, rel string) bool {
+	name := path.Base(rel)
+	return !filter.SkipDir(name) && !filter.IsBackup(name) && !filter.Excluded(rel)
+}
+
+// corpusFile reports whether the file rel, of the given size, is selected
+// for the corpus. Its directories are not checked.
+func corpusFile(filter config.CorpusFilter, rel string, size int64) bool {
+	return !filter.IsBackup(path.Base(rel)) && filter.Included(rel) && size <= MaxFileBytes
+}
+
+// inCorpus reports whether rel, a file or directory relative to the
+// project root, is selected for the corpus, checking every parent
+// directory. The binary check and total size cap are not applied.
+func inCorpus(filter config.CorpusFilter, rel string, dir bool, size int64) bool {
+	parts := strings.Split(rel, "/")
+	for i := range parts[:len(parts)-1] {
+		if !corpusDir(filter, strings.Join(parts[:i+1], "/")) {
+			return false
+		}
+	}
+	if dir {
+		return corpusDir(filter, rel)
+	}
+	return corpusFile(filter, rel, size)
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"customgemini/config"
+)
+
+// BenchmarkWriteCorpus builds the corpus of a generated project of 400
+// files. Files are streamed through pooled buffers, so the allocations per
+// build stay small and do not grow with the size of the files.
+func BenchmarkWriteCorpus(b *testing.B) {
+	root := b.TempDir()
+	line := strings.Repeat("x", 79) + "\n"
+	for d := range 20 {
+		dir := filepath.Join(root, fmt.Sprintf("pkg%02d", d))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			b.Fatal(err)
+		}
+		for f := range 20 {
+			// 1KB to 16KB, 3.4MB in all, under MaxTotalChars
+			content := "package main\n" + strings.Repeat(line, 10*(f+1))
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%02d.go", f)), []byte(content), 0o644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	s := &Server{cfg: config.Default(), projectRoot: root}
+	total, err := s.WriteCorpus(io.Discard, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if total.Files != 400 {
+		b.Fatalf("corpus has %d files, want 400", total.Files)
+	}
+	b.SetBytes(total.Bytes)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := s.WriteCorpus(io.Discard, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
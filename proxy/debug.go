@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxRequestDumpBytes caps the body a request dump keeps.
+const maxRequestDumpBytes = 1 << 20
+
+// DebugSwitches are the debug aids, each turned on and off on a running
+// server through /debug/config. -debug starts with all of them on.
+type DebugSwitches struct {
+	DumpRequests     bool `json:"dump_requests"`     // Client request bodies to logs/debug/requests
+	DumpResponses    bool `json:"dump_responses"`    // Final responses to logs/debug
+	LogToolArgs      bool `json:"log_tool_args"`     // Each tool call's arguments in the log
+	UpstreamPayloads bool `json:"upstream_payloads"` // Gemini API exchanges to logs/captures
+}
+
+// debugSwitches holds the DebugSwitches in effect.
+type debugSwitches struct {
+	dumpRequests     atomic.Bool
+	dumpResponses    atomic.Bool
+	logToolArgs      atomic.Bool
+	upstreamPayloads atomic.Bool
+}
+
+func (d *debugSwitches) snapshot() DebugSwitches {
+	return DebugSwitches{
+		DumpRequests:     d.dumpRequests.Load(),
+		DumpResponses:    d.dumpResponses.Load(),
+		LogToolArgs:      d.logToolArgs.Load(),
+		UpstreamPayloads: d.upstreamPayloads.Load(),
+	}
+}
+
+func (d *debugSwitches) setAll(on bool) {
+	d.dumpRequests.Store(on)
+	d.dumpResponses.Store(on)
+	d.logToolArgs.Store(on)
+	d.upstreamPayloads.Store(on)
+}
+
+// any reports whether some debug aid is on.
+func (d *debugSwitches) any() bool {
+	sw := d.snapshot()
+	return sw.DumpRequests || sw.DumpResponses || sw.LogToolArgs || sw.UpstreamPayloads
+}
+
+// handleDebugConfig reports (GET) or changes (POST) the debug switches. A
+// POST sets the switches its body names and leaves the others as they are.
+func (s *Server) handleDebugConfig(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			DumpRequests     *bool `json:"dump_requests"`
+			DumpResponses    *bool `json:"dump_responses"`
+			LogToolArgs      *bool `json:"log_tool_args"`
+			UpstreamPayloads *bool `json:"upstream_payloads"`
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, sw := range []struct {
+			v  *bool
+			to *atomic.Bool
+		}{
+			{req.DumpRequests, &s.debug.dumpRequests},
+			{req.DumpResponses, &s.debug.dumpResponses},
+			{req.LogToolArgs, &s.debug.logToolArgs},
+			{req.UpstreamPayloads, &s.debug.upstreamPayloads},
+		} {
+			if sw.v != nil {
+				sw.to.Store(*sw.v)
+			}
+		}
+		sw := s.debug.snapshot()
+		s.requestLogger(r.Context()).Info("debug switches changed",
+			"dump_requests", sw.DumpRequests,
+			"dump_responses", sw.DumpResponses,
+			"log_tool_args", sw.LogToolArgs,
+			"upstream_payloads", sw.UpstreamPayloads,
+		)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"switches":     s.debug.snapshot(),
+		"dumps_dir":    s.debugDir(),
+		"captures_dir": s.capturesDir(),
+	})
+}
+
+func (s *Server) debugDir() string {
+	return filepath.Join(s.home, "logs", "debug")
+}
+
+// withRequestDump saves the body of each request that has one, with its
+// request line and content type, to logs/debug/requests while the
+// dump_requests switch is on. Bodies are cut at maxRequestDumpBytes and
+// file uploads are left out; the handler still reads the whole body.
+func (s *Server) withRequestDump(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.debug.dumpRequests.Load() || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "%s %s %s\nContent-Type: %s\n\n", r.Method, redactedURI(r), r.Proto, r.Header.Get("Content-Type"))
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); strings.HasPrefix(mt, "multipart/") {
+			b.WriteString("(multipart body not dumped)\n")
+		} else {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestDumpBytes+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			if err != nil {
+				fmt.Fprintf(&b, "(reading body: %v)\n", err)
+			}
+			if len(body) > maxRequestDumpBytes {
+				body = append(body[:maxRequestDumpBytes], "\n... (truncated)"...)
+			}
+			b.Write(body)
+		}
+		s.writeDebugDump(r.Context(), filepath.Join(s.debugDir(), "requests"), b.Bytes())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeDebugDump saves a dump named after the time and the request ID in
+// dir, keeping only the newest s.cfg.DebugDumpLimit dumps there.
+func (s *Server) writeDebugDump(ctx context.Context, dir string, content []byte) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		s.requestLogger(ctx).Warn("creating debug dump dir", "error", err)
+		return
+	}
+	name := fmt.Sprintf("%s_%s.txt", time.Now().Format("20060102-150405.000"), requestIDFrom(ctx))
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+		s.requestLogger(ctx).Warn("writing debug dump", "error", err)
+		return
+	}
+	pruneDebugDumps(dir, "*.txt", s.cfg.DebugDumpLimit)
+}
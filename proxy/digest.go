@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"customgemini/config"
+)
+
+// digestSession is the session repo_digest usage is recorded under. Its
+// history is never saved.
+const digestSession = "digest"
+
+const (
+	maxDigestCommits   = 200
+	maxDigestDiffBytes = 256 << 10 // Of the diff sent to the model
+	digestFirstWindow  = 24 * time.Hour
+)
+
+// emptyTree is git's empty tree, the base a digest diffs a root commit
+// against.
+const emptyTree = "4b825dc642cb6eb9a060e54bf8d69288fbee4904"
+
+// RepoDigestMessage is the JSON a repo_digest job POSTs to its webhook.
+// Text is the summary in Markdown, so Slack incoming webhooks take the
+// message as it is.
+type RepoDigestMessage struct {
+	Job     string    `json:"job"`
+	Text    string    `json:"text"`
+	Since   time.Time `json:"since"`
+	From    string    `json:"from,omitempty"` // The commit of the previous digest
+	To      string    `json:"to"`
+	Commits int       `json:"commits"`
+	Model   string    `json:"model"`
+	Cost    float64   `json:"cost"`
+}
+
+// digestState is where a repo_digest job left off, kept under the server
+// home so restarts pick up from there.
+type digestState struct {
+	Commit string    `json:"commit"`
+	Time   time.Time `json:"time"`
+}
+
+func (s *Server) digestStatePath(job string) string {
+	return filepath.Join(s.home, "digests", job+".json")
+}
+
+// sendRepoDigest summarizes the project's commits since the job's last
+// digest and sends the summary to its webhook and mail recipients. The
+// first digest covers the last day. The model writes it with the context
+// cache, so it can say what the changes mean for the rest of the code.
+// When nothing could be sent, the next run covers the same commits.
+func (s *Server) sendRepoDigest(ctx context.Context, cfg config.JobConfig) (string, error) {
+	dir := s.projectRoot
+	head, err := git(ctx, dir, "rev-parse", "--verify", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("the project is not a git repository with commits: %w", err)
+	}
+	var state digestState
+	if data, err := os.ReadFile(s.digestStatePath(cfg.Name)); err == nil {
+		json.Unmarshal(data, &state)
+	}
+	now := time.Now().UTC()
+	since := state.Time
+	if since.IsZero() {
+		since = now.Add(-digestFirstWindow)
+	}
+	if state.Commit == head {
+		return "no commits since " + short(head), nil
+	}
+
+	// The last digest's commit may be gone after a rebase or force push;
+	// then the digest covers what was committed since it ran
+	args := []string{"log", "--no-merges", fmt.Sprintf("--max-count=%d", maxDigestCommits), "--format=%H%x09%h %an %ad%x09%s", "--date=short"}
+	from := ""
+	if state.Commit != "" {
+		if _, err := git(ctx, dir, "cat-file", "-e", state.Commit+"^{commit}"); err == nil {
+			from = state.Commit
+		}
+	}
+	base := from
+	if from != "" {
+		args = append(args, from+"..HEAD")
+	} else {
+		args = append(args, "--since="+since.Format(time.RFC3339), "HEAD")
+	}
+	out, err := git(ctx, dir, args...)
+	if err != nil {
+		return "", err
+	}
+	var commits []string
+	oldest := ""
+	for _, line := range strings.Split(out, "\n") {
+		hash, rest, ok := strings.Cut(line, "\t")
+		if !ok {
+			continue
+		}
+		commits = append(commits, strings.Replace(rest, "\t", " ", 1))
+		oldest = hash
+	}
+	if len(commits) == 0 {
+		s.saveDigestState(cfg.Name, digestState{Commit: head, Time: now})
+		return "no commits since " + since.Format(time.RFC3339), nil
+	}
+	if base == "" {
+		base = emptyTree
+		if parent, err := git(ctx, dir, "rev-parse", "--verify", "--quiet", oldest+"^"); err == nil {
+			base = parent
+		}
+	}
+	stat, err := git(ctx, dir, "diff", "--stat", base, head)
+	if err != nil {
+		return "", err
+	}
+	diff, err := git(ctx, dir, "diff", base, head)
+	if err != nil {
+		return "", err
+	}
+	if len(diff) > maxDigestDiffBytes {
+		diff = diff[:maxDigestDiffBytes] + "\n... (truncated)"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Write a digest of what changed in this repository since %s for the team that works on it. Open with two or three sentences on the gist, then group the changes by theme, not by commit, citing the short commit hashes. Say what the changes mean for the rest of the code where the project's context shows it, and point out anything risky or unfinished. Use Markdown; keep it short enough to read in a minute.\n\n",
+		since.Format("2006-01-02 15:04 UTC"))
+	writeFenced(&b, fmt.Sprintf("The %d commits, newest first:", len(commits)), "", strings.Join(commits, "\n"))
+	writeFenced(&b, "Files changed:", "", stat)
+	writeFenced(&b, "The diff:", "diff", diff)
+
+	ctx = context.WithValue(ctx, requestIDKey, newRequestID())
+	ctx = context.WithValue(ctx, requestTimerKey, &requestTimer{received: time.Now()})
+	if err := s.checkBudget(ctx); err != nil {
+		return "", err
+	}
+	req := &ChatRequest{SessionID: digestSession, Message: b.String(), ephemeral: true}
+	resp, _, err := s.runChat(ctx, "/jobs/"+cfg.Name, req)
+	if err != nil {
+		return "", err
+	}
+
+	msg := RepoDigestMessage{Job: cfg.Name, Text: resp.Text, Since: since, From: from, To: head, Commits: len(commits), Model: req.Model, Cost: resp.Cost}
+	var sent []string
+	var errs []error
+	if cfg.Webhook != "" {
+		body, err := json.Marshal(msg)
+		if err == nil {
+			err = postJSON(ctx, cfg.Webhook, body, "")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		} else {
+			sent = append(sent, "webhook")
+		}
+	}
+	if len(cfg.Email) > 0 {
+		subject := fmt.Sprintf("%s: %d commits since %s", filepath.Base(dir), len(commits), since.Format("2006-01-02"))
+		if err := s.sendMail(cfg.Email, subject, resp.Text+"\n"); err != nil {
+			errs = append(errs, fmt.Errorf("email: %w", err))
+		} else {
+			sent = append(sent, "email")
+		}
+	}
+	result := fmt.Sprintf("%d commits up to %s", len(commits), short(head))
+	if len(sent) > 0 {
+		s.saveDigestState(cfg.Name, digestState{Commit: head, Time: now})
+		result += ", sent by " + strings.Join(sent, " and ")
+	}
+	return result, errors.Join(errs...)
+}
+
+func (s *Server) saveDigestState(job string, state digestState) {
+	path := s.digestStatePath(job)
+	data, _ := json.Marshal(state)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err == nil {
+		err = os.WriteFile(path, data, 0o644)
+	}
+	if err != nil {
+		s.logger.Warn("saving digest state", "job", job, "error", err)
+	}
+}
+
+// git runs a git command in dir and returns its trimmed output. A failure
+// carries what git printed to stderr.
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// short abbreviates a commit hash.
+func short(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
+	}
+	return hash
+}
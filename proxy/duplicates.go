@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// DuplicateAnswer marks a reply as the answer to an earlier question close
+// in meaning, given again instead of asking the model. Sending the
+// question with fresh set gets a new answer.
+type DuplicateAnswer struct {
+	Question   string    `json:"question"`
+	Session    string    `json:"session"`
+	AnsweredAt time.Time `json:"answered_at"`
+	Similarity float64   `json:"similarity"`
+}
+
+type answeredQuestion struct {
+	scope    string
+	question string
+	vector   []float32
+	answer   string
+	session  string
+	at       time.Time
+}
+
+// answerIndex holds the recent answers to questions that may be asked
+// again, in the order they were answered. It is kept in memory, so each
+// replica has its own.
+type answerIndex struct {
+	cfg     config.DuplicatesConfig
+	mu      sync.Mutex
+	answers []answeredQuestion
+}
+
+func newAnswerIndex(cfg config.DuplicatesConfig) *answerIndex {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &answerIndex{cfg: cfg}
+}
+
+// duplicateCheck is a question that can be answered from, and then join,
+// the answer index. A nil check does nothing.
+type duplicateCheck struct {
+	ix       *answerIndex
+	scope    string // What the answer depends on besides the question
+	question string
+	vector   []float32
+}
+
+// checkDuplicate embeds the question of req if a recent answer to it could
+// stand in for a new one. That is when it opens its session, without
+// attachments, tools, search, a selection, a system prompt, an output
+// format or generation settings that could change the answer, and
+// req.Fresh is unset. An embedding error only skips the check.
+func (s *Server) checkDuplicate(ctx context.Context, req *ChatRequest) *duplicateCheck {
+	if s.answers == nil || req.Fresh || req.ephemeral || strings.TrimSpace(req.Message) == "" ||
+		req.UseAgentic || req.UseSearch || len(req.Images) > 0 || len(req.Attachments) > 0 ||
+		req.SystemPrompt != "" || len(req.ResponseSchema) > 0 || req.ResponseMIMEType != "" ||
+		generationOverridden(req) || !validContextMode(req.ContextMode) {
+		return nil
+	}
+	lg := s.requestLogger(ctx)
+	if history, err := s.sessions(ctx).History(ctx, req.SessionID); err != nil || len(history) > 0 {
+		return nil
+	}
+	if req.selectionKey != "" {
+		if sel, err := s.store.Selection(ctx, req.selectionKey); err != nil || sel != nil {
+			return nil
+		}
+	}
+	cache := req.CacheID
+	if cache == "" && (req.ContextMode == "" || req.ContextMode == ContextCache) {
+		cache, _ = s.cacheFor(ctx)
+	}
+	vectors, err := s.embed(ctx, []string{req.Message}, "SEMANTIC_SIMILARITY")
+	if err != nil {
+		lg.Warn("embedding question for duplicate check", "error", err)
+		return nil
+	}
+	scope := strings.Join([]string{workspaceName(ctx), req.Model, req.ContextMode, cache}, "\x00")
+	return &duplicateCheck{ix: s.answers, scope: scope, question: req.Message, vector: vectors[0]}
+}
+
+// generationOverridden reports whether req sets any generation setting.
+// A stop sequence or token limit cuts an answer short while it still ends
+// with STOP, thoughts are only in answers that asked for them, and
+// sampling and safety settings change what the model says, so such
+// answers are neither reused nor recorded.
+func generationOverridden(req *ChatRequest) bool {
+	return req.Temperature != nil || req.TopP != nil || req.TopK != nil || req.Seed != nil ||
+		req.MaxOutputTokens != nil || len(req.StopSequences) > 0 || (req.CandidateCount != nil && *req.CandidateCount > 1) ||
+		req.ThinkingBudget != nil || req.IncludeThoughts || len(req.SafetySettings) > 0
+}
+
+// match returns the closest recent answer to the question that is close
+// enough to stand in for it, or nil.
+func (c *duplicateCheck) match() (*answeredQuestion, float64) {
+	if c == nil {
+		return nil, 0
+	}
+	ix := c.ix
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	cutoff := time.Now().Add(-time.Duration(ix.cfg.MaxAgeMinutes) * time.Minute)
+	for len(ix.answers) > 0 && ix.answers[0].at.Before(cutoff) {
+		ix.answers = ix.answers[1:]
+	}
+	var best *answeredQuestion
+	bestScore := ix.cfg.Similarity
+	for i := range ix.answers {
+		a := &ix.answers[i]
+		if a.scope != c.scope {
+			continue
+		}
+		if score := dot(a.vector, c.vector); score >= bestScore {
+			best, bestScore = a, score
+		}
+	}
+	if best == nil {
+		return nil, 0
+	}
+	found := *best
+	return &found, bestScore
+}
+
+// record adds the answer to the question to the index.
+func (c *duplicateCheck) record(answer, session string) {
+	if c == nil {
+		return
+	}
+	ix := c.ix
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.answers = append(ix.answers, answeredQuestion{
+		scope:    c.scope,
+		question: c.question,
+		vector:   c.vector,
+		answer:   answer,
+		session:  session,
+		at:       time.Now(),
+	})
+	if n := len(ix.answers) - ix.cfg.MaxEntries; n > 0 {
+		ix.answers = ix.answers[n:]
+	}
+}
+
+// answerDuplicate saves a recent answer as the reply to req's question in
+// its session, as if the model had given it, and describes it.
+func (s *Server) answerDuplicate(ctx context.Context, req *ChatRequest, found *answeredQuestion, score float64) *DuplicateAnswer {
+	history := []*genai.Content{
+		genai.NewContentFromText(req.Message, genai.RoleUser),
+		genai.NewContentFromText(found.answer, genai.RoleModel),
+	}
+	if err := s.sessions(ctx).SetHistory(ctx, req.SessionID, history); err != nil {
+		s.requestLogger(ctx).Error("saving session", "session", req.SessionID, "error", err)
+	}
+	s.requestLogger(ctx).Info("answered as a duplicate",
+		"session", req.SessionID,
+		"model", req.Model,
+		"similarity", score,
+		"original_session", found.session,
+		"original", preview(found.question, 50),
+	)
+	return &DuplicateAnswer{Question: found.question, Session: found.session, AnsweredAt: found.at.UTC(), Similarity: score}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// Reasons a reply was empty, besides a finish reason other than STOP,
+// which is reported in lower case (max_tokens, safety, ...)
+const (
+	emptyPromptBlocked = "prompt_blocked" // The prompt was blocked before any reply
+	emptyAfterTools    = "no_summary"     // Tools ran, then the model said nothing
+	emptyNoContent     = "no_content"     // Nothing explains it
+)
+
+// emptyReason says why a reply came back without text or images, given
+// how the model finished and how many tools it ran first.
+func emptyReason(finish FinishInfo, tools int) string {
+	switch {
+	case finish.BlockReason != "":
+		return emptyPromptBlocked
+	case finish.FinishReason != "" && finish.FinishReason != string(genai.FinishReasonStop):
+		return strings.ToLower(finish.FinishReason)
+	case tools > 0:
+		return emptyAfterTools
+	}
+	return emptyNoContent
+}
+
+// warnEmpty reports whether empty replies on the request's endpoint get
+// a warning in place of their text.
+func (s *Server) warnEmpty(ctx context.Context) bool {
+	return s.cfg.EmptyReplyPolicy(endpointFrom(ctx)) == config.EmptyReplyWarn
+}
+
+// emptyWarning is the text the warn policy puts in place of an empty
+// reply.
+func emptyWarning(finish FinishInfo, tools int) string {
+	if tools > 0 {
+		return fmt.Sprintf("[Executed %d tool(s) but model provided no summary.]", tools)
+	}
+	if w := finish.Warning(); w != "" {
+		return w
+	}
+	return emptyReplyWarning
+}
+
+// emptyResponse reports whether res has nothing to show: no text, tool
+// calls or images. A blocked prompt counts as answered, since asking
+// again gets it blocked again.
+func emptyResponse(res *genai.GenerateContentResponse) bool {
+	if res == nil || (res.PromptFeedback != nil && res.PromptFeedback.BlockReason != "") {
+		return false
+	}
+	if len(res.Candidates) == 0 || res.Candidates[0].Content == nil {
+		return true
+	}
+	for _, p := range res.Candidates[0].Content.Parts {
+		if p != nil && ((p.Text != "" && !p.Thought) || p.FunctionCall != nil || p.InlineData != nil) {
+			return false
+		}
+	}
+	return true
+}
+
+// retryChat returns a chat to ask again on after an empty reply, under the
+// retry and fallback policies: chat without its last exchange, on the
+// fallback model for fallback, with the model it is on. The fallback
+// model is asked without the context cache, which belongs to the first
+// model, so cfg is changed to leave it out of the rest of the request. It
+// returns nil when the policy does not ask again.
+func (s *Server) retryChat(ctx context.Context, chat *genai.Chat, model string, cfg *genai.GenerateContentConfig) (*genai.Chat, string) {
+	policy := s.cfg.EmptyReplyPolicy(endpointFrom(ctx))
+	if policy != config.EmptyReplyRetry && policy != config.EmptyReplyFallback {
+		return nil, ""
+	}
+	history := chat.History(false)
+	if len(history) < 2 {
+		return nil, ""
+	}
+	if policy == config.EmptyReplyFallback {
+		model = s.cfg.EmptyReply.FallbackModel
+		if cfg != nil {
+			cfg.CachedContent = ""
+		}
+	}
+	next, err := s.client.Chats.Create(ctx, model, cfg, history[:len(history)-2])
+	if err != nil {
+		return nil, ""
+	}
+	s.requestLogger(ctx).Warn("empty reply, asking again", "policy", policy, "model", model)
+	return next, model
+}
+
+// sendAnswered sends parts as sendFitting does and, when the reply is
+// empty, asks once more as the empty reply policy says. It returns the
+// chat and model to carry on with.
+func (s *Server) sendAnswered(ctx context.Context, chat *genai.Chat, model string, cfg *genai.GenerateContentConfig, parts ...genai.Part) (*genai.GenerateContentResponse, *genai.Chat, string, int, error) {
+	res, chat, dropped, err := s.sendFitting(ctx, chat, model, cfg, parts...)
+	if err != nil || !emptyResponse(res) {
+		return res, chat, model, dropped, err
+	}
+	next, nextModel := s.retryChat(ctx, chat, model, cfg)
+	if next == nil {
+		return res, chat, model, dropped, nil
+	}
+	retried, next, n, err := s.sendFitting(ctx, next, nextModel, cfg, parts...)
+	if err != nil {
+		// The first, empty reply stands
+		s.requestLogger(ctx).Warn("asking again after an empty reply", "model", nextModel, "error", err)
+		return res, chat, model, dropped, nil
+	}
+	return retried, next, nextModel, dropped + n, nil
+}
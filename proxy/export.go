@@ -0,0 +1,229 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"strings"
+	"time"
+)
+
+// Transcript export formats
+const (
+	ExportMarkdown = "markdown"
+	ExportHTML     = "html"
+)
+
+// maxExportResultBytes caps each tool result in an export, as a read_file
+// result can hold a whole file.
+const maxExportResultBytes = 4000
+
+// ExportExtension returns the file extension of an export format.
+func ExportExtension(format string) string {
+	if format == ExportHTML {
+		return ".html"
+	}
+	return ".md"
+}
+
+// ExportTranscript renders a transcript as a document to share: Markdown,
+// or a standalone HTML page without scripts. Tool calls and results are
+// included, results cut to maxExportResultBytes, and images are embedded.
+func ExportTranscript(t *SessionTranscript, format string) ([]byte, error) {
+	switch format {
+	case ExportMarkdown, "md":
+		return exportMarkdown(t), nil
+	case ExportHTML:
+		var b bytes.Buffer
+		err := exportPage.Execute(&b, exportView(t))
+		return b.Bytes(), err
+	}
+	return nil, fmt.Errorf("invalid format %q: want %s or %s", format, ExportMarkdown, ExportHTML)
+}
+
+func exportTitle(info SessionInfo) string {
+	if info.Title != "" {
+		return info.Title
+	}
+	return "Session " + info.ID
+}
+
+func exportRole(role string) string {
+	switch role {
+	case "user":
+		return "User"
+	case "model":
+		return "Assistant"
+	}
+	return "Tool"
+}
+
+// exportJSON renders tool arguments or a result, cut to
+// maxExportResultBytes.
+func exportJSON(v map[string]any) string {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	if len(data) > maxExportResultBytes {
+		return string(data[:maxExportResultBytes]) + "\n... (truncated)"
+	}
+	return string(data)
+}
+
+// fenceFor returns a code fence longer than any run of backticks in s, so
+// s cannot close it.
+func fenceFor(s string) string {
+	longest, run := 0, 0
+	for _, c := range s {
+		if c == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	return strings.Repeat("`", max(3, longest+1))
+}
+
+func exportMarkdown(t *SessionTranscript) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", exportTitle(t.Session))
+	fmt.Fprintf(&b, "Session `%s` · created %s · updated %s · %d messages\n",
+		t.Session.ID, t.Session.Created.UTC().Format(time.RFC3339), t.Session.Updated.UTC().Format(time.RFC3339), t.Session.Messages)
+	for _, m := range t.Messages {
+		fmt.Fprintf(&b, "\n---\n\n### %s\n", exportRole(m.Role))
+		if m.Text != "" {
+			fmt.Fprintf(&b, "\n%s\n", strings.TrimSpace(m.Text))
+		}
+		for _, c := range m.ToolCalls {
+			args := exportJSON(c.Args)
+			fence := fenceFor(args)
+			fmt.Fprintf(&b, "\n**Tool call** `%s`\n\n%sjson\n%s\n%s\n", c.Name, fence, args, fence)
+		}
+		for _, r := range m.ToolResults {
+			res := exportJSON(r.Response)
+			fence := fenceFor(res)
+			fmt.Fprintf(&b, "\n**Result** `%s`\n\n%sjson\n%s\n%s\n", r.Name, fence, res, fence)
+		}
+		for i, img := range m.Images {
+			fmt.Fprintf(&b, "\n![image %d](data:%s;base64,%s)\n", i+1, img.MimeType, img.Data)
+		}
+	}
+	return []byte(b.String())
+}
+
+// exportBlock is a run of a message's text: prose, or a fenced code block.
+type exportBlock struct {
+	Code bool
+	Lang string
+	Text string
+}
+
+// exportBlocks splits Markdown text at its fenced code blocks, which the
+// HTML export sets apart. The rest is shown as written.
+func exportBlocks(text string) []exportBlock {
+	var blocks []exportBlock
+	var cur []string
+	fence := ""
+	lang := ""
+	flush := func(code bool) {
+		if s := strings.Join(cur, "\n"); code || strings.TrimSpace(s) != "" {
+			blocks = append(blocks, exportBlock{Code: code, Lang: lang, Text: strings.Trim(s, "\n")})
+		}
+		cur = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence == "" && strings.HasPrefix(trimmed, "```"):
+			flush(false)
+			fence = trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, "`"))]
+			lang = strings.TrimSpace(trimmed[len(fence):])
+		case fence != "" && strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, "`") == "":
+			flush(true)
+			fence, lang = "", ""
+		default:
+			cur = append(cur, line)
+		}
+	}
+	flush(fence != "")
+	return blocks
+}
+
+type exportTool struct {
+	Label, Name, JSON string
+}
+
+type exportMessage struct {
+	Role   string
+	Class  string
+	Blocks []exportBlock
+	Tools  []exportTool
+	Images []template.URL
+}
+
+type exportDoc struct {
+	Title    string
+	Session  SessionInfo
+	Messages []exportMessage
+}
+
+func exportView(t *SessionTranscript) exportDoc {
+	doc := exportDoc{Title: exportTitle(t.Session), Session: t.Session}
+	for _, m := range t.Messages {
+		em := exportMessage{Role: exportRole(m.Role), Class: m.Role, Blocks: exportBlocks(m.Text)}
+		for _, c := range m.ToolCalls {
+			em.Tools = append(em.Tools, exportTool{"Tool call", c.Name, exportJSON(c.Args)})
+		}
+		for _, r := range m.ToolResults {
+			em.Tools = append(em.Tools, exportTool{"Result", r.Name, exportJSON(r.Response)})
+		}
+		for _, img := range m.Images {
+			// transcript keeps image/ parts only, so the URL is an image
+			em.Images = append(em.Images, template.URL("data:"+img.MimeType+";base64,"+img.Data))
+		}
+		doc.Messages = append(doc.Messages, em)
+	}
+	return doc
+}
+
+var exportPage = template.Must(template.New("export").Funcs(template.FuncMap{
+	"date": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04 UTC") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; max-width: 900px; margin: 2rem auto; padding: 0 1rem; color: #1f2937; line-height: 1.55; }
+header { border-bottom: 1px solid #e5e7eb; margin-bottom: 1.5rem; }
+header p { color: #6b7280; font-size: 0.85rem; }
+.message { border: 1px solid #e5e7eb; border-radius: 8px; padding: 0.75rem 1rem; margin: 1rem 0; }
+.message.user { background: #eff6ff; }
+.message.tool { background: #f9fafb; font-size: 0.9rem; }
+.role { font-weight: 600; font-size: 0.8rem; text-transform: uppercase; color: #6b7280; }
+.text { white-space: pre-wrap; }
+pre { background: #111827; color: #e5e7eb; padding: 0.75rem; border-radius: 6px; overflow-x: auto; font-size: 0.85rem; }
+.tool-name { font-size: 0.85rem; margin: 0.5rem 0 0; }
+img { max-width: 100%; border-radius: 6px; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<p>Session <code>{{.Session.ID}}</code> · created {{date .Session.Created}} · updated {{date .Session.Updated}} · {{.Session.Messages}} messages</p>
+</header>
+{{range .Messages}}<section class="message {{.Class}}">
+<div class="role">{{.Role}}</div>
+{{range .Blocks}}{{if .Code}}<pre><code{{with .Lang}} class="language-{{.}}"{{end}}>{{.Text}}</code></pre>
+{{else}}<div class="text">{{.Text}}</div>
+{{end}}{{end}}{{range .Tools}}<p class="tool-name">{{.Label}} <code>{{.Name}}</code></p>
+<pre><code class="language-json">{{.JSON}}</code></pre>
+{{end}}{{range .Images}}<img src="{{.}}" alt="">
+{{end}}</section>
+{{end}}</body>
+</html>
+`))
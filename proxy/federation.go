@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// mainProject names the served project in search scopes and results.
+// Registered projects go by their names in Index.Projects.
+const mainProject = "main"
+
+// IndexReport is the served project's index status followed by those of
+// the registered projects and, when enabled, of past conversations, whose
+// files are sessions.
+type IndexReport struct {
+	IndexStatus
+	Projects      []IndexStatus `json:"projects,omitempty"`
+	Conversations *IndexStatus  `json:"conversations,omitempty"`
+}
+
+// loadIndexes opens the index of the served project and of every project
+// registered in Index.Projects, which are kept under index/projects/, and
+// the conversation index when it is enabled.
+func (s *Server) loadIndexes() error {
+	var err error
+	main := filepath.Join(s.home, "index", "embeddings.gob")
+	if s.vectors, err = loadVectorIndex(main, mainProject, s.projectRoot, s.cfg.Index); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.cfg.Index.Projects)) {
+		root, err := filepath.Abs(s.cfg.Index.Projects[name])
+		if err != nil {
+			return fmt.Errorf("index project %s: %w", name, err)
+		}
+		path := filepath.Join(s.home, "index", "projects", name, "embeddings.gob")
+		ix, err := loadVectorIndex(path, name, root, s.cfg.Index)
+		if err != nil {
+			return fmt.Errorf("index project %s: %w", name, err)
+		}
+		s.federated = append(s.federated, ix)
+	}
+	if s.cfg.Index.Conversations {
+		path := filepath.Join(s.home, "index", "conversations.gob")
+		if s.conversations, err = loadVectorIndex(path, conversationsIndex, "", s.cfg.Index); err != nil {
+			return fmt.Errorf("conversation index: %w", err)
+		}
+	}
+	return nil
+}
+
+// indexes returns the served project's index followed by the registered
+// projects'.
+func (s *Server) indexes() []*vectorIndex {
+	return append([]*vectorIndex{s.vectors}, s.federated...)
+}
+
+// indexNamed returns the index of the named project, or nil.
+func (s *Server) indexNamed(name string) *vectorIndex {
+	for _, ix := range s.indexes() {
+		if ix.name == name {
+			return ix
+		}
+	}
+	return nil
+}
+
+// searchScope resolves a search scope: empty for the served project,
+// "all" for every project, or project names separated by commas.
+func (s *Server) searchScope(scope string) ([]*vectorIndex, error) {
+	switch strings.TrimSpace(scope) {
+	case "":
+		return []*vectorIndex{s.vectors}, nil
+	case "all":
+		return s.indexes(), nil
+	}
+	var out []*vectorIndex
+	for name := range strings.SplitSeq(scope, ",") {
+		name = strings.TrimSpace(name)
+		ix := s.indexNamed(name)
+		if ix == nil {
+			return nil, fmt.Errorf("unknown project %q in scope: want %s", name, strings.Join(s.projectNames(), ", "))
+		}
+		if !slices.Contains(out, ix) {
+			out = append(out, ix)
+		}
+	}
+	return out, nil
+}
+
+func (s *Server) projectNames() []string {
+	var names []string
+	for _, ix := range s.indexes() {
+		names = append(names, ix.name)
+	}
+	return names
+}
+
+// indexedChunks returns the number of chunks across indexes.
+func indexedChunks(indexes []*vectorIndex) int {
+	n := 0
+	for _, ix := range indexes {
+		n += ix.status().Chunks
+	}
+	return n
+}
+
+func (s *Server) indexReport() IndexReport {
+	report := IndexReport{IndexStatus: s.vectors.status()}
+	for _, ix := range s.federated {
+		report.Projects = append(report.Projects, ix.status())
+	}
+	if s.conversations != nil {
+		st := s.conversations.status()
+		report.Conversations = &st
+	}
+	return report
+}
@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxPreviewBytes = 512 * 1024 // /files/content returns at most this much
+	maxTreeEntries  = 10000      // /files/tree stops listing after this many entries
+)
+
+// listSkipDirs are hidden from the file browser regardless of corpus settings.
+var listSkipDirs = map[string]bool{
+	"node_modules": true, "vendor": true, ".git": true,
+	"dist": true, "build": true, ".next": true, "target": true,
+	"__pycache__": true, "venv": true, ".venv": true,
+}
+
+// languages maps file extensions to the syntax names used by the web UI's
+// highlighter.
+var languages = map[string]string{
+	".go": "go", ".py": "python", ".js": "javascript", ".mjs": "javascript",
+	".ts": "typescript", ".tsx": "tsx", ".jsx": "jsx", ".json": "json",
+	".yaml": "yaml", ".yml": "yaml", ".toml": "toml", ".md": "markdown",
+	".html": "html", ".css": "css", ".scss": "scss", ".sh": "bash",
+	".bash": "bash", ".sql": "sql", ".rs": "rust", ".java": "java",
+	".kt": "kotlin", ".c": "c", ".h": "c", ".cpp": "cpp", ".hpp": "cpp",
+	".cs": "csharp", ".rb": "ruby", ".php": "php", ".swift": "swift",
+	".xml": "xml", ".proto": "protobuf", ".dockerfile": "docker",
+}
+
+// FileEntry describes one file or directory in the project explorer.
+type FileEntry struct {
+	Name     string       `json:"name"`
+	Path     string       `json:"path"` // Relative to the project root, slash-separated
+	Dir      bool         `json:"dir,omitempty"`
+	Size     int64        `json:"size"`
+	ModTime  time.Time    `json:"mtime"`
+	Cached   bool         `json:"cached"` // Selected for the context cache corpus
+	Children []*FileEntry `json:"children,omitempty"`
+}
+
+// FileContent is the /files/content response.
+type FileContent struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	Language  string    `json:"language,omitempty"`
+	Binary    bool      `json:"binary,omitempty"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Cached    bool      `json:"cached"`
+	Content   string    `json:"content,omitempty"`
+}
+
+// projectPath resolves a client-supplied path against the project root of
+// the request's workspace, returning the absolute and slash-separated
+// relative forms. ok is false when the path escapes the root.
+func (s *Server) projectPath(ctx context.Context, p string) (abs, rel string, ok bool) {
+	root := s.root(ctx)
+	abs = filepath.Join(root, filepath.Clean("/"+p))
+	r, err := filepath.Rel(root, abs)
+	if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", "", false
+	}
+	return abs, filepath.ToSlash(r), true
+}
+
+// hiddenFromListing reports whether the explorer omits an entry.
+func hiddenFromListing(name string, dir bool) bool {
+	return strings.HasPrefix(name, ".") || (dir && listSkipDirs[name])
+}
+
+func (s *Server) fileEntry(rel string, info os.FileInfo) *FileEntry {
+	e := &FileEntry{
+		Name:    info.Name(),
+		Path:    rel,
+		Dir:     info.IsDir(),
+		ModTime: info.ModTime().UTC(),
+	}
+	if !e.Dir {
+		e.Size = info.Size()
+	}
+	return e
+}
+
+// handleFiles lists one directory of the project. files keeps the plain
+// name list the web UI's tree uses, directories suffixed with "/"; entries
+// carries sizes, mtimes and the cached flag.
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	targetDir, relDir, ok := s.projectPath(r.Context(), r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	dirEntries, err := os.ReadDir(targetDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filter := s.cfg.Corpus.Filter()
+	files := []string{}
+	entries := []*FileEntry{}
+	for _, d := range dirEntries {
+		name := d.Name()
+		if hiddenFromListing(name, d.IsDir()) {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		e := s.fileEntry(path.Join(relDir, name), info)
+		e.Cached = inCorpus(filter, e.Path, e.Dir, e.Size)
+		entries = append(entries, e)
+		if e.Dir {
+			name += "/"
+		}
+		files = append(files, name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"files": files, "entries": entries})
+}
+
+// handleFileTree lists the project recursively from ?path=, down to ?depth=
+// levels (unlimited when unset). Directory sizes are the sum of the files
+// listed below them.
+func (s *Server) handleFileTree(w http.ResponseWriter, r *http.Request) {
+	root, rel, ok := s.projectPath(r.Context(), r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	depth := -1
+	if v := r.URL.Query().Get("depth"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid depth", http.StatusBadRequest)
+			return
+		}
+		depth = n
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		http.Error(w, "Path not found", http.StatusNotFound)
+		return
+	}
+	filter := s.cfg.Corpus.Filter()
+	count := 0
+	var walk func(abs string, e *FileEntry, level int)
+	walk = func(abs string, e *FileEntry, level int) {
+		if !e.Dir || level == depth {
+			return
+		}
+		dirEntries, err := os.ReadDir(abs)
+		if err != nil {
+			return
+		}
+		for _, d := range dirEntries {
+			if count >= maxTreeEntries {
+				return
+			}
+			if hiddenFromListing(d.Name(), d.IsDir()) {
+				continue
+			}
+			info, err := d.Info()
+			if err != nil {
+				continue
+			}
+			child := s.fileEntry(path.Join(e.Path, d.Name()), info)
+			// A directory's children inherit its exclusion
+			child.Cached = e.Cached && inCorpus(filter, child.Path, child.Dir, child.Size)
+			count++
+			walk(filepath.Join(abs, d.Name()), child, level+1)
+			e.Size += child.Size
+			e.Children = append(e.Children, child)
+		}
+	}
+	top := s.fileEntry(rel, info)
+	top.Cached = rel == "." || inCorpus(filter, rel, top.Dir, top.Size)
+	walk(root, top, 0)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"tree":      top,
+		"truncated": count >= maxTreeEntries,
+	})
+}
+
+// handleFileContent returns one project file for preview. Text is capped at
+// maxPreviewBytes; binary files are reported without content.
+func (s *Server) handleFileContent(w http.ResponseWriter, r *http.Request) {
+	abs, rel, ok := s.projectPath(r.Context(), r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Path is a directory", http.StatusBadRequest)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(f, maxPreviewBytes))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fc := FileContent{
+		Path:     rel,
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UTC(),
+		Language: languageFor(rel),
+		Cached:   inCorpus(s.cfg.Corpus.Filter(), rel, false, info.Size()),
+	}
+	if isBinary(data) {
+		fc.Binary = true
+	} else {
+		fc.Truncated = info.Size() > int64(len(data))
+		if fc.Truncated {
+			// Don't cut a multi-byte character in half
+			for i := 0; i < utf8.UTFMax-1 && len(data) > 0; i++ {
+				if r, size := utf8.DecodeLastRune(data); r != utf8.RuneError || size > 1 {
+					break
+				}
+				data = data[:len(data)-1]
+			}
+		}
+		fc.Content = string(data)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fc)
+}
+
+// languageFor guesses the syntax of a file from its name.
+func languageFor(rel string) string {
+	base := strings.ToLower(path.Base(rel))
+	switch base {
+	case "dockerfile":
+		return "docker"
+	case "makefile":
+		return "makefile"
+	}
+	return languages[path.Ext(base)]
+}
+
+// isBinary applies the corpus rule: a NUL byte in the first 1KB.
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), 1024)], 0) >= 0
+}
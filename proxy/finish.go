@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// FinishInfo explains why the model stopped, so empty or cut-off replies
+// can be told apart from proxy failures.
+type FinishInfo struct {
+	FinishReason  string         `json:"finish_reason,omitempty"`
+	FinishMessage string         `json:"finish_message,omitempty"`
+	BlockReason   string         `json:"block_reason,omitempty"` // The prompt itself was blocked
+	BlockMessage  string         `json:"block_message,omitempty"`
+	SafetyRatings []SafetyRating `json:"safety_ratings,omitempty"`
+}
+
+// SafetyRating is a harm category the model rated above negligible.
+type SafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability"`
+	Blocked     bool   `json:"blocked,omitempty"`
+}
+
+// finishInfo extracts finish and block details from a response. Only
+// ratings above NEGLIGIBLE are kept to avoid noise on ordinary replies.
+func finishInfo(res *genai.GenerateContentResponse) FinishInfo {
+	var info FinishInfo
+	if res == nil {
+		return info
+	}
+	var ratings []*genai.SafetyRating
+	if fb := res.PromptFeedback; fb != nil {
+		info.BlockReason = string(fb.BlockReason)
+		info.BlockMessage = fb.BlockReasonMessage
+		ratings = append(ratings, fb.SafetyRatings...)
+	}
+	if len(res.Candidates) > 0 {
+		c := res.Candidates[0]
+		info.FinishReason = string(c.FinishReason)
+		info.FinishMessage = c.FinishMessage
+		ratings = append(ratings, c.SafetyRatings...)
+	}
+	for _, r := range ratings {
+		if r == nil || (!r.Blocked && (r.Probability == "" || r.Probability == genai.HarmProbabilityNegligible)) {
+			continue
+		}
+		info.SafetyRatings = append(info.SafetyRatings, SafetyRating{
+			Category:    strings.TrimPrefix(string(r.Category), "HARM_CATEGORY_"),
+			Probability: string(r.Probability),
+			Blocked:     r.Blocked,
+		})
+	}
+	return info
+}
+
+// Warning describes an abnormal finish for display in place of an empty
+// reply. It returns "" for normal completions.
+func (f FinishInfo) Warning() string {
+	var b strings.Builder
+	switch {
+	case f.BlockReason != "":
+		fmt.Fprintf(&b, "[Prompt blocked: %s", f.BlockReason)
+		if f.BlockMessage != "" {
+			fmt.Fprintf(&b, " - %s", f.BlockMessage)
+		}
+	case f.FinishReason == string(genai.FinishReasonMaxTokens):
+		return "[Response truncated: the model hit its output token limit (MAX_TOKENS).]"
+	case f.FinishReason != "" && f.FinishReason != string(genai.FinishReasonStop):
+		fmt.Fprintf(&b, "[Response stopped: %s", f.FinishReason)
+		if f.FinishMessage != "" {
+			fmt.Fprintf(&b, " - %s", f.FinishMessage)
+		}
+	default:
+		return ""
+	}
+	var flagged []string
+	for _, r := range f.SafetyRatings {
+		flagged = append(flagged, r.Category+"="+r.Probability)
+	}
+	if len(flagged) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(flagged, ", "))
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+// openAIFinishReason maps a Gemini finish reason onto the values OpenAI
+// clients understand: stop, length or content_filter.
+func openAIFinishReason(reason genai.FinishReason) string {
+	switch reason {
+	case genai.FinishReasonMaxTokens:
+		return "length"
+	case genai.FinishReasonSafety, genai.FinishReasonRecitation, genai.FinishReasonBlocklist,
+		genai.FinishReasonProhibitedContent, genai.FinishReasonSPII, genai.FinishReasonImageSafety,
+		genai.FinishReasonImageProhibitedContent, genai.FinishReasonImageRecitation:
+		return "content_filter"
+	}
+	return "stop"
+}
+
+// openAIFinish returns the OpenAI finish_reason for a whole response,
+// treating a blocked prompt as filtered.
+func openAIFinish(info FinishInfo) string {
+	if info.BlockReason != "" {
+		return "content_filter"
+	}
+	return openAIFinishReason(genai.FinishReason(info.FinishReason))
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// --- HANDLERS ---
+
+func (s *Server) handleOfficialAPI(w http.ResponseWriter, r *http.Request) {
+	// Check if this is a streaming request
+	if strings.Contains(r.URL.Path, ":streamGenerateContent") {
+		s.handleStream(w, r)
+		return
+	}
+	s.handleChat(w, r)
+}
+
+// --- GEMINI STREAMING ---
+
+// SessionHeader names the session a Gemini streaming request continues.
+const SessionHeader = "X-Session-ID"
+
+// streamSession picks the session of a Gemini streaming request: the
+// X-Session-ID header when set, and otherwise one per context cache, so
+// an IDE working against a cache keeps a single conversation.
+func streamSession(r *http.Request, cacheID string) (string, bool) {
+	if id := r.Header.Get(SessionHeader); id != "" {
+		return id, validRequestID(id)
+	}
+	if cacheID == "" {
+		return "gemini-default", true
+	}
+	sum := sha256.Sum256([]byte(cacheID))
+	return "gemini-" + hex.EncodeToString(sum[:6]), true
+}
+
+// handleStream answers streamGenerateContent. Only the last user message
+// of the request is sent; earlier turns come from the session history,
+// which is saved once the stream completes.
+func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	lg := s.requestLogger(r.Context())
+	rctx, span := tracer.Start(r.Context(), "gemini.stream")
+	defer span.End()
+	ctx, cancel := s.endpointContext(rctx, config.EndpointGemini)
+	defer cancel()
+	var reqBody struct {
+		Contents      []map[string]any `json:"contents"`
+		CachedContent string           `json:"cachedContent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request", 400)
+		return
+	}
+
+	// Extract user message from contents
+	userMsg := ""
+	for _, content := range reqBody.Contents {
+		if role, ok := content["role"].(string); ok && role == "user" {
+			if parts, ok := content["parts"].([]any); ok && len(parts) > 0 {
+				if part, ok := parts[0].(map[string]any); ok {
+					if text, ok := part["text"].(string); ok {
+						userMsg = text
+					}
+				}
+			}
+		}
+	}
+
+	// Extract model from URL
+	path := r.URL.Path
+	defaultModel, temperature := s.cfg.Endpoint(config.EndpointGemini)
+	model := defaultModel
+	if strings.Contains(path, "/models/") {
+		parts := strings.Split(path, "/models/")
+		if len(parts) > 1 {
+			modelPart := strings.Split(parts[1], ":")[0]
+			if modelPart != "" {
+				model = modelPart
+			}
+		}
+	}
+	if ok, reason := s.models.allowed(model); !ok && model != defaultModel {
+		http.Error(w, reason, http.StatusForbidden)
+		return
+	}
+
+	activeCID := reqBody.CachedContent
+	if err := checkCacheID(ctx, activeCID); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if activeCID == "" {
+		activeCID, _ = s.cacheFor(ctx)
+	}
+	session, ok := streamSession(r, activeCID)
+	if !ok {
+		http.Error(w, "Invalid "+SessionHeader, http.StatusBadRequest)
+		return
+	}
+	ctx = withSession(ctx, session)
+	ctx, endTurn := s.beginTurn(ctx, session, userMsg)
+	defer endTurn()
+	history, err := s.sessions(ctx).History(ctx, session)
+	if err != nil {
+		lg.Error("loading session", "session", session, "error", err)
+		http.Error(w, "session store unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	history = s.trimHistory(ctx, session, history)
+
+	start := time.Now()
+	lg.Info("gemini stream request", "endpoint", r.URL.Path, "model", model, "session", session, "history", len(history), "msg", preview(userMsg, 50))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", 500)
+		return
+	}
+
+	// Tool calls are run here unless tools are disabled, and then passed on
+	runTools := s.toolPolicy(ctx) != config.ToolPolicyNone
+	config := &genai.GenerateContentConfig{
+		Temperature:    genai.Ptr[float32](temperature),
+		SafetySettings: s.buildSafetySettings(nil),
+	}
+
+	if activeCID != "" {
+		// Tools, when the cache was built with them, live in the cache
+		config.CachedContent = activeCID
+	} else if fileTools := s.fileToolDeclarations(ctx); len(fileTools) > 0 {
+		config.Tools = []*genai.Tool{{FunctionDeclarations: fileTools}}
+	}
+
+	s.applySystemPrompt(config, "")
+	tagUpstream(r.Context(), config)
+	chat, err := s.client.Chats.Create(ctx, model, config, history)
+	if err != nil {
+		fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
+		flusher.Flush()
+		return
+	}
+
+	// Chunks are forwarded as they arrive, with plain text batched by the
+	// coalescer; only a bounded preview is kept
+	var fullResponse responsePreview
+	complete := true
+	write := func(chunk map[string]any) {
+		chunk["responseId"] = requestIDFrom(r.Context())
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			lg.Error("marshalling Gemini stream chunk", "error", err)
+			return
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+	batch := s.newCoalescer(func(text string) {
+		write(map[string]any{"candidates": []map[string]any{{
+			"content": map[string]any{"parts": []map[string]any{{"text": text}}, "role": "model"},
+		}}})
+	})
+	defer batch.flush()
+	// Gemini SDKs reject SSE comments, so the keepalive is an empty chunk
+	defer batch.keepAlive(func() { write(map[string]any{}) })()
+	send := func(chunk map[string]any) {
+		batch.do(func() { write(chunk) })
+	}
+
+	parts := []genai.Part{{Text: userMsg}}
+	var toolLogs []string
+	var usage streamUsage
+	sheds := 0
+	for complete {
+		var calls []*genai.FunctionCall
+		var last *genai.GenerateContentResponse
+		shed := false
+		for resp, err := range s.sendMessageStream(ctx, chat, model, parts...) {
+			// A request too long for the context window fails before
+			// anything streams, and is sent again with less history
+			if err != nil && last == nil && sheds < maxContextRetries && contextTooLong(err) {
+				if next, n := s.shedChat(ctx, chat, model, config); next != nil {
+					chat, shed = next, true
+					usage.historyDropped += n
+					sheds++
+					break
+				}
+			}
+			if err != nil {
+				s.logAbort(ctx, "stream", "bytes", fullResponse.total)
+				batch.do(func() {
+					fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
+					flusher.Flush()
+				})
+				complete = false
+				break
+			}
+			last = resp
+
+			text := resp.Text()
+			fullResponse.WriteString(text)
+
+			// Send in Gemini format. Tool calls the proxy runs itself are
+			// reported as toolActivity instead of being passed on.
+			out := []map[string]any{}
+			if text != "" {
+				out = append(out, map[string]any{"text": text})
+			}
+			for _, call := range resp.FunctionCalls() {
+				if runTools {
+					calls = append(calls, call)
+				} else {
+					out = append(out, map[string]any{"functionCall": call})
+				}
+			}
+			candidate := map[string]any{
+				"content": map[string]any{
+					"parts": out,
+					"role":  "model",
+				},
+			}
+			if len(resp.Candidates) > 0 {
+				if c := resp.Candidates[0]; c.FinishReason != "" {
+					candidate["finishReason"] = c.FinishReason
+					candidate["safetyRatings"] = c.SafetyRatings
+				}
+			}
+			chunk := map[string]any{"candidates": []map[string]any{candidate}}
+			if resp.PromptFeedback != nil {
+				chunk["promptFeedback"] = resp.PromptFeedback
+			}
+			switch {
+			case candidate["finishReason"] != nil || resp.PromptFeedback != nil:
+				send(chunk)
+			case len(out) == 1 && text != "":
+				batch.add(text)
+			case len(out) > 0:
+				send(chunk)
+			}
+		}
+		if shed {
+			continue
+		}
+		usage.add(model, last)
+		if !complete || len(calls) == 0 {
+			break
+		}
+
+		// Run the tools and stream the model's answer to their results.
+		// Each call is announced in a chunk without candidates, which
+		// Gemini SDKs pass through as an empty response.
+		parts = parts[:0]
+		for _, call := range calls {
+			send(map[string]any{"toolActivity": map[string]any{"name": call.Name, "args": call.Args, "status": "running"}})
+			toolLogs = append(toolLogs, call.Name)
+			result := s.executeTool(ctx, call.Name, call.Args)
+			activity := map[string]any{"name": call.Name, "status": "done"}
+			if w, failed := toolWarning(call.Name, call.Args, result); failed {
+				activity["status"], activity["error"] = "failed", w.Error
+				usage.warnings = append(usage.warnings, w)
+			}
+			send(map[string]any{"toolActivity": activity})
+			parts = append(parts, genai.Part{FunctionResponse: functionResponse(model, call, result)})
+		}
+		if ctx.Err() != nil {
+			s.logAbort(ctx, "tool loop", "tools", toolLogs, "bytes", fullResponse.total)
+			complete = false
+		}
+	}
+
+	// The chat records the turn only when the stream ran to the end, which
+	// a final chunk reports with the request's usage
+	if complete {
+		send(usage.gemini(timerFrom(ctx).Timings()))
+		if err := s.sessions(ctx).SetHistory(ctx, session, chat.History(false)); err != nil {
+			lg.Error("saving session", "session", session, "error", err)
+		}
+	}
+
+	s.writeDebugResponse(ctx, fullResponse.String())
+	lg.Info("gemini stream complete", "model", model, "session", session, "tools", toolLogs, "cost", usage.cost, "latency_ms", time.Since(start).Milliseconds(), "bytes", fullResponse.total, "resp", preview(fullResponse.String(), 50))
+}
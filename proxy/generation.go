@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+
+	"google.golang.org/genai"
+)
+
+// maxStopSequences is the most stop sequences Gemini accepts.
+const maxStopSequences = 5
+
+// applyGeneration sets the sampling and length settings of a chat request
+// on config. Unset fields keep the model's defaults.
+func applyGeneration(req *ChatRequest, config *genai.GenerateContentConfig) error {
+	switch {
+	case req.MaxOutputTokens != nil && *req.MaxOutputTokens < 1:
+		return fmt.Errorf("invalid max_output_tokens %d: want a positive token count", *req.MaxOutputTokens)
+	case len(req.StopSequences) > maxStopSequences:
+		return fmt.Errorf("too many stop_sequences: want at most %d, got %d", maxStopSequences, len(req.StopSequences))
+	case req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1):
+		return fmt.Errorf("invalid top_p %g: want 0 to 1", *req.TopP)
+	case req.TopK != nil && *req.TopK < 1:
+		return fmt.Errorf("invalid top_k %g: want 1 or more", *req.TopK)
+	case req.CandidateCount != nil && *req.CandidateCount < 1:
+		return fmt.Errorf("invalid candidate_count %d: want 1 or more", *req.CandidateCount)
+	}
+	if req.MaxOutputTokens != nil {
+		config.MaxOutputTokens = *req.MaxOutputTokens
+	}
+	if req.CandidateCount != nil {
+		config.CandidateCount = *req.CandidateCount
+	}
+	config.StopSequences = req.StopSequences
+	config.TopP = req.TopP
+	config.TopK = req.TopK
+	config.Seed = req.Seed
+	return nil
+}
+
+// candidateTexts returns the text of every candidate of a reply, for a
+// request with candidate_count above 1. The first is the one the session
+// keeps.
+func candidateTexts(res *genai.GenerateContentResponse) []string {
+	if res == nil || len(res.Candidates) < 2 {
+		return nil
+	}
+	texts := make([]string, len(res.Candidates))
+	for i, c := range res.Candidates {
+		if c.Content == nil {
+			continue
+		}
+		for _, p := range c.Content.Parts {
+			if p.Text != "" && !p.Thought {
+				texts[i] += p.Text
+			}
+		}
+	}
+	return texts
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errGenerationCancelled is the cause of a request cancelled through
+// POST /generations/<id>/cancel.
+var errGenerationCancelled = errors.New("generation cancelled")
+
+// generation is a request's upstream calls and tool loop, which can be
+// cancelled by request ID.
+type generation struct {
+	ID       string    `json:"id"`
+	Endpoint string    `json:"endpoint"` // web, openai or gemini
+	Started  time.Time `json:"started"`
+	cancel   context.CancelCauseFunc
+
+	workspace string // Name of the workspace that started it; "" for the server's own
+}
+
+// generationTable tracks running generations by request ID. One request
+// may hold more than one, as the OpenAI handler does when it streams.
+type generationTable struct {
+	mu      sync.Mutex
+	running map[string][]*generation
+}
+
+func newGenerationTable() *generationTable {
+	return &generationTable{running: map[string][]*generation{}}
+}
+
+// add registers g and returns a function that removes it.
+func (t *generationTable) add(g *generation) func() {
+	t.mu.Lock()
+	t.running[g.ID] = append(t.running[g.ID], g)
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		list := slices.DeleteFunc(t.running[g.ID], func(x *generation) bool { return x == g })
+		if len(list) == 0 {
+			delete(t.running, g.ID)
+		} else {
+			t.running[g.ID] = list
+		}
+	}
+}
+
+// cancel cancels the request's generations in workspace and reports
+// whether it had any. Request IDs come from clients, so two workspaces may
+// use the same one.
+func (t *generationTable) cancel(id, workspace string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	found := false
+	for _, g := range t.running[id] {
+		if g.workspace == workspace {
+			g.cancel(errGenerationCancelled)
+			found = true
+		}
+	}
+	return found
+}
+
+// list returns one entry per running request of workspace, oldest first.
+func (t *generationTable) list(workspace string) []generation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := []generation{}
+	for _, gs := range t.running {
+		if i := slices.IndexFunc(gs, func(g *generation) bool { return g.workspace == workspace }); i >= 0 {
+			list = append(list, *gs[i])
+		}
+	}
+	slices.SortFunc(list, func(a, b generation) int { return a.Started.Compare(b.Started) })
+	return list
+}
+
+// handleGenerations lets the web UI's stop button and API clients halt a
+// request, streaming or not, by the ID in its X-Request-ID header. A
+// client that wants to stop a request before its response arrives sends
+// its own X-Request-ID. A workspace sees and cancels only its own
+// requests.
+//
+//	GET  /generations              running requests, oldest first
+//	POST /generations/<id>/cancel  cancel the request's upstream calls and tool loop
+func (s *Server) handleGenerations(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/generations")
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"generations": s.generations.list(workspaceName(r.Context()))})
+		return
+	case rest == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	if !strings.HasPrefix(rest, "/") || action != "cancel" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.generations.cancel(id, workspaceName(r.Context())) {
+		http.Error(w, "No running generation with this ID", http.StatusNotFound)
+		return
+	}
+	s.requestLogger(r.Context()).Info("generation cancel requested", "target", id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "cancelled": true})
+}
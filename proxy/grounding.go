@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/genai"
+)
+
+// Grounding is what a reply grounded with Google Search was based on: the
+// queries the model ran, the pages it used and which of them back each
+// part of the reply.
+type Grounding struct {
+	SearchQueries []string          `json:"search_queries,omitempty"`
+	Sources       []GroundingSource `json:"sources,omitempty"`
+	Citations     []Citation        `json:"citations,omitempty"`
+}
+
+// GroundingSource is a web page a reply was grounded in. The URI is
+// usually a Google redirect to the page.
+type GroundingSource struct {
+	Title string `json:"title,omitempty"` // Usually the page's domain
+	URI   string `json:"uri"`
+}
+
+// Citation ties a span of the reply to the sources that support it.
+// Offsets are in bytes of the reply's text.
+type Citation struct {
+	StartIndex int       `json:"start_index"`
+	EndIndex   int       `json:"end_index"`
+	Text       string    `json:"text"`
+	Sources    []int     `json:"sources"`              // Indexes into Sources
+	Confidence []float32 `json:"confidence,omitempty"` // For each source, where the model reports it
+}
+
+// groundingMetadata returns the grounding of a response's first candidate.
+func groundingMetadata(res *genai.GenerateContentResponse) *genai.GroundingMetadata {
+	if res == nil || len(res.Candidates) == 0 {
+		return nil
+	}
+	return res.Candidates[0].GroundingMetadata
+}
+
+// newGrounding converts Gemini's grounding metadata for the reply text.
+// Gemini's offsets count from the start of the candidate's part, which a
+// tool loop or trimmed whitespace can move, so each span is looked up in
+// text, and left out if it is not there. It returns nil when the reply
+// was not grounded.
+func newGrounding(md *genai.GroundingMetadata, text string) *Grounding {
+	if md == nil || (len(md.WebSearchQueries) == 0 && len(md.GroundingChunks) == 0) {
+		return nil
+	}
+	g := &Grounding{SearchQueries: md.WebSearchQueries}
+	for _, c := range md.GroundingChunks {
+		var src GroundingSource
+		if c != nil && c.Web != nil {
+			src = GroundingSource{Title: c.Web.Title, URI: c.Web.URI}
+		}
+		g.Sources = append(g.Sources, src)
+	}
+	from := 0
+	for _, sup := range md.GroundingSupports {
+		if sup == nil || sup.Segment == nil || len(sup.GroundingChunkIndices) == 0 {
+			continue
+		}
+		seg := sup.Segment
+		start, end := int(seg.StartIndex), int(seg.EndIndex)
+		if start < 0 || end > len(text) || start > end || text[start:end] != seg.Text {
+			i := strings.Index(text[from:], seg.Text)
+			if seg.Text == "" || i < 0 {
+				continue
+			}
+			start, end = from+i, from+i+len(seg.Text)
+		}
+		from = start
+		c := Citation{StartIndex: start, EndIndex: end, Text: seg.Text, Confidence: sup.ConfidenceScores}
+		for _, i := range sup.GroundingChunkIndices {
+			if int(i) < len(g.Sources) {
+				c.Sources = append(c.Sources, int(i))
+			}
+		}
+		g.Citations = append(g.Citations, c)
+	}
+	return g
+}
+
+// OpenAIAnnotation is a url_citation annotation of an OpenAI message.
+type OpenAIAnnotation struct {
+	Type        string            `json:"type"` // Always url_citation
+	URLCitation OpenAIURLCitation `json:"url_citation"`
+}
+
+// OpenAIURLCitation is a web page backing a span of an OpenAI message.
+// Offsets are in characters, as OpenAI counts them.
+type OpenAIURLCitation struct {
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+}
+
+// openAIAnnotations maps grounding onto url_citation annotations of text,
+// one for each source of each citation. Sources no span cites are
+// annotated over the whole text, so every page the reply used is listed.
+func openAIAnnotations(g *Grounding, text string) []OpenAIAnnotation {
+	if g == nil {
+		return nil
+	}
+	var out []OpenAIAnnotation
+	cited := make([]bool, len(g.Sources))
+	for _, c := range g.Citations {
+		start := utf8.RuneCountInString(text[:c.StartIndex])
+		end := start + utf8.RuneCountInString(text[c.StartIndex:c.EndIndex])
+		for _, i := range c.Sources {
+			cited[i] = true
+			src := g.Sources[i]
+			out = append(out, OpenAIAnnotation{"url_citation", OpenAIURLCitation{start, end, src.URI, src.Title}})
+		}
+	}
+	for i, src := range g.Sources {
+		if !cited[i] && src.URI != "" {
+			out = append(out, OpenAIAnnotation{"url_citation", OpenAIURLCitation{0, utf8.RuneCountInString(text), src.URI, src.Title}})
+		}
+	}
+	return out
+}
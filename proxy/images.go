@@ -0,0 +1,334 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// ImageRequest is the body of POST /images/generate.
+type ImageRequest struct {
+	Prompt      string `json:"prompt"`
+	Model       string `json:"model"`        // Default images.model
+	N           int    `json:"n"`            // Images to generate, default 1
+	AspectRatio string `json:"aspect_ratio"` // "1:1", "3:4", "4:3", "9:16" or "16:9"
+	Output      string `json:"output"`       // "base64" (default) or "file"
+}
+
+// GeneratedImage is one image of an ImageResponse: base64 data, or the
+// file it was written to and the URL it is served at.
+type GeneratedImage struct {
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data,omitempty"`
+	Path     string `json:"path,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// ImageResponse is the result of POST /images/generate.
+type ImageResponse struct {
+	Model     string           `json:"model"`
+	Images    []GeneratedImage `json:"images"`
+	Text      string           `json:"text,omitempty"` // Any text the model returned alongside
+	Cost      float64          `json:"cost"`
+	TotalCost float64          `json:"total_cost"`
+}
+
+var aspectRatios = map[string]float64{"1:1": 1, "3:4": 0.75, "4:3": 4.0 / 3, "9:16": 9.0 / 16, "16:9": 16.0 / 9}
+
+// imageBlob is a generated image before it is encoded or saved.
+type imageBlob struct {
+	mimeType string
+	data     []byte
+}
+
+// generateImages runs req against an image model. Imagen models produce
+// all images in one call; Gemini image models produce one per call. Usage
+// and cost are recorded like any other upstream call.
+func (s *Server) generateImages(ctx context.Context, req *ImageRequest) ([]imageBlob, string, float64, error) {
+	if strings.HasPrefix(req.Model, "imagen-") {
+		res, err := s.client.Models.GenerateImages(ctx, req.Model, req.Prompt, &genai.GenerateImagesConfig{
+			NumberOfImages: int32(req.N),
+			AspectRatio:    req.AspectRatio,
+		})
+		if err != nil {
+			return nil, "", 0, err
+		}
+		var blobs []imageBlob
+		for _, g := range res.GeneratedImages {
+			if g != nil && g.Image != nil && len(g.Image.ImageBytes) > 0 {
+				blobs = append(blobs, imageBlob{mimeType: g.Image.MIMEType, data: g.Image.ImageBytes})
+			}
+		}
+		price, _ := longestPrefix(imageCosts, req.Model)
+		cost := price * float64(len(blobs))
+		day := time.Now().UTC().Format(dayLayout)
+		if err := s.sessions(ctx).RecordUsage(context.WithoutCancel(ctx), day, req.Model, sessionFrom(ctx), UsageTotals{Requests: 1, Cost: cost}); err != nil {
+			s.requestLogger(ctx).Warn("recording usage", "error", err)
+		}
+		if len(blobs) == 0 {
+			return nil, "", cost, fmt.Errorf("the model returned no images; the prompt may have been filtered")
+		}
+		return blobs, "", cost, nil
+	}
+
+	cfg := &genai.GenerateContentConfig{
+		ResponseModalities: []string{"TEXT", "IMAGE"},
+		SafetySettings:     s.buildSafetySettings(nil),
+	}
+	if req.AspectRatio != "" {
+		cfg.ImageConfig = &genai.ImageConfig{AspectRatio: req.AspectRatio}
+	}
+	tagUpstream(ctx, cfg)
+	var blobs []imageBlob
+	var text []string
+	var cost float64
+	var last *genai.GenerateContentResponse
+	for range req.N {
+		res, err := s.client.Models.GenerateContent(ctx, req.Model, genai.Text(req.Prompt), cfg)
+		if err != nil {
+			return blobs, strings.Join(text, "\n"), cost, err
+		}
+		last = res
+		s.recordUsage(ctx, req.Model, res)
+		cost += calculateCost(req.Model, res)
+		if t := res.Text(); t != "" {
+			text = append(text, t)
+		}
+		if len(res.Candidates) > 0 && res.Candidates[0].Content != nil {
+			for _, p := range res.Candidates[0].Content.Parts {
+				if p.InlineData != nil && strings.HasPrefix(p.InlineData.MIMEType, "image/") {
+					blobs = append(blobs, imageBlob{mimeType: p.InlineData.MIMEType, data: p.InlineData.Data})
+				}
+			}
+		}
+	}
+	if len(blobs) == 0 {
+		msg := finishInfo(last).Warning()
+		if len(text) > 0 {
+			msg = strings.Join(text, "\n")
+		}
+		return nil, "", cost, fmt.Errorf("the model returned no images: %s", msg)
+	}
+	return blobs, strings.Join(text, "\n"), cost, nil
+}
+
+// imageDir is where the request's generated image files are written.
+// Workspaces each get a directory of their own under the output directory,
+// which /images/files/ cannot reach from outside the workspace.
+func (s *Server) imageDir(ctx context.Context) string {
+	dir := s.cfg.Images.OutputDir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(s.home, dir)
+	}
+	if ws := workspaceFrom(ctx); ws != nil {
+		dir = filepath.Join(dir, "workspaces", ws.name)
+	}
+	return dir
+}
+
+// saveImage writes an image to the output directory and returns its file
+// name, which /images/files/ serves.
+func (s *Server) saveImage(ctx context.Context, b imageBlob, i int) (string, error) {
+	ext := ".png"
+	if exts, _ := mime.ExtensionsByType(b.mimeType); len(exts) > 0 {
+		ext = exts[len(exts)-1]
+	}
+	name := fmt.Sprintf("%s_%s_%d%s", time.Now().UTC().Format("20060102-150405"), requestIDFrom(ctx), i+1, ext)
+	if err := os.MkdirAll(s.imageDir(ctx), 0755); err != nil {
+		return "", err
+	}
+	return name, os.WriteFile(filepath.Join(s.imageDir(ctx), name), b.data, 0644)
+}
+
+// normalizeImageRequest fills in defaults and checks the request.
+func (s *Server) normalizeImageRequest(req *ImageRequest) error {
+	if strings.TrimSpace(req.Prompt) == "" {
+		return fmt.Errorf("prompt is required")
+	}
+	if req.Model == "" {
+		req.Model = s.cfg.Images.Model
+	}
+	if req.N == 0 {
+		req.N = 1
+	}
+	if req.N < 0 || req.N > s.cfg.Images.MaxImages {
+		return fmt.Errorf("n must be between 1 and %d", s.cfg.Images.MaxImages)
+	}
+	if _, ok := aspectRatios[req.AspectRatio]; req.AspectRatio != "" && !ok {
+		return fmt.Errorf("unsupported aspect_ratio %q", req.AspectRatio)
+	}
+	if req.Output == "" {
+		req.Output = "base64"
+	}
+	if req.Output != "base64" && req.Output != "file" {
+		return fmt.Errorf("output must be base64 or file")
+	}
+	return nil
+}
+
+// runImages generates the images of req and encodes or saves them. It
+// returns the HTTP status to use on failure.
+func (s *Server) runImages(ctx context.Context, req *ImageRequest) (*ImageResponse, int, error) {
+	lg := s.requestLogger(ctx)
+	start := time.Now()
+	lg.Info("image request", "model", req.Model, "n", req.N, "aspect_ratio", req.AspectRatio, "output", req.Output, "msg", preview(req.Prompt, 50))
+
+	// Images generated before a failure are billed all the same
+	blobs, text, cost, err := s.generateImages(ctx, req)
+	total, cerr := s.sessions(ctx).AddCost(context.WithoutCancel(ctx), cost)
+	if cerr != nil {
+		lg.Error("recording cost", "error", cerr)
+	}
+	if err != nil {
+		s.logAbort(ctx, "upstream")
+		if ctx.Err() != nil {
+			return nil, upstreamStatus(ctx, err), abortError(ctx, err)
+		}
+		lg.Error("image generation failed", "model", req.Model, "error", err)
+		return nil, http.StatusBadGateway, err
+	}
+
+	resp := &ImageResponse{Model: req.Model, Text: text, Cost: cost, TotalCost: total, Images: []GeneratedImage{}}
+	for i, b := range blobs {
+		img := GeneratedImage{MimeType: b.mimeType}
+		if req.Output == "file" {
+			name, err := s.saveImage(ctx, b, i)
+			if err != nil {
+				return nil, http.StatusInternalServerError, fmt.Errorf("saving image: %w", err)
+			}
+			img.Path = filepath.Join(s.imageDir(ctx), name)
+			img.URL = "/images/files/" + name
+		} else {
+			img.Data = base64.StdEncoding.EncodeToString(b.data)
+		}
+		resp.Images = append(resp.Images, img)
+	}
+	lg.Info("image response", "model", req.Model, "images", len(resp.Images), "cost", cost, "latency_ms", time.Since(start).Milliseconds())
+	return resp, http.StatusOK, nil
+}
+
+// handleImages serves POST /images/generate, taking an ImageRequest and
+// answering an ImageResponse.
+func (s *Server) handleImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rctx, span := tracer.Start(r.Context(), "images.generate")
+	defer span.End()
+	ctx, cancel := s.endpointContext(rctx, config.EndpointWeb)
+	defer cancel()
+
+	var req ImageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := s.normalizeImageRequest(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, status, err := s.runImages(ctx, &req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleOpenAIImages serves POST /v1/images/generations in the OpenAI
+// format. Models other than Gemini and Imagen ones, such as dall-e-3, use
+// images.model, and size picks the closest supported aspect ratio.
+// response_format "url" (the default) saves the images and links them.
+func (s *Server) handleOpenAIImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rctx, span := tracer.Start(r.Context(), "openai.images")
+	defer span.End()
+	ctx, cancel := s.endpointContext(rctx, config.EndpointOpenAI)
+	defer cancel()
+
+	var body struct {
+		Prompt         string `json:"prompt"`
+		Model          string `json:"model"`
+		N              int    `json:"n"`
+		Size           string `json:"size"`
+		ResponseFormat string `json:"response_format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req := ImageRequest{Prompt: body.Prompt, N: body.N, AspectRatio: sizeAspectRatio(body.Size), Output: "file"}
+	if strings.HasPrefix(body.Model, "gemini-") || strings.HasPrefix(body.Model, "imagen-") {
+		req.Model = body.Model
+	}
+	if body.ResponseFormat == "b64_json" {
+		req.Output = "base64"
+	}
+	if err := s.normalizeImageRequest(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, status, err := s.runImages(ctx, &req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	data := []map[string]string{}
+	for _, img := range resp.Images {
+		if img.URL != "" {
+			data = append(data, map[string]string{"url": "http://" + r.Host + img.URL})
+		} else {
+			data = append(data, map[string]string{"b64_json": img.Data})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"created": time.Now().Unix(), "data": data})
+}
+
+// sizeAspectRatio maps an OpenAI size such as "1792x1024" to the closest
+// supported aspect ratio, or "" to use the model's default.
+func sizeAspectRatio(size string) string {
+	ws, hs, ok := strings.Cut(size, "x")
+	wv, err1 := strconv.Atoi(ws)
+	hv, err2 := strconv.Atoi(hs)
+	if !ok || err1 != nil || err2 != nil || wv <= 0 || hv <= 0 {
+		return ""
+	}
+	want := float64(wv) / float64(hv)
+	best, diff := "", math.Inf(1)
+	for name, ratio := range aspectRatios {
+		if d := math.Abs(math.Log(ratio / want)); d < diff {
+			best, diff = name, d
+		}
+	}
+	return best
+}
+
+// handleImageFiles serves the images saved under the output directory.
+func (s *Server) handleImageFiles(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/images/files/")
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(s.imageDir(r.Context()), name))
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// An index file is a gzipped gob of an indexData: a project's chunks and
+// embeddings keyed by relative path, with the model, dimensionality and
+// chunking they were made with. Nothing in it depends on where the project
+// is checked out, so one built by CI serves every clone of the repository.
+
+// writeIndexFile writes the index to w as an index file.
+func (ix *vectorIndex) writeIndexFile(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	ix.mu.RLock()
+	err := gob.NewEncoder(zw).Encode(ix.data)
+	ix.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// readIndexFile reads an index file.
+func readIndexFile(r io.Reader) (indexData, error) {
+	var data indexData
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return data, err
+	}
+	defer zr.Close()
+	if err := gob.NewDecoder(zr).Decode(&data); err != nil {
+		return data, err
+	}
+	if data.Files == nil {
+		data.Files = map[string]indexedFile{}
+	}
+	return data, nil
+}
+
+// ExportIndex brings the served project's index up to date and writes it
+// to path as an index file, for -index-export.
+func (s *Server) ExportIndex(ctx context.Context, path string) (IndexStatus, error) {
+	st, err := s.buildIndex(ctx, s.vectors)
+	if err != nil {
+		return st, err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return st, err
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return st, err
+	}
+	err = s.vectors.writeIndexFile(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return st, err
+}
+
+// openIndexFile opens Index.File, fetching it when it is an http(s) URL.
+func (s *Server) openIndexFile(ctx context.Context) (io.ReadCloser, error) {
+	src := s.cfg.Index.File
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return os.Open(src)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", src, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// importIndexFile loads Index.File into the served project's index when it
+// was built more recently than the index on disk, so local updates made
+// since the last import are kept. It has to match the configured model,
+// dimensions and chunking, or every chunk would be embedded again anyway.
+// The file's modification times are those of the machine that built it,
+// so the first update afterwards reads every file once to compare hashes,
+// but only embeds those whose content differs.
+func (s *Server) importIndexFile(ctx context.Context) error {
+	r, err := s.openIndexFile(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := readIndexFile(r)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", s.cfg.Index.File, err)
+	}
+	cfg := s.cfg.Index
+	if data.Model != cfg.Model || data.Dimensions != cfg.Dimensions || data.Chunking != chunkingKey(cfg) {
+		return fmt.Errorf("%s was built with %s at %d dimensions, chunked %s; this proxy uses %s at %d, chunked %s",
+			cfg.File, data.Model, data.Dimensions, data.Chunking, cfg.Model, cfg.Dimensions, chunkingKey(cfg))
+	}
+
+	ix := s.vectors
+	ix.mu.Lock()
+	if ix.building || !data.Built.After(ix.data.Built) {
+		ix.mu.Unlock()
+		s.logger.Info("semantic index is newer than the index file, keeping it", "file", cfg.File, "file_built", data.Built)
+		return nil
+	}
+	ix.data = data
+	ix.mu.Unlock()
+	if err := ix.save(); err != nil {
+		return fmt.Errorf("saving the index: %w", err)
+	}
+	st := ix.status()
+	s.logger.Info("semantic index imported", "file", cfg.File, "files", st.Files, "chunks", st.Chunks, "built", st.Built)
+	return nil
+}
+
+// handleIndexExport downloads a project's index as an index file, which
+// another proxy can import with -index-file.
+//
+//	GET /index/export?project=<name>
+func (s *Server) handleIndexExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ix := s.vectors
+	if name := r.URL.Query().Get("project"); name != "" {
+		if ix = s.indexNamed(name); ix == nil {
+			http.Error(w, "Unknown project "+name, http.StatusNotFound)
+			return
+		}
+	}
+	if ix.status().Built.IsZero() {
+		http.Error(w, "The index of "+ix.name+" has not been built; build it with POST /index", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", ix.name+".index.gz"))
+	if err := ix.writeIndexFile(w); err != nil {
+		s.logger.Warn("exporting semantic index", "project", ix.name, "error", err)
+	}
+}
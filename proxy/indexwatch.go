@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// IndexChanges lists the project files that differ from the semantic
+// index.
+type IndexChanges struct {
+	Changed []string `json:"changed,omitempty"`
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Rechunk bool     `json:"rechunk,omitempty"` // Chunking settings changed; every file is re-chunked
+}
+
+func (c IndexChanges) stale() bool {
+	return c.Rechunk || len(c.Changed)+len(c.Added)+len(c.Removed) > 0
+}
+
+// IndexStaleness is the semantic index's status with how far it has
+// fallen behind the project.
+type IndexStaleness struct {
+	IndexStatus
+	Stale        bool `json:"stale"`
+	WatchSeconds int  `json:"watch_seconds"` // 0 when the index is only updated on request
+	IndexChanges
+}
+
+// indexChanges compares a project with its index by size and
+// modification time, without reading any file.
+func (s *Server) indexChanges(ix *vectorIndex) (IndexChanges, error) {
+	ix.mu.RLock()
+	indexed := maps.Clone(ix.data.Files)
+	rechunk := ix.data.Chunking != chunkingKey(s.cfg.Index)
+	ix.mu.RUnlock()
+
+	c := IndexChanges{Rechunk: rechunk}
+	err := s.walkIndexable(ix.root, func(rel, _ string, info fs.FileInfo) {
+		f, ok := indexed[rel]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, rel)
+		case !f.unchanged(info):
+			c.Changed = append(c.Changed, rel)
+		}
+		delete(indexed, rel)
+	})
+	for rel := range indexed {
+		c.Removed = append(c.Removed, rel)
+	}
+	slices.Sort(c.Removed)
+	return c, err
+}
+
+// WatchIndex keeps the semantic indexes current until ctx is done. Every
+// Index.WatchSeconds it looks in each project for files added, changed or
+// removed since its index was last built and, if there are any, updates
+// it, which only re-embeds those files. An index that has never been built
+// is left for POST /index or -index to create. New exchanges in the
+// session store are added to the conversation index too.
+func (s *Server) WatchIndex(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.cfg.Index.WatchSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, ix := range s.indexes() {
+			if st := ix.status(); st.Built.IsZero() || st.Building {
+				continue
+			}
+			changes, err := s.indexChanges(ix)
+			if err != nil {
+				s.logger.Warn("checking the project for index changes", "project", ix.name, "error", err)
+				continue
+			}
+			if !changes.stale() {
+				continue
+			}
+			s.logger.Info("project changed, updating semantic index", "project", ix.name, "changed", len(changes.Changed), "added", len(changes.Added), "removed", len(changes.Removed), "rechunk", changes.Rechunk)
+			if _, err := s.buildIndex(ctx, ix); err != nil && !errors.Is(err, errIndexBuilding) {
+				s.logger.Warn("updating semantic index", "project", ix.name, "error", err)
+			}
+		}
+		if s.conversations != nil {
+			if err := s.updateConversationIndex(ctx); err != nil {
+				s.logger.Warn("updating conversation index", "error", err)
+			}
+		}
+	}
+}
+
+// handleIndexStatus reports a project's index status and the files that
+// have changed since it was built. Without a project, the served one is
+// reported.
+//
+//	GET /index/status?project=<name>
+func (s *Server) handleIndexStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ix := s.vectors
+	if name := r.URL.Query().Get("project"); name != "" {
+		if ix = s.indexNamed(name); ix == nil {
+			http.Error(w, "Unknown project "+name, http.StatusNotFound)
+			return
+		}
+	}
+	changes, err := s.indexChanges(ix)
+	if err != nil {
+		http.Error(w, "Checking project files: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(IndexStaleness{
+		IndexStatus:  ix.status(),
+		Stale:        changes.stale(),
+		WatchSeconds: s.cfg.Index.WatchSeconds,
+		IndexChanges: changes,
+	})
+}
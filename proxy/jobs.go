@@ -0,0 +1,380 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"customgemini/config"
+)
+
+// JobRun is the outcome of one run of a scheduled job.
+type JobRun struct {
+	Started    time.Time `json:"started"`
+	DurationMs int64     `json:"duration_ms"`
+	Manual     bool      `json:"manual,omitempty"` // Started through /jobs rather than the schedule
+	Result     string    `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// JobStatus is a scheduled job as /jobs reports it.
+type JobStatus struct {
+	Name     string     `json:"name"`
+	Task     string     `json:"task"`
+	Schedule string     `json:"schedule"`
+	Paused   bool       `json:"paused"`
+	Running  bool       `json:"running"`
+	Next     *time.Time `json:"next,omitempty"` // Unset while paused
+	Runs     int        `json:"runs"`
+	Failures int        `json:"failures"`
+	Last     *JobRun    `json:"last,omitempty"`
+}
+
+type job struct {
+	cfg      config.JobConfig
+	schedule config.Schedule
+
+	// Guarded by jobTable.mu
+	paused   bool
+	running  bool
+	next     time.Time
+	runs     int
+	failures int
+	last     *JobRun
+}
+
+// jobTable holds the configured jobs. Jobs run in the process that
+// schedules them, so replicas sharing a store each run every job.
+type jobTable struct {
+	mu   sync.Mutex
+	jobs []*job
+	wake chan struct{} // Pokes the scheduler when a job is paused or resumed
+}
+
+func newJobTable(cfgs []config.JobConfig) (*jobTable, error) {
+	t := &jobTable{wake: make(chan struct{}, 1)}
+	now := time.Now()
+	for _, c := range cfgs {
+		sched, err := config.ParseSchedule(c.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %w", c.Name, err)
+		}
+		t.jobs = append(t.jobs, &job{cfg: c, schedule: sched, paused: c.Paused, next: sched.Next(now)})
+	}
+	return t, nil
+}
+
+func (t *jobTable) find(name string) *job {
+	for _, j := range t.jobs {
+		if j.cfg.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+func (t *jobTable) status(j *job) JobStatus {
+	st := JobStatus{
+		Name:     j.cfg.Name,
+		Task:     j.cfg.Task,
+		Schedule: j.cfg.Schedule,
+		Paused:   j.paused,
+		Running:  j.running,
+		Runs:     j.runs,
+		Failures: j.failures,
+		Last:     j.last,
+	}
+	if !j.paused {
+		next := j.next
+		st.Next = &next
+	}
+	return st
+}
+
+func (t *jobTable) list() []JobStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]JobStatus, 0, len(t.jobs))
+	for _, j := range t.jobs {
+		list = append(list, t.status(j))
+	}
+	return list
+}
+
+// setPaused pauses or resumes a job. A resumed job runs at its next
+// scheduled time from now.
+func (t *jobTable) setPaused(j *job, paused bool) JobStatus {
+	t.mu.Lock()
+	j.paused = paused
+	j.next = j.schedule.Next(time.Now())
+	st := t.status(j)
+	t.mu.Unlock()
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	return st
+}
+
+// RunJobs runs the configured jobs on their schedules until ctx is done.
+// A job that is still running when it comes due again is skipped.
+func (s *Server) RunJobs(ctx context.Context) {
+	if len(s.jobs.jobs) == 0 {
+		return
+	}
+	s.logger.Info("job scheduler started", "jobs", len(s.jobs.jobs))
+	for {
+		now := time.Now()
+		wait := time.Hour
+		s.jobs.mu.Lock()
+		for _, j := range s.jobs.jobs {
+			if j.paused {
+				continue
+			}
+			if !j.next.After(now) {
+				j.next = j.schedule.Next(now)
+				if j.running {
+					s.logger.Warn("job still running, skipping its run", "job", j.cfg.Name)
+				} else {
+					j.running = true
+					go s.runJob(context.WithoutCancel(ctx), j, false)
+				}
+			}
+			wait = min(wait, j.next.Sub(now))
+		}
+		s.jobs.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.jobs.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// runJob runs j, which the caller has marked running, and records the
+// outcome.
+func (s *Server) runJob(ctx context.Context, j *job, manual bool) {
+	run := &JobRun{Started: time.Now().UTC(), Manual: manual}
+	lg := s.logger.With("job", j.cfg.Name, "task", j.cfg.Task)
+	lg.Info("job started", "manual", manual)
+	result, err := s.jobTask(ctx, j.cfg)
+	run.DurationMs = time.Since(run.Started).Milliseconds()
+	run.Result = result
+	if err != nil {
+		run.Error = err.Error()
+		lg.Error("job failed", "duration_ms", run.DurationMs, "error", err)
+	} else {
+		lg.Info("job finished", "duration_ms", run.DurationMs, "result", result)
+	}
+
+	s.jobs.mu.Lock()
+	defer s.jobs.mu.Unlock()
+	j.running = false
+	j.runs++
+	if err != nil {
+		j.failures++
+	}
+	j.last = run
+}
+
+// jobTask does the work of a job and describes what it did.
+func (s *Server) jobTask(ctx context.Context, cfg config.JobConfig) (string, error) {
+	switch cfg.Task {
+	case config.JobRebuildCache:
+		return s.rebuildCache(ctx)
+	case config.JobPruneSessions:
+		days := cfg.MaxAgeDays
+		if days == 0 {
+			days = config.DefaultPruneDays
+		}
+		n, err := s.PruneSessions(ctx, time.Duration(days)*24*time.Hour)
+		return fmt.Sprintf("deleted %d sessions idle for %d days", n, days), err
+	case config.JobCostReport:
+		return s.sendCostReport(ctx, cfg)
+	case config.JobRepoDigest:
+		return s.sendRepoDigest(ctx, cfg)
+	}
+	return "", fmt.Errorf("unknown task %q", cfg.Task)
+}
+
+// rebuildCache builds a new context cache from the project and, once it is
+// active, deletes the one it replaces.
+func (s *Server) rebuildCache(ctx context.Context) (string, error) {
+	old, _ := s.Cache()
+	name := s.BuildCache(ctx)
+	if name == "" {
+		return "", errors.New("building the cache failed; the previous cache stays active")
+	}
+	if old != "" && old != name {
+		if _, err := s.client.Caches.Delete(ctx, old, nil); err != nil {
+			s.logger.Warn("deleting the replaced cache", "cache_id", old, "error", err)
+		}
+	}
+	return "built " + name, nil
+}
+
+// PruneSessions deletes the sessions, in every workspace, not updated for
+// maxAge, and returns how many it deleted.
+func (s *Server) PruneSessions(ctx context.Context, maxAge time.Duration) (int, error) {
+	list, err := s.store.ListSessions(ctx)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-maxAge)
+	n := 0
+	for _, info := range list {
+		if info.Updated.After(cutoff) {
+			continue
+		}
+		if err := s.store.DeleteSession(ctx, info.ID); err != nil {
+			return n, err
+		}
+		s.uploads.drop(info.ID)
+		n++
+	}
+	return n, nil
+}
+
+// CostReportMessage is the JSON a cost_report job POSTs to its webhook.
+type CostReportMessage struct {
+	Job    string      `json:"job"`
+	Report UsageReport `json:"report"`
+}
+
+// sendCostReport sends the previous UTC day's usage by model to the job's
+// webhook and mail recipients. Each is tried even when another fails.
+func (s *Server) sendCostReport(ctx context.Context, cfg config.JobConfig) (string, error) {
+	day := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	report, err := s.UsageReport(ctx, day, day, GroupByModel)
+	if err != nil {
+		return "", err
+	}
+	var sent []string
+	var errs []error
+	if cfg.Webhook != "" {
+		body, err := json.Marshal(CostReportMessage{Job: cfg.Name, Report: report})
+		if err == nil {
+			err = postJSON(ctx, cfg.Webhook, body, "")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		} else {
+			sent = append(sent, "webhook")
+		}
+	}
+	if len(cfg.Email) > 0 {
+		if err := s.mailCostReport(cfg.Email, report); err != nil {
+			errs = append(errs, fmt.Errorf("email: %w", err))
+		} else {
+			sent = append(sent, "email")
+		}
+	}
+	result := fmt.Sprintf("%s: $%.4f over %d requests", report.Since, report.Total.Cost, report.Total.Requests)
+	if len(sent) > 0 {
+		result += ", sent by " + strings.Join(sent, " and ")
+	}
+	return result, errors.Join(errs...)
+}
+
+func (s *Server) mailCostReport(to []string, report UsageReport) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Usage on %s (UTC)\r\n\r\n", report.Since)
+	for _, row := range report.Rows {
+		fmt.Fprintf(&b, "%-32s %8d requests  $%.4f\r\n", row.Key, row.Requests, row.Cost)
+	}
+	fmt.Fprintf(&b, "%-32s %8d requests  $%.4f\r\n", "Total", report.Total.Requests, report.Total.Cost)
+	fmt.Fprintf(&b, "\r\nCache savings: $%.4f\r\n", report.Total.CacheSavings)
+	return s.sendMail(to, "Gemini proxy cost report for "+report.Since, b.String())
+}
+
+// sendMail mails a plain text body through the configured SMTP server.
+func (s *Server) sendMail(to []string, subject, body string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\n", s.cfg.SMTP.From, strings.Join(to, ", "), subject)
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(body)
+
+	var auth smtp.Auth
+	if c := s.cfg.SMTP; c.Username != "" {
+		host, _, _ := strings.Cut(c.Addr, ":")
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	return smtp.SendMail(s.cfg.SMTP.Addr, auth, s.cfg.SMTP.From, to, []byte(b.String()))
+}
+
+// handleJobs lists the scheduled jobs and controls them.
+//
+//	GET  /jobs               every job, with its next and last run
+//	GET  /jobs/{name}        one job
+//	POST /jobs/{name}/run    run it now
+//	POST /jobs/{name}/pause  stop running it on schedule
+//	POST /jobs/{name}/resume run it on schedule again
+func (s *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON := func(status int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	rest := strings.TrimPrefix(r.URL.Path, "/jobs")
+	if rest == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(http.StatusOK, map[string]any{"jobs": s.jobs.list()})
+		return
+	}
+	name, action, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+	j := s.jobs.find(name)
+	if !strings.HasPrefix(rest, "/") || j == nil {
+		http.Error(w, "No job with this name", http.StatusNotFound)
+		return
+	}
+	if action == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.jobs.mu.Lock()
+		st := s.jobs.status(j)
+		s.jobs.mu.Unlock()
+		writeJSON(http.StatusOK, st)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lg := s.requestLogger(r.Context())
+	switch action {
+	case "run":
+		s.jobs.mu.Lock()
+		if j.running {
+			s.jobs.mu.Unlock()
+			http.Error(w, "The job is already running", http.StatusConflict)
+			return
+		}
+		j.running = true
+		st := s.jobs.status(j)
+		s.jobs.mu.Unlock()
+		lg.Info("job run requested", "job", name)
+		go s.runJob(context.WithoutCancel(r.Context()), j, true)
+		writeJSON(http.StatusAccepted, st)
+	case "pause", "resume":
+		lg.Info("job "+action+" requested", "job", name)
+		writeJSON(http.StatusOK, s.jobs.setPaused(j, action == "pause"))
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,331 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// A turn journal records a turn's tool calls on disk while they run, so
+// that a turn the proxy stopped in the middle of leaves a trace. It is
+// written before the first tool runs and removed when the turn ends;
+// turns that run no tools never touch the disk. RecoverTurns finds the
+// journals left behind by a process that is gone, rolls back the files
+// they wrote if crash_recovery is rollback, and annotates their sessions.
+//
+// A process ID cannot tell whether the writer of a journal is gone: a
+// restarted proxy in a container is PID 1 again, and a PID may be reused.
+// Instead each process holds a lock on a file of its own in the journal
+// directory for as long as it runs, and names that file in its journals.
+// A journal whose lock nobody holds was left by a process that is gone.
+
+// Journal entry statuses
+const (
+	journalPending = "pending" // Started; the proxy stopped before it returned
+	journalDone    = "done"
+	journalFailed  = "failed"
+)
+
+// turnJournal is a turn in progress. It is used by one request at a time.
+type turnJournal struct {
+	path string
+
+	RequestID string         `json:"request_id"`
+	PID       int            `json:"pid"`
+	Owner     string         `json:"owner,omitempty"` // ID of the writer's lock file, <owner>.lock
+	Endpoint  string         `json:"endpoint,omitempty"`
+	Workspace string         `json:"workspace,omitempty"`
+	Session   string         `json:"session,omitempty"` // Empty for requests that keep no session
+	Message   string         `json:"message"`
+	Started   time.Time      `json:"started"`
+	Tools     []journalEntry `json:"tools"`
+}
+
+// journalEntry is one tool call of a turn. A write_file call keeps the
+// file as it was before, to roll back to, and once done the lines it
+// changed, for write hooks.
+type journalEntry struct {
+	Tool     string       `json:"tool"`
+	Path     string       `json:"path,omitempty"`
+	Status   string       `json:"status"`
+	File     string       `json:"file,omitempty"` // Absolute path of the file written
+	Existed  bool         `json:"existed,omitempty"`
+	Previous []byte       `json:"previous,omitempty"`
+	Diff     *DiffSummary `json:"diff,omitempty"`
+}
+
+func (s *Server) journalDir() string {
+	return filepath.Join(s.home, "journal")
+}
+
+// beginTurn starts the journal of a turn on session, which the returned
+// context carries to executeTool. The returned func ends the turn, removes
+// its journal and tells the write hooks about the files it wrote; it must
+// be called however the turn ends, short of the process dying.
+func (s *Server) beginTurn(ctx context.Context, session, message string) (context.Context, func()) {
+	id := requestIDFrom(ctx)
+	if id == "" {
+		id = newRequestID()
+	}
+	j := &turnJournal{
+		path:      filepath.Join(s.journalDir(), id+".json"),
+		RequestID: id,
+		PID:       os.Getpid(),
+		Owner:     s.journalOwner(),
+		Endpoint:  endpointFrom(ctx),
+		Session:   session,
+		Message:   message,
+		Started:   time.Now().UTC(),
+	}
+	if ws := workspaceFrom(ctx); ws != nil {
+		j.Workspace = ws.name
+	}
+	return context.WithValue(ctx, journalKey, j), func() {
+		if len(j.Tools) > 0 {
+			os.Remove(j.path)
+			s.notifyWrites(ctx, j)
+		}
+	}
+}
+
+func journalFrom(ctx context.Context) *turnJournal {
+	j, _ := ctx.Value(journalKey).(*turnJournal)
+	return j
+}
+
+// toolStarted records a tool call about to run, and returns its index for
+// toolFinished. A failure to write the journal is logged; the tool runs
+// regardless.
+func (s *Server) toolStarted(ctx context.Context, name string, args map[string]any) int {
+	j := journalFrom(ctx)
+	if j == nil {
+		return -1
+	}
+	e := journalEntry{Tool: name, Status: journalPending}
+	e.Path, _ = args["path"].(string)
+	if name == "write_file" && e.Path != "" {
+		if file, _, ok := s.projectPath(ctx, e.Path); ok {
+			e.File = file
+			data, err := os.ReadFile(file)
+			e.Existed = !errors.Is(err, fs.ErrNotExist)
+			e.Previous = data
+		}
+	}
+	j.Tools = append(j.Tools, e)
+	if err := j.save(); err != nil {
+		s.requestLogger(ctx).Warn("writing turn journal", "error", err)
+	}
+	return len(j.Tools) - 1
+}
+
+// toolFinished records the result of the tool call at index i.
+func (s *Server) toolFinished(ctx context.Context, i int, result map[string]any) {
+	j := journalFrom(ctx)
+	if j == nil || i < 0 {
+		return
+	}
+	j.Tools[i].Status = journalDone
+	if _, failed := result["error"]; failed {
+		j.Tools[i].Status = journalFailed
+	}
+	j.Tools[i].Diff, _ = result["diff"].(*DiffSummary)
+	if err := j.save(); err != nil {
+		s.requestLogger(ctx).Warn("writing turn journal", "error", err)
+	}
+}
+
+// lockJournal creates this process's lock file in the journal directory
+// and locks it until the process exits, returning the owner ID journals
+// name it by. When the lock cannot be taken, the journals of this process
+// fall back to being told apart by PID.
+func (s *Server) lockJournal() string {
+	owner := newRequestID()
+	path := filepath.Join(s.journalDir(), owner+".lock")
+	if err := os.MkdirAll(s.journalDir(), 0o755); err != nil {
+		s.logger.Warn("locking turn journals", "error", err)
+		return ""
+	}
+	f, err := lockFile(path)
+	if err != nil {
+		s.logger.Warn("locking turn journals", "error", err)
+		os.Remove(path)
+		return ""
+	}
+	s.journalLock = f
+	return owner
+}
+
+// writerGone reports whether the process that wrote j has stopped.
+func (s *Server) writerGone(j *turnJournal) bool {
+	if j.Owner == "" {
+		return j.PID != os.Getpid() && !processAlive(j.PID)
+	}
+	if j.Owner == s.journalOwner() {
+		return false
+	}
+	return !lockHeld(filepath.Join(s.journalDir(), j.Owner+".lock"), j.PID)
+}
+
+// save writes the journal through a temporary file, so a crash leaves
+// either the old journal or the new one.
+func (j *turnJournal) save() error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0o755); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// RecoverTurns deals with the turns interrupted by a proxy that stopped
+// while running their tools. Each has its session annotated with the
+// message and the tools that ran; with crash_recovery rollback, the files
+// the turn wrote are first restored, newest write first. Journals of
+// processes still running are left alone, and the lock files of those
+// gone are removed. It returns the number of turns recovered.
+func (s *Server) RecoverTurns(ctx context.Context) int {
+	defer s.removeStaleLocks()
+	paths, _ := filepath.Glob(filepath.Join(s.journalDir(), "*.json"))
+	recovered := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var j turnJournal
+		if err := json.Unmarshal(data, &j); err != nil {
+			s.logger.Warn("unreadable turn journal", "path", path, "error", err)
+			continue
+		}
+		if !s.writerGone(&j) {
+			continue
+		}
+		rolledBack := 0
+		if s.cfg.CrashRecovery == config.CrashRecoveryRollback {
+			rolledBack = s.rollBack(j.Tools)
+		}
+		if j.Session != "" {
+			if err := s.annotateInterrupted(ctx, j, rolledBack > 0); err != nil {
+				s.logger.Warn("annotating interrupted turn", "session", j.Session, "error", err)
+				continue
+			}
+		}
+		os.Remove(path)
+		recovered++
+		s.logger.Warn("recovered interrupted turn", "request_id", j.RequestID, "session", j.Session, "endpoint", j.Endpoint,
+			"started", j.Started, "tools", len(j.Tools), "rolled_back", rolledBack)
+	}
+	return recovered
+}
+
+// removeStaleLocks removes the lock files of processes that are gone and
+// left no journal behind.
+func (s *Server) removeStaleLocks() {
+	own := s.journalOwner()
+	locks, _ := filepath.Glob(filepath.Join(s.journalDir(), "*.lock"))
+	journals, _ := filepath.Glob(filepath.Join(s.journalDir(), "*.json"))
+	owners := map[string]bool{}
+	for _, path := range journals {
+		var j turnJournal
+		if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &j) == nil {
+			owners[j.Owner] = true
+		}
+	}
+	for _, path := range locks {
+		owner := strings.TrimSuffix(filepath.Base(path), ".lock")
+		if owner != own && !owners[owner] && !lockHeld(path, 0) {
+			os.Remove(path)
+		}
+	}
+}
+
+// rollBack restores the files written by entries, newest first, deleting
+// those that did not exist before, and returns the number restored.
+func (s *Server) rollBack(entries []journalEntry) int {
+	n := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.File == "" {
+			continue
+		}
+		var err error
+		if e.Existed {
+			err = os.WriteFile(e.File, e.Previous, 0o644)
+		} else if err = os.Remove(e.File); errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			s.logger.Warn("rolling back interrupted write", "path", e.Path, "error", err)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// annotateInterrupted adds the turn's message to its session, answered by
+// a note of what it did before the proxy stopped, so the transcript shows
+// the turn and the model sees it on the next one.
+func (s *Server) annotateInterrupted(ctx context.Context, j turnJournal, rolledBack bool) error {
+	store := s.store
+	if j.Workspace != "" {
+		ws := s.workspaceNamed(j.Workspace)
+		if ws == nil {
+			return fmt.Errorf("workspace %s is no longer configured", j.Workspace)
+		}
+		store = ws.store
+	}
+	history, err := store.History(ctx, j.Session)
+	if err != nil {
+		return err
+	}
+	var tools []string
+	for _, e := range j.Tools {
+		t := e.Tool
+		if e.Path != "" {
+			t += " " + e.Path
+		}
+		if e.Status != journalDone {
+			t += " (" + e.Status + ")"
+		}
+		tools = append(tools, t)
+	}
+	note := fmt.Sprintf("[The proxy stopped during this turn, after running: %s.", strings.Join(tools, ", "))
+	if rolledBack {
+		note += " The files it wrote were restored to how they were before the turn."
+	} else if j.wrote() {
+		note += " The files it wrote were kept, so the change may be half done."
+	}
+	note += " The turn has no answer; send the message again to retry it.]"
+	history = append(history,
+		&genai.Content{Role: genai.RoleUser, Parts: []*genai.Part{{Text: j.Message}}},
+		&genai.Content{Role: genai.RoleModel, Parts: []*genai.Part{{Text: note}}},
+	)
+	return store.SetHistory(ctx, j.Session, history)
+}
+
+// wrote reports whether the turn wrote, or may have written, any file.
+func (j *turnJournal) wrote() bool {
+	for _, e := range j.Tools {
+		if e.File != "" && e.Status != journalFailed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+//go:build !unix || aix || solaris
+
+package proxy
+
+import "os"
+
+// lockFile creates the file at path and keeps it open. Without flock
+// there is no lock to take; see lockHeld.
+func lockFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+}
+
+// lockHeld reports whether the process that created the lock file at path
+// may still be running. Without flock that is judged by its PID, and a
+// lock file with no PID to go by is taken as held.
+func lockHeld(path string, pid int) bool {
+	if _, err := os.Stat(path); err != nil {
+		return false
+	}
+	return pid == 0 || processAlive(pid)
+}
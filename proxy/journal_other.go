@@ -0,0 +1,13 @@
+//go:build !unix
+
+package proxy
+
+import "os"
+
+// processAlive reports whether a process with the ID may exist. Finding a
+// process fails on Windows when there is none; elsewhere it always
+// succeeds, which leaves journals alone rather than recover a live turn.
+func processAlive(pid int) bool {
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
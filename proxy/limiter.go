@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"customgemini/config"
+)
+
+// shedRetryAfter is the Retry-After hint, in seconds, sent with a 429.
+const shedRetryAfter = 5
+
+var (
+	errQueueFull    = errors.New("too many requests queued")
+	errQueueTimeout = errors.New("timed out waiting for a free slot")
+)
+
+// limiter bounds the generation requests served at once. A request holds
+// its slot for its whole tool loop, so a burst from several IDE clients
+// queues up instead of opening unbounded concurrent upstream calls. A nil
+// limiter admits everything.
+type limiter struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+func newLimiter(cfg config.ConcurrencyConfig) *limiter {
+	if cfg.MaxInFlight <= 0 {
+		return nil
+	}
+	return &limiter{
+		slots:   make(chan struct{}, cfg.MaxInFlight),
+		queue:   make(chan struct{}, cfg.MaxQueue),
+		timeout: time.Duration(cfg.QueueTimeoutSeconds) * time.Second,
+	}
+}
+
+// acquire takes a slot, waiting in the queue if none is free. The returned
+// release must be called once the request is done.
+func (l *limiter) acquire(ctx context.Context) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	release = func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+		defer func() { <-l.queue }()
+	default:
+		return nil, errQueueFull
+	}
+
+	var expired <-chan time.Time
+	if l.timeout > 0 {
+		t := time.NewTimer(l.timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-expired:
+		return nil, errQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stats reports the slots in use and the requests waiting for one.
+func (l *limiter) stats() (inFlight, queued int) {
+	if l == nil {
+		return 0, 0
+	}
+	return len(l.slots), len(l.queue)
+}
+
+// withUpstreamLimit admits a generation request through the server's
+// limiter, shedding it with 429 when the queue is full or the wait expires.
+// While the circuit breaker is open it fails at once with 503 instead, and
+// once the request's workspace has spent its daily budget, with 429.
+func (s *Server) withUpstreamLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.breaker.check(); err != nil {
+			writeCircuitOpen(w, err, s.breaker.status())
+			return
+		}
+		if err := s.checkBudget(r.Context()); err != nil {
+			s.requestLogger(r.Context()).Warn("request refused", "endpoint", r.URL.Path, "reason", err.Error())
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		release, err := s.limiter.acquire(r.Context())
+		if err != nil {
+			if r.Context().Err() != nil {
+				s.logAbort(r.Context(), "queue")
+				return
+			}
+			inFlight, queued := s.limiter.stats()
+			s.requestLogger(r.Context()).Warn("request shed",
+				"endpoint", r.URL.Path,
+				"reason", err.Error(),
+				"in_flight", inFlight,
+				"queued", queued,
+			)
+			w.Header().Set("Retry-After", strconv.Itoa(shedRetryAfter))
+			http.Error(w, "Server busy: "+err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		defer release()
+		next(w, r)
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"customgemini/config"
+)
+
+// NewLogger returns a leveled logger in the configured format ("text" or
+// "json") writing to stdout and to the rotating log file under home/logs.
+func NewLogger(cfg config.Config, home string) *slog.Logger {
+	logsDir := filepath.Join(home, "logs")
+	retention := time.Duration(cfg.LogRetentionDays) * 24 * time.Hour
+	logFile, err := newRotatingWriter(logsDir, "server", int64(cfg.LogMaxSizeMB)<<20, retention)
+	if err != nil {
+		log.Printf("Warning: Could not open log file: %v", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if logFile != nil {
+		out = io.MultiWriter(os.Stdout, logFile)
+	}
+	return slog.New(newLogHandler(out, cfg.LogFormat, parseLevel(cfg.LogLevel)))
+}
+
+func newLogHandler(w io.Writer, format string, level slog.Level) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+func parseLevel(s string) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.ToUpper(s))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// preview shortens s to n runes on a single line for log output.
+func preview(s string, n int) string {
+	s = strings.ReplaceAll(s, "\n", " ")
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "..."
+	}
+	return s
+}
+
+// writeDebugResponse saves a request's full response under logs/debug
+// while the dump_responses switch is on.
+func (s *Server) writeDebugResponse(ctx context.Context, content string) {
+	if !s.debug.dumpResponses.Load() {
+		return
+	}
+	s.writeDebugDump(ctx, s.debugDir(), []byte(content))
+}
+
+// pruneDebugDumps deletes the oldest files matching pattern beyond limit.
+// Dump names start with a timestamp, so lexical order is chronological.
+func pruneDebugDumps(dir, pattern string, limit int) {
+	if limit <= 0 {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+	if len(matches) <= limit {
+		return
+	}
+	sort.Strings(matches)
+	for _, m := range matches[:len(matches)-limit] {
+		os.Remove(m)
+	}
+}
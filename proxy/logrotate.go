@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingWriter appends to logs/<name>_YYYY-MM-DD.log and starts a new
+// file when the day changes or the current one exceeds maxBytes. Finished
+// files are gzipped and files older than the retention window are deleted.
+type rotatingWriter struct {
+	mu        sync.Mutex
+	dir       string
+	name      string        // "server" or "access"
+	maxBytes  int64         // 0 disables size-based rotation
+	retention time.Duration // 0 keeps logs forever
+
+	file *os.File
+	day  string
+	size int64
+}
+
+func newRotatingWriter(dir, name string, maxBytes int64, retention time.Duration) (*rotatingWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &rotatingWriter{dir: dir, name: name, maxBytes: maxBytes, retention: retention}
+	if err := w.open(time.Now()); err != nil {
+		return nil, err
+	}
+	w.cleanup()
+	return w, nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	if day := now.Format("2006-01-02"); day != w.day || (w.maxBytes > 0 && w.size+int64(len(p)) > w.maxBytes && w.size > 0) {
+		if err := w.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) path(day string) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s_%s.log", w.name, day))
+}
+
+func (w *rotatingWriter) open(now time.Time) error {
+	w.day = now.Format("2006-01-02")
+	f, err := os.OpenFile(w.path(w.day), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+// rotate closes the active file, moving it aside with a sequence number when
+// it is rotated for size within the same day, and opens a fresh one.
+func (w *rotatingWriter) rotate(now time.Time) error {
+	w.file.Close()
+	if now.Format("2006-01-02") == w.day {
+		current := w.path(w.day)
+		for i := 1; ; i++ {
+			next := strings.TrimSuffix(current, ".log") + fmt.Sprintf(".%d.log", i)
+			if !exists(next) && !exists(next+".gz") {
+				os.Rename(current, next)
+				break
+			}
+		}
+	}
+	if err := w.open(now); err != nil {
+		return err
+	}
+	go w.cleanup()
+	return nil
+}
+
+// cleanup compresses every finished log and prunes expired ones.
+func (w *rotatingWriter) cleanup() {
+	w.mu.Lock()
+	active := w.path(w.day)
+	w.mu.Unlock()
+
+	matches, _ := filepath.Glob(filepath.Join(w.dir, w.name+"_*.log*"))
+	sort.Strings(matches)
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil {
+			continue
+		}
+		if w.retention > 0 && time.Since(info.ModTime()) > w.retention {
+			os.Remove(m)
+			continue
+		}
+		if m != active && strings.HasSuffix(m, ".log") {
+			if err := gzipFile(m); err != nil {
+				slog.Warn("compressing log", "path", m, "error", err)
+			}
+		}
+	}
+}
+
+// gzipFile replaces path with path.gz, keeping the modification time so
+// retention still counts from when the log was last written.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(path)
+	zw.ModTime = info.ModTime()
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	os.Chtimes(path+".gz", info.ModTime(), info.ModTime())
+	return os.Remove(path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
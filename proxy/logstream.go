@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logHub fans structured log records out to live /logs/stream subscribers
+// and keeps a short backlog for clients that just connected. The tool
+// activity feed uses a second hub of JSON-encoded ToolActivity entries.
+type logHub struct {
+	mu      sync.Mutex
+	subs    map[chan []byte]struct{}
+	backlog [][]byte
+	next    int
+}
+
+const logBacklogSize = 500
+
+func newLogHub() *logHub {
+	return &logHub{subs: map[chan []byte]struct{}{}}
+}
+
+func (h *logHub) publish(line []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.backlog) < logBacklogSize {
+		h.backlog = append(h.backlog, line)
+	} else {
+		h.backlog[h.next] = line
+		h.next = (h.next + 1) % logBacklogSize
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- line:
+		default: // Slow subscriber; drop rather than stall logging
+		}
+	}
+}
+
+func (h *logHub) subscribe() (chan []byte, [][]byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan []byte, 256)
+	h.subs[ch] = struct{}{}
+	return ch, h.ordered()
+}
+
+// recent returns the backlog, oldest first.
+func (h *logHub) recent() [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ordered()
+}
+
+// ordered copies the backlog ring oldest first. The caller holds mu.
+func (h *logHub) ordered() [][]byte {
+	out := make([][]byte, 0, len(h.backlog))
+	out = append(out, h.backlog[h.next:]...)
+	return append(out, h.backlog[:h.next]...)
+}
+
+func (h *logHub) unsubscribe(ch chan []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+func (h *logHub) watched() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs) > 0
+}
+
+// hubHandler encodes records as JSON lines for the hub. Records at the
+// configured level are always kept for the backlog; debug records are only
+// produced while someone is watching.
+type hubHandler struct {
+	hub   *logHub
+	level slog.Level
+	json  slog.Handler
+	buf   *bytes.Buffer
+	mu    *sync.Mutex
+}
+
+func newHubHandler(hub *logHub, level slog.Level) *hubHandler {
+	buf := &bytes.Buffer{}
+	return &hubHandler{
+		hub:   hub,
+		level: level,
+		json:  slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		buf:   buf,
+		mu:    &sync.Mutex{},
+	}
+}
+
+func (h *hubHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level || h.hub.watched()
+}
+
+func (h *hubHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.json.Handle(ctx, r); err != nil {
+		return err
+	}
+	h.hub.publish(bytes.Clone(bytes.TrimSpace(h.buf.Bytes())))
+	return nil
+}
+
+func (h *hubHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &hubHandler{hub: h.hub, level: h.level, json: h.json.WithAttrs(attrs), buf: h.buf, mu: h.mu}
+}
+
+func (h *hubHandler) WithGroup(name string) slog.Handler {
+	return &hubHandler{hub: h.hub, level: h.level, json: h.json.WithGroup(name), buf: h.buf, mu: h.mu}
+}
+
+// teeHandler sends each record to every handler that accepts its level.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range t {
+		if h.Enabled(ctx, r.Level) {
+			if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// logFilter selects which streamed records a subscriber sees. A session
+// filter also follows the request IDs first seen with that session, so tool
+// and upstream records of the same request are included.
+type logFilter struct {
+	level     slog.Level
+	session   string
+	requestID string
+	requests  map[string]bool
+}
+
+func (f *logFilter) match(line []byte) bool {
+	var rec struct {
+		Level     string `json:"level"`
+		Session   string `json:"session"`
+		RequestID string `json:"request_id"`
+	}
+	if json.Unmarshal(line, &rec) != nil {
+		return false
+	}
+	if parseLevel(rec.Level) < f.level {
+		return false
+	}
+	if f.requestID != "" && rec.RequestID != f.requestID {
+		return false
+	}
+	if f.session != "" {
+		if rec.Session == f.session && rec.RequestID != "" {
+			f.requests[rec.RequestID] = true
+		}
+		return rec.Session == f.session || f.requests[rec.RequestID]
+	}
+	return true
+}
+
+// handleLogStream tails the structured log as Server-Sent Events. Query
+// parameters: level (minimum, default debug), session, request_id and
+// backlog (recent records to replay first, default 100).
+func (s *Server) handleLogStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	filter := &logFilter{
+		level:     slog.LevelDebug,
+		session:   q.Get("session"),
+		requestID: q.Get("request_id"),
+		requests:  map[string]bool{},
+	}
+	if lv := q.Get("level"); lv != "" {
+		if !streamLevel(lv) {
+			http.Error(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+		filter.level = parseLevel(lv)
+	}
+	backlog := 100
+	if n, err := strconv.Atoi(q.Get("backlog")); err == nil && n >= 0 {
+		backlog = n
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ch, recent := s.logs.subscribe()
+	defer s.logs.unsubscribe(ch)
+
+	var replay [][]byte
+	for _, line := range recent {
+		if filter.match(line) {
+			replay = append(replay, line)
+		}
+	}
+	if len(replay) > backlog {
+		replay = replay[len(replay)-backlog:]
+	}
+	for _, line := range replay {
+		fmt.Fprintf(w, "data: %s\n\n", line)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case line := <-ch:
+			if filter.match(line) {
+				fmt.Fprintf(w, "data: %s\n\n", line)
+				flusher.Flush()
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// streamLevel reports whether s names a valid log level for the stream.
+func streamLevel(s string) bool {
+	switch strings.ToLower(s) {
+	case "debug", "info", "warn", "error":
+		return true
+	}
+	return false
+}
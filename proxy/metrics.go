@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+)
+
+// handleMetrics exposes counters in the Prometheus text format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP gemini_proxy_http_requests_total Requests served, by status class.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_http_requests_total counter")
+	var served uint64
+	for class := 1; class <= 5; class++ {
+		n := s.http.requests[class].Load()
+		served += n
+		fmt.Fprintf(w, "gemini_proxy_http_requests_total{code=\"%dxx\"} %d\n", class, n)
+	}
+	fmt.Fprintln(w, "# HELP gemini_proxy_http_request_duration_seconds Time spent serving requests, streams included.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_http_request_duration_seconds summary")
+	fmt.Fprintf(w, "gemini_proxy_http_request_duration_seconds_sum %g\n", float64(s.http.durations.Load())/1e6)
+	fmt.Fprintf(w, "gemini_proxy_http_request_duration_seconds_count %d\n", served)
+	fmt.Fprintln(w, "# HELP gemini_proxy_http_requests_in_flight Requests being served, this one included.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_http_requests_in_flight gauge")
+	fmt.Fprintf(w, "gemini_proxy_http_requests_in_flight %d\n", s.http.inFlight.Load())
+	fmt.Fprintln(w, "# HELP gemini_proxy_panics_total Requests whose handler panicked.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_panics_total counter")
+	fmt.Fprintf(w, "gemini_proxy_panics_total %d\n", s.panics.Load())
+
+	var hits, misses uint64
+	if c := s.respCache; c != nil {
+		hits, misses = c.hits.Load(), c.misses.Load()
+	}
+	fmt.Fprintln(w, "# HELP gemini_proxy_response_cache_hits_total Upstream requests answered from the response cache.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_response_cache_hits_total counter")
+	fmt.Fprintf(w, "gemini_proxy_response_cache_hits_total %d\n", hits)
+	fmt.Fprintln(w, "# HELP gemini_proxy_response_cache_misses_total Cacheable upstream requests sent to the Gemini API.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_response_cache_misses_total counter")
+	fmt.Fprintf(w, "gemini_proxy_response_cache_misses_total %d\n", misses)
+	fmt.Fprintln(w, "# HELP gemini_proxy_response_cache_entries Responses currently held in the response cache.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_response_cache_entries gauge")
+	fmt.Fprintf(w, "gemini_proxy_response_cache_entries %d\n", s.respCache.len())
+	fmt.Fprintln(w, "# HELP gemini_proxy_upstream_retries_total Upstream calls repeated after a transient failure.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_upstream_retries_total counter")
+	fmt.Fprintf(w, "gemini_proxy_upstream_retries_total %d\n", s.upstreamRetries.Load())
+	st := s.breaker.status()
+	open := 0
+	if st.State != breakerClosed {
+		open = 1
+	}
+	fmt.Fprintln(w, "# HELP gemini_proxy_breaker_open Whether the upstream circuit breaker is open or half-open.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_breaker_open gauge")
+	fmt.Fprintf(w, "gemini_proxy_breaker_open %d\n", open)
+	fmt.Fprintln(w, "# HELP gemini_proxy_breaker_opens_total Times the upstream circuit breaker has opened.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_breaker_opens_total counter")
+	fmt.Fprintf(w, "gemini_proxy_breaker_opens_total %d\n", st.Opens)
+	quota := s.quota.status()
+	models := slices.Sorted(maps.Keys(quota))
+	fmt.Fprintln(w, "# HELP gemini_proxy_quota_throttled_total Upstream calls held back as the model's rate limit came near.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_quota_throttled_total counter")
+	for _, m := range models {
+		fmt.Fprintf(w, "gemini_proxy_quota_throttled_total{model=%q} %d\n", m, quota[m].Throttled)
+	}
+	fmt.Fprintln(w, "# HELP gemini_proxy_quota_exceeded_total Upstream calls answered 429 for exceeding a quota.")
+	fmt.Fprintln(w, "# TYPE gemini_proxy_quota_exceeded_total counter")
+	for _, m := range models {
+		fmt.Fprintf(w, "gemini_proxy_quota_exceeded_total{model=%q} %d\n", m, quota[m].Exceeded)
+	}
+}
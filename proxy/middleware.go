@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// middleware wraps a handler with behavior shared by every request.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in mws, the first outermost, so a request passes through
+// them in the order they are listed.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for _, mw := range slices.Backward(mws) {
+		h = mw(h)
+	}
+	return h
+}
+
+// route is an endpoint of the server. Upstream endpoints call Gemini, so
+// they are admitted through the concurrency limiter and the workspace's
+// budget.
+type route struct {
+	pattern  string
+	handler  http.HandlerFunc
+	upstream bool
+}
+
+// newRouter registers routes on a mux of their own.
+func (s *Server) newRouter(routes []route) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rt := range routes {
+		h := rt.handler
+		if rt.upstream {
+			h = s.withUpstreamLimit(h)
+		}
+		mux.HandleFunc(rt.pattern, h)
+	}
+	return mux
+}
+
+// statusRecorder notes the status and body size of a response for the
+// middleware that report on it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps streaming responses streaming.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// code is the response's status, 200 when the handler set none.
+func (r *statusRecorder) code() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
+
+// withRecovery turns a panicking handler into a 500 for its request alone,
+// logged with the stack and counted in /metrics. A response already under
+// way is cut off instead, as its status has been sent. Panics in
+// goroutines a handler starts are theirs to recover.
+func (s *Server) withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if err, ok := p.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+				panic(p)
+			}
+			s.panics.Add(1)
+			s.requestLogger(r.Context()).Error("handler panicked",
+				"endpoint", r.URL.Path,
+				"panic", fmt.Sprint(p),
+				"stack", string(debug.Stack()),
+			)
+			if rec.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// httpMetrics counts the requests served, by status class, for /metrics.
+type httpMetrics struct {
+	inFlight  atomic.Int64
+	requests  [6]atomic.Uint64 // Index is the status code / 100
+	durations atomic.Uint64    // Microseconds, summed
+}
+
+// withMetrics counts each request and how long it took. Streams count
+// once they end, and responses cut off by a panic count too.
+func (s *Server) withMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		s.http.inFlight.Add(1)
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			s.http.inFlight.Add(-1)
+			if class := rec.code() / 100; class >= 1 && class <= 5 {
+				s.http.requests[class].Add(1)
+			}
+			s.http.durations.Add(uint64(time.Since(start).Microseconds()))
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
+
+// CORS headers for allowed origins
+const (
+	corsMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	corsHeaders = "Authorization, Content-Type, X-Goog-Api-Key, X-Request-ID, " + SessionHeader
+	corsExposed = "X-Request-ID, " + SessionHeader + ", " + StreamHeader + ", " + cacheHeader
+)
+
+// withCORS lets pages on the cors_origins call the proxy from a browser.
+// Preflight requests are answered here, before the workspace key is
+// checked, as browsers send them without credentials. Without
+// cors_origins, browsers keep the same-origin policy.
+func (s *Server) withCORS(next http.Handler) http.Handler {
+	if len(s.cfg.CORSOrigins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !s.corsAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Expose-Headers", corsExposed)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", corsMethods)
+			h.Set("Access-Control-Allow-Headers", corsHeaders)
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) corsAllowed(origin string) bool {
+	for _, o := range s.cfg.CORSOrigins {
+		if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
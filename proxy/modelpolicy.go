@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// experimentalMarkers are the parts of a model ID that mark a model as
+// experimental. Experimental models come and go without notice, so they
+// are denied unless a rule allows them by name.
+var experimentalMarkers = []string{"-exp", "experimental"}
+
+// ModelRule allows or denies one model ID, overriding the default that
+// only experimental models are denied.
+type ModelRule struct {
+	Model   string    `json:"model"`
+	Allow   bool      `json:"allow"`
+	Note    string    `json:"note,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"` // Zero: until removed
+}
+
+func (r ModelRule) expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// modelPolicy holds the model rules set through /admin/models, saved as
+// one JSON file in the home directory so they survive a restart.
+type modelPolicy struct {
+	mu    sync.RWMutex
+	path  string
+	rules map[string]ModelRule
+}
+
+var errNoModelRule = errors.New("no rule for this model")
+
+// loadModelPolicy reads the rules saved at path. A missing file is an
+// empty policy.
+func loadModelPolicy(path string) (*modelPolicy, error) {
+	p := &modelPolicy{path: path, rules: map[string]ModelRule{}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rules []ModelRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	for _, r := range rules {
+		p.rules[r.Model] = r
+	}
+	return p, nil
+}
+
+// allowed reports whether model may be used, and why not when it may not.
+func (p *modelPolicy) allowed(model string) (bool, string) {
+	id := strings.TrimPrefix(model, "models/")
+	p.mu.RLock()
+	r, ok := p.rules[id]
+	p.mu.RUnlock()
+	if ok && !r.expired(time.Now()) {
+		if r.Allow {
+			return true, ""
+		}
+		return false, fmt.Sprintf("model %s is denied by the model policy", id)
+	}
+	for _, m := range experimentalMarkers {
+		if strings.Contains(id, m) {
+			return false, fmt.Sprintf("experimental model %s is not allowed", id)
+		}
+	}
+	return true, ""
+}
+
+// list returns the rules in effect, by model.
+func (p *modelPolicy) list() []ModelRule {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	now := time.Now()
+	rules := []ModelRule{}
+	for _, r := range p.rules {
+		if !r.expired(now) {
+			rules = append(rules, r)
+		}
+	}
+	slices.SortFunc(rules, func(a, b ModelRule) int { return strings.Compare(a.Model, b.Model) })
+	return rules
+}
+
+// set replaces the rule for r.Model and saves the policy. The rule only
+// takes effect once saved.
+func (p *modelPolicy) set(r ModelRule) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rules := maps.Clone(p.rules)
+	rules[r.Model] = r
+	return p.save(rules)
+}
+
+// remove drops the rule for model and saves the policy. The rule stays in
+// effect if saving fails.
+func (p *modelPolicy) remove(model string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if r, ok := p.rules[model]; !ok || r.expired(time.Now()) {
+		return errNoModelRule
+	}
+	rules := maps.Clone(p.rules)
+	delete(rules, model)
+	return p.save(rules)
+}
+
+// save writes the unexpired rules of next, replacing the file atomically,
+// and makes them the policy once written. p.mu must be held.
+func (p *modelPolicy) save(next map[string]ModelRule) error {
+	now := time.Now()
+	rules := []ModelRule{}
+	for id, r := range next {
+		if r.expired(now) {
+			delete(next, id)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	slices.SortFunc(rules, func(a, b ModelRule) int { return strings.Compare(a.Model, b.Model) })
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		return err
+	}
+	tmp := p.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		return err
+	}
+	p.rules = next
+	return nil
+}
+
+// handleAdminModels manages the model policy at runtime:
+//
+//	GET    /admin/models          rules in effect and the experimental markers
+//	PUT    /admin/models/<model>  set a rule from {"allow", "hours", "note"}
+//	DELETE /admin/models/<model>  drop a rule, restoring the default
+//
+// hours, when above zero, makes the rule lapse after that many hours.
+func (s *Server) handleAdminModels(w http.ResponseWriter, r *http.Request) {
+	model := strings.TrimPrefix(r.URL.Path, "/admin/models/")
+	if model == r.URL.Path {
+		model = ""
+	}
+	model = strings.TrimPrefix(model, "models/")
+	if model != "" && !validRequestID(model) {
+		http.Error(w, "Invalid model ID", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case model == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"rules":                s.models.list(),
+			"experimental_markers": experimentalMarkers,
+			"file":                 s.models.path,
+		})
+
+	case model != "" && r.Method == http.MethodPut:
+		var req struct {
+			Allow *bool   `json:"allow"`
+			Hours float64 `json:"hours"`
+			Note  string  `json:"note"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Allow == nil {
+			http.Error(w, "Invalid request: allow is required", http.StatusBadRequest)
+			return
+		}
+		if req.Hours < 0 {
+			http.Error(w, "hours must not be negative", http.StatusBadRequest)
+			return
+		}
+		rule := ModelRule{Model: model, Allow: *req.Allow, Note: strings.TrimSpace(req.Note), Created: time.Now().UTC()}
+		if req.Hours > 0 {
+			rule.Expires = rule.Created.Add(time.Duration(req.Hours * float64(time.Hour)))
+		}
+		if err := s.models.set(rule); err != nil {
+			http.Error(w, "Saving model policy: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.requestLogger(r.Context()).Info("model rule set", "model", model, "allow", rule.Allow, "expires", rule.Expires, "note", rule.Note)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rule)
+
+	case model != "" && r.Method == http.MethodDelete:
+		if err := s.models.remove(model); errors.Is(err, errNoModelRule) {
+			http.Error(w, "No rule for "+model, http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Saving model policy: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.requestLogger(r.Context()).Info("model rule removed", "model", model)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+var modelCosts = map[string]struct{ In, Out float64 }{
+	"gemini-1.5-flash":                    {0.075, 0.30},
+	"gemini-1.5-flash-8b":                 {0.0375, 0.15},
+	"gemini-1.5-pro":                      {1.25, 5.00},
+	"gemini-2.0-flash":                    {0.10, 0.40},
+	"gemini-2.0-flash-exp":                {0.00, 0.00},
+	"gemini-2.0-flash-lite-preview-02-05": {0.075, 0.30},
+	"gemini-exp-1206":                     {0.00, 0.00},
+	"gemini-2.0-pro-exp-02-05":            {0.00, 0.00},
+	"gemini-2.5-flash":                    {0.075, 0.30}, // Added pricing for gemini-2.5-flash
+	"gemini-2.5-flash-image":              {0.30, 30.00}, // About 1290 output tokens per image
+	"gemini-2.5-flash-lite":               {0.10, 0.40},
+	"gemini-embedding-001":                {0.15, 0.00},
+}
+
+// imageCosts are the USD prices per image of the Imagen models, which
+// report no token usage.
+var imageCosts = map[string]float64{
+	"imagen-3.0-generate":       0.03,
+	"imagen-4.0-generate":       0.04,
+	"imagen-4.0-fast-generate":  0.02,
+	"imagen-4.0-ultra-generate": 0.06,
+}
+
+// longestPrefix returns the key of prices that modelName equals or starts
+// with, preferring the longest, so gemini-2.5-flash-image is not priced as
+// gemini-2.5-flash.
+func longestPrefix[V any](prices map[string]V, modelName string) (V, bool) {
+	var best string
+	var v V
+	found := false
+	for key, p := range prices {
+		if strings.HasPrefix(modelName, key) && len(key) >= len(best) {
+			best, v, found = key, p, true
+		}
+	}
+	return v, found
+}
+
+// modelRates returns the USD prices per million input and output tokens.
+// ok is false for unknown or free models.
+func modelRates(modelName string) (in, out float64, ok bool) {
+	r, found := longestPrefix(modelCosts, modelName)
+	return r.In, r.Out, found && (r.In != 0 || r.Out != 0)
+}
+
+func calculateCost(modelName string, resp *genai.GenerateContentResponse) float64 {
+	cost, _ := usageCost(modelName, resp)
+	return cost
+}
+
+// usageCost prices one response. cost is what the API bills; savings is
+// what caching avoided: the context cache discount on cached input tokens,
+// or the whole price of a response replayed from the response cache.
+func usageCost(modelName string, resp *genai.GenerateContentResponse) (cost, savings float64) {
+	rateIn, rateOut, ok := modelRates(modelName)
+	if !ok || resp == nil || resp.UsageMetadata == nil {
+		return 0, 0
+	}
+
+	// Cached tokens are 90% cheaper (1/10th the normal rate)
+	cachedTokens := float64(resp.UsageMetadata.CachedContentTokenCount)
+	promptTokens := float64(resp.UsageMetadata.PromptTokenCount)
+	// Thinking is billed as output, though it is not part of the candidates
+	outTokens := float64(resp.UsageMetadata.CandidatesTokenCount + resp.UsageMetadata.ThoughtsTokenCount)
+
+	full := (promptTokens/1000000.0)*rateIn + (outTokens/1000000.0)*rateOut
+	discount := (cachedTokens / 1000000.0) * rateIn * 0.9
+
+	// Responses replayed from the response cache cost nothing
+	if servedFromCache(resp) {
+		return 0, full
+	}
+	return full - discount, discount
+}
+
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	type ModelData struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		Cost string `json:"cost"`
+	}
+
+	var models []ModelData
+
+	// Use the new iterator API
+	for m, err := range s.client.Models.All(r.Context()) {
+		if err != nil {
+			break
+		}
+		// Check if model supports generateContent by looking at SupportedActions
+		supportsGenerate := false
+		for _, action := range m.SupportedActions {
+			if action == "generateContent" {
+				supportsGenerate = true
+				break
+			}
+		}
+
+		if supportsGenerate {
+			id := strings.TrimPrefix(m.Name, "models/")
+
+			// Skip models the model policy denies
+			if ok, _ := s.models.allowed(id); !ok {
+				continue
+			}
+
+			costStr := "Price: Variable"
+
+			// Try exact match or prefix match for pricing
+			for modelKey, rates := range modelCosts {
+				if id == modelKey || strings.HasPrefix(id, modelKey) {
+					if rates.In == 0 && rates.Out == 0 {
+						costStr = "Price: Free (Beta)"
+					} else {
+						costStr = fmt.Sprintf("$%.2f/1M tokens", rates.In)
+					}
+					break
+				}
+			}
+
+			models = append(models, ModelData{
+				ID:   id,
+				Name: id,
+				Cost: costStr,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"models": models})
+}
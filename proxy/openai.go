@@ -0,0 +1,716 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// --- OPENAI COMPATIBILITY ---
+
+type OpenAIChatRequest struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Role    string        `json:"role"`
+		Content OpenAIContent `json:"content"`
+	} `json:"messages"`
+	Stream        bool `json:"stream"`
+	StreamOptions struct {
+		IncludeUsage bool `json:"include_usage"` // Send a usage chunk before [DONE]
+	} `json:"stream_options"`
+	ContextMode string `json:"context_mode"` // "rag" sends retrieved project chunks; there is no cache here
+	Rerank      *bool  `json:"rerank"`       // Rerank the retrieved chunks; defaults to index.rerank
+
+	// Thinking: reasoning_effort as OpenAI names it, or a thinking_budget
+	// in tokens as Gemini does. Thoughts come back as reasoning_content.
+	ReasoningEffort string `json:"reasoning_effort"`
+	ThinkingBudget  *int32 `json:"thinking_budget"`
+
+	// WebSearchOptions grounds the reply with Google Search, in place of
+	// the file tools; its settings are ignored. The pages come back as
+	// url_citation annotations.
+	WebSearchOptions *struct{} `json:"web_search_options"`
+}
+
+// systemPrompt joins the request's system and developer messages, which
+// are combined with the configured system prompt per system_prompt_policy.
+func (req *OpenAIChatRequest) systemPrompt() string {
+	var prompts []string
+	for _, msg := range req.Messages {
+		if (msg.Role == "system" || msg.Role == "developer") && strings.TrimSpace(msg.Content.Text) != "" {
+			prompts = append(prompts, msg.Content.Text)
+		}
+	}
+	return strings.Join(prompts, "\n\n")
+}
+
+type OpenAIChatResponse struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Index   int `json:"index"`
+		Message struct {
+			Role             string             `json:"role"`
+			Content          string             `json:"content"`
+			ReasoningContent string             `json:"reasoning_content,omitempty"` // Thought summaries
+			Annotations      []OpenAIAnnotation `json:"annotations,omitempty"`       // Web pages, with web_search_options
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens            int `json:"prompt_tokens"`
+		CompletionTokens        int `json:"completion_tokens"` // Reasoning included, as OpenAI counts it
+		TotalTokens             int `json:"total_tokens"`
+		CompletionTokensDetails struct {
+			ReasoningTokens int `json:"reasoning_tokens"`
+		} `json:"completion_tokens_details"`
+		Timings        *Timings `json:"timings,omitempty"`         // Extension: latency breakdown
+		HistoryDropped int      `json:"history_dropped,omitempty"` // Extension: session messages dropped to fit the context window
+	} `json:"usage"`
+	Warnings    []ToolWarning `json:"warnings,omitempty"`     // Extension: tool calls that failed
+	EmptyReason string        `json:"empty_reason,omitempty"` // Extension: why the model replied with nothing
+
+}
+
+func (s *Server) handleOpenAIModels(w http.ResponseWriter, r *http.Request) {
+	// Return actual Gemini models (excluding experimental)
+	// Users can select any model from this list in Continue.dev
+	var modelList []map[string]any
+
+	// Fetch real models from Gemini API
+	for m, err := range s.client.Models.All(r.Context()) {
+		if err != nil {
+			break
+		}
+		// Check if model supports generateContent
+		supportsGenerate := false
+		for _, action := range m.SupportedActions {
+			if action == "generateContent" {
+				supportsGenerate = true
+				break
+			}
+		}
+
+		if supportsGenerate {
+			geminiID := strings.TrimPrefix(m.Name, "models/")
+
+			// Skip image models and those the model policy denies
+			if strings.Contains(geminiID, "image-generation") {
+				continue
+			}
+			if ok, _ := s.models.allowed(geminiID); !ok {
+				continue
+			}
+
+			// Return actual Gemini model ID - Continue.dev will show these in dropdown
+			modelList = append(modelList, map[string]any{
+				"id":       geminiID,
+				"object":   "model",
+				"created":  time.Now().Unix(),
+				"owned_by": modelOwner(),
+			})
+		}
+	}
+
+	// Fallback if no models found
+	if len(modelList) == 0 {
+		defaultModel, _ := s.cfg.Endpoint(config.EndpointOpenAI)
+		modelList = []map[string]any{
+			{
+				"id":       defaultModel,
+				"object":   "model",
+				"created":  time.Now().Unix(),
+				"owned_by": modelOwner(),
+			},
+		}
+	}
+
+	response := map[string]any{
+		"object": "list",
+		"data":   modelList,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleOpenAIChat(w http.ResponseWriter, r *http.Request) {
+	lg := s.requestLogger(r.Context())
+	rctx, span := tracer.Start(r.Context(), "openai.chat")
+	defer span.End()
+	ctx, cancel := s.endpointContext(rctx, config.EndpointOpenAI)
+	defer cancel()
+	var req OpenAIChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request: "+err.Error(), 400)
+		return
+	}
+
+	// Extract last user message, with any audio it carries
+	userMsg := ""
+	var audio []genai.Part
+	for _, msg := range req.Messages {
+		if msg.Role == "user" {
+			userMsg, audio = msg.Content.Text, msg.Content.Audio
+		}
+	}
+	if maxBytes := s.cfg.Uploads.MaxFileMB << 20; audioSize(audio) > maxBytes {
+		http.Error(w, fmt.Sprintf("Audio is larger than %d MB", s.cfg.Uploads.MaxFileMB), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if userMsg == "" && len(audio) > 0 {
+		userMsg = audioPrompt
+	}
+	if !validContextMode(req.ContextMode) {
+		http.Error(w, fmt.Sprintf("Invalid context_mode %q: want cache, rag or none", req.ContextMode), 400)
+		return
+	}
+	if _, err := openAIThinking(&req); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	if req.Stream {
+		s.handleOpenAIStream(w, r.WithContext(rctx), &req, userMsg, audio)
+		return
+	}
+
+	// Use model directly if it's a valid Gemini model ID, otherwise use cached/default
+	model := req.Model
+
+	// Check if it's a Gemini model ID and not banned
+	if strings.HasPrefix(model, "gemini-") {
+		if ok, reason := s.models.allowed(model); !ok {
+			http.Error(w, reason, http.StatusForbidden)
+			return
+		}
+		// Use the specified Gemini model
+	} else {
+		// Not a Gemini model ID (e.g., "gpt-4"), use the endpoint's configured default
+		model, _ = s.cfg.Endpoint(config.EndpointOpenAI)
+	}
+	if len(audio) > 0 && !acceptsMedia(model) {
+		http.Error(w, "Model "+model+" does not accept audio", 400)
+		return
+	}
+
+	start := time.Now()
+	lg.Info("openai request", "endpoint", "/v1/chat/completions", "model", model, "session", "openai-compat", "msg", preview(userMsg, 50), "audio_bytes", audioSize(audio))
+
+	// Create chat request
+	chatReq := ChatRequest{
+		SessionID: "openai-compat",
+		Model:     model,
+		Message:   userMsg,
+	}
+
+	ctx, endTurn := s.beginTurn(ctx, chatReq.SessionID, userMsg)
+	defer endTurn()
+
+	// Get history
+	history, err := s.sessions(ctx).History(ctx, chatReq.SessionID)
+	if err != nil {
+		lg.Error("loading session", "session", chatReq.SessionID, "error", err)
+		http.Error(w, "Session store unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	_, temperature := s.cfg.Endpoint(config.EndpointOpenAI)
+	config := &genai.GenerateContentConfig{
+		Temperature:    genai.Ptr[float32](temperature),
+		SafetySettings: s.buildSafetySettings(nil),
+	}
+	config.ThinkingConfig, _ = openAIThinking(&req)
+
+	// Enable agentic tools for OpenAI endpoint (subject to tool policy)
+	// --- NOTE: This comment might be outdated. Gemini API supports CachedContent with Tools.
+	// --- If you want caching for OpenAI compatibility, you'd need to add:
+	// if s.cacheName != "" {
+	//     config.CachedContent = s.cacheName
+	// }
+	if fileTools := s.fileToolDeclarations(ctx); len(fileTools) > 0 {
+		config.Tools = []*genai.Tool{{FunctionDeclarations: fileTools}}
+	}
+	if req.WebSearchOptions != nil {
+		config.Tools = []*genai.Tool{{GoogleSearch: &genai.GoogleSearch{}}}
+	}
+
+	s.applySystemPrompt(config, req.systemPrompt())
+	tagUpstream(r.Context(), config)
+	chat, err := s.client.Chats.Create(ctx, model, config, history)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	// Handle tool calls in a loop (similar to handleChat)
+	var responseText string
+	var reasoning strings.Builder
+	selection, turnOnly, status, err := s.openAIContext(ctx, r, &req, userMsg)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	res, chat, model, dropped, err := s.sendAnswered(ctx, chat, model, config, append(append(selection, genai.Part{Text: userMsg}), audio...)...)
+	if err != nil {
+		s.logAbort(ctx, "upstream")
+		http.Error(w, err.Error(), upstreamStatus(ctx, err))
+		return
+	}
+	var warnings []ToolWarning
+	tools := 0
+
+	for {
+		reasoning.WriteString(thoughtText(res))
+		funcCalls := res.FunctionCalls()
+		if len(funcCalls) == 0 {
+			responseText = res.Text()
+			break
+		}
+
+		// Execute function calls
+		var funcResponses []genai.Part
+		tools += len(funcCalls)
+		for _, funcCall := range funcCalls {
+			funcResult := s.executeTool(ctx, funcCall.Name, funcCall.Args)
+			if w, failed := toolWarning(funcCall.Name, funcCall.Args, funcResult); failed {
+				warnings = append(warnings, w)
+			}
+
+			funcResponses = append(funcResponses, genai.Part{
+				FunctionResponse: functionResponse(model, funcCall, funcResult),
+			})
+		}
+
+		var n int
+		res, chat, model, n, err = s.sendAnswered(ctx, chat, model, config, funcResponses...)
+		dropped += n
+		if err != nil && ctx.Err() != nil {
+			s.logAbort(ctx, "tool loop")
+			http.Error(w, err.Error(), upstreamStatus(ctx, err))
+			return
+		}
+		if err != nil {
+			responseText = "Error after tool execution: " + err.Error()
+			break
+		}
+	}
+
+	// Under the warn policy an empty reply explains an abnormal finish,
+	// such as truncation or a block, and is otherwise left empty
+	finish := finishInfo(res)
+	var empty string
+	if strings.TrimSpace(responseText) == "" {
+		empty = emptyReason(finish, tools)
+		if s.warnEmpty(ctx) {
+			responseText = finish.Warning()
+		}
+	}
+
+	s.writeDebugResponse(ctx, responseText)
+
+	// Store history
+	if err := s.sessions(ctx).SetHistory(ctx, chatReq.SessionID, withoutTurnOnly(chat.History(false), turnOnly)); err != nil {
+		lg.Error("saving session", "session", chatReq.SessionID, "error", err)
+	}
+
+	// Build OpenAI response
+	response := OpenAIChatResponse{
+		ID:      "chatcmpl-" + requestIDFrom(r.Context()),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+	}
+	response.Choices = []struct {
+		Index   int `json:"index"`
+		Message struct {
+			Role             string             `json:"role"`
+			Content          string             `json:"content"`
+			ReasoningContent string             `json:"reasoning_content,omitempty"`
+			Annotations      []OpenAIAnnotation `json:"annotations,omitempty"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	}{
+		{
+			Index: 0,
+			Message: struct {
+				Role             string             `json:"role"`
+				Content          string             `json:"content"`
+				ReasoningContent string             `json:"reasoning_content,omitempty"`
+				Annotations      []OpenAIAnnotation `json:"annotations,omitempty"`
+			}{
+				Role:             "assistant",
+				Content:          responseText,
+				ReasoningContent: strings.TrimSpace(reasoning.String()),
+				Annotations:      openAIAnnotations(newGrounding(groundingMetadata(res), responseText), responseText),
+			},
+			FinishReason: openAIFinish(finish),
+		},
+	}
+
+	if res.UsageMetadata != nil {
+		response.Usage.PromptTokens = int(res.UsageMetadata.PromptTokenCount)
+		response.Usage.CompletionTokens = int(res.UsageMetadata.CandidatesTokenCount + res.UsageMetadata.ThoughtsTokenCount)
+		response.Usage.CompletionTokensDetails.ReasoningTokens = int(res.UsageMetadata.ThoughtsTokenCount)
+		response.Usage.TotalTokens = int(res.UsageMetadata.TotalTokenCount)
+	}
+
+	response.Usage.Timings = timerFrom(r.Context()).Timings()
+	response.Usage.HistoryDropped = dropped
+	response.Warnings = warnings
+	response.EmptyReason = empty
+
+	lg.Info("openai response",
+		"endpoint", "/v1/chat/completions",
+		"model", model,
+		"session", "openai-compat",
+		"prompt_tokens", response.Usage.PromptTokens,
+		"response_tokens", response.Usage.CompletionTokens,
+		"finish_reason", finish.FinishReason,
+		"block_reason", finish.BlockReason,
+		"latency_ms", time.Since(start).Milliseconds(),
+		"timings", response.Usage.Timings,
+		"resp", preview(responseText, 50),
+	)
+
+	setServerTiming(w, response.Usage.Timings)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// openAIContext returns the parts sent ahead of an OpenAI request's
+// message: the IDE's registered selection and, in the rag context mode,
+// the project chunks retrieved for the message. On failure it also returns
+// the HTTP status to report.
+func (s *Server) openAIContext(ctx context.Context, r *http.Request, req *OpenAIChatRequest, userMsg string) ([]genai.Part, map[*genai.Blob]string, int, error) {
+	parts, turnOnly := s.selectionContext(ctx, settingsKey(r))
+	if req.ContextMode != ContextRAG {
+		return parts, turnOnly, 0, nil
+	}
+	retrieved, ragTurnOnly, status, err := s.retrievalContext(ctx, userMsg, s.rerankFor(req.Rerank))
+	if err != nil {
+		return nil, nil, status, err
+	}
+	if turnOnly == nil {
+		turnOnly = ragTurnOnly
+	} else {
+		maps.Copy(turnOnly, ragTurnOnly)
+	}
+	return append(retrieved, parts...), turnOnly, 0, nil
+}
+
+func (s *Server) handleOpenAIStream(w http.ResponseWriter, r *http.Request, req *OpenAIChatRequest, userMsg string, audio []genai.Part) {
+	lg := s.requestLogger(r.Context())
+	rctx, span := tracer.Start(r.Context(), "openai.stream")
+	defer span.End()
+	ctx, cancel := s.endpointContext(rctx, config.EndpointOpenAI)
+	defer cancel()
+	// Use model directly if it's a valid Gemini model ID, otherwise use cached/default
+	model := req.Model
+
+	// Check if it's a Gemini model ID and not banned
+	if strings.HasPrefix(model, "gemini-") {
+		if ok, reason := s.models.allowed(model); !ok {
+			data, _ := json.Marshal(map[string]string{"error": reason})
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			return
+		}
+		// Use the specified Gemini model
+	} else {
+		// Not a Gemini model ID (e.g., "gpt-4"), use the endpoint's configured default
+		model, _ = s.cfg.Endpoint(config.EndpointOpenAI)
+	}
+	if len(audio) > 0 && !acceptsMedia(model) {
+		fmt.Fprintf(w, "data: {\"error\": \"Model %s does not accept audio\"}\n\n", model)
+		return
+	}
+	selection, turnOnly, status, err := s.openAIContext(ctx, r, req, userMsg)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	start := time.Now()
+	lg.Info("openai stream request", "endpoint", "/v1/chat/completions", "model", model, "session", "openai-stream", "msg", preview(userMsg, 50), "audio_bytes", audioSize(audio))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", 500)
+		return
+	}
+
+	_, temperature := s.cfg.Endpoint(config.EndpointOpenAI)
+	config := &genai.GenerateContentConfig{
+		Temperature:    genai.Ptr[float32](temperature),
+		SafetySettings: s.buildSafetySettings(nil),
+	}
+	config.ThinkingConfig, _ = openAIThinking(req) // Validated by handleOpenAIChat
+
+	// Enable agentic tools for OpenAI endpoint (subject to tool policy)
+	// --- NOTE: This comment might be outdated. Gemini API supports CachedContent with Tools.
+	// --- If you want caching for OpenAI compatibility, you'd need to add:
+	// if s.cacheName != "" {
+	//     config.CachedContent = s.cacheName
+	// }
+	if fileTools := s.fileToolDeclarations(ctx); len(fileTools) > 0 {
+		config.Tools = []*genai.Tool{{FunctionDeclarations: fileTools}}
+	}
+	if req.WebSearchOptions != nil {
+		config.Tools = []*genai.Tool{{GoogleSearch: &genai.GoogleSearch{}}}
+	}
+
+	ctx, endTurn := s.beginTurn(ctx, "openai-stream", userMsg)
+	defer endTurn()
+	history, err := s.sessions(ctx).History(ctx, "openai-stream")
+	if err != nil {
+		lg.Error("loading session", "session", "openai-stream", "error", err)
+		fmt.Fprintf(w, "data: {\"error\": \"session store unavailable\"}\n\n")
+		flusher.Flush()
+		return
+	}
+
+	s.applySystemPrompt(config, req.systemPrompt())
+	tagUpstream(r.Context(), config)
+	chat, err := s.client.Chats.Create(ctx, model, config, history)
+	if err != nil {
+		fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
+		flusher.Flush()
+		return
+	}
+
+	// For tool-enabled chats, use non-streaming to handle function calls properly
+	// Then stream the final response
+	var fullResponse responsePreview
+	currentMsg := userMsg
+	var finish FinishInfo
+	var usage streamUsage
+	var annotations []OpenAIAnnotation
+	var empty string
+	tools := 0
+
+	// Text deltas are batched by the coalescer, and every other write goes
+	// through it so the keepalive never interleaves with them
+	batch := s.newCoalescer(func(piece string) {
+		chunk := map[string]any{
+			"id":      "chatcmpl-" + requestIDFrom(r.Context()),
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []map[string]any{
+				{
+					"index": 0,
+					"delta": map[string]string{
+						"content": piece,
+					},
+					"finish_reason": nil,
+				},
+			},
+		}
+		// --- LINTER FIX START ---
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			lg.Error("marshalling OpenAI stream chunk", "error", err)
+		} else {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+		// --- LINTER FIX END ---
+	})
+	defer batch.flush()
+	defer batch.keepAlive(func() {
+		fmt.Fprint(w, ": ping\n\n")
+		flusher.Flush()
+	})()
+	// Thought summaries go ahead of the text they led to, as reasoning_content
+	sendReasoning := func(res *genai.GenerateContentResponse) {
+		thought := thoughtText(res)
+		if thought == "" {
+			return
+		}
+		chunk := map[string]any{
+			"id":      "chatcmpl-" + requestIDFrom(r.Context()),
+			"object":  "chat.completion.chunk",
+			"created": time.Now().Unix(),
+			"model":   model,
+			"choices": []map[string]any{
+				{"index": 0, "delta": map[string]string{"reasoning_content": thought}, "finish_reason": nil},
+			},
+		}
+		if data, err := json.Marshal(chunk); err == nil {
+			batch.do(func() {
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				flusher.Flush()
+			})
+		}
+	}
+
+	for {
+		// Use non-streaming to detect function calls
+		res, next, answeredBy, dropped, err := s.sendAnswered(ctx, chat, model, config, append(append(selection, genai.Part{Text: currentMsg}), audio...)...)
+		chat, model = next, answeredBy
+		usage.historyDropped += dropped
+		if err != nil {
+			s.logAbort(ctx, "upstream")
+			batch.do(func() {
+				fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
+				flusher.Flush()
+			})
+			return
+		}
+		usage.add(model, res)
+		sendReasoning(res)
+
+		// Check for function calls
+		funcCalls := res.FunctionCalls()
+		if len(funcCalls) > 0 {
+			// Send function call notification in OpenAI format
+			for _, funcCall := range funcCalls {
+				chunk := map[string]any{
+					"id":      "chatcmpl-" + requestIDFrom(r.Context()),
+					"object":  "chat.completion.chunk",
+					"created": time.Now().Unix(),
+					"model":   model,
+					"choices": []map[string]any{
+						{
+							"index": 0,
+							"delta": map[string]any{
+								"role": "assistant",
+								"tool_calls": []map[string]any{
+									{
+										"id":   funcCall.Name + "-" + fmt.Sprintf("%d", time.Now().UnixNano()),
+										"type": "function",
+										"function": map[string]any{
+											"name":      funcCall.Name,
+											"arguments": funcCall.Args,
+										},
+									},
+								},
+							},
+							"finish_reason": "tool_calls",
+						},
+					},
+				}
+				// --- LINTER FIX START ---
+				data, err := json.Marshal(chunk)
+				if err != nil {
+					lg.Error("marshalling OpenAI stream chunk", "error", err)
+				} else {
+					batch.do(func() {
+						fmt.Fprintf(w, "data: %s\n\n", data)
+						flusher.Flush()
+					})
+				}
+				// --- LINTER FIX END ---
+			}
+
+			// Execute function calls
+			var funcResponses []genai.Part
+			tools += len(funcCalls)
+			for _, funcCall := range funcCalls {
+				funcResult := s.executeTool(ctx, funcCall.Name, funcCall.Args)
+				if w, failed := toolWarning(funcCall.Name, funcCall.Args, funcResult); failed {
+					usage.warnings = append(usage.warnings, w)
+				}
+
+				funcResponses = append(funcResponses, genai.Part{
+					FunctionResponse: functionResponse(model, funcCall, funcResult),
+				})
+			}
+
+			// Continue with function responses
+			currentMsg, audio, selection = "", nil, nil
+			res, chat, model, dropped, err = s.sendAnswered(ctx, chat, model, config, funcResponses...)
+			usage.historyDropped += dropped
+			if err != nil {
+				s.logAbort(ctx, "tool loop")
+				batch.do(func() {
+					fmt.Fprintf(w, "data: {\"error\": \"%s\"}\n\n", err.Error())
+					flusher.Flush()
+				})
+				return
+			}
+			usage.add(model, res)
+			sendReasoning(res)
+			continue
+		}
+
+		// No function calls, stream the text response
+		finish = finishInfo(res)
+		responseText := res.Text()
+		if strings.TrimSpace(responseText) == "" {
+			empty = emptyReason(finish, tools)
+			if s.warnEmpty(ctx) {
+				responseText = finish.Warning()
+			}
+		}
+		fullResponse.WriteString(responseText)
+		annotations = openAIAnnotations(newGrounding(groundingMetadata(res), responseText), responseText)
+
+		// Replay the response in small deltas
+		for piece := range textChunks(responseText) {
+			if ctx.Err() != nil {
+				s.logAbort(ctx, "stream", "bytes", fullResponse.total)
+				return
+			}
+			batch.add(piece)
+		}
+		break
+	}
+
+	// Close the choice with the mapped finish reason and any citations,
+	// report usage if the client asked for it, then end the stream
+	delta := map[string]any{}
+	if len(annotations) > 0 {
+		delta["annotations"] = annotations
+	}
+	final := map[string]any{
+		"id":      "chatcmpl-" + requestIDFrom(r.Context()),
+		"object":  "chat.completion.chunk",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []map[string]any{
+			{
+				"index":         0,
+				"delta":         delta,
+				"finish_reason": openAIFinish(finish),
+			},
+		},
+	}
+	if empty != "" {
+		final["empty_reason"] = empty
+	}
+	batch.do(func() {
+		if data, err := json.Marshal(final); err == nil {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		if req.StreamOptions.IncludeUsage {
+			summary := usage.openAI("chatcmpl-"+requestIDFrom(r.Context()), model, timerFrom(r.Context()).Timings())
+			if data, err := json.Marshal(summary); err == nil {
+				fmt.Fprintf(w, "data: %s\n\n", data)
+			}
+		}
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+		flusher.Flush()
+	})
+
+	s.writeDebugResponse(ctx, fullResponse.String())
+
+	if err := s.sessions(ctx).SetHistory(ctx, "openai-stream", withoutTurnOnly(chat.History(false), turnOnly)); err != nil {
+		lg.Error("saving session", "session", "openai-stream", "error", err)
+	}
+
+	lg.Info("openai stream complete", "model", model, "session", "openai-stream", "finish_reason", finish.FinishReason, "cost", usage.cost, "latency_ms", time.Since(start).Milliseconds(), "bytes", fullResponse.total, "resp", preview(fullResponse.String(), 50))
+}
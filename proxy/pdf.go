@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+	"google.golang.org/genai"
+)
+
+const (
+	maxPDFBytes   = 50 << 20
+	pdfChunkChars = 32 * 1024 // Text returned per read_pdf call
+)
+
+// pageRange parses "3" or "2-5" into 1-based bounds within total pages.
+// An empty spec selects every page.
+func pageRange(spec string, total int) (first, last int, err error) {
+	if spec == "" {
+		return 1, total, nil
+	}
+	lo, hi, found := strings.Cut(spec, "-")
+	if first, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return 0, 0, fmt.Errorf("invalid pages %q: want N or N-M", spec)
+	}
+	last = first
+	if found {
+		if last, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+			return 0, 0, fmt.Errorf("invalid pages %q: want N or N-M", spec)
+		}
+	}
+	if first < 1 || last < first || first > total {
+		return 0, 0, fmt.Errorf("pages %q out of range: the PDF has %d pages", spec, total)
+	}
+	return first, min(last, total), nil
+}
+
+// pdfChunks splits page texts into chunks of about pdfChunkChars, breaking
+// between pages where it can and within a page only when it alone is
+// larger.
+func pdfChunks(pages []string) []string {
+	var chunks []string
+	var cur strings.Builder
+	for _, page := range pages {
+		if cur.Len() > 0 && cur.Len()+len(page) > pdfChunkChars {
+			chunks = append(chunks, cur.String())
+			cur.Reset()
+		}
+		for len(page) > pdfChunkChars {
+			cut := pdfChunkChars
+			if i := strings.LastIndexByte(page[:cut], '\n'); i > 0 {
+				cut = i + 1
+			}
+			chunks = append(chunks, page[:cut])
+			page = page[cut:]
+		}
+		cur.WriteString(page)
+	}
+	if cur.Len() > 0 || len(chunks) == 0 {
+		chunks = append(chunks, cur.String())
+	}
+	return chunks
+}
+
+// toolReadPDF extracts the text of a project PDF, which the context cache
+// skips, page by page and returns one chunk of it. With images set, the
+// PDF itself is attached to the response so the model can see its pages.
+func (s *Server) toolReadPDF(ctx context.Context, relPath, pages string, chunk int, images bool) (result map[string]any) {
+	// The PDF reader panics on malformed files
+	defer func() {
+		if p := recover(); p != nil {
+			result = map[string]any{"error": fmt.Sprintf("malformed PDF: %v", p)}
+		}
+	}()
+	abs, rel, ok := s.projectPath(ctx, relPath)
+	if !ok {
+		return map[string]any{"error": "Access denied: outside project root"}
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	if info.Size() > maxPDFBytes {
+		return map[string]any{"error": "PDF too large"}
+	}
+	f, r, err := pdf.Open(abs)
+	if err != nil {
+		return map[string]any{"error": "not a readable PDF: " + err.Error()}
+	}
+	defer f.Close()
+
+	first, last, err := pageRange(pages, r.NumPage())
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	var texts []string
+	hasText := false
+	for n := first; n <= last; n++ {
+		text, err := r.Page(n).GetPlainText(nil)
+		if err != nil {
+			text = "[text could not be extracted: " + err.Error() + "]"
+		}
+		hasText = hasText || strings.TrimSpace(text) != ""
+		texts = append(texts, fmt.Sprintf("--- Page %d ---\n%s\n", n, strings.TrimSpace(text)))
+	}
+	chunks := pdfChunks(texts)
+	if chunk < 1 || chunk > len(chunks) {
+		return map[string]any{"error": fmt.Sprintf("chunk %d out of range: there are %d", chunk, len(chunks))}
+	}
+
+	result = map[string]any{
+		"path":    rel,
+		"pages":   r.NumPage(),
+		"chunk":   chunk,
+		"chunks":  len(chunks),
+		"content": chunks[chunk-1],
+	}
+	if chunk < len(chunks) {
+		result["next_chunk"] = chunk + 1
+	}
+	if !hasText {
+		result["note"] = "no text layer; the PDF may be scanned, call again with images to see the pages"
+	}
+	if images {
+		data, err := os.ReadFile(abs)
+		if err != nil {
+			return map[string]any{"error": err.Error()}
+		}
+		result["media"] = []*genai.FunctionResponsePart{genai.NewFunctionResponsePartFromBytes(data, "application/pdf")}
+	}
+	return result
+}
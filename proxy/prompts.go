@@ -0,0 +1,322 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prompt is a saved prompt template. {{name}} placeholders are filled in
+// when it is rendered; see render.
+type Prompt struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Template    string    `json:"template"`
+	Variables   []string  `json:"variables"` // Placeholders used by Template, in order of appearance
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+var placeholder = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// promptVariables lists the distinct placeholders in a template.
+func promptVariables(tmpl string) []string {
+	vars := []string{}
+	seen := map[string]bool{}
+	for _, m := range placeholder.FindAllStringSubmatch(tmpl, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			vars = append(vars, m[1])
+		}
+	}
+	return vars
+}
+
+// promptLibrary keeps one JSON file per prompt in <home>/prompts, or in
+// the workspace's own directory; see Server.promptLibrary.
+type promptLibrary struct {
+	mu  sync.Mutex
+	dir string
+}
+
+var errPromptNotFound = errors.New("prompt not found")
+
+func (l *promptLibrary) path(id string) string {
+	return filepath.Join(l.dir, id+".json")
+}
+
+func (l *promptLibrary) list() ([]Prompt, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	matches, err := filepath.Glob(filepath.Join(l.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	list := []Prompt{}
+	for _, m := range matches {
+		var p Prompt
+		data, err := os.ReadFile(m)
+		if err != nil || json.Unmarshal(data, &p) != nil {
+			continue
+		}
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name) })
+	return list, nil
+}
+
+func (l *promptLibrary) get(id string) (*Prompt, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	data, err := os.ReadFile(l.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errPromptNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p Prompt
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("decoding prompt %s: %w", id, err)
+	}
+	return &p, nil
+}
+
+// save writes p, replacing the file atomically. create fails if the
+// prompt exists; otherwise the prompt must exist and keeps its Created time.
+func (l *promptLibrary) save(p *Prompt, create bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now().UTC()
+	data, err := os.ReadFile(l.path(p.ID))
+	switch {
+	case create && err == nil:
+		return fs.ErrExist
+	case !create && errors.Is(err, fs.ErrNotExist):
+		return errPromptNotFound
+	case !create && err != nil:
+		return err
+	case create:
+		p.Created = now
+	default:
+		var old Prompt
+		if json.Unmarshal(data, &old) == nil {
+			p.Created = old.Created
+		}
+	}
+	p.Updated = now
+	p.Variables = promptVariables(p.Template)
+
+	if err := os.MkdirAll(l.dir, 0755); err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := l.path(p.ID) + ".tmp"
+	if err := os.WriteFile(tmp, out, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path(p.ID))
+}
+
+func (l *promptLibrary) remove(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := os.Remove(l.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return errPromptNotFound
+	}
+	return err
+}
+
+// promptID turns a prompt name into a file-safe ID.
+func promptID(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(strings.TrimSpace(name)) {
+		switch {
+		case c >= 'a' && c <= 'z' || c >= '0' && c <= '9':
+			b.WriteRune(c)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// render fills in a prompt's placeholders from vars. {{file}} is special:
+// vars["file"] names a project file and the placeholder becomes its
+// contents. Placeholders without a value are left in place and reported
+// as missing.
+func (s *Server) render(ctx context.Context, p *Prompt, vars map[string]string) (string, []string, error) {
+	values := make(map[string]string, len(vars))
+	for k, v := range vars {
+		values[k] = v
+	}
+	if rel, ok := vars["file"]; ok && rel != "" {
+		abs, _, ok := s.projectPath(ctx, rel)
+		if !ok {
+			return "", nil, fmt.Errorf("file %s is outside the project", rel)
+		}
+		info, err := os.Stat(abs)
+		if err != nil {
+			return "", nil, fmt.Errorf("file %s not found", rel)
+		}
+		if info.Size() > MaxFileBytes {
+			return "", nil, fmt.Errorf("file %s is larger than %d KB", rel, MaxFileBytes/1024)
+		}
+		data, err := os.ReadFile(abs)
+		if err != nil {
+			return "", nil, err
+		}
+		values["file"] = string(data)
+	}
+
+	missing := []string{}
+	text := placeholder.ReplaceAllStringFunc(p.Template, func(m string) string {
+		name := placeholder.FindStringSubmatch(m)[1]
+		if v, ok := values[name]; ok {
+			return v
+		}
+		missing = append(missing, name)
+		return m
+	})
+	return text, missing, nil
+}
+
+// handlePrompts serves the prompt library shared by the web UI and MCP
+// clients of the request's workspace:
+//
+//	GET    /prompts              list prompts, by name
+//	POST   /prompts              create from {"name", "description", "template"}
+//	GET    /prompts/<id>         one prompt
+//	PUT    /prompts/<id>         replace name, description and template
+//	DELETE /prompts/<id>         delete
+//	POST   /prompts/<id>/render  fill in {"vars": {...}}; returns {"text", "missing"}
+func (s *Server) handlePrompts(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/prompts/")
+	if rest == r.URL.Path {
+		rest = ""
+	}
+	id, action, _ := strings.Cut(rest, "/")
+	if id != "" && !validRequestID(id) {
+		http.Error(w, "Invalid prompt ID", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON := func(status int, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(v)
+	}
+	promptError := func(err error) {
+		switch {
+		case errors.Is(err, errPromptNotFound):
+			http.Error(w, "Prompt not found", http.StatusNotFound)
+		case errors.Is(err, fs.ErrExist):
+			http.Error(w, "A prompt with this name already exists", http.StatusConflict)
+		default:
+			http.Error(w, "Prompt library: "+err.Error(), http.StatusInternalServerError)
+		}
+	}
+	decode := func() (*Prompt, bool) {
+		var p Prompt
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil || strings.TrimSpace(p.Name) == "" || p.Template == "" {
+			http.Error(w, "Invalid request: name and template are required", http.StatusBadRequest)
+			return nil, false
+		}
+		p.Name = strings.TrimSpace(p.Name)
+		return &p, true
+	}
+
+	lib := s.promptLibrary(r.Context())
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		list, err := lib.list()
+		if err != nil {
+			promptError(err)
+			return
+		}
+		writeJSON(http.StatusOK, map[string]any{"prompts": list})
+
+	case id == "" && r.Method == http.MethodPost:
+		p, ok := decode()
+		if !ok {
+			return
+		}
+		if p.ID = promptID(p.Name); p.ID == "" {
+			http.Error(w, "Prompt name needs a letter or digit", http.StatusBadRequest)
+			return
+		}
+		if err := lib.save(p, true); err != nil {
+			promptError(err)
+			return
+		}
+		writeJSON(http.StatusCreated, p)
+
+	case action == "" && r.Method == http.MethodGet:
+		p, err := lib.get(id)
+		if err != nil {
+			promptError(err)
+			return
+		}
+		writeJSON(http.StatusOK, p)
+
+	case action == "" && r.Method == http.MethodPut:
+		p, ok := decode()
+		if !ok {
+			return
+		}
+		p.ID = id
+		if err := lib.save(p, false); err != nil {
+			promptError(err)
+			return
+		}
+		writeJSON(http.StatusOK, p)
+
+	case action == "" && r.Method == http.MethodDelete:
+		if err := lib.remove(id); err != nil {
+			promptError(err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case action == "render" && r.Method == http.MethodPost:
+		var req struct {
+			Vars map[string]string `json:"vars"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		p, err := lib.get(id)
+		if err != nil {
+			promptError(err)
+			return
+		}
+		text, missing, err := s.render(r.Context(), p, req.Vars)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(http.StatusOK, map[string]any{"text": text, "missing": missing})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
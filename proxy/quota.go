@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"customgemini/config"
+)
+
+// Where a model's per-minute request limit came from
+const (
+	quotaFromConfig = "config"  // quota.requests_per_minute
+	quotaFromError  = "learned" // The QuotaFailure of a 429
+	quotaFromHeader = "header"  // x-ratelimit-limit-requests
+)
+
+// QuotaStatus is what the proxy knows of a model's rate limit, reported by
+// /status.
+type QuotaStatus struct {
+	LimitPerMinute int        `json:"limit_per_minute,omitempty"` // 0 until known
+	Source         string     `json:"source,omitempty"`
+	UsedLastMinute int        `json:"used_last_minute"`
+	Remaining      *int       `json:"remaining,omitempty"` // Unknown without a limit
+	BlockedUntil   *time.Time `json:"blocked_until,omitempty"`
+	Throttled      uint64     `json:"throttled"` // Calls held back
+	Exceeded       uint64     `json:"exceeded"`  // Calls answered 429
+	LastViolation  string     `json:"last_violation,omitempty"`
+}
+
+// modelQuota tracks one model's calls over the last minute.
+type modelQuota struct {
+	limit        int
+	source       string
+	sent         []time.Time // Sorted; calls held back are at the time they go out
+	blockedUntil time.Time
+	throttled    uint64
+	exceeded     uint64
+	violation    string
+}
+
+// quotaTracker paces upstream calls against each model's per-minute
+// request limit, as far as the proxy knows it. The calls counted are this
+// process's own, so replicas sharing an API key each see only part of
+// the usage; a 429 blocks the model for the delay the API asks for either
+// way.
+type quotaTracker struct {
+	cfg config.QuotaConfig
+
+	mu     sync.Mutex
+	models map[string]*modelQuota
+}
+
+func newQuotaTracker(cfg config.QuotaConfig) *quotaTracker {
+	return &quotaTracker{cfg: cfg, models: map[string]*modelQuota{}}
+}
+
+// model returns the tracking of a model, pruned to the last minute. The
+// caller holds q.mu.
+func (q *quotaTracker) model(name string, now time.Time) *modelQuota {
+	m := q.models[name]
+	if m == nil {
+		m = &modelQuota{}
+		if n := q.cfg.RequestsPerMinute[name]; n > 0 {
+			m.limit, m.source = n, quotaFromConfig
+		}
+		q.models[name] = m
+	}
+	cutoff := now.Add(-time.Minute)
+	i := 0
+	for i < len(m.sent) && !m.sent[i].After(cutoff) {
+		i++
+	}
+	m.sent = m.sent[i:]
+	return m
+}
+
+// reserve counts a call to model and returns how long it should wait
+// before going out: until a 429's block ends, until the minute's window
+// has room, or, past slowdown_at of the limit, until its share of the
+// minute since the last call has passed.
+func (q *quotaTracker) reserve(model string, now time.Time) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m := q.model(model, now)
+	at := now
+	if m.blockedUntil.After(at) {
+		at = m.blockedUntil
+	}
+	if used := len(m.sent); m.limit > 0 && used > 0 {
+		switch {
+		case used >= m.limit:
+			at = latest(at, m.sent[used-m.limit].Add(time.Minute))
+		case float64(used) >= q.cfg.SlowdownAt*float64(m.limit):
+			at = latest(at, m.sent[used-1].Add(time.Minute/time.Duration(m.limit)))
+		}
+	}
+	wait := min(at.Sub(now), time.Duration(q.cfg.MaxWaitSeconds)*time.Second)
+	if wait > 0 {
+		m.throttled++
+	} else {
+		wait = 0
+	}
+	at = now.Add(wait)
+	i, _ := slices.BinarySearchFunc(m.sent, at, time.Time.Compare)
+	m.sent = slices.Insert(m.sent, i, at)
+	return wait
+}
+
+// headroom returns how long until a call to model could go out without
+// pacing: until a 429's block ends and until the calls of the last minute
+// fall below slowdown_at of the limit. It reserves nothing. Background
+// work waits it out, leaving the rest of the limit to interactive calls.
+func (q *quotaTracker) headroom(model string, now time.Time) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m := q.model(model, now)
+	at := now
+	if m.blockedUntil.After(at) {
+		at = m.blockedUntil
+	}
+	if m.limit > 0 {
+		allowed := max(1, int(q.cfg.SlowdownAt*float64(m.limit)))
+		if used := len(m.sent); used >= allowed {
+			at = latest(at, m.sent[used-allowed].Add(time.Minute))
+		}
+	}
+	return at.Sub(now)
+}
+
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
+
+// quotaError is the part of a 429 body that describes the quota: the
+// google.rpc QuotaFailure and RetryInfo details.
+type quotaError struct {
+	Error struct {
+		Details []struct {
+			Violations []struct {
+				QuotaID    string `json:"quotaId"`
+				QuotaValue string `json:"quotaValue"`
+			} `json:"violations"`
+			RetryDelay string `json:"retryDelay"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// observe learns from a response to a call to model: the limit and what
+// is left of it from rate-limit headers, and from a 429 the quota that was
+// exceeded and how long to wait. A 429's body is read and put back.
+func (q *quotaTracker) observe(model string, resp *http.Response, now time.Time) {
+	var delay time.Duration
+	var qe quotaError
+	if resp.StatusCode == http.StatusTooManyRequests {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err == nil {
+			json.Unmarshal(body, &qe)
+		}
+		delay, _ = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	m := q.model(model, now)
+	if n, err := strconv.Atoi(resp.Header.Get("x-ratelimit-limit-requests")); err == nil && n > 0 && m.source != quotaFromConfig {
+		m.limit, m.source = n, quotaFromHeader
+	}
+	if resp.Header.Get("x-ratelimit-remaining-requests") == "0" {
+		if d, err := time.ParseDuration(resp.Header.Get("x-ratelimit-reset-requests")); err == nil {
+			m.blockedUntil = latest(m.blockedUntil, now.Add(d))
+		}
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return
+	}
+	m.exceeded++
+	for _, d := range qe.Error.Details {
+		for _, v := range d.Violations {
+			m.violation = v.QuotaID
+			n, err := strconv.Atoi(v.QuotaValue)
+			if err == nil && n > 0 && strings.Contains(v.QuotaID, "RequestsPerMinute") && m.source != quotaFromConfig {
+				m.limit, m.source = n, quotaFromError
+			}
+		}
+		if dd, err := time.ParseDuration(d.RetryDelay); err == nil {
+			delay = max(delay, dd)
+		}
+	}
+	if delay > 0 {
+		m.blockedUntil = latest(m.blockedUntil, now.Add(delay))
+	}
+}
+
+// status reports every model called so far.
+func (q *quotaTracker) status() map[string]QuotaStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	out := map[string]QuotaStatus{}
+	for name := range q.models {
+		m := q.model(name, now)
+		st := QuotaStatus{
+			LimitPerMinute: m.limit,
+			Source:         m.source,
+			UsedLastMinute: len(m.sent),
+			Throttled:      m.throttled,
+			Exceeded:       m.exceeded,
+			LastViolation:  m.violation,
+		}
+		if m.limit > 0 {
+			st.Remaining = new(int)
+			*st.Remaining = max(m.limit-len(m.sent), 0)
+		}
+		if m.blockedUntil.After(now) {
+			t := m.blockedUntil.UTC()
+			st.BlockedUntil = &t
+		}
+		out[name] = st
+	}
+	return out
+}
+
+// quotaModel returns the model a Gemini API call is for, from a path such
+// as /v1beta/models/gemini-2.5-flash:generateContent.
+func quotaModel(path string) (string, bool) {
+	i := strings.LastIndex(path, "/models/")
+	if i < 0 {
+		return "", false
+	}
+	model, _, ok := strings.Cut(path[i+len("/models/"):], ":")
+	return model, ok && model != ""
+}
+
+// quotaTransport holds calls back as their model's rate limit comes near
+// and learns the limits from the responses. It sits below retries, so a
+// retried 429 waits out the block the API asked for.
+type quotaTransport struct {
+	s    *Server
+	base http.RoundTripper
+}
+
+func (t *quotaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	model, ok := quotaModel(req.URL.Path)
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	ctx := req.Context()
+	if wait := t.s.quota.reserve(model, time.Now()); wait > 0 {
+		t.s.requestLogger(ctx).Info("pacing upstream call near the rate limit", "model", model, "wait_ms", wait.Milliseconds())
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		t.s.quota.observe(model, resp, time.Now())
+	}
+	return resp, err
+}
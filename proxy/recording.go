@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"customgemini/config"
+)
+
+// Recording is one upstream exchange as replay.mode record stores it,
+// under the hash of the request it answers. The request is kept only to
+// show what was asked; replay matches on the hash.
+type Recording struct {
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	Status   int             `json:"status"`
+	Header   http.Header     `json:"header"`
+	Response string          `json:"response"` // The body as sent, SSE streams included
+}
+
+// recordTransport records upstream exchanges to disk, or answers from
+// them without calling the API. Requests are matched on their method, URL
+// and body, after generation requests have their temperature and seed
+// pinned, so the same conversation against the same project asks the same
+// thing on every run. A request with several recorded answers gets the
+// last one.
+type recordTransport struct {
+	cfg  config.ReplayConfig
+	dir  string
+	base http.RoundTripper
+	mu   sync.Mutex // Serializes writes to dir
+}
+
+func (s *Server) recordingsDir() string {
+	if filepath.IsAbs(s.cfg.Replay.Dir) {
+		return s.cfg.Replay.Dir
+	}
+	return filepath.Join(s.home, s.cfg.Replay.Dir)
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = pinSampling(req.URL.Path, body, t.cfg.Seed)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	path := filepath.Join(t.dir, recordingKey(req, body)+".json")
+
+	if t.cfg.Mode == config.ReplayReplay {
+		return replayResponse(req, path)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recording{
+		Method:  req.Method,
+		URL:     sanitizeURL(req),
+		Request: sanitizeBody(body),
+		Status:  resp.StatusCode,
+		Header:  http.Header{"Content-Type": resp.Header.Values("Content-Type")},
+	}
+	// Streamed responses are saved once the caller has read them through
+	resp.Body = &recordingBody{ReadCloser: resp.Body, save: func(data []byte) {
+		rec.Response = string(data)
+		t.save(path, rec)
+	}}
+	return resp, nil
+}
+
+func (t *recordTransport) save(path string, rec *Recording) {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := os.MkdirAll(t.dir, 0o755); err == nil {
+		os.WriteFile(path, data, 0o644)
+	}
+}
+
+// replayResponse answers req from the recording at path. A request that
+// was never recorded fails with 404, naming what to record.
+func replayResponse(req *http.Request, path string) (*http.Response, error) {
+	rec := Recording{Status: http.StatusNotFound, Header: http.Header{"Content-Type": {"application/json"}}}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("reading recording %s: %w", path, err)
+		}
+	case os.IsNotExist(err):
+		msg, _ := json.Marshal(fmt.Sprintf("no recording of %s %s in %s; record it with -record", req.Method, req.URL.Path, filepath.Dir(path)))
+		rec.Response = fmt.Sprintf(`{"error": {"code": 404, "message": %s, "status": "NOT_FOUND"}}`, msg)
+	default:
+		return nil, err
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+		StatusCode:    rec.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.Header,
+		Body:          io.NopCloser(strings.NewReader(rec.Response)),
+		ContentLength: int64(len(rec.Response)),
+		Request:       req,
+	}, nil
+}
+
+// recordingKey identifies a request across runs. The API key, sent as a
+// header or query parameter, is left out.
+func recordingKey(req *http.Request, body []byte) string {
+	q := req.URL.Query()
+	q.Del("key")
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s?%s\n", req.Method, req.URL.Path, q.Encode())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// pinSampling sets temperature 0 and seed on a generation request, so its
+// answer is as repeatable as the model allows. Other requests, and bodies
+// that are not JSON, are returned unchanged.
+func pinSampling(path string, body []byte, seed int32) []byte {
+	if !strings.HasSuffix(path, ":generateContent") && !strings.HasSuffix(path, ":streamGenerateContent") {
+		return body
+	}
+	var req map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		return body
+	}
+	gen, _ := req["generationConfig"].(map[string]any)
+	if gen == nil {
+		gen = map[string]any{}
+		req["generationConfig"] = gen
+	}
+	gen["temperature"] = 0
+	gen["seed"] = seed
+	pinned, err := json.Marshal(req)
+	if err != nil {
+		return body
+	}
+	return pinned
+}
+
+// recordingBody hands the whole body to save once it has been read to the
+// end. A body closed early, by a client that went away, is not recorded.
+type recordingBody struct {
+	io.ReadCloser
+	save func([]byte)
+	buf  bytes.Buffer
+	once sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.once.Do(func() { b.save(b.buf.Bytes()) })
+	}
+	return n, err
+}
@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"google.golang.org/genai"
+)
+
+// RedisStore is a SessionStore shared through Redis, so several proxy
+// replicas see the same sessions, cost total and context cache. All keys
+// start with the configured prefix:
+//
+//	<prefix>session:<id>  JSON chat history
+//	<prefix>meta:<id>     hash with the session's title, created, updated, messages and JSON summary
+//	<prefix>sessions      set of session IDs
+//	<prefix>total_cost    running cost total
+//	<prefix>usage:<day>   hash of usage totals, fields "<metric>|<model>"
+//	<prefix>usage:<day>:sessions  sorted set of session IDs by cost
+//	<prefix>cache         hash with the active cache name and model
+//	<prefix>cache_manifest  JSON summary of the last cache built
+//	<prefix>settings:<key>  JSON web UI settings of an API key
+//	<prefix>selection:<key>  JSON editor selection of an API key, with a TTL
+type RedisStore struct {
+	rdb    *redis.Client
+	prefix string
+}
+
+// NewRedisStore connects to the Redis server at url (redis://[:password@]host:port/db)
+// and verifies the connection.
+func NewRedisStore(ctx context.Context, url, prefix string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	rdb := redis.NewClient(opts)
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		rdb.Close()
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return &RedisStore{rdb: rdb, prefix: prefix}, nil
+}
+
+// Close releases the Redis connections.
+func (st *RedisStore) Close() error {
+	return st.rdb.Close()
+}
+
+func (st *RedisStore) History(ctx context.Context, id string) ([]*genai.Content, error) {
+	data, err := st.rdb.Get(ctx, st.prefix+"session:"+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var history []*genai.Content
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil, fmt.Errorf("decoding session %s: %w", id, err)
+	}
+	return history, nil
+}
+
+func (st *RedisStore) SetHistory(ctx context.Context, id string, history []*genai.Content) error {
+	data, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	meta := st.prefix + "meta:" + id
+	_, err = st.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.Set(ctx, st.prefix+"session:"+id, data, 0)
+		p.SAdd(ctx, st.prefix+"sessions", id)
+		p.HSetNX(ctx, meta, "created", now)
+		p.HSet(ctx, meta, "updated", now, "messages", len(history))
+		if title := sessionTitle(history); title != "" {
+			p.HSetNX(ctx, meta, "title", title)
+		}
+		return nil
+	})
+	return err
+}
+
+func (st *RedisStore) Reset(ctx context.Context) error {
+	ids, err := st.rdb.SMembers(ctx, st.prefix+"sessions").Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{st.prefix + "sessions"}
+	for _, id := range ids {
+		keys = append(keys, st.prefix+"session:"+id, st.prefix+"meta:"+id)
+	}
+	return st.rdb.Del(ctx, keys...).Err()
+}
+
+func (st *RedisStore) Sessions(ctx context.Context) (int, error) {
+	n, err := st.rdb.SCard(ctx, st.prefix+"sessions").Result()
+	return int(n), err
+}
+
+func (st *RedisStore) ListSessions(ctx context.Context) ([]SessionInfo, error) {
+	ids, err := st.rdb.SMembers(ctx, st.prefix+"sessions").Result()
+	if err != nil {
+		return nil, err
+	}
+	cmds := make([]*redis.MapStringStringCmd, len(ids))
+	_, err = st.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = p.HGetAll(ctx, st.prefix+"meta:"+id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]SessionInfo, len(ids))
+	for i, id := range ids {
+		list[i] = sessionInfoFromHash(id, cmds[i].Val())
+	}
+	return list, nil
+}
+
+func (st *RedisStore) SessionInfo(ctx context.Context, id string) (*SessionInfo, error) {
+	ok, err := st.rdb.SIsMember(ctx, st.prefix+"sessions", id).Result()
+	if err != nil || !ok {
+		return nil, err
+	}
+	m, err := st.rdb.HGetAll(ctx, st.prefix+"meta:"+id).Result()
+	if err != nil {
+		return nil, err
+	}
+	info := sessionInfoFromHash(id, m)
+	return &info, nil
+}
+
+func (st *RedisStore) CreateSession(ctx context.Context, id, title string) error {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	meta := st.prefix + "meta:" + id
+	_, err := st.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.SAdd(ctx, st.prefix+"sessions", id)
+		p.HSetNX(ctx, meta, "created", now)
+		p.HSetNX(ctx, meta, "updated", now)
+		p.HSet(ctx, meta, "title", title)
+		return nil
+	})
+	return err
+}
+
+func (st *RedisStore) DeleteSession(ctx context.Context, id string) error {
+	_, err := st.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.SRem(ctx, st.prefix+"sessions", id)
+		p.Del(ctx, st.prefix+"session:"+id, st.prefix+"meta:"+id)
+		return nil
+	})
+	return err
+}
+
+func (st *RedisStore) SetSessionSummary(ctx context.Context, id string, sum SessionSummary) error {
+	ok, err := st.rdb.SIsMember(ctx, st.prefix+"sessions", id).Result()
+	if err != nil || !ok {
+		return err
+	}
+	data, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	return st.rdb.HSet(ctx, st.prefix+"meta:"+id, "summary", data).Err()
+}
+
+// sessionInfoFromHash decodes a meta:<id> hash. Sessions written before
+// metadata was tracked have an empty hash and report zero values.
+func sessionInfoFromHash(id string, m map[string]string) SessionInfo {
+	info := SessionInfo{ID: id, Title: m["title"]}
+	info.Created, _ = time.Parse(time.RFC3339Nano, m["created"])
+	info.Updated, _ = time.Parse(time.RFC3339Nano, m["updated"])
+	info.Messages, _ = strconv.Atoi(m["messages"])
+	if data := m["summary"]; data != "" {
+		var sum SessionSummary
+		if json.Unmarshal([]byte(data), &sum) == nil {
+			info.Summary = &sum
+		}
+	}
+	return info
+}
+
+func (st *RedisStore) AddCost(ctx context.Context, cost float64) (float64, error) {
+	return st.rdb.IncrByFloat(ctx, st.prefix+"total_cost", cost).Result()
+}
+
+func (st *RedisStore) TotalCost(ctx context.Context) (float64, error) {
+	v, err := st.rdb.Get(ctx, st.prefix+"total_cost").Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(v, 64)
+}
+
+func (st *RedisStore) RecordUsage(ctx context.Context, day, model, session string, u UsageTotals) error {
+	key := st.prefix + "usage:" + day
+	ttl := UsageRetentionDays * 24 * time.Hour
+	_, err := st.rdb.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.HIncrBy(ctx, key, "requests|"+model, u.Requests)
+		p.HIncrBy(ctx, key, "prompt_tokens|"+model, u.PromptTokens)
+		p.HIncrBy(ctx, key, "response_tokens|"+model, u.ResponseTokens)
+		p.HIncrBy(ctx, key, "thinking_tokens|"+model, u.ThinkingTokens)
+		p.HIncrBy(ctx, key, "cached_tokens|"+model, u.CachedTokens)
+		p.HIncrByFloat(ctx, key, "cost|"+model, u.Cost)
+		p.HIncrByFloat(ctx, key, "cache_savings|"+model, u.CacheSavings)
+		p.Expire(ctx, key, ttl)
+		if session != "" {
+			p.ZIncrBy(ctx, key+":sessions", u.Cost, session)
+			p.Expire(ctx, key+":sessions", ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+func (st *RedisStore) Usage(ctx context.Context, days []string) ([]DailyUsage, error) {
+	totals := make([]*redis.MapStringStringCmd, len(days))
+	sessions := make([]*redis.ZSliceCmd, len(days))
+	_, err := st.rdb.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for i, day := range days {
+			key := st.prefix + "usage:" + day
+			totals[i] = p.HGetAll(ctx, key)
+			sessions[i] = p.ZRangeWithScores(ctx, key+":sessions", 0, -1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []DailyUsage
+	for i, day := range days {
+		fields := totals[i].Val()
+		if len(fields) == 0 {
+			continue
+		}
+		d := DailyUsage{Day: day, Models: make(map[string]UsageTotals), Sessions: make(map[string]float64)}
+		for field, v := range fields {
+			metric, model, ok := strings.Cut(field, "|")
+			if !ok {
+				continue
+			}
+			u := d.Models[model]
+			switch metric {
+			case "requests":
+				u.Requests, _ = strconv.ParseInt(v, 10, 64)
+			case "prompt_tokens":
+				u.PromptTokens, _ = strconv.ParseInt(v, 10, 64)
+			case "response_tokens":
+				u.ResponseTokens, _ = strconv.ParseInt(v, 10, 64)
+			case "thinking_tokens":
+				u.ThinkingTokens, _ = strconv.ParseInt(v, 10, 64)
+			case "cached_tokens":
+				u.CachedTokens, _ = strconv.ParseInt(v, 10, 64)
+			case "cost":
+				u.Cost, _ = strconv.ParseFloat(v, 64)
+			case "cache_savings":
+				u.CacheSavings, _ = strconv.ParseFloat(v, 64)
+			}
+			d.Models[model] = u
+		}
+		for _, z := range sessions[i].Val() {
+			if id, ok := z.Member.(string); ok {
+				d.Sessions[id] = z.Score
+			}
+		}
+		list = append(list, d)
+	}
+	return list, nil
+}
+
+func (st *RedisStore) ActiveCache(ctx context.Context) (string, string, error) {
+	m, err := st.rdb.HGetAll(ctx, st.prefix+"cache").Result()
+	if err != nil {
+		return "", "", err
+	}
+	return m["name"], m["model"], nil
+}
+
+func (st *RedisStore) SetActiveCache(ctx context.Context, name, model string) error {
+	return st.rdb.HSet(ctx, st.prefix+"cache", "name", name, "model", model).Err()
+}
+
+func (st *RedisStore) CacheManifest(ctx context.Context) (*CacheManifest, error) {
+	data, err := st.rdb.Get(ctx, st.prefix+"cache_manifest").Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m CacheManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("decoding cache manifest: %w", err)
+	}
+	return &m, nil
+}
+
+func (st *RedisStore) SetCacheManifest(ctx context.Context, m CacheManifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return st.rdb.Set(ctx, st.prefix+"cache_manifest", data, 0).Err()
+}
+
+func (st *RedisStore) Settings(ctx context.Context, key string) (*UISettings, error) {
+	data, err := st.rdb.Get(ctx, st.prefix+"settings:"+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s UISettings
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("decoding settings: %w", err)
+	}
+	return &s, nil
+}
+
+func (st *RedisStore) SetSettings(ctx context.Context, key string, s UISettings) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return st.rdb.Set(ctx, st.prefix+"settings:"+key, data, 0).Err()
+}
+
+func (st *RedisStore) Selection(ctx context.Context, key string) (*Selection, error) {
+	data, err := st.rdb.Get(ctx, st.prefix+"selection:"+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sel Selection
+	if err := json.Unmarshal(data, &sel); err != nil {
+		return nil, fmt.Errorf("decoding selection: %w", err)
+	}
+	return &sel, nil
+}
+
+func (st *RedisStore) SetSelection(ctx context.Context, key string, sel *Selection, ttl time.Duration) error {
+	if sel == nil {
+		return st.rdb.Del(ctx, st.prefix+"selection:"+key).Err()
+	}
+	data, err := json.Marshal(sel)
+	if err != nil {
+		return err
+	}
+	return st.rdb.Set(ctx, st.prefix+"selection:"+key, data, ttl).Err()
+}
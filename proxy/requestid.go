@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	requestTimerKey
+	sessionIDKey
+	endpointKey
+	journalKey
+	workspaceKey
+	upstreamConnKey
+	noResponseCacheKey
+)
+
+// withRequestID assigns every request an ID (reusing a well-formed incoming
+// X-Request-ID), returns it in the response header and stores it in the
+// request context for logging and upstream correlation, along with a timer
+// for the latency breakdown.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timer := &requestTimer{received: time.Now()}
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		ctx = context.WithValue(ctx, requestTimerKey, timer)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts short IDs made of URL- and log-safe characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom returns the request ID stored in ctx, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// requestLogger returns the logger annotated with the request ID from ctx.
+func (s *Server) requestLogger(ctx context.Context) *slog.Logger {
+	if id := requestIDFrom(ctx); id != "" {
+		return s.logger.With("request_id", id)
+	}
+	return s.logger
+}
+
+// tagUpstream forwards the request ID to the Gemini API so upstream calls
+// can be correlated with proxy logs.
+func tagUpstream(ctx context.Context, config *genai.GenerateContentConfig) {
+	id := requestIDFrom(ctx)
+	if id == "" {
+		return
+	}
+	if config.HTTPOptions == nil {
+		config.HTTPOptions = &genai.HTTPOptions{}
+	}
+	if config.HTTPOptions.Headers == nil {
+		config.HTTPOptions.Headers = http.Header{}
+	}
+	config.HTTPOptions.Headers.Set("X-Request-ID", id)
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// rerankSnippetChars caps each candidate in the rerank prompt, so fifty
+// candidates stay a cheap request.
+const rerankSnippetChars = 1500
+
+// rerankFor resolves a request's rerank override against the configured
+// default.
+func (s *Server) rerankFor(override *bool) bool {
+	if override != nil {
+		return *override
+	}
+	return s.cfg.Index.Rerank
+}
+
+// rerank asks Index.RerankModel which of the candidates answer query and
+// returns up to k of them, most relevant first. Vector similarity often
+// ranks a snippet that mentions the right names above the code that does
+// the work; a model reading both does not. Candidates the model judges
+// irrelevant are dropped. Scores are kept from retrieval.
+func (s *Server) rerank(ctx context.Context, query string, candidates []SearchHit, k int) ([]SearchHit, error) {
+	if len(candidates) <= 1 {
+		return candidates[:min(k, len(candidates))], nil
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Query: %s\n\nBelow are %d numbered snippets from a code base. Return the numbers of the snippets that help answer the query, most useful first, at most %d of them. Leave out snippets that do not help.\n", query, len(candidates), k)
+	for i, h := range candidates {
+		text := h.Text
+		if len(text) > rerankSnippetChars {
+			text = text[:rerankSnippetChars]
+		}
+		fmt.Fprintf(&b, "\n[%d]\n%s\n", i, text)
+	}
+
+	model := s.cfg.Index.RerankModel
+	cfg := &genai.GenerateContentConfig{
+		Temperature:      genai.Ptr[float32](0),
+		ResponseMIMEType: "application/json",
+		ResponseSchema:   &genai.Schema{Type: genai.TypeArray, Items: &genai.Schema{Type: genai.TypeInteger}},
+	}
+	tagUpstream(ctx, cfg)
+	res, err := s.client.Models.GenerateContent(ctx, model, genai.Text(b.String()), cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.recordUsage(ctx, model, res)
+
+	var order []int
+	if err := json.Unmarshal([]byte(res.Text()), &order); err != nil {
+		return nil, fmt.Errorf("%s returned an unreadable ranking: %w", model, err)
+	}
+	seen := map[int]bool{}
+	var out []SearchHit
+	for _, i := range order {
+		if i >= 0 && i < len(candidates) && !seen[i] && len(out) < k {
+			seen[i] = true
+			out = append(out, candidates[i])
+		}
+	}
+	s.requestLogger(ctx).Debug("reranked retrieval", "model", model, "candidates", len(candidates), "kept", len(out))
+	return out, nil
+}
+
+// rerankOrKeep reranks candidates, falling back to their retrieval order
+// if the rerank call fails, since a worse ranking beats no context.
+func (s *Server) rerankOrKeep(ctx context.Context, query string, candidates []SearchHit, k int) []SearchHit {
+	hits, err := s.rerank(ctx, query, candidates, k)
+	if err != nil {
+		s.requestLogger(ctx).Warn("reranking failed, keeping retrieval order", "error", err)
+		return candidates[:min(k, len(candidates))]
+	}
+	return hits
+}
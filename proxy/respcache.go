@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// cacheHeader marks upstream responses served from the response cache so
+// cost accounting can tell them apart.
+const cacheHeader = "X-Proxy-Cache"
+
+// responseCache holds upstream generateContent responses keyed on the exact
+// request: the model in the URL plus the full JSON body, which carries the
+// history, the new turn, tools, system prompt and generation config. Any
+// difference in prompt or settings is a miss. A nil cache is disabled.
+type responseCache struct {
+	ttl time.Duration
+	max int
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cachedResponse struct {
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func newResponseCache(cfg config.ResponseCacheConfig) *responseCache {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &responseCache{
+		ttl:     time.Duration(cfg.TTLSeconds) * time.Second,
+		max:     cfg.MaxEntries,
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e
+}
+
+func (c *responseCache) put(key string, e *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max > 0 && len(c.entries) >= c.max {
+		c.evictLocked()
+	}
+	c.entries[key] = e
+}
+
+// evictLocked drops expired entries, or the one closest to expiry when none
+// have expired yet.
+func (c *responseCache) evictLocked() {
+	now := time.Now()
+	var oldest string
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+			continue
+		}
+		if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+			oldest = k
+		}
+	}
+	if len(c.entries) >= c.max && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
+
+// len reports the number of cached responses, including expired ones not
+// yet evicted.
+func (c *responseCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// cacheTransport answers repeated generateContent calls from the response
+// cache. Streaming calls, capture replays and everything else pass
+// straight through.
+type cacheTransport struct {
+	cache *responseCache
+	base  http.RoundTripper
+}
+
+func (t *cacheTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodPost || !strings.HasSuffix(req.URL.Path, ":generateContent") || req.Body == nil ||
+		req.Context().Value(noResponseCacheKey) != nil {
+		return t.base.RoundTrip(req)
+	}
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	sum := sha256.Sum256(append([]byte(req.URL.Path+"\n"), body...))
+	key := hex.EncodeToString(sum[:])
+	if e := t.cache.get(key); e != nil {
+		t.cache.hits.Add(1)
+		header := e.header.Clone()
+		header.Set(cacheHeader, "HIT")
+		return &http.Response{
+			Status:        "200 OK",
+			StatusCode:    http.StatusOK,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(e.body)),
+			ContentLength: int64(len(e.body)),
+			Request:       req,
+		}, nil
+	}
+	t.cache.misses.Add(1)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	t.cache.put(key, &cachedResponse{
+		header:  resp.Header.Clone(),
+		body:    data,
+		expires: time.Now().Add(t.cache.ttl),
+	})
+	return resp, nil
+}
+
+// servedFromCache reports whether res was answered by the response cache
+// rather than the Gemini API.
+func servedFromCache(res *genai.GenerateContentResponse) bool {
+	return res != nil && res.SDKHTTPResponse != nil && res.SDKHTTPResponse.Headers.Get(cacheHeader) == "HIT"
+}
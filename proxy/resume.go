@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StreamHeader carries a /chat/stream response's stream ID, which
+// GET /chat/stream/<id> takes to resume it.
+const StreamHeader = "X-Stream-ID"
+
+// maxStreamBuffer bounds the events kept per stream. The oldest are
+// dropped beyond it, and a client can no longer resume from before them.
+const maxStreamBuffer = 8 << 20
+
+type streamEvent struct {
+	id    uint64
+	frame []byte // Complete SSE frame, ID included
+}
+
+// resumableStream buffers the events of one /chat/stream generation so a
+// client whose connection drops can reconnect with Last-Event-ID and pick
+// up where it left off. The generation publishes events and every
+// connected client serves them. When the last client goes, generation
+// continues for the grace period before it is cancelled.
+type resumableStream struct {
+	mu      sync.Mutex
+	events  []streamEvent
+	bytes   int
+	seq     uint64
+	wake    chan struct{} // Closed and replaced whenever an event arrives or the stream ends
+	ended   bool
+	readers int
+	grace   time.Duration
+	cancel  context.CancelFunc
+	orphan  *time.Timer
+}
+
+func (st *resumableStream) publish(event string, data []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seq++
+	frame := fmt.Appendf(nil, "id: %d\nevent: %s\ndata: %s\n\n", st.seq, event, data)
+	st.events = append(st.events, streamEvent{id: st.seq, frame: frame})
+	st.bytes += len(frame)
+	for st.bytes > maxStreamBuffer && len(st.events) > 1 {
+		st.bytes -= len(st.events[0].frame)
+		st.events = st.events[1:]
+	}
+	close(st.wake)
+	st.wake = make(chan struct{})
+}
+
+// end marks the generation finished; clients are served what is left.
+func (st *resumableStream) end() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.ended = true
+	if st.orphan != nil {
+		st.orphan.Stop()
+	}
+	close(st.wake)
+	st.wake = make(chan struct{})
+}
+
+// attach registers a client resuming after the given event. It fails when
+// events after that one have already been dropped from the buffer.
+func (st *resumableStream) attach(after uint64) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(st.events) > 0 && after+1 < st.events[0].id {
+		return false
+	}
+	st.readers++
+	if st.orphan != nil {
+		st.orphan.Stop()
+		st.orphan = nil
+	}
+	return true
+}
+
+// detach unregisters a client. When the last one goes before the stream
+// has ended, the generation is cancelled unless another client attaches
+// within the grace period.
+func (st *resumableStream) detach() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.readers--
+	if st.readers > 0 || st.ended {
+		return
+	}
+	if st.grace <= 0 {
+		st.cancel()
+		return
+	}
+	st.orphan = time.AfterFunc(st.grace, func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if st.readers == 0 {
+			st.cancel()
+		}
+	})
+}
+
+// serve writes the events after the given one to w as they arrive, until
+// the stream ends or ctx is done, sending a comment when it has been idle
+// for keepalive. It reports whether the client received the whole stream.
+func (st *resumableStream) serve(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, after uint64, keepalive time.Duration) bool {
+	var idle <-chan time.Time
+	var t *time.Timer
+	if keepalive > 0 {
+		t = time.NewTimer(keepalive)
+		defer t.Stop()
+		idle = t.C
+	}
+	reset := func() {
+		if t != nil {
+			t.Reset(keepalive)
+		}
+	}
+	for {
+		st.mu.Lock()
+		i := sort.Search(len(st.events), func(i int) bool { return st.events[i].id > after })
+		pending := st.events[i:]
+		ended, wake := st.ended, st.wake
+		st.mu.Unlock()
+
+		if len(pending) > 0 {
+			for _, e := range pending {
+				w.Write(e.frame)
+			}
+			flusher.Flush()
+			after = pending[len(pending)-1].id
+			reset()
+		}
+		if ended {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-wake:
+		case <-idle:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+			reset()
+		}
+	}
+}
+
+// streamTable holds the resumable streams of running generations, and of
+// finished ones for a grace period.
+type streamTable struct {
+	mu      sync.Mutex
+	streams map[string]*resumableStream
+}
+
+func newStreamTable() *streamTable {
+	return &streamTable{streams: map[string]*resumableStream{}}
+}
+
+// open registers a stream with its first client attached. cancel stops its
+// generation.
+func (t *streamTable) open(id string, grace time.Duration, cancel context.CancelFunc) *resumableStream {
+	st := &resumableStream{wake: make(chan struct{}), readers: 1, grace: grace, cancel: cancel}
+	t.mu.Lock()
+	t.streams[id] = st
+	t.mu.Unlock()
+	return st
+}
+
+func (t *streamTable) get(id string) *resumableStream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.streams[id]
+}
+
+// expire forgets a finished stream once the grace period has passed.
+func (t *streamTable) expire(id string, grace time.Duration) {
+	time.AfterFunc(grace, func() {
+		t.mu.Lock()
+		delete(t.streams, id)
+		t.mu.Unlock()
+	})
+}
+
+// handleChatStreamResume serves GET /chat/stream/<id>, replaying a
+// /chat/stream response from the event after Last-Event-ID (or ?after=)
+// and following it to the end. A stream can be resumed while it runs and
+// for the grace period after it ends.
+func (s *Server) handleChatStreamResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/chat/stream/")
+	st := s.streams.get(id)
+	if st == nil {
+		http.Error(w, "Stream not found or expired", http.StatusNotFound)
+		return
+	}
+	after, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	if v := r.URL.Query().Get("after"); v != "" {
+		var err error
+		if after, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if !st.attach(after) {
+		http.Error(w, "Events after this one are no longer buffered", http.StatusGone)
+		return
+	}
+	defer st.detach()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	s.requestLogger(r.Context()).Info("chat stream resumed", "stream", id, "after", after)
+	st.serve(r.Context(), w, flusher, after, time.Duration(s.cfg.Streaming.KeepaliveSeconds)*time.Second)
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"google.golang.org/genai"
+)
+
+// Context modes select what project context a chat message is sent with.
+const (
+	ContextCache = "cache" // The active context cache, when there is one (the default)
+	ContextRAG   = "rag"   // Chunks retrieved from the semantic index for the message
+	ContextNone  = "none"  // Neither
+)
+
+// rrfK damps the reciprocal rank fusion of keyword and semantic results,
+// so a chunk ranked well by both beats one ranked first by only one.
+const rrfK = 60
+
+// validContextMode reports whether mode is a context mode, or empty.
+func validContextMode(mode string) bool {
+	switch mode {
+	case "", ContextCache, ContextRAG, ContextNone:
+		return true
+	}
+	return false
+}
+
+// searchTerms splits a query into lower-case words and identifiers of two
+// or more characters.
+func searchTerms(query string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+	seen := map[string]bool{}
+	var terms []string
+	for _, f := range fields {
+		if len(f) >= 2 && !seen[f] {
+			seen[f] = true
+			terms = append(terms, f)
+		}
+	}
+	return terms
+}
+
+// keywordSearch ranks chunks by the query's terms, weighting rare terms
+// higher and saturating repeated ones, as BM25 does.
+func (ix *vectorIndex) keywordSearch(query string, k int) []SearchHit {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	type doc struct {
+		hit    SearchHit
+		counts []int
+	}
+	var docs []doc
+	df := make([]int, len(terms))
+	for rel, f := range ix.data.Files {
+		for _, c := range f.Chunks {
+			text := strings.ToLower(c.Text)
+			d := doc{SearchHit{Project: ix.name, Path: rel, StartLine: c.StartLine, EndLine: c.EndLine, Text: c.Text}, make([]int, len(terms))}
+			for i, t := range terms {
+				if d.counts[i] = strings.Count(text, t); d.counts[i] > 0 {
+					df[i]++
+				}
+			}
+			docs = append(docs, d)
+		}
+	}
+	var hits []SearchHit
+	n := float64(len(docs))
+	for _, d := range docs {
+		score := 0.0
+		for i, tf := range d.counts {
+			if tf > 0 {
+				idf := math.Log(1 + (n-float64(df[i])+0.5)/(float64(df[i])+0.5))
+				score += idf * float64(tf) * 2.2 / (float64(tf) + 1.2)
+			}
+		}
+		if score > 0 {
+			d.hit.Score = score
+			hits = append(hits, d.hit)
+		}
+	}
+	sortHits(hits)
+	return hits[:min(k, len(hits))]
+}
+
+// retrieve returns the k chunks most relevant to query, fusing the keyword
+// and semantic rankings. If the query cannot be embedded, the keyword
+// ranking is used alone.
+func (s *Server) retrieve(ctx context.Context, query string, k int) []SearchHit {
+	keyword := s.vectors.keywordSearch(query, 2*k)
+	semantic, err := s.SemanticSearch(ctx, query, 2*k, "")
+	if err != nil {
+		s.requestLogger(ctx).Warn("semantic retrieval failed, using keywords only", "error", err)
+	}
+
+	type key struct {
+		path  string
+		start int
+	}
+	fused := map[key]*SearchHit{}
+	for _, ranking := range [][]SearchHit{keyword, semantic} {
+		for rank, h := range ranking {
+			kk := key{h.Path, h.StartLine}
+			if fused[kk] == nil {
+				h.Score = 0
+				fused[kk] = &h
+			}
+			fused[kk].Score += 1 / float64(rrfK+rank+1)
+		}
+	}
+	hits := make([]SearchHit, 0, len(fused))
+	for _, h := range fused {
+		hits = append(hits, *h)
+	}
+	sortHits(hits)
+	return hits[:min(k, len(hits))]
+}
+
+// retrievalContext retrieves the chunks relevant to a message, reranked
+// if asked, and returns them as a turn-only part to send ahead of it. On
+// failure it also returns the HTTP status to report.
+func (s *Server) retrievalContext(ctx context.Context, message string, rerank bool) ([]genai.Part, map[*genai.Blob]string, int, error) {
+	if s.vectors.status().Chunks == 0 {
+		return nil, nil, http.StatusConflict, fmt.Errorf("context_mode %q needs the semantic index; build it with POST /index or -index", ContextRAG)
+	}
+	var hits []SearchHit
+	if rerank {
+		candidates := s.retrieve(ctx, message, s.cfg.Index.RerankCandidates)
+		hits = s.rerankOrKeep(ctx, message, candidates, s.cfg.Index.TopK)
+	} else {
+		hits = s.retrieve(ctx, message, s.cfg.Index.TopK)
+	}
+	if len(hits) == 0 {
+		return nil, nil, 0, nil
+	}
+	var b strings.Builder
+	b.WriteString("Excerpts of the project retrieved for this message. They may be incomplete; use the file tools to read more.\n")
+	for _, h := range hits {
+		fmt.Fprintf(&b, "\n```\n%s\n```\n", h.Text)
+	}
+	s.requestLogger(ctx).Debug("retrieved project context", "chunks", len(hits), "bytes", b.Len())
+	blob := &genai.Blob{MIMEType: "text/plain", Data: []byte(b.String())}
+	name := fmt.Sprintf("%d retrieved project excerpts", len(hits))
+	return []genai.Part{{InlineData: blob}}, map[*genai.Blob]string{blob: name}, 0, nil
+}
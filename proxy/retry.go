@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryAfter caps how long a Retry-After header from the API can stall a
+// request before the retry is attempted anyway.
+const maxRetryAfter = time.Minute
+
+// retryTransport retries transient upstream failures — 429, 5xx gateway
+// errors and network errors — with exponential backoff and full jitter,
+// honoring Retry-After. It sits below the response cache and above request
+// capture, so every attempt is captured.
+type retryTransport struct {
+	s    *Server
+	base http.RoundTripper
+}
+
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attempts := t.s.cfg.Retry.MaxAttempts
+	if attempts <= 1 {
+		return t.base.RoundTrip(req)
+	}
+
+	// Buffer the body so each attempt can resend it
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := req.Context()
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.base.RoundTrip(req)
+		if ctx.Err() != nil || attempt >= attempts {
+			return resp, err
+		}
+		if err == nil && !retryable(resp.StatusCode) {
+			return resp, nil
+		}
+
+		delay := t.backoff(attempt)
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+			if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = min(d, maxRetryAfter)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		t.s.upstreamRetries.Add(1)
+		timerFrom(ctx).retried()
+		t.s.requestLogger(ctx).Warn("retrying upstream call",
+			"attempt", attempt,
+			"max_attempts", attempts,
+			"status", status,
+			"error", err,
+			"delay_ms", delay.Milliseconds(),
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// backoff returns a random delay between zero and the exponential bound
+// for the given attempt, capped at the configured maximum.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	rc := t.s.cfg.Retry
+	bound := time.Duration(rc.InitialBackoffMs) * time.Millisecond << (attempt - 1)
+	if limit := time.Duration(rc.MaxBackoffMs) * time.Millisecond; bound > limit || bound <= 0 {
+		bound = limit
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return rand.N(bound) + 1
+}
+
+// parseRetryAfter reads a Retry-After header in either delay-seconds or
+// HTTP-date form.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
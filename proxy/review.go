@@ -0,0 +1,418 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"customgemini/config"
+)
+
+// reviewSession is the session review usage is recorded under. Its
+// history is never saved.
+const reviewSession = "review"
+
+// maxReviewDiffBytes caps the diff a review reads, whether posted or
+// fetched, so one large pull request cannot fill the context window.
+const maxReviewDiffBytes = 1 << 20
+
+// Review comment severities
+const (
+	SeverityError      = "error"      // A bug, security hole or broken build
+	SeverityWarning    = "warning"    // Likely wrong or fragile
+	SeveritySuggestion = "suggestion" // Style, naming, simplification
+)
+
+const reviewPrompt = `Review the change below as a careful senior engineer on this project would, using what you know of the code base. Report bugs, security problems, race conditions, missing error handling, broken callers elsewhere in the project and places that go against the project's conventions. Do not praise, restate the change or comment on formatting a formatter would fix. Give every comment the file path as the diff names it and the line number in the new version of the file, on a line the diff shows. Severity is "error" for bugs, security holes and broken builds, "warning" for code that is likely wrong or fragile, and "suggestion" for the rest. Sum up the change and your verdict in a few sentences. Return no comments if there is nothing worth saying.`
+
+// reviewSchema is the JSON Schema review replies follow.
+var reviewSchema = json.RawMessage(`{
+	"type": "object",
+	"properties": {
+		"summary": {"type": "string"},
+		"comments": {
+			"type": "array",
+			"items": {
+				"type": "object",
+				"properties": {
+					"file": {"type": "string"},
+					"line": {"type": "integer"},
+					"severity": {"type": "string", "enum": ["error", "warning", "suggestion"]},
+					"message": {"type": "string"}
+				},
+				"required": ["file", "line", "severity", "message"]
+			}
+		}
+	},
+	"required": ["summary", "comments"]
+}`)
+
+// ReviewRequest is the body of POST /review: a unified diff, or the URL
+// of a GitHub pull request or GitLab merge request to fetch it from.
+type ReviewRequest struct {
+	Diff  string `json:"diff,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Token string `json:"token,omitempty"` // Sent to the forge only, to read a private repository
+	Model string `json:"model,omitempty"`
+	Focus string `json:"focus,omitempty"` // What to look at most closely, added to the prompt
+}
+
+// ReviewComment is a comment on one line of the reviewed change. Line is
+// in the new version of File. InDiff is false when the line is not one
+// the diff shows, where forges refuse line comments; such comments
+// belong in the review body.
+type ReviewComment struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	InDiff   bool   `json:"in_diff"`
+}
+
+// ReviewResponse is the review of a change.
+type ReviewResponse struct {
+	Summary  string          `json:"summary"`
+	Comments []ReviewComment `json:"comments"`
+	Model    string          `json:"model"`
+	Cost     float64         `json:"cost"`
+	Timings  *Timings        `json:"timings,omitempty"`
+}
+
+func (s *Server) handleReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req ReviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, status, err := s.review(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	setServerTiming(w, resp.Timings)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// review runs req's diff past the model with the project's context. On
+// failure it also returns the HTTP status to report.
+func (s *Server) review(ctx context.Context, req ReviewRequest) (*ReviewResponse, int, error) {
+	diff := req.Diff
+	switch {
+	case diff != "" && req.URL != "":
+		return nil, http.StatusBadRequest, errors.New("send either diff or url, not both")
+	case req.URL != "":
+		var err error
+		if diff, err = s.fetchDiff(ctx, req.URL, req.Token); err != nil {
+			var fe *forgeError
+			if errors.As(err, &fe) {
+				return nil, fe.status, err
+			}
+			return nil, http.StatusBadGateway, fmt.Errorf("fetching %s: %w", req.URL, err)
+		}
+	case diff == "":
+		return nil, http.StatusBadRequest, errors.New("diff or url is required")
+	}
+	if len(diff) > maxReviewDiffBytes {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("the diff is over %d bytes", maxReviewDiffBytes)
+	}
+	lines := diffLines(diff)
+	if len(lines) == 0 {
+		return nil, http.StatusBadRequest, errors.New("no file changes found in the diff")
+	}
+
+	prompt := reviewPrompt
+	if req.Focus != "" {
+		prompt += "\n\nPay most attention to: " + req.Focus
+	}
+	prompt += "\n\n```diff\n" + diff + "\n```"
+	chatReq := &ChatRequest{
+		SessionID:      reviewSession,
+		Model:          req.Model,
+		Message:        prompt,
+		ResponseSchema: reviewSchema,
+		ephemeral:      true,
+	}
+	resp, status, err := s.runChat(ctx, "/review", chatReq)
+	if err != nil {
+		return nil, status, err
+	}
+	var reply struct {
+		Summary  string          `json:"summary"`
+		Comments []ReviewComment `json:"comments"`
+	}
+	if err := json.Unmarshal(resp.Structured, &reply); err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("the model's review does not follow the schema: %w", err)
+	}
+	comments := make([]ReviewComment, 0, len(reply.Comments))
+	for _, c := range reply.Comments {
+		c.File = strings.TrimPrefix(c.File, "b/")
+		if c.Severity != SeverityError && c.Severity != SeverityWarning {
+			c.Severity = SeveritySuggestion
+		}
+		c.InDiff = lines[c.File][c.Line]
+		comments = append(comments, c)
+	}
+	return &ReviewResponse{
+		Summary:  reply.Summary,
+		Comments: comments,
+		Model:    chatReq.Model,
+		Cost:     resp.Cost,
+		Timings:  resp.Timings,
+	}, http.StatusOK, nil
+}
+
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// diffLines returns, for each file a unified diff changes, the line
+// numbers of its new version that the diff shows: those added and the
+// context around them. Deleted files are left out. Hunks are read by
+// their line counts, so content lines that look like headers are not
+// taken for them.
+func diffLines(diff string) map[string]map[int]bool {
+	files := make(map[string]map[int]bool)
+	var cur map[int]bool
+	line, oldLeft, newLeft := 0, 0, 0
+	count := func(s string) int {
+		if s == "" {
+			return 1
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	for _, l := range strings.Split(diff, "\n") {
+		if oldLeft > 0 || newLeft > 0 {
+			switch {
+			case strings.HasPrefix(l, "+"):
+				newLeft--
+			case strings.HasPrefix(l, "-"):
+				oldLeft--
+				continue
+			case strings.HasPrefix(l, `\`):
+				continue
+			default:
+				oldLeft--
+				newLeft--
+			}
+			if cur != nil {
+				cur[line] = true
+			}
+			line++
+			continue
+		}
+		switch {
+		case strings.HasPrefix(l, "+++ "):
+			cur = nil
+			path, _, _ := strings.Cut(strings.TrimPrefix(l, "+++ "), "\t")
+			if path = strings.TrimSpace(path); path != "/dev/null" {
+				cur = make(map[int]bool)
+				files[strings.TrimPrefix(path, "b/")] = cur
+			}
+		case strings.HasPrefix(l, "@@"):
+			if m := hunkHeader.FindStringSubmatch(l); m != nil {
+				oldLeft, newLeft = count(m[1]), count(m[3])
+				line, _ = strconv.Atoi(m[2])
+			}
+		}
+	}
+	return files
+}
+
+// forgeError is a forge refusing a request, reported with a status the
+// client can act on.
+type forgeError struct {
+	status int
+	msg    string
+}
+
+func (e *forgeError) Error() string { return e.msg }
+
+// forgeTimeout bounds each request to a forge.
+const forgeTimeout = 30 * time.Second
+
+// newForgeClient returns the client forge requests go through: the
+// upstream transport, so they follow the same proxy settings, with a
+// timeout. Redirects to another host are refused, since GitLab's token
+// header would follow them.
+func newForgeClient(cfg config.UpstreamConfig) (*http.Client, error) {
+	transport, err := UpstreamTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   forgeTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 || req.URL.Host != via[0].URL.Host {
+				return fmt.Errorf("%s redirected to %s", via[0].URL.Host, req.URL.Host)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// forgeKind returns the kind of forge at host: github.com, gitlab.com or
+// one configured under forges. Diffs are fetched from no other host, since
+// the request's token goes with the fetch.
+func (s *Server) forgeKind(host string) (string, bool) {
+	switch host {
+	case "github.com":
+		return config.ForgeGitHub, true
+	case "gitlab.com":
+		return config.ForgeGitLab, true
+	}
+	for _, f := range s.cfg.Forges {
+		if strings.EqualFold(f.Host, host) {
+			return f.Kind, true
+		}
+	}
+	return "", false
+}
+
+// pathSegments splits a URL path into its segments, or returns false if
+// any is empty, "." or "..".
+func pathSegments(p string) ([]string, bool) {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return nil, false
+		}
+	}
+	return parts, true
+}
+
+// requestNumber reports whether n is the number of a pull or merge request.
+func requestNumber(n string) bool {
+	_, err := strconv.ParseUint(n, 10, 32)
+	return err == nil && n[0] != '0'
+}
+
+// fetchDiff fetches the diff of a GitHub pull request
+// (https://github.com/owner/repo/pull/N) or GitLab merge request
+// (https://gitlab.com/group/project/-/merge_requests/N), on github.com,
+// gitlab.com or a forge configured under forges.
+func (s *Server) fetchDiff(ctx context.Context, rawURL, token string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return "", &forgeError{http.StatusBadRequest, fmt.Sprintf("invalid url %q", rawURL)}
+	}
+	kind, ok := s.forgeKind(u.Host)
+	if !ok {
+		return "", &forgeError{http.StatusBadRequest, fmt.Sprintf("%s is not github.com, gitlab.com or a forge listed under forges", u.Host)}
+	}
+	base := u.Scheme + "://" + u.Host
+	notRequest := &forgeError{http.StatusBadRequest, fmt.Sprintf("%s is not a GitHub pull request or GitLab merge request URL", rawURL)}
+	if kind == config.ForgeGitLab {
+		project, rest, ok := strings.Cut(u.Path, "/-/merge_requests/")
+		n, _, _ := strings.Cut(rest, "/")
+		parts, valid := pathSegments(project)
+		if !ok || !valid || len(parts) < 2 || !requestNumber(n) {
+			return "", notRequest
+		}
+		if u.Host == "gitlab.com" {
+			base = "https://gitlab.com"
+		}
+		return s.fetchGitLabDiff(ctx, base+"/api/v4/projects/"+url.PathEscape(strings.Join(parts, "/"))+"/merge_requests/"+n+"/diffs", token)
+	}
+	parts, valid := pathSegments(u.Path)
+	if !valid || len(parts) < 4 || parts[2] != "pull" || !requestNumber(parts[3]) {
+		return "", notRequest
+	}
+	api := base + "/api/v3"
+	if u.Host == "github.com" {
+		api = "https://api.github.com"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api+"/repos/"+url.PathEscape(parts[0])+"/"+url.PathEscape(parts[1])+"/pulls/"+parts[3], nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github.diff")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	body, _, err := s.forgeGet(req)
+	return string(body), err
+}
+
+// gitlabDiff is a file in GitLab's merge request diffs.
+type gitlabDiff struct {
+	OldPath     string `json:"old_path"`
+	NewPath     string `json:"new_path"`
+	Diff        string `json:"diff"`
+	NewFile     bool   `json:"new_file"`
+	DeletedFile bool   `json:"deleted_file"`
+}
+
+// fetchGitLabDiff reads every page of a merge request's diffs and joins
+// them into a unified diff.
+func (s *Server) fetchGitLabDiff(ctx context.Context, api, token string) (string, error) {
+	var b strings.Builder
+	for page := "1"; page != ""; {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, api+"?per_page=100&page="+page, nil)
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			req.Header.Set("PRIVATE-TOKEN", token)
+		}
+		body, header, err := s.forgeGet(req)
+		if err != nil {
+			return "", err
+		}
+		var files []gitlabDiff
+		if err := json.Unmarshal(body, &files); err != nil {
+			return "", fmt.Errorf("reading GitLab diffs: %w", err)
+		}
+		for _, f := range files {
+			from, to := "a/"+f.OldPath, "b/"+f.NewPath
+			if f.NewFile {
+				from = "/dev/null"
+			}
+			if f.DeletedFile {
+				to = "/dev/null"
+			}
+			fmt.Fprintf(&b, "diff --git a/%s b/%s\n--- %s\n+++ %s\n%s", f.OldPath, f.NewPath, from, to, f.Diff)
+			if !strings.HasSuffix(f.Diff, "\n") {
+				b.WriteByte('\n')
+			}
+		}
+		if b.Len() > maxReviewDiffBytes {
+			break
+		}
+		page = header.Get("X-Next-Page")
+	}
+	return b.String(), nil
+}
+
+// forgeGet runs a forge API request and reads up to just over
+// maxReviewDiffBytes of its body. A 401, 403 or 404 is reported as such,
+// since it usually means the token is missing or cannot read the
+// repository.
+func (s *Server) forgeGet(req *http.Request) ([]byte, http.Header, error) {
+	resp, err := s.forgeClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return nil, nil, &forgeError{resp.StatusCode, fmt.Sprintf("%s answered %s; check the url and token", req.URL.Host, resp.Status)}
+	default:
+		return nil, nil, fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxReviewDiffBytes+1))
+	return body, resp.Header, err
+}
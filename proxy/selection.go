@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// selectionTTL is how long a registered selection applies after the IDE
+// last sent it.
+const selectionTTL = 30 * time.Minute
+
+// Selection is the file and code an IDE user has selected, registered so
+// that chat requests with the same API key can refer to "this" without
+// pasting it.
+type Selection struct {
+	Path      string    `json:"path"` // Relative to the project when it lies inside it
+	Language  string    `json:"language,omitempty"`
+	StartLine int       `json:"start_line,omitempty"`
+	EndLine   int       `json:"end_line,omitempty"`
+	Text      string    `json:"text,omitempty"` // Empty when only a file is open
+	Updated   time.Time `json:"updated"`
+}
+
+func (sel *Selection) validate() error {
+	if sel.Path == "" && sel.Text == "" {
+		return fmt.Errorf("path or text is required")
+	}
+	if len(sel.Text) > MaxFileBytes {
+		return fmt.Errorf("selection is larger than %d KB", MaxFileBytes>>10)
+	}
+	if sel.StartLine < 0 || sel.EndLine < sel.StartLine && sel.EndLine != 0 {
+		return fmt.Errorf("invalid line range %d-%d", sel.StartLine, sel.EndLine)
+	}
+	return nil
+}
+
+// prompt renders the selection as the context sent ahead of a message.
+func (sel *Selection) prompt() string {
+	var b strings.Builder
+	switch {
+	case sel.Text == "":
+		fmt.Fprintf(&b, "The user has %s open in their editor.", sel.Path)
+	case sel.Path == "":
+		b.WriteString("The user has selected this code in their editor:")
+	case sel.StartLine > 0 && sel.EndLine > sel.StartLine:
+		fmt.Fprintf(&b, "The user has selected lines %d-%d of %s in their editor:", sel.StartLine, sel.EndLine, sel.Path)
+	case sel.StartLine > 0:
+		fmt.Fprintf(&b, "The user has selected line %d of %s in their editor:", sel.StartLine, sel.Path)
+	default:
+		fmt.Fprintf(&b, "The user has selected this code in %s in their editor:", sel.Path)
+	}
+	if sel.Text != "" {
+		fmt.Fprintf(&b, "\n```%s\n%s\n```", sel.Language, strings.TrimRight(sel.Text, "\n"))
+	}
+	return b.String()
+}
+
+// selectionContext returns the selection registered under key as a
+// turn-only part to send ahead of the message, or nothing when there is
+// none. A store failure only costs the context, so it is logged.
+func (s *Server) selectionContext(ctx context.Context, key string) ([]genai.Part, map[*genai.Blob]string) {
+	sel, err := s.store.Selection(ctx, key)
+	if err != nil {
+		s.requestLogger(ctx).Warn("loading selection", "error", err)
+		return nil, nil
+	}
+	if sel == nil {
+		return nil, nil
+	}
+	blob := &genai.Blob{MIMEType: "text/plain", Data: []byte(sel.prompt())}
+	name := "editor selection"
+	if sel.Path != "" {
+		name += " in " + sel.Path
+	}
+	return []genai.Part{{InlineData: blob}}, map[*genai.Blob]string{blob: name}
+}
+
+// handleSelection lets IDE plugins register the user's current file and
+// selection for their API key. Until it expires or is cleared, /chat and
+// /v1/chat/completions requests with the same key send it ahead of the
+// message.
+//
+//	GET    /context/selection  the registered selection
+//	POST   /context/selection  register {"path", "language", "start_line", "end_line", "text"}
+//	DELETE /context/selection  clear it
+func (s *Server) handleSelection(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	key := settingsKey(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		sel, err := s.store.Selection(ctx, key)
+		if err != nil {
+			http.Error(w, "Loading selection: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if sel == nil {
+			http.Error(w, "No selection registered", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sel)
+
+	case http.MethodPost:
+		var sel Selection
+		if err := json.NewDecoder(r.Body).Decode(&sel); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := sel.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filepath.IsAbs(sel.Path) {
+			if rel, err := filepath.Rel(s.root(ctx), sel.Path); err == nil && !strings.HasPrefix(rel, "..") {
+				sel.Path = filepath.ToSlash(rel)
+			}
+		}
+		sel.Updated = time.Now().UTC()
+		if err := s.store.SetSelection(ctx, key, &sel, selectionTTL); err != nil {
+			http.Error(w, "Saving selection: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sel)
+
+	case http.MethodDelete:
+		if err := s.store.SetSelection(ctx, key, nil, 0); err != nil {
+			http.Error(w, "Clearing selection: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,553 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+const (
+	embedBatchSize     = 100  // Texts per batchEmbedContents call
+	maxChunkChars      = 8000 // Keeps a chunk of long lines within the model's input limit
+	defaultSearchHits  = 8
+	maxSearchHits      = 50
+	charsPerTokenGuess = 4 // The Gemini API reports no token counts for embeddings
+)
+
+var (
+	errIndexBuilding = errors.New("the index is already being built")
+	errIndexEmpty    = errors.New("the semantic index is empty; build it with POST /index or -index")
+)
+
+// indexChunk is a run of lines of one file and its embedding, normalized
+// so that cosine similarity is a dot product.
+type indexChunk struct {
+	StartLine, EndLine int
+	Text               string
+	Vector             []float32
+}
+
+// indexedFile is a file as it was last indexed. Binary files are kept
+// without chunks, so they are not mistaken for new ones.
+type indexedFile struct {
+	Hash    string // sha256 of the content the chunks were made from
+	ModTime time.Time
+	Size    int64
+	Chunks  []indexChunk
+}
+
+// unchanged reports whether info has the size and modification time the
+// file was indexed with.
+func (f indexedFile) unchanged(info fs.FileInfo) bool {
+	return f.Size == info.Size() && f.ModTime.Equal(info.ModTime())
+}
+
+// indexData is what is saved to disk.
+type indexData struct {
+	Model      string
+	Dimensions int
+	Chunking   string // chunkingKey of the settings the files were chunked with
+	Built      time.Time
+	Files      map[string]indexedFile
+}
+
+// vectorIndex is the semantic search index of a project: every file the
+// corpus filter selects, split into chunks and embedded. It is small
+// enough to search exhaustively, and is kept as a gob file under the home
+// directory so a restart only re-embeds files that changed.
+type vectorIndex struct {
+	name string // mainProject for the served project
+	root string
+	path string
+
+	mu       sync.RWMutex
+	data     indexData
+	building bool
+}
+
+// IndexStatus describes the semantic search index.
+type IndexStatus struct {
+	Project    string    `json:"project"`
+	Root       string    `json:"root"`
+	Model      string    `json:"model"`
+	Dimensions int       `json:"dimensions"`
+	Files      int       `json:"files"`
+	Chunks     int       `json:"chunks"`
+	Built      time.Time `json:"built,omitzero"`
+	Building   bool      `json:"building"`
+	Embedded   int       `json:"embedded,omitempty"` // Chunks embedded by the last build
+}
+
+// SearchHit is a chunk of a project file matching a semantic search.
+type SearchHit struct {
+	Project   string  `json:"project"`
+	Path      string  `json:"path"` // Relative to the project's root
+	StartLine int     `json:"start_line"`
+	EndLine   int     `json:"end_line"`
+	Score     float64 `json:"score"`
+	Text      string  `json:"text"`
+}
+
+// chunkingKey identifies the chunking settings, so that a change to them
+// re-chunks every file.
+func chunkingKey(cfg config.IndexConfig) string {
+	return fmt.Sprintf("%s/%d/%d", cfg.Chunking, cfg.ChunkLines, cfg.ChunkOverlap)
+}
+
+// loadVectorIndex opens the index of the project at root saved at path.
+// An index built with a different model or dimensionality is discarded,
+// since its vectors cannot be compared with new ones.
+func loadVectorIndex(path, name, root string, cfg config.IndexConfig) (*vectorIndex, error) {
+	model, dims := cfg.Model, cfg.Dimensions
+	ix := &vectorIndex{
+		name: name,
+		root: root,
+		path: path,
+		data: indexData{Model: model, Dimensions: dims, Chunking: chunkingKey(cfg), Files: map[string]indexedFile{}},
+	}
+	f, err := os.Open(ix.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ix, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var data indexData
+	if err := gob.NewDecoder(f).Decode(&data); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", ix.path, err)
+	}
+	if data.Model == model && data.Dimensions == dims && data.Files != nil {
+		ix.data = data
+	}
+	return ix, nil
+}
+
+func (ix *vectorIndex) save() error {
+	if err := os.MkdirAll(filepath.Dir(ix.path), 0o755); err != nil {
+		return err
+	}
+	tmp := ix.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	ix.mu.RLock()
+	err = gob.NewEncoder(f).Encode(ix.data)
+	ix.mu.RUnlock()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, ix.path)
+}
+
+func (ix *vectorIndex) status() IndexStatus {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	st := IndexStatus{
+		Project:    ix.name,
+		Root:       ix.root,
+		Model:      ix.data.Model,
+		Dimensions: ix.data.Dimensions,
+		Files:      len(ix.data.Files),
+		Built:      ix.data.Built,
+		Building:   ix.building,
+	}
+	for _, f := range ix.data.Files {
+		st.Chunks += len(f.Chunks)
+	}
+	return st
+}
+
+// search returns the k chunks most similar to the normalized query vector.
+func (ix *vectorIndex) search(query []float32, k int) []SearchHit {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	var hits []SearchHit
+	for rel, f := range ix.data.Files {
+		for _, c := range f.Chunks {
+			hits = append(hits, SearchHit{Project: ix.name, Path: rel, StartLine: c.StartLine, EndLine: c.EndLine, Score: dot(query, c.Vector), Text: c.Text})
+		}
+	}
+	sortHits(hits)
+	return hits[:min(k, len(hits))]
+}
+
+// sortHits orders hits by descending score, then by path and line.
+func sortHits(hits []SearchHit) {
+	slices.SortFunc(hits, func(a, b SearchHit) int {
+		if a.Score != b.Score {
+			if a.Score > b.Score {
+				return -1
+			}
+			return 1
+		}
+		if c := strings.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return a.StartLine - b.StartLine
+	})
+}
+
+func dot(a, b []float32) float64 {
+	var sum float64
+	for i := range min(len(a), len(b)) {
+		sum += float64(a[i]) * float64(b[i])
+	}
+	return sum
+}
+
+// normalize scales v to unit length in place. Gemini only normalizes
+// embeddings at full dimensionality.
+func normalize(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	n := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= n
+	}
+	return v
+}
+
+// embed returns the normalized embeddings of texts, calling the API in
+// batches, and records the estimated usage.
+func (s *Server) embed(ctx context.Context, texts []string, taskType string) ([][]float32, error) {
+	model := s.cfg.Index.Model
+	dims := int32(s.cfg.Index.Dimensions)
+	cfg := &genai.EmbedContentConfig{TaskType: taskType, OutputDimensionality: &dims}
+	vectors := make([][]float32, 0, len(texts))
+	for batch := range slices.Chunk(texts, embedBatchSize) {
+		contents := make([]*genai.Content, len(batch))
+		chars := 0
+		for i, t := range batch {
+			contents[i] = genai.NewContentFromText(t, genai.RoleUser)
+			chars += len(t)
+		}
+		res, err := s.client.Models.EmbedContent(ctx, model, contents, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Embeddings) != len(batch) {
+			return nil, fmt.Errorf("%s returned %d embeddings for %d texts", model, len(res.Embeddings), len(batch))
+		}
+		for _, e := range res.Embeddings {
+			vectors = append(vectors, normalize(e.Values))
+		}
+
+		tokens := int64(chars / charsPerTokenGuess)
+		in, _, _ := modelRates(model)
+		day := time.Now().UTC().Format(dayLayout)
+		u := UsageTotals{Requests: 1, PromptTokens: tokens, Cost: float64(tokens) * in / 1e6}
+		if err := s.sessions(ctx).RecordUsage(context.WithoutCancel(ctx), day, model, sessionFrom(ctx), u); err != nil {
+			s.requestLogger(ctx).Warn("recording usage", "error", err)
+		}
+	}
+	return vectors, nil
+}
+
+// walkIndexable calls fn for every file under root the index covers:
+// those the corpus filter selects, until MaxTotalChars of them have been
+// seen, as the corpus is capped.
+func (s *Server) walkIndexable(root string, fn func(rel, abs string, info fs.FileInfo)) error {
+	var total int64
+	filter := s.cfg.Corpus.Filter()
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel != "." && !corpusDir(filter, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !corpusFile(filter, rel, 0) {
+			return nil
+		}
+		if total > MaxTotalChars {
+			return filepath.SkipAll
+		}
+		info, err := d.Info()
+		if err != nil || !corpusFile(filter, rel, info.Size()) {
+			return nil
+		}
+		total += info.Size()
+		fn(rel, p, info)
+		return nil
+	})
+}
+
+// BuildIndex brings the semantic index of the served project and of every
+// registered project up to date.
+func (s *Server) BuildIndex(ctx context.Context) error {
+	var errs []error
+	for _, ix := range s.indexes() {
+		if _, err := s.buildIndex(ctx, ix); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", ix.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// buildIndex brings one project's index up to date. Files whose size and
+// modification time are unchanged are not read again, and files whose
+// content is unchanged keep their embeddings, so only new and modified
+// files are embedded.
+func (s *Server) buildIndex(ctx context.Context, ix *vectorIndex) (IndexStatus, error) {
+	ix.mu.Lock()
+	if ix.building {
+		ix.mu.Unlock()
+		return ix.status(), errIndexBuilding
+	}
+	ix.building = true
+	old := ix.data.Files
+	chunking := chunkingKey(s.cfg.Index)
+	if ix.data.Chunking != chunking {
+		old = nil
+	}
+	ix.mu.Unlock()
+	defer func() {
+		ix.mu.Lock()
+		ix.building = false
+		ix.mu.Unlock()
+	}()
+
+	start := time.Now()
+	files := map[string]indexedFile{}
+	var pending []*indexChunk
+	err := s.walkIndexable(ix.root, func(rel, abs string, info fs.FileInfo) {
+		prev, known := old[rel]
+		if known && prev.unchanged(info) {
+			files[rel] = prev
+			return
+		}
+		data, err := os.ReadFile(abs)
+		if err != nil {
+			return
+		}
+		sum := sha256.Sum256(data)
+		f := indexedFile{Hash: hex.EncodeToString(sum[:]), ModTime: info.ModTime(), Size: info.Size()}
+		switch {
+		case known && prev.Hash == f.Hash:
+			// Touched but not modified
+			f.Chunks = prev.Chunks
+		case !isBinary(data):
+			f.Chunks = chunkFile(rel, string(data), s.cfg.Index)
+			for i := range f.Chunks {
+				pending = append(pending, &f.Chunks[i])
+			}
+		}
+		files[rel] = f
+	})
+	if err != nil {
+		return ix.status(), err
+	}
+
+	texts := make([]string, len(pending))
+	for i, c := range pending {
+		texts[i] = c.Text
+	}
+	vectors, err := s.embed(ctx, texts, "RETRIEVAL_DOCUMENT")
+	if err != nil {
+		return ix.status(), fmt.Errorf("embedding %d chunks: %w", len(texts), err)
+	}
+	for i, c := range pending {
+		c.Vector = vectors[i]
+	}
+
+	ix.mu.Lock()
+	ix.data.Files = files
+	ix.data.Chunking = chunking
+	ix.data.Built = time.Now().UTC()
+	ix.building = false
+	ix.mu.Unlock()
+	if err := ix.save(); err != nil {
+		return ix.status(), fmt.Errorf("saving the index: %w", err)
+	}
+	st := ix.status()
+	st.Embedded = len(pending)
+	s.logger.Info("semantic index built", "project", ix.name, "files", st.Files, "chunks", st.Chunks, "embedded", st.Embedded, "latency_ms", time.Since(start).Milliseconds())
+	return st, nil
+}
+
+// SemanticSearch returns the k chunks closest in meaning to query from the
+// projects in scope (see searchScope).
+func (s *Server) SemanticSearch(ctx context.Context, query string, k int, scope string) ([]SearchHit, error) {
+	indexes, err := s.searchScope(scope)
+	if err != nil {
+		return nil, err
+	}
+	if indexedChunks(indexes) == 0 {
+		return nil, errIndexEmpty
+	}
+	return s.searchIndexes(ctx, query, k, indexes)
+}
+
+// searchIndexes embeds query once and returns the k closest chunks across
+// indexes.
+func (s *Server) searchIndexes(ctx context.Context, query string, k int, indexes []*vectorIndex) ([]SearchHit, error) {
+	vectors, err := s.embed(ctx, []string{query}, "RETRIEVAL_QUERY")
+	if err != nil {
+		return nil, fmt.Errorf("embedding the query: %w", err)
+	}
+	var hits []SearchHit
+	for _, ix := range indexes {
+		hits = append(hits, ix.search(vectors[0], k)...)
+	}
+	sortHits(hits)
+	return hits[:min(k, len(hits))], nil
+}
+
+// searchHits clamps a requested number of hits, defaulting when unset.
+func searchHits(k int) int {
+	if k <= 0 {
+		return defaultSearchHits
+	}
+	return min(k, maxSearchHits)
+}
+
+// searchRanked runs searchIndexes, and with rerank draws more candidates
+// and lets the rerank model pick k of them.
+func (s *Server) searchRanked(ctx context.Context, query string, k int, indexes []*vectorIndex, rerank bool) ([]SearchHit, error) {
+	if !rerank {
+		return s.searchIndexes(ctx, query, k, indexes)
+	}
+	candidates, err := s.searchIndexes(ctx, query, max(k, s.cfg.Index.RerankCandidates), indexes)
+	if err != nil {
+		return nil, err
+	}
+	return s.rerankOrKeep(ctx, query, candidates, k), nil
+}
+
+func (s *Server) toolSemanticSearch(ctx context.Context, query string, k int, scope string) map[string]any {
+	indexes, err := s.searchScope(scope)
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	if indexedChunks(indexes) == 0 {
+		return map[string]any{"error": errIndexEmpty.Error()}
+	}
+	hits, err := s.searchRanked(ctx, query, searchHits(k), indexes, s.cfg.Index.Rerank)
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	return map[string]any{"query": query, "results": hits}
+}
+
+// handleIndex reports on and builds the semantic search indexes. A build
+// runs until it finishes, so the response carries the new totals.
+//
+//	GET  /index                 status of the served project, with the registered ones
+//	POST /index?project=<name>  build or update one project, or all of them
+func (s *Server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.indexReport())
+
+	case http.MethodPost:
+		indexes := s.indexes()
+		if name := r.URL.Query().Get("project"); name != "" {
+			ix := s.indexNamed(name)
+			if ix == nil {
+				http.Error(w, "Unknown project "+name, http.StatusNotFound)
+				return
+			}
+			indexes = []*vectorIndex{ix}
+		}
+		for _, ix := range indexes {
+			_, err := s.buildIndex(r.Context(), ix)
+			if errors.Is(err, errIndexBuilding) {
+				http.Error(w, ix.name+": "+err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Building index of "+ix.name+": "+err.Error(), http.StatusBadGateway)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.indexReport())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleIndexSearch runs a semantic search over the projects in scope.
+//
+//	GET /index/search?q=...&k=8&scope=main,billing&rerank=true
+func (s *Server) handleIndexSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	k := 0
+	if v := r.URL.Query().Get("k"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "k must be a positive number", http.StatusBadRequest)
+			return
+		}
+		k = n
+	}
+	rerank := s.cfg.Index.Rerank
+	if v := r.URL.Query().Get("rerank"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "rerank must be true or false", http.StatusBadRequest)
+			return
+		}
+		rerank = b
+	}
+	indexes, err := s.searchScope(r.URL.Query().Get("scope"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if indexedChunks(indexes) == 0 {
+		http.Error(w, "The semantic index is empty; build it with POST /index", http.StatusConflict)
+		return
+	}
+	hits, err := s.searchRanked(r.Context(), q, searchHits(k), indexes, rerank)
+	if err != nil {
+		http.Error(w, "Searching: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"query": q, "results": hits})
+}
@@ -0,0 +1,440 @@
+// Package proxy implements the Gemini context caching proxy: the native chat
+// API used by the web UI, the OpenAI and Gemini compatibility endpoints, the
+// agentic file tools and the context cache built from a project directory.
+//
+// A Server is an http.Handler and can be mounted in any mux:
+//
+//	srv, err := proxy.New(ctx, proxy.Options{Config: cfg, APIKey: key})
+//	http.ListenAndServe(":8080", srv)
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"customgemini/config"
+	"customgemini/web"
+
+	"google.golang.org/genai"
+)
+
+// --- CONFIGURATION ---
+const (
+	HistoryPath   = ".history"
+	MaxFileBytes  = 256 * 1024 // 256KB cap per file
+	MaxTotalChars = 4000000    // ~1M token safety cap
+)
+
+// Server is the caching proxy. It owns the Gemini client, the chat sessions
+// and the context cache; all request handlers are methods on it.
+type Server struct {
+	cfg           config.Config
+	client        *genai.Client
+	logger        *slog.Logger
+	logs          *logHub
+	accessLog     io.Writer // Nil unless access_log is set
+	activity      *logHub   // Tool executions for /activity
+	limiter       *limiter
+	respCache     *responseCache
+	answers       *answerIndex    // Recent answers for duplicate detection; nil unless enabled
+	latency       upstreamLatency // First-token latency by connection state, for /status
+	breaker       *breaker
+	quota         *quotaTracker
+	uploads       *uploadStore
+	streams       *streamTable     // Resumable /chat/stream generations
+	generations   *generationTable // Running requests, for /generations
+	jobs          *jobTable        // Scheduled jobs, run by RunJobs
+	batches       *batchTable      // Prompts submitted to /batch
+	prompts       *promptLibrary
+	models        *modelPolicy      // Model rules set through /admin/models
+	journalOwner  func() string     // Locks this process's journal lock file on first use; see turnJournal.Owner
+	journalLock   *os.File          // Held open so the lock lasts as long as the process
+	forgeClient   *http.Client      // Fetches the pull requests /review is given
+	instanceID    string            // Tags the context caches this server builds; kept in <home>/instance_id
+	cacheMu       sync.Mutex        // Held while a cache is built and published, and while orphans are deleted
+	vectors       *vectorIndex      // Semantic search index of the served project
+	federated     []*vectorIndex    // Indexes of the projects in Index.Projects, by name
+	conversations *vectorIndex      // Past chat sessions, when Index.Conversations is set
+	assets        map[string]*asset // Embedded web assets keyed by URL path
+	index         *template.Template
+
+	corpusProgress func(CorpusProgress)
+	projectRoot    string // Absolute path to the directory being served/cached
+	home           string // Directory holding logs, debug dumps and captures
+
+	store      SessionStore          // Sessions, cost total and active cache
+	workspaces map[string]*workspace // By API key; none unless configured
+
+	debug           debugSwitches // Debug aids toggled at runtime
+	captureSeq      atomic.Uint64
+	upstreamRetries atomic.Uint64
+	activitySeq     atomic.Uint64
+	panics          atomic.Uint64 // Handlers recovered by withRecovery
+	http            httpMetrics
+
+	handler http.Handler
+}
+
+// Options configures a Server. Only Config is required.
+type Options struct {
+	Config config.Config
+
+	// Client is used for every upstream call. When nil, New creates one
+	// from APIKey that supports request capture, the response cache and
+	// tracing.
+	Client *genai.Client
+	APIKey string
+
+	// Logger receives structured logs. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// ProjectRoot is the directory exposed to the file tools and compiled
+	// into the context cache. Home holds logs/. Both default to the
+	// working directory.
+	ProjectRoot string
+	Home        string
+
+	// Store holds sessions, the cost total and the active cache. Defaults
+	// to Redis when Config.Store.RedisURL is set, otherwise to memory.
+	Store SessionStore
+
+	// CorpusProgress, if set, is called after each file BuildCache adds to
+	// the corpus.
+	CorpusProgress func(CorpusProgress)
+}
+
+// New creates a Server from opts. With Config.CacheID set the existing cache
+// is used; call BuildCache to compile one from ProjectRoot.
+func New(ctx context.Context, opts Options) (*Server, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		cfg:         opts.Config,
+		client:      opts.Client,
+		logs:        newLogHub(),
+		activity:    newLogHub(),
+		limiter:     newLimiter(opts.Config.Concurrency),
+		respCache:   newResponseCache(opts.Config.ResponseCache),
+		answers:     newAnswerIndex(opts.Config.Duplicates),
+		breaker:     newBreaker(opts.Config.Breaker),
+		quota:       newQuotaTracker(opts.Config.Quota),
+		uploads:     newUploadStore(),
+		streams:     newStreamTable(),
+		generations: newGenerationTable(),
+		batches:     &batchTable{},
+		prompts:     &promptLibrary{dir: filepath.Join(opts.Home, "prompts")},
+		projectRoot: opts.ProjectRoot,
+		home:        opts.Home,
+		store:       opts.Store,
+
+		corpusProgress: opts.CorpusProgress,
+	}
+	if s.jobs, err = newJobTable(opts.Config.Jobs); err != nil {
+		return nil, err
+	}
+	if s.assets, err = loadAssets(); err != nil {
+		return nil, err
+	}
+	if s.index, err = template.New("index").Parse(web.IndexHTML); err != nil {
+		return nil, fmt.Errorf("parsing web/index.html: %w", err)
+	}
+	if s.projectRoot == "" {
+		s.projectRoot = wd
+	}
+	if s.home == "" {
+		s.home = wd
+	}
+	s.journalOwner = sync.OnceValue(s.lockJournal)
+	if s.models, err = loadModelPolicy(filepath.Join(s.home, "model_policy.json")); err != nil {
+		return nil, err
+	}
+	if err := s.loadIndexes(); err != nil {
+		return nil, err
+	}
+	base := opts.Logger
+	if base == nil {
+		base = slog.Default()
+	}
+	s.logger = slog.New(teeHandler{base.Handler(), newHubHandler(s.logs, parseLevel(s.cfg.LogLevel))})
+	s.debug.setAll(s.cfg.Debug)
+	s.loadInstanceID()
+	if s.cfg.AccessLog != "" {
+		retention := time.Duration(s.cfg.LogRetentionDays) * 24 * time.Hour
+		w, err := newRotatingWriter(filepath.Join(s.home, "logs"), "access", int64(s.cfg.LogMaxSizeMB)<<20, retention)
+		if err != nil {
+			return nil, fmt.Errorf("opening the access log: %w", err)
+		}
+		s.accessLog = w
+	}
+	if s.cfg.Index.File != "" {
+		if err := s.importIndexFile(ctx); err != nil {
+			s.logger.Warn("importing semantic index", "file", s.cfg.Index.File, "error", err)
+		}
+	}
+
+	if s.client == nil {
+		httpClient, err := s.upstreamHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		s.client, err = genai.NewClient(ctx, &genai.ClientConfig{
+			APIKey:     opts.APIKey,
+			HTTPClient: httpClient,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.forgeClient, err = newForgeClient(s.cfg.Upstream); err != nil {
+		return nil, err
+	}
+
+	if s.store == nil {
+		if url := s.cfg.Store.RedisURL; url != "" {
+			if s.store, err = NewRedisStore(ctx, url, s.cfg.Store.KeyPrefix); err != nil {
+				return nil, err
+			}
+		} else {
+			s.store = NewMemoryStore()
+		}
+	}
+	if err := s.loadWorkspaces(); err != nil {
+		return nil, err
+	}
+	if s.cfg.CacheID != "" {
+		if err := s.store.SetActiveCache(ctx, s.cfg.CacheID, s.cfg.Model); err != nil {
+			return nil, err
+		}
+	}
+
+	// A request passes through the middleware in this order. Those that
+	// report on the response come first, so they see the 500 of a
+	// recovered panic; CORS preflights are answered before the workspace
+	// key is checked.
+	s.handler = chain(s.newRouter(s.routes()),
+		s.withAccessLog,
+		s.withMetrics,
+		s.withTracing,
+		withRequestID,
+		s.withRecovery,
+		s.withCORS,
+		s.withSlowRequestLog,
+		s.withWorkspace,
+		s.withRequestDump,
+	)
+	return s, nil
+}
+
+// routes lists the server's endpoints.
+func (s *Server) routes() []route {
+	return []route{
+		// Core endpoints
+		{"/chat", s.handleChat, true},
+		{"/chat/stream", s.handleChatStream, true},
+		{"/chat/stream/", s.handleChatStreamResume, false},
+		{"/review", s.handleReview, true},
+		{"/generate/tests", s.handleGenerateTests, true},
+		{"/compare", s.handleCompare, true},
+		{"/tokens/count", s.handleTokenCount, true},
+		{"/images/generate", s.handleImages, true},
+		{"/images/files/", s.handleImageFiles, false},
+		{"/generations", s.handleGenerations, false},
+		{"/generations/", s.handleGenerations, false},
+		{"/batch", s.handleBatch, false},
+		{"/batch/", s.handleBatch, false},
+		{"/jobs", s.handleJobs, false},
+		{"/jobs/", s.handleJobs, false},
+		{"/reset", s.handleReset, false},
+		{"/sessions", s.handleSessions, false},
+		{"/sessions/", s.handleSessions, false},
+		{"/api/v2/", s.handleAPIv2, false},
+		{"/upload", s.handleUpload, false},
+		{"/settings", s.handleSettings, false},
+		{"/context/selection", s.handleSelection, false},
+		{"/prompts", s.handlePrompts, false},
+		{"/prompts/", s.handlePrompts, false},
+		{"/index", s.handleIndex, true},
+		{"/index/status", s.handleIndexStatus, false},
+		{"/index/export", s.handleIndexExport, false},
+		{"/index/conversations", s.handleConversationSearch, true},
+		{"/index/search", s.handleIndexSearch, true},
+		{"/files", s.handleFiles, false},
+		{"/files/tree", s.handleFileTree, false},
+		{"/files/content", s.handleFileContent, false},
+		{"/models", s.handleModels, false},
+		{"/status", s.handleStatus, false},
+		{"/version", s.handleVersion, false},
+		{"/cache/info", s.handleCacheInfo, false},
+		{"/caches", s.handleCaches, false},
+		{"/caches/", s.handleCaches, false},
+		{"/metrics", s.handleMetrics, false},
+		{"/dashboard/summary", s.handleDashboardSummary, false},
+		{"/logs/stream", s.handleLogStream, false},
+		{"/activity", s.handleActivity, false},
+		{"/activity/stream", s.handleActivityStream, false},
+		{"/admin/models", s.handleAdminModels, false},
+		{"/admin/models/", s.handleAdminModels, false},
+		{"/debug/config", s.handleDebugConfig, false},
+		{"/debug/capture", s.handleDebugCapture, false},
+		{"/debug/captures", s.handleDebugCaptures, false},
+		{"/debug/captures/", s.handleDebugCaptures, false},
+		{"/debug/replay/", s.handleDebugReplay, true},
+
+		// Official Gemini API compatibility (for IDE SDKs)
+		{"/v1beta/models/", s.handleOfficialAPI, true},
+
+		// OpenAI API compatibility (for tools expecting OpenAI)
+		{"/v1/models", s.handleOpenAIModels, false},
+		{"/v1/chat/completions", s.handleOpenAIChat, true},
+		{"/v1/images/generations", s.handleOpenAIImages, true},
+
+		// Static assets and root
+		{"/assets/", s.handleAssets, false},
+		{"/", s.handleRoot, false},
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// Client returns the Gemini client used for upstream calls.
+func (s *Server) Client() *genai.Client {
+	return s.client
+}
+
+// Logger returns the server's logger, which also feeds /logs/stream.
+func (s *Server) Logger() *slog.Logger {
+	return s.logger
+}
+
+// Cache returns the active context cache and the model it is bound to. The
+// name is "" in clean mode, and the model is then the configured default.
+func (s *Server) Cache() (name, model string) {
+	return s.cacheFor(context.Background())
+}
+
+// cacheFor returns the context cache of the request's workspace, as Cache
+// does.
+func (s *Server) cacheFor(ctx context.Context) (name, model string) {
+	name, model, err := s.sessions(ctx).ActiveCache(ctx)
+	if err != nil {
+		s.logger.Warn("reading active cache", "error", err)
+	}
+	if model == "" {
+		model = s.cfg.Model
+	}
+	return name, model
+}
+
+// TemplateData holds data for HTML template rendering
+type TemplateData struct {
+	CacheName  string
+	CacheModel string
+	ServerPort string
+	MCPPath    string
+}
+
+// --- STATUS ENDPOINT ---
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cacheName, cacheModel := s.cacheFor(ctx)
+	mode := "CLEAN"
+	if cacheName != "" {
+		mode = "CACHED"
+	}
+	totalCost, err := s.sessions(ctx).TotalCost(ctx)
+	if err != nil {
+		s.requestLogger(ctx).Warn("reading total cost", "error", err)
+	}
+	sessions, err := s.sessions(ctx).Sessions(ctx)
+	if err != nil {
+		s.requestLogger(ctx).Warn("counting sessions", "error", err)
+	}
+
+	status := map[string]any{
+		"mode":         mode,
+		"cache_id":     cacheName,
+		"cache_model":  cacheModel,
+		"project_root": s.root(ctx),
+		"server_port":  s.cfg.Port,
+		"debug_mode":   s.debug.any(),
+		"total_cost":   totalCost,
+		"sessions":     sessions,
+	}
+	status["in_flight"], status["queued"] = s.limiter.stats()
+	status["breaker"] = s.breaker.status()
+	status["quota"] = s.quota.status()
+	status["first_token"] = s.latency.status()
+	status["debug"] = s.debug.snapshot()
+	status["build"] = Build()
+	if ws := workspaceFrom(ctx); ws != nil {
+		st := WorkspaceStatus{Name: ws.name, DailyBudgetUSD: ws.cfg.DailyBudgetUSD}
+		if st.SpentToday, err = ws.spentToday(ctx); err != nil {
+			s.requestLogger(ctx).Warn("reading workspace spend", "workspace", ws.name, "error", err)
+		}
+		status["workspace"] = st
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// indexTemplate returns the web UI template parsed at startup. In dev mode
+// it is re-read from web/index.html under the server home on every call so
+// UI edits show up without a rebuild.
+func (s *Server) indexTemplate() (*template.Template, error) {
+	if !s.cfg.Dev {
+		return s.index, nil
+	}
+	return template.ParseFiles(filepath.Join(s.home, "web", "index.html"))
+}
+
+func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := s.indexTemplate()
+	if err != nil {
+		http.Error(w, "Template parsing error: "+err.Error(), 500)
+		return
+	}
+
+	// Prepare template data
+	cacheName, cacheModel := s.cacheFor(r.Context())
+	data := TemplateData{
+		CacheName:  cacheName,
+		CacheModel: cacheModel,
+		ServerPort: s.cfg.Port,
+		MCPPath:    filepath.Join(s.home, "cmd/mcp/main.go"),
+	}
+
+	// Execute template to buffer first to catch errors
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		http.Error(w, "Template execution error: "+err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if err := s.sessions(r.Context()).Reset(r.Context()); err != nil {
+		http.Error(w, "Resetting sessions: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "All sessions cleared.")
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// TranscriptMessage is one turn of a session as the web UI renders it.
+// Function responses sent back to the model appear as role "tool".
+type TranscriptMessage struct {
+	Role        string           `json:"role"` // "user", "model" or "tool"
+	Text        string           `json:"text,omitempty"`
+	ToolCalls   []TranscriptTool `json:"tool_calls,omitempty"`
+	ToolResults []TranscriptTool `json:"tool_results,omitempty"`
+	Images      []ImageData      `json:"images,omitempty"`
+}
+
+// TranscriptTool is a tool call (with Args) or its result (with Response).
+type TranscriptTool struct {
+	Name     string         `json:"name"`
+	Args     map[string]any `json:"args,omitempty"`
+	Response map[string]any `json:"response,omitempty"`
+}
+
+// transcript converts a chat history into renderable messages. Thought
+// parts are dropped.
+func transcript(history []*genai.Content) []TranscriptMessage {
+	msgs := []TranscriptMessage{}
+	for _, c := range history {
+		if c == nil {
+			continue
+		}
+		m := TranscriptMessage{Role: c.Role}
+		var text []string
+		for _, p := range c.Parts {
+			switch {
+			case p == nil || p.Thought:
+			case p.Text != "":
+				text = append(text, p.Text)
+			case p.FunctionCall != nil:
+				m.ToolCalls = append(m.ToolCalls, TranscriptTool{Name: p.FunctionCall.Name, Args: p.FunctionCall.Args})
+			case p.FunctionResponse != nil:
+				m.Role = "tool"
+				m.ToolResults = append(m.ToolResults, TranscriptTool{Name: p.FunctionResponse.Name, Response: p.FunctionResponse.Response})
+			case p.InlineData != nil && strings.HasPrefix(p.InlineData.MIMEType, "image/"):
+				m.Images = append(m.Images, ImageData{MimeType: p.InlineData.MIMEType, Data: base64.StdEncoding.EncodeToString(p.InlineData.Data)})
+			}
+		}
+		m.Text = strings.Join(text, "")
+		msgs = append(msgs, m)
+	}
+	return msgs
+}
+
+// SessionTranscript is a session with its transcript, as GET /sessions/<id>
+// returns it and the sessions dump command writes it.
+type SessionTranscript struct {
+	Session  SessionInfo         `json:"session"`
+	Messages []TranscriptMessage `json:"messages"`
+}
+
+// Transcript returns a session and its transcript, or nil if there is no
+// such session.
+func (s *Server) Transcript(ctx context.Context, id string) (*SessionTranscript, error) {
+	info, err := s.sessions(ctx).SessionInfo(ctx, id)
+	if err != nil || info == nil {
+		return nil, err
+	}
+	history, err := s.sessions(ctx).History(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionTranscript{Session: *info, Messages: transcript(history)}, nil
+}
+
+// handleSessionExport renders a session's transcript as Markdown (the
+// default) or HTML, for download, or with save=true, into the exports
+// directory of the server home, answering with the file's path.
+func (s *Server) handleSessionExport(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = ExportMarkdown
+	}
+	t, err := s.Transcript(ctx, id)
+	if err != nil {
+		http.Error(w, "Loading session: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if t == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	doc, err := ExportTranscript(t, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Session IDs from /chat are not checked, so one that is not safe in
+	// a file name is left out of it
+	name := id
+	if !validRequestID(name) {
+		name = "session"
+	}
+	if save, _ := strconv.ParseBool(r.URL.Query().Get("save")); save {
+		dir := filepath.Join(s.home, "exports")
+		if ws := workspaceFrom(ctx); ws != nil {
+			dir = filepath.Join(dir, ws.name)
+		}
+		path := filepath.Join(dir, name+"-"+time.Now().UTC().Format("20060102-150405")+ExportExtension(format))
+		err := os.MkdirAll(dir, 0o755)
+		if err == nil {
+			err = os.WriteFile(path, doc, 0o644)
+		}
+		if err != nil {
+			http.Error(w, "Saving export: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.requestLogger(ctx).Info("session exported", "session", id, "path", path)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"path": path})
+		return
+	}
+	if format == ExportHTML {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s%s"`, name, ExportExtension(format)))
+	w.Write(doc)
+}
+
+// sortSessions orders sessions most recently updated first.
+func sortSessions(list []SessionInfo) {
+	sort.Slice(list, func(i, j int) bool { return list[i].Updated.After(list[j].Updated) })
+}
+
+// handleSessions serves the session picker:
+//
+//	GET    /sessions       list sessions, most recently updated first
+//	POST   /sessions       create a session from {"id", "title"}; id is optional
+//	GET    /sessions/<id>  session metadata and transcript
+//	DELETE /sessions/<id>  delete a session
+//	GET    /sessions/<id>/export?format=markdown|html  the transcript as a document
+//	POST   /sessions/<id>/summarize  summarize the session into its metadata
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if id == r.URL.Path {
+		id = ""
+	}
+	if sid, ok := strings.CutSuffix(id, "/export"); ok {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.handleSessionExport(w, r, sid)
+		return
+	}
+	if sid, ok := strings.CutSuffix(id, "/summarize"); ok {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// The summary is written by a model, so it is admitted as upstream
+		// endpoints are
+		s.withUpstreamLimit(func(w http.ResponseWriter, r *http.Request) {
+			s.handleSessionSummarize(w, r, sid)
+		})(w, r)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		list, err := s.sessions(ctx).ListSessions(ctx)
+		if err != nil {
+			http.Error(w, "Listing sessions: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		sortSessions(list)
+		if list == nil {
+			list = []SessionInfo{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"sessions": list})
+
+	case id == "" && r.Method == http.MethodPost:
+		var req struct {
+			ID    string `json:"id"`
+			Title string `json:"title"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.ID == "" {
+			req.ID = "web-" + newRequestID()
+		} else if !validRequestID(req.ID) {
+			http.Error(w, "Invalid session ID", http.StatusBadRequest)
+			return
+		}
+		if err := s.sessions(ctx).CreateSession(ctx, req.ID, strings.TrimSpace(req.Title)); err != nil {
+			http.Error(w, "Creating session: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		info, err := s.sessions(ctx).SessionInfo(ctx, req.ID)
+		if err != nil || info == nil {
+			http.Error(w, "Creating session failed", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+
+	case id != "" && r.Method == http.MethodGet:
+		t, err := s.Transcript(ctx, id)
+		if err != nil {
+			http.Error(w, "Loading session: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if t == nil {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+
+	case id != "" && r.Method == http.MethodDelete:
+		if err := s.sessions(ctx).DeleteSession(ctx, id); err != nil {
+			http.Error(w, "Deleting session: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		s.uploads.drop(scopedSession(ctx, id))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
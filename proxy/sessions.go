@@ -0,0 +1,378 @@
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// SessionStore holds the state that replicas of the proxy may share: chat
+// histories keyed by session ID, the running cost total and the active
+// context cache. The default store keeps everything in process memory;
+// RedisStore shares it between replicas behind a load balancer.
+type SessionStore interface {
+	// History returns the chat history of a session, or nil if it has none.
+	History(ctx context.Context, id string) ([]*genai.Content, error)
+	SetHistory(ctx context.Context, id string, history []*genai.Content) error
+	// Reset drops every session. Costs and the active cache are kept.
+	Reset(ctx context.Context) error
+	Sessions(ctx context.Context) (int, error)
+
+	// ListSessions returns every session's metadata in no particular order.
+	ListSessions(ctx context.Context) ([]SessionInfo, error)
+	// SessionInfo returns one session's metadata, or nil if it does not exist.
+	SessionInfo(ctx context.Context, id string) (*SessionInfo, error)
+	// CreateSession records an empty session with a title. An existing
+	// session with the same ID is renamed.
+	CreateSession(ctx context.Context, id, title string) error
+	DeleteSession(ctx context.Context, id string) error
+	// SetSessionSummary attaches a summary to an existing session,
+	// replacing the one it had.
+	SetSessionSummary(ctx context.Context, id string, sum SessionSummary) error
+
+	// AddCost adds to the running cost total and returns the new total.
+	AddCost(ctx context.Context, cost float64) (float64, error)
+	TotalCost(ctx context.Context) (float64, error)
+
+	// RecordUsage adds one upstream call to the totals of a UTC day
+	// (YYYY-MM-DD), by model and, when session is set, by session. Days
+	// older than UsageRetentionDays may be dropped.
+	RecordUsage(ctx context.Context, day, model, session string, u UsageTotals) error
+	// Usage returns the totals of the given days. Days without usage are
+	// omitted.
+	Usage(ctx context.Context, days []string) ([]DailyUsage, error)
+
+	// ActiveCache returns the context cache in use, or "" when there is none.
+	ActiveCache(ctx context.Context) (name, model string, err error)
+	SetActiveCache(ctx context.Context, name, model string) error
+	// CacheManifest returns the manifest of the last cache built, or nil.
+	CacheManifest(ctx context.Context) (*CacheManifest, error)
+	SetCacheManifest(ctx context.Context, m CacheManifest) error
+
+	// Settings returns the web UI settings saved under key, or nil if
+	// there are none. Reset keeps them.
+	Settings(ctx context.Context, key string) (*UISettings, error)
+	SetSettings(ctx context.Context, key string, s UISettings) error
+
+	// Selection returns the editor selection registered under key, or nil
+	// if there is none or it has expired.
+	Selection(ctx context.Context, key string) (*Selection, error)
+	// SetSelection registers a selection under key for ttl. A nil
+	// selection clears it.
+	SetSelection(ctx context.Context, key string, sel *Selection, ttl time.Duration) error
+}
+
+// SessionInfo describes a session for the web UI's session picker. Untitled
+// sessions take their title from the first user message.
+type SessionInfo struct {
+	ID       string    `json:"id"`
+	Title    string    `json:"title"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+	Messages int       `json:"messages"` // Turns in the history, tool calls included
+
+	Summary *SessionSummary `json:"summary,omitempty"` // The latest from POST /sessions/<id>/summarize
+}
+
+// maxTitleRunes bounds titles derived from the first message.
+const maxTitleRunes = 60
+
+// sessionTitle derives a title from the first line of the first user text.
+func sessionTitle(history []*genai.Content) string {
+	for _, c := range history {
+		if c == nil || c.Role != genai.RoleUser {
+			continue
+		}
+		for _, p := range c.Parts {
+			if p == nil || p.Text == "" {
+				continue
+			}
+			line, _, _ := strings.Cut(strings.TrimSpace(p.Text), "\n")
+			if r := []rune(line); len(r) > maxTitleRunes {
+				line = string(r[:maxTitleRunes]) + "…"
+			}
+			return line
+		}
+	}
+	return ""
+}
+
+// sessionShards is the number of independently locked partitions of the
+// memory store. Requests on unrelated sessions rarely share a lock.
+const sessionShards = 32
+
+// memoryStore is the in-process SessionStore. Histories are sharded by a
+// hash of the session ID so concurrent users do not contend on one mutex.
+type memoryStore struct {
+	shards [sessionShards]sessionShard
+
+	mu         sync.Mutex
+	totalCost  float64
+	usage      map[string]*DailyUsage
+	cacheName  string
+	cacheModel string
+	manifest   *CacheManifest
+	settings   map[string]UISettings
+	selections map[string]memorySelection
+}
+
+type memorySelection struct {
+	sel     Selection
+	expires time.Time
+}
+
+type sessionShard struct {
+	mu sync.RWMutex
+	m  map[string]*memorySession
+}
+
+type memorySession struct {
+	history []*genai.Content
+	info    SessionInfo
+}
+
+// NewMemoryStore returns a SessionStore that lives in process memory and is
+// lost on restart.
+func NewMemoryStore() SessionStore {
+	st := &memoryStore{usage: make(map[string]*DailyUsage), settings: make(map[string]UISettings), selections: make(map[string]memorySelection)}
+	for i := range st.shards {
+		st.shards[i].m = make(map[string]*memorySession)
+	}
+	return st
+}
+
+func (st *memoryStore) shard(id string) *sessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &st.shards[h.Sum32()%sessionShards]
+}
+
+func (st *memoryStore) History(_ context.Context, id string) ([]*genai.Content, error) {
+	sh := st.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	if sess := sh.m[id]; sess != nil {
+		return sess.history, nil
+	}
+	return nil, nil
+}
+
+func (st *memoryStore) SetHistory(_ context.Context, id string, history []*genai.Content) error {
+	sh := st.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	now := time.Now().UTC()
+	sess := sh.m[id]
+	if sess == nil {
+		sess = &memorySession{info: SessionInfo{ID: id, Created: now}}
+		sh.m[id] = sess
+	}
+	sess.history = history
+	sess.info.Updated = now
+	sess.info.Messages = len(history)
+	if sess.info.Title == "" {
+		sess.info.Title = sessionTitle(history)
+	}
+	return nil
+}
+
+func (st *memoryStore) Reset(context.Context) error {
+	for i := range st.shards {
+		sh := &st.shards[i]
+		sh.mu.Lock()
+		sh.m = make(map[string]*memorySession)
+		sh.mu.Unlock()
+	}
+	return nil
+}
+
+func (st *memoryStore) Sessions(context.Context) (int, error) {
+	n := 0
+	for i := range st.shards {
+		sh := &st.shards[i]
+		sh.mu.RLock()
+		n += len(sh.m)
+		sh.mu.RUnlock()
+	}
+	return n, nil
+}
+
+func (st *memoryStore) ListSessions(context.Context) ([]SessionInfo, error) {
+	var list []SessionInfo
+	for i := range st.shards {
+		sh := &st.shards[i]
+		sh.mu.RLock()
+		for _, sess := range sh.m {
+			list = append(list, sess.info)
+		}
+		sh.mu.RUnlock()
+	}
+	return list, nil
+}
+
+func (st *memoryStore) SessionInfo(_ context.Context, id string) (*SessionInfo, error) {
+	sh := st.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	sess := sh.m[id]
+	if sess == nil {
+		return nil, nil
+	}
+	info := sess.info
+	return &info, nil
+}
+
+func (st *memoryStore) CreateSession(_ context.Context, id, title string) error {
+	sh := st.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sess := sh.m[id]; sess != nil {
+		sess.info.Title = title
+		return nil
+	}
+	now := time.Now().UTC()
+	sh.m[id] = &memorySession{info: SessionInfo{ID: id, Title: title, Created: now, Updated: now}}
+	return nil
+}
+
+func (st *memoryStore) DeleteSession(_ context.Context, id string) error {
+	sh := st.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	delete(sh.m, id)
+	return nil
+}
+
+func (st *memoryStore) SetSessionSummary(_ context.Context, id string, sum SessionSummary) error {
+	sh := st.shard(id)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sess := sh.m[id]; sess != nil {
+		sess.info.Summary = &sum
+	}
+	return nil
+}
+
+func (st *memoryStore) AddCost(_ context.Context, cost float64) (float64, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.totalCost += cost
+	return st.totalCost, nil
+}
+
+func (st *memoryStore) TotalCost(context.Context) (float64, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.totalCost, nil
+}
+
+func (st *memoryStore) RecordUsage(_ context.Context, day, model, session string, u UsageTotals) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	d := st.usage[day]
+	if d == nil {
+		d = &DailyUsage{Day: day, Models: make(map[string]UsageTotals), Sessions: make(map[string]float64)}
+		st.usage[day] = d
+		// Day keys sort chronologically, so anything older than the cutoff goes
+		cutoff := time.Now().UTC().AddDate(0, 0, -UsageRetentionDays).Format(dayLayout)
+		for k := range st.usage {
+			if k < cutoff {
+				delete(st.usage, k)
+			}
+		}
+	}
+	m := d.Models[model]
+	m.add(u)
+	d.Models[model] = m
+	if session != "" {
+		d.Sessions[session] += u.Cost
+	}
+	return nil
+}
+
+func (st *memoryStore) Usage(_ context.Context, days []string) ([]DailyUsage, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var list []DailyUsage
+	for _, day := range days {
+		d := st.usage[day]
+		if d == nil {
+			continue
+		}
+		c := DailyUsage{Day: day, Models: make(map[string]UsageTotals, len(d.Models)), Sessions: make(map[string]float64, len(d.Sessions))}
+		maps.Copy(c.Models, d.Models)
+		maps.Copy(c.Sessions, d.Sessions)
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+func (st *memoryStore) ActiveCache(context.Context) (string, string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.cacheName, st.cacheModel, nil
+}
+
+func (st *memoryStore) SetActiveCache(_ context.Context, name, model string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.cacheName, st.cacheModel = name, model
+	return nil
+}
+
+func (st *memoryStore) CacheManifest(context.Context) (*CacheManifest, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.manifest, nil
+}
+
+func (st *memoryStore) SetCacheManifest(_ context.Context, m CacheManifest) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.manifest = &m
+	return nil
+}
+
+func (st *memoryStore) Settings(_ context.Context, key string) (*UISettings, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	s, ok := st.settings[key]
+	if !ok {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (st *memoryStore) SetSettings(_ context.Context, key string, s UISettings) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.settings[key] = s
+	return nil
+}
+
+func (st *memoryStore) Selection(_ context.Context, key string) (*Selection, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	m, ok := st.selections[key]
+	if !ok || time.Now().After(m.expires) {
+		delete(st.selections, key)
+		return nil, nil
+	}
+	return &m.sel, nil
+}
+
+func (st *memoryStore) SetSelection(_ context.Context, key string, sel *Selection, ttl time.Duration) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if sel == nil {
+		delete(st.selections, key)
+		return nil
+	}
+	st.selections[key] = memorySelection{sel: *sel, expires: time.Now().Add(ttl)}
+	return nil
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/genai"
+)
+
+// BenchmarkMemoryStore measures History and SetHistory under concurrent
+// load, with each goroutine on a session of its own and with every
+// goroutine on the same session.
+func BenchmarkMemoryStore(b *testing.B) {
+	history := []*genai.Content{
+		{Role: genai.RoleUser, Parts: []*genai.Part{{Text: "How does the cache get refreshed?"}}},
+		{Role: genai.RoleModel, Parts: []*genai.Part{{Text: "BuildCache compiles the project again."}}},
+	}
+	for _, bc := range []struct {
+		name   string
+		shared bool
+	}{
+		{"distinct", false},
+		{"shared", true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			ctx := context.Background()
+			st := NewMemoryStore()
+			var next atomic.Int64
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				id := "shared"
+				if !bc.shared {
+					id = "session-" + strconv.FormatInt(next.Add(1), 10)
+				}
+				for i := 0; pb.Next(); i++ {
+					if i%4 == 0 {
+						if err := st.SetHistory(ctx, id, history); err != nil {
+							b.Error(err)
+							return
+						}
+						continue
+					}
+					if _, err := st.History(ctx, id); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"customgemini/config"
+)
+
+// UISettings are the web UI's preferences, saved per API key so the UI
+// behaves the same in every browser.
+type UISettings struct {
+	Model          string            `json:"model"`           // Default model; "" uses the active cache's model
+	Temperature    float32           `json:"temperature"`     // 0 to 2
+	Agentic        bool              `json:"agentic"`         // Default of the agentic mode toggle
+	Theme          string            `json:"theme"`           // "dark" or "light"
+	SafetySettings map[string]string `json:"safety_settings"` // As in ChatRequest
+	Updated        time.Time         `json:"updated,omitzero"`
+}
+
+var (
+	safetyCategories = []string{"harassment", "hate", "sexual", "dangerous"}
+	safetyThresholds = map[string]bool{
+		"BLOCK_NONE":             true,
+		"BLOCK_ONLY_HIGH":        true,
+		"BLOCK_MEDIUM_AND_ABOVE": true,
+		"BLOCK_LOW_AND_ABOVE":    true,
+	}
+)
+
+// defaultSettings are served until settings are saved: the web endpoint's
+// configured temperature and safety thresholds, agentic mode on and the
+// dark theme.
+func (s *Server) defaultSettings() UISettings {
+	_, temperature := s.cfg.Endpoint(config.EndpointWeb)
+	safety := make(map[string]string, len(safetyCategories))
+	for _, c := range safetyCategories {
+		safety[c] = "BLOCK_NONE"
+		if v, ok := s.cfg.Safety[c]; ok {
+			safety[c] = v
+		}
+	}
+	return UISettings{Temperature: temperature, Agentic: true, Theme: "dark", SafetySettings: safety}
+}
+
+func (u *UISettings) validate() error {
+	if u.Temperature < 0 || u.Temperature > 2 {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if u.Theme != "dark" && u.Theme != "light" {
+		return fmt.Errorf("invalid theme %q (want dark or light)", u.Theme)
+	}
+	if len(u.Model) > 128 {
+		return fmt.Errorf("model name too long")
+	}
+	for k, v := range u.SafetySettings {
+		known := false
+		for _, c := range safetyCategories {
+			known = known || c == k
+		}
+		if !known {
+			return fmt.Errorf("unknown safety category %q", k)
+		}
+		if !safetyThresholds[v] {
+			return fmt.Errorf("invalid %s threshold %q", k, v)
+		}
+	}
+	return nil
+}
+
+// requestAPIKey returns the API key a request presents, in any of the ways
+// the OpenAI and Gemini clients send one.
+func requestAPIKey(r *http.Request) string {
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		key = r.Header.Get("X-Goog-Api-Key")
+	}
+	if key == "" {
+		key = r.URL.Query().Get("key")
+	}
+	return key
+}
+
+// settingsKey identifies whose settings a request reads: a hash of its API
+// key, or "default" for the web UI, which sends none.
+func settingsKey(r *http.Request) string {
+	key := requestAPIKey(r)
+	if key == "" {
+		return "default"
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// handleSettings serves GET /settings, returning the saved settings or the
+// defaults, and PUT /settings, replacing them.
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	key := settingsKey(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		settings, err := s.store.Settings(ctx, key)
+		if err != nil {
+			http.Error(w, "Loading settings: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if settings == nil {
+			d := s.defaultSettings()
+			settings = &d
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+
+	case http.MethodPut:
+		settings := s.defaultSettings()
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := settings.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		settings.Updated = time.Now().UTC()
+		if err := s.store.SetSettings(ctx, key, settings); err != nil {
+			http.Error(w, "Saving settings: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
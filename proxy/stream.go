@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"fmt"
+	"iter"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/genai"
+)
+
+const (
+	// maxRetainedResponse bounds how much of a streamed response is kept
+	// for the log preview and the debug dump.
+	maxRetainedResponse = 64 * 1024
+
+	// streamChunkBytes is the largest text delta sent in one SSE event when
+	// replaying a complete response as a stream.
+	streamChunkBytes = 256
+)
+
+// responsePreview keeps the head of a streamed response, up to
+// maxRetainedResponse bytes, and counts the rest, so long outputs are not
+// held in memory twice.
+type responsePreview struct {
+	buf   strings.Builder
+	total int
+}
+
+func (p *responsePreview) WriteString(s string) {
+	p.total += len(s)
+	room := maxRetainedResponse - p.buf.Len()
+	if room <= 0 {
+		return
+	}
+	if len(s) > room {
+		s = strings.ToValidUTF8(s[:room], "")
+	}
+	p.buf.WriteString(s)
+}
+
+// String returns the retained text, noting how much was dropped.
+func (p *responsePreview) String() string {
+	if p.total > p.buf.Len() {
+		return fmt.Sprintf("%s\n[... truncated, %d bytes total]", p.buf.String(), p.total)
+	}
+	return p.buf.String()
+}
+
+// textChunks splits s into pieces of at most streamChunkBytes, never
+// breaking a UTF-8 sequence.
+func textChunks(s string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		for len(s) > 0 {
+			n := min(len(s), streamChunkBytes)
+			for n < len(s) && !utf8.RuneStart(s[n]) {
+				n--
+			}
+			if n == 0 {
+				_, n = utf8.DecodeRuneInString(s)
+			}
+			if !yield(s[:n]) {
+				return
+			}
+			s = s[n:]
+		}
+	}
+}
+
+// coalescer batches streamed text so a client receives one event per flush
+// interval or size threshold instead of one per upstream chunk. emit runs
+// under the coalescer's lock, either in the caller's goroutine or from the
+// flush timer; every other write to the stream goes through do so the two
+// never interleave.
+type coalescer struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	maxBytes  int
+	keepalive time.Duration
+	emit      func(text string)
+	buf       strings.Builder
+	timer     *time.Timer
+	sent      time.Time // Last write to the stream
+}
+
+func (s *Server) newCoalescer(emit func(text string)) *coalescer {
+	return &coalescer{
+		interval:  time.Duration(s.cfg.Streaming.FlushMs) * time.Millisecond,
+		maxBytes:  s.cfg.Streaming.FlushBytes,
+		keepalive: time.Duration(s.cfg.Streaming.KeepaliveSeconds) * time.Second,
+		emit:      emit,
+		sent:      time.Now(),
+	}
+}
+
+// keepAlive calls ping, under the coalescer's lock, whenever nothing has
+// been written to the stream for the keepalive interval, as while the model
+// thinks or a tool runs. The returned stop ends it and must be called
+// before the handler returns.
+func (c *coalescer) keepAlive(ping func()) (stop func()) {
+	if c.keepalive <= 0 {
+		return func() {}
+	}
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		t := time.NewTimer(c.keepalive)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			c.mu.Lock()
+			idle := time.Since(c.sent)
+			if idle >= c.keepalive {
+				ping()
+				c.sent, idle = time.Now(), 0
+			}
+			c.mu.Unlock()
+			t.Reset(c.keepalive - idle)
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// add queues text, sending it at once when coalescing is off or the
+// pending text has reached the size threshold.
+func (c *coalescer) add(text string) {
+	if text == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.buf.WriteString(text)
+	switch {
+	case c.interval <= 0, c.maxBytes > 0 && c.buf.Len() >= c.maxBytes:
+		c.flushLocked()
+	case c.timer == nil:
+		c.timer = time.AfterFunc(c.interval, c.flush)
+	}
+}
+
+// flush sends any pending text.
+func (c *coalescer) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+}
+
+// do sends any pending text, then runs write, keeping the stream in order.
+func (c *coalescer) do(write func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked()
+	write()
+	c.sent = time.Now()
+}
+
+func (c *coalescer) flushLocked() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.buf.Len() > 0 {
+		c.emit(c.buf.String())
+		c.buf.Reset()
+		c.sent = time.Now()
+	}
+}
+
+// streamUsage adds up the model calls of a streamed request for the usage
+// summary that ends the stream.
+type streamUsage struct {
+	prompt, response, cached, total int32
+	thinking                        int32
+	cost, savings                   float64
+	cacheHits                       int           // Calls answered by the response cache
+	historyDropped                  int           // Session messages dropped to fit the context window
+	warnings                        []ToolWarning // Tool calls that failed
+	finish                          FinishInfo
+}
+
+// add counts one model call, given its final response.
+func (u *streamUsage) add(model string, res *genai.GenerateContentResponse) {
+	if res == nil {
+		return
+	}
+	u.finish = finishInfo(res)
+	if servedFromCache(res) {
+		u.cacheHits++
+	}
+	if m := res.UsageMetadata; m != nil {
+		u.prompt += m.PromptTokenCount
+		u.response += m.CandidatesTokenCount
+		u.thinking += m.ThoughtsTokenCount
+		u.cached += m.CachedContentTokenCount
+		u.total += m.TotalTokenCount
+	}
+	cost, savings := usageCost(model, res)
+	u.cost += cost
+	u.savings += savings
+}
+
+// openAI is the usage chunk sent before [DONE] when the client asks for
+// stream_options.include_usage. Cost, cache and timing fields extend the
+// OpenAI format.
+func (u *streamUsage) openAI(id, model string, timings *Timings) map[string]any {
+	usage := map[string]any{
+		"prompt_tokens":             u.prompt,
+		"completion_tokens":         u.response + u.thinking,
+		"total_tokens":              u.total,
+		"prompt_tokens_details":     map[string]any{"cached_tokens": u.cached},
+		"completion_tokens_details": map[string]any{"reasoning_tokens": u.thinking},
+		"cost":                      u.cost,
+		"cache_savings":             u.savings,
+		"response_cache_hits":       u.cacheHits,
+		"timings":                   timings,
+	}
+	if u.historyDropped > 0 {
+		usage["history_dropped"] = u.historyDropped
+	}
+	if len(u.warnings) > 0 {
+		usage["warnings"] = u.warnings
+	}
+	return map[string]any{
+		"id":      id,
+		"object":  "chat.completion.chunk",
+		"created": time.Now().Unix(),
+		"model":   model,
+		"choices": []map[string]any{},
+		"usage":   usage,
+	}
+}
+
+// gemini is the chunk that ends a streamGenerateContent response: the
+// request's usage in Gemini's usageMetadata, and cost, cache and finish
+// details under proxyUsage. It has no candidates, so SDKs read it as an
+// empty response carrying usage.
+func (u *streamUsage) gemini(timings *Timings) map[string]any {
+	proxyUsage := map[string]any{
+		"cost":              u.cost,
+		"cacheSavings":      u.savings,
+		"responseCacheHits": u.cacheHits,
+		"finishReason":      u.finish.FinishReason,
+		"timings":           timings,
+	}
+	if u.finish.BlockReason != "" {
+		proxyUsage["blockReason"] = u.finish.BlockReason
+	}
+	if u.historyDropped > 0 {
+		proxyUsage["historyDropped"] = u.historyDropped
+	}
+	if len(u.warnings) > 0 {
+		proxyUsage["warnings"] = u.warnings
+	}
+	return map[string]any{
+		"usageMetadata": map[string]any{
+			"promptTokenCount":        u.prompt,
+			"candidatesTokenCount":    u.response,
+			"thoughtsTokenCount":      u.thinking,
+			"cachedContentTokenCount": u.cached,
+			"totalTokenCount":         u.total,
+		},
+		"proxyUsage": proxyUsage,
+	}
+}
@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"google.golang.org/genai"
+)
+
+// Response MIME types a chat request may ask for.
+const (
+	mimeText = "text/plain"
+	mimeJSON = "application/json"
+	mimeEnum = "text/x.enum" // One of the values of an enum schema
+)
+
+// applyResponseFormat sets the structured output of a chat request on
+// config. A schema without a MIME type asks for JSON. The schema is a JSON
+// Schema, which Gemini constrains the reply to.
+func applyResponseFormat(req *ChatRequest, config *genai.GenerateContentConfig) error {
+	if len(req.ResponseSchema) > 0 && req.ResponseMIMEType == "" {
+		req.ResponseMIMEType = mimeJSON
+	}
+	switch req.ResponseMIMEType {
+	case "", mimeText:
+		if len(req.ResponseSchema) > 0 {
+			return fmt.Errorf("response_schema needs response_mime_type %s or %s", mimeJSON, mimeEnum)
+		}
+	case mimeJSON, mimeEnum:
+	default:
+		return fmt.Errorf("invalid response_mime_type %q: want %s, %s or %s", req.ResponseMIMEType, mimeText, mimeJSON, mimeEnum)
+	}
+	if len(req.ResponseSchema) > 0 {
+		var schema map[string]any
+		if err := json.Unmarshal(req.ResponseSchema, &schema); err != nil {
+			return fmt.Errorf("response_schema must be a JSON Schema object: %w", err)
+		}
+		config.ResponseJsonSchema = req.ResponseSchema
+	}
+	config.ResponseMIMEType = req.ResponseMIMEType
+	return nil
+}
+
+// structuredReply parses a reply to a request for JSON. A reply cut off at
+// the token limit is the usual reason one does not parse.
+func structuredReply(text string, finish FinishInfo) (json.RawMessage, error) {
+	if !json.Valid([]byte(text)) {
+		if finish.FinishReason != "" && finish.FinishReason != string(genai.FinishReasonStop) {
+			return nil, fmt.Errorf("the model's reply is not valid JSON (finish reason %s)", finish.FinishReason)
+		}
+		return nil, fmt.Errorf("the model's reply is not valid JSON")
+	}
+	return json.RawMessage(text), nil
+}
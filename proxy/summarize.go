@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// maxSummaryInputBytes caps the conversation a summary reads. Longer ones
+// lose their oldest turns.
+const maxSummaryInputBytes = 512 << 10
+
+const summaryPrompt = `Summarize the conversation below between a developer and an AI assistant working on a software project, for someone who needs to pick up where it left off. Write the summary in two to five sentences. List the decisions that were made, such as approaches chosen, designs agreed on or options ruled out, and the action items still open, each in one short sentence. Leave a list empty when there is nothing for it; do not invent items.`
+
+// SummarizeRequest is the optional body of POST /sessions/<id>/summarize.
+type SummarizeRequest struct {
+	Model         string `json:"model,omitempty"`          // Default summary_model
+	AppendHistory bool   `json:"append_history,omitempty"` // Add the summary to the project's .history file
+}
+
+// SessionSummary is a short account of a session, kept with its metadata.
+// Messages is how many history turns it covers; a session that has grown
+// past it has moved on since.
+type SessionSummary struct {
+	Summary     string    `json:"summary"`
+	Decisions   []string  `json:"decisions"`
+	ActionItems []string  `json:"action_items"`
+	Messages    int       `json:"messages"`
+	Model       string    `json:"model"`
+	Created     time.Time `json:"created"`
+}
+
+// SummarizeResponse is the new summary of a session.
+type SummarizeResponse struct {
+	SessionSummary
+	Cost        float64 `json:"cost"`
+	HistoryFile string  `json:"history_file,omitempty"` // Where the summary was appended
+}
+
+// handleSessionSummarize serves POST /sessions/<id>/summarize.
+func (s *Server) handleSessionSummarize(w http.ResponseWriter, r *http.Request, id string) {
+	ctx, cancel := s.endpointContext(r.Context(), config.EndpointWeb)
+	defer cancel()
+	var req SummarizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, status, err := s.summarizeSession(ctx, id, req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// summarizeSession has a cheap model sum up a session and list its
+// decisions and open action items, and stores the summary with the
+// session. The model reads the conversation only, not the project. On
+// failure it also returns the HTTP status to report.
+func (s *Server) summarizeSession(ctx context.Context, id string, req SummarizeRequest) (*SummarizeResponse, int, error) {
+	if req.AppendHistory && s.toolPolicy(ctx) != config.ToolPolicyFull {
+		return nil, http.StatusForbidden, errors.New("append_history needs the full tool policy")
+	}
+	t, err := s.Transcript(ctx, id)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("loading session: %w", err)
+	}
+	if t == nil {
+		return nil, http.StatusNotFound, errors.New("session not found")
+	}
+	conversation := summaryInput(t.Messages)
+	if conversation == "" {
+		return nil, http.StatusBadRequest, errors.New("the session has no messages to summarize")
+	}
+	model := req.Model
+	if model == "" {
+		model = s.cfg.SummaryModel
+	}
+
+	ctx = withSession(ctx, id)
+	cfg := &genai.GenerateContentConfig{
+		Temperature:      genai.Ptr[float32](0.2),
+		ResponseMIMEType: "application/json",
+		ResponseSchema: &genai.Schema{
+			Type: genai.TypeObject,
+			Properties: map[string]*genai.Schema{
+				"summary":      {Type: genai.TypeString},
+				"decisions":    {Type: genai.TypeArray, Items: &genai.Schema{Type: genai.TypeString}},
+				"action_items": {Type: genai.TypeArray, Items: &genai.Schema{Type: genai.TypeString}},
+			},
+			Required: []string{"summary", "decisions", "action_items"},
+		},
+	}
+	tagUpstream(ctx, cfg)
+	res, err := s.client.Models.GenerateContent(ctx, model, genai.Text(summaryPrompt+"\n\n"+conversation), cfg)
+	if err != nil {
+		s.logAbort(ctx, "upstream")
+		if ctx.Err() != nil {
+			return nil, upstreamStatus(ctx, err), abortError(ctx, err)
+		}
+		return nil, http.StatusBadGateway, err
+	}
+	s.recordUsage(ctx, model, res)
+	cost := calculateCost(model, res)
+	if _, err := s.sessions(ctx).AddCost(context.WithoutCancel(ctx), cost); err != nil {
+		s.requestLogger(ctx).Error("recording cost", "error", err)
+	}
+
+	var reply struct {
+		Summary     string   `json:"summary"`
+		Decisions   []string `json:"decisions"`
+		ActionItems []string `json:"action_items"`
+	}
+	if err := json.Unmarshal([]byte(res.Text()), &reply); err != nil || reply.Summary == "" {
+		return nil, http.StatusBadGateway, fmt.Errorf("%s returned no usable summary: %s", model, finishInfo(res).Warning())
+	}
+	sum := SessionSummary{
+		Summary:     strings.TrimSpace(reply.Summary),
+		Decisions:   nonEmpty(reply.Decisions),
+		ActionItems: nonEmpty(reply.ActionItems),
+		Messages:    t.Session.Messages,
+		Model:       model,
+		Created:     time.Now().UTC(),
+	}
+	if err := s.sessions(ctx).SetSessionSummary(ctx, id, sum); err != nil {
+		return nil, http.StatusServiceUnavailable, fmt.Errorf("saving summary: %w", err)
+	}
+	resp := &SummarizeResponse{SessionSummary: sum, Cost: cost}
+	if req.AppendHistory {
+		path := filepath.Join(s.root(ctx), HistoryPath)
+		if err := appendHistory(path, t.Session, sum); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("appending to %s: %w", HistoryPath, err)
+		}
+		resp.HistoryFile = path
+	}
+	s.requestLogger(ctx).Info("session summarized",
+		"session", id,
+		"model", model,
+		"decisions", len(sum.Decisions),
+		"action_items", len(sum.ActionItems),
+		"history", req.AppendHistory,
+		"cost", cost,
+	)
+	return resp, http.StatusOK, nil
+}
+
+// summaryInput renders a transcript as plain text for the summary model,
+// keeping the latest turns that fit. Tool results are left out; the
+// calls show what the assistant looked at or changed.
+func summaryInput(msgs []TranscriptMessage) string {
+	var turns []string
+	for _, m := range msgs {
+		speaker := "Developer"
+		switch m.Role {
+		case "user":
+		case "model":
+			speaker = "Assistant"
+		default:
+			continue
+		}
+		var lines []string
+		if text := strings.TrimSpace(m.Text); text != "" {
+			lines = append(lines, text)
+		}
+		for _, c := range m.ToolCalls {
+			args, _ := json.Marshal(c.Args)
+			lines = append(lines, fmt.Sprintf("[called %s %s]", c.Name, preview(string(args), 200)))
+		}
+		if len(m.Images) > 0 {
+			lines = append(lines, fmt.Sprintf("[%d images]", len(m.Images)))
+		}
+		if len(lines) > 0 {
+			turns = append(turns, speaker+": "+strings.Join(lines, "\n"))
+		}
+	}
+	size := 0
+	for i := len(turns) - 1; i >= 0; i-- {
+		if size += len(turns[i]) + 2; size > maxSummaryInputBytes {
+			turns = append([]string{"[earlier turns left out]"}, turns[i+1:]...)
+			break
+		}
+	}
+	return strings.Join(turns, "\n\n")
+}
+
+// appendHistory adds a session's summary to the project history log,
+// which the context cache is built with, so later conversations know what
+// was decided.
+func appendHistory(path string, info SessionInfo, sum SessionSummary) error {
+	var b strings.Builder
+	title := info.Title
+	if title == "" {
+		title = info.ID
+	}
+	fmt.Fprintf(&b, "\n## %s: %s (session %s)\n\n%s\n", sum.Created.Format("2006-01-02 15:04 UTC"), title, info.ID, sum.Summary)
+	for _, list := range []struct {
+		heading string
+		items   []string
+	}{{"Decisions", sum.Decisions}, {"Action items", sum.ActionItems}} {
+		if len(list.items) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n", list.heading)
+		for _, item := range list.items {
+			fmt.Fprintf(&b, "- %s\n", item)
+		}
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// nonEmpty trims items and drops the blank ones, returning an empty
+// rather than nil slice.
+func nonEmpty(items []string) []string {
+	out := []string{}
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"customgemini/config"
+)
+
+// testGenSession is the session test generation usage is recorded under.
+// Its history is never saved.
+const testGenSession = "tests"
+
+const (
+	defaultTestAttempts = 3
+	maxTestAttempts     = 5
+	maxSymbolBytes      = 64 << 10        // Declarations sent along with the file
+	maxVetOutputBytes   = 8 << 10         // go vet output sent back to the model
+	testCheckTimeout    = 2 * time.Minute // Per go vet run
+)
+
+// TestGenRequest is the body of POST /generate/tests.
+type TestGenRequest struct {
+	Path        string `json:"path"` // A Go source file in the project
+	Model       string `json:"model,omitempty"`
+	Check       bool   `json:"check,omitempty"`        // Compile the tests with go vet, asking again on errors
+	MaxAttempts int    `json:"max_attempts,omitempty"` // With check; default 3, at most 5
+	Write       bool   `json:"write,omitempty"`        // Write the tests to the project, as write_file does
+}
+
+// TestGenAttempt is one try at tests that pass the check.
+type TestGenAttempt struct {
+	Passed bool   `json:"passed"`
+	Errors string `json:"errors,omitempty"` // What go vet said, or why the reply was unusable
+}
+
+// TestGenResponse is the generated test file.
+type TestGenResponse struct {
+	Path     string           `json:"path"` // The test file, next to the source
+	Content  string           `json:"content"`
+	Checked  bool             `json:"checked"`
+	Passed   bool             `json:"passed"` // The last attempt passed go vet
+	Attempts []TestGenAttempt `json:"attempts,omitempty"`
+	Written  bool             `json:"written,omitempty"`
+	Diff     *DiffSummary     `json:"diff,omitempty"`
+	Model    string           `json:"model"`
+	Cost     float64          `json:"cost"`
+}
+
+func (s *Server) handleGenerateTests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req TestGenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, status, err := s.generateTests(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// generateTests asks the model for table-driven tests of a Go file. With
+// Check, each attempt is compiled and vetted with go vet, the test file
+// laid over the package through -overlay so nothing is written and no
+// test runs, and the errors go back to the model until it passes or the
+// attempts run out. On failure it also returns the HTTP status to report.
+func (s *Server) generateTests(ctx context.Context, req TestGenRequest) (*TestGenResponse, int, error) {
+	abs, rel, ok := s.projectPath(ctx, req.Path)
+	switch {
+	case req.Path == "" || !ok:
+		return nil, http.StatusBadRequest, errors.New("path must be a file in the project")
+	case !strings.HasSuffix(rel, ".go") || strings.HasSuffix(rel, "_test.go"):
+		return nil, http.StatusBadRequest, errors.New("path must be a Go source file, not a test")
+	case req.Write && s.toolPolicy(ctx) != config.ToolPolicyFull:
+		return nil, http.StatusForbidden, errors.New("write needs the full tool policy")
+	}
+	src, err := os.ReadFile(abs)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, http.StatusNotFound, fmt.Errorf("%s not found", rel)
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if len(src) > 1000000 {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("file too large")
+	}
+	pkg, err := parser.ParseFile(token.NewFileSet(), abs, src, parser.PackageClauseOnly)
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("parsing %s: %w", rel, err)
+	}
+	attempts := 1
+	if req.Check {
+		attempts = defaultTestAttempts
+		if req.MaxAttempts > 0 {
+			attempts = min(req.MaxAttempts, maxTestAttempts)
+		}
+	}
+
+	testAbs := strings.TrimSuffix(abs, ".go") + "_test.go"
+	resp := &TestGenResponse{Path: strings.TrimSuffix(rel, ".go") + "_test.go", Checked: req.Check}
+	existing, _ := os.ReadFile(testAbs)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Write table-driven Go tests for %s, in package %s, so unexported identifiers are in reach. Cover the usual cases, the edge cases and the errors of each function worth testing, as subtests named after their case. Use the standard testing package and what the module already imports. Reply with the complete file %s in one Go code block and nothing else.\n\n",
+		rel, pkg.Name.Name, resp.Path)
+	writeFenced(&b, rel+":", "go", string(src))
+	if symbols := goSymbols(s.root(ctx), abs); symbols != "" {
+		writeFenced(&b, "Declarations of the rest of the package and of the project packages it imports:", "go", symbols)
+	}
+	if len(existing) > 0 {
+		writeFenced(&b, "The current "+resp.Path+", whose tests your file replaces and must keep:", "go", string(existing))
+	}
+	prompt := b.String()
+
+	lg := s.requestLogger(ctx)
+	for i := range attempts {
+		message := prompt
+		if i > 0 {
+			var retry strings.Builder
+			retry.WriteString(prompt)
+			last := resp.Attempts[len(resp.Attempts)-1]
+			if resp.Content != "" {
+				writeFenced(&retry, "Your last attempt:", "go", resp.Content)
+			}
+			writeFenced(&retry, "It failed go vet. Fix it:", "", last.Errors)
+			message = retry.String()
+		}
+		chatReq := &ChatRequest{SessionID: testGenSession, Model: req.Model, Message: message, ephemeral: true}
+		chat, status, err := s.runChat(ctx, "/generate/tests", chatReq)
+		if err != nil {
+			return nil, status, err
+		}
+		resp.Model = chatReq.Model
+		resp.Cost += chat.Cost
+		code := goCodeBlock(chat.Text)
+		if code == "" {
+			resp.Attempts = append(resp.Attempts, TestGenAttempt{Errors: "the reply had no Go code block"})
+			continue
+		}
+		resp.Content = code
+		if !req.Check {
+			break
+		}
+		out, err := goVet(ctx, testAbs, code)
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("checking the tests: %w", err)
+		}
+		resp.Attempts = append(resp.Attempts, TestGenAttempt{Passed: out == "", Errors: out})
+		lg.Info("generated tests checked", "path", resp.Path, "attempt", i+1, "passed", out == "")
+		if out == "" {
+			resp.Passed = true
+			break
+		}
+	}
+	if resp.Content == "" {
+		return nil, http.StatusBadGateway, errors.New("the model did not reply with Go code")
+	}
+
+	if req.Write && (resp.Passed || !req.Check) {
+		// Journaled as a turn of its own, so write hooks hear of it
+		turnCtx, endTurn := s.beginTurn(ctx, "", "generate tests for "+rel)
+		result := s.executeTool(turnCtx, "write_file", map[string]any{"path": resp.Path, "content": resp.Content})
+		endTurn()
+		if e, ok := result["error"]; ok {
+			return nil, http.StatusInternalServerError, fmt.Errorf("writing %s: %v", resp.Path, e)
+		}
+		resp.Written = true
+		resp.Diff, _ = result["diff"].(*DiffSummary)
+	}
+	return resp, http.StatusOK, nil
+}
+
+// writeFenced writes a heading and text in a code fence it cannot close.
+func writeFenced(b *strings.Builder, heading, lang, text string) {
+	fence := fenceFor(text)
+	fmt.Fprintf(b, "%s\n%s%s\n%s\n%s\n\n", heading, fence, lang, strings.TrimRight(text, "\n"), fence)
+}
+
+// goCodeBlock returns the first Go code block of a reply, or the whole
+// reply when it is bare Go source.
+func goCodeBlock(text string) string {
+	for _, blk := range exportBlocks(text) {
+		if blk.Code && (blk.Lang == "go" || blk.Lang == "") {
+			return blk.Text + "\n"
+		}
+	}
+	if t := strings.TrimSpace(text); strings.HasPrefix(t, "package ") {
+		return t + "\n"
+	}
+	return ""
+}
+
+// goVet vets the package of testFile with content laid over it, and
+// returns what go vet reported, or "" when it passed. go vet compiles the
+// tests but runs nothing.
+func goVet(ctx context.Context, testFile, content string) (string, error) {
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		return "", errors.New("the go command is not installed")
+	}
+	dir, err := os.MkdirTemp("", "gemini-proxy-tests-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, filepath.Base(testFile))
+	overlay, err := json.Marshal(map[string]any{"Replace": map[string]string{testFile: src}})
+	if err == nil {
+		err = os.WriteFile(src, []byte(content), 0o644)
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "overlay.json"), overlay, 0o644)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, testCheckTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, goBin, "vet", "-overlay="+filepath.Join(dir, "overlay.json"), ".")
+	cmd.Dir = filepath.Dir(testFile)
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+		return "", nil
+	case ctx.Err() != nil:
+		return "", fmt.Errorf("go vet did not finish in %s", testCheckTimeout)
+	case !errors.As(err, &exit):
+		return "", err
+	}
+	// Paths in the temporary directory mean nothing to the model
+	report := strings.ReplaceAll(string(out), src, filepath.Base(testFile))
+	if len(report) > maxVetOutputBytes {
+		report = report[:maxVetOutputBytes] + "\n... (truncated)"
+	}
+	return strings.TrimSpace(report), nil
+}
+
+// goSymbols summarizes the declarations file can use, without function
+// bodies or comments: all of those in the other files of its package, and
+// the exported ones of the packages of its module it imports. It is cut
+// at maxSymbolBytes.
+func goSymbols(root, file string) string {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ImportsOnly)
+	if err != nil {
+		return ""
+	}
+	var b bytes.Buffer
+	summarizePackage(&b, fset, filepath.Dir(file), file, false)
+	if modDir, modPath := goModule(root, filepath.Dir(file)); modPath != "" {
+		for _, imp := range f.Imports {
+			path := strings.Trim(imp.Path.Value, `"`)
+			sub, ok := strings.CutPrefix(path, modPath)
+			if !ok || (sub != "" && !strings.HasPrefix(sub, "/")) {
+				continue
+			}
+			fmt.Fprintf(&b, "// package %s\n\n", path)
+			summarizePackage(&b, fset, filepath.Join(modDir, filepath.FromSlash(sub)), "", true)
+		}
+	}
+	if b.Len() > maxSymbolBytes {
+		return b.String()[:maxSymbolBytes] + "\n// ... (truncated)"
+	}
+	return b.String()
+}
+
+// goModule finds the go.mod governing dir, no higher than root, and
+// returns its directory and module path.
+func goModule(root, dir string) (string, string) {
+	for {
+		if data, err := os.ReadFile(filepath.Join(dir, "go.mod")); err == nil {
+			for _, line := range strings.Split(string(data), "\n") {
+				if path, ok := strings.CutPrefix(strings.TrimSpace(line), "module "); ok {
+					return dir, strings.Trim(strings.TrimSpace(path), `"`)
+				}
+			}
+			return "", ""
+		}
+		if dir == root || filepath.Dir(dir) == dir {
+			return "", ""
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// summarizePackage writes the declarations of the Go files in dir, other
+// than skip and tests, with exported ones only if exportedOnly.
+func summarizePackage(b *bytes.Buffer, fset *token.FileSet, dir, skip string, exportedOnly bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(dir, name)
+		if e.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") || path == skip {
+			continue
+		}
+		f, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+		if err != nil {
+			continue
+		}
+		for _, decl := range f.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if exportedOnly && !d.Name.IsExported() {
+					continue
+				}
+				d.Body = nil
+				printer.Fprint(b, fset, d)
+				b.WriteString("\n\n")
+			case *ast.GenDecl:
+				if d.Tok == token.IMPORT {
+					continue
+				}
+				specs := d.Specs
+				if exportedOnly {
+					specs = exportedSpecs(d.Specs)
+				}
+				if len(specs) == 0 {
+					continue
+				}
+				printer.Fprint(b, fset, &ast.GenDecl{Tok: d.Tok, Lparen: d.Lparen, Specs: specs, Rparen: d.Rparen})
+				b.WriteString("\n\n")
+			}
+		}
+		if b.Len() > maxSymbolBytes {
+			return
+		}
+	}
+}
+
+func exportedSpecs(specs []ast.Spec) []ast.Spec {
+	var out []ast.Spec
+	for _, spec := range specs {
+		switch sp := spec.(type) {
+		case *ast.TypeSpec:
+			if sp.Name.IsExported() {
+				out = append(out, sp)
+			}
+		case *ast.ValueSpec:
+			for _, n := range sp.Names {
+				if n.IsExported() {
+					out = append(out, sp)
+					break
+				}
+			}
+		}
+	}
+	return out
+}
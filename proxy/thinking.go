@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// reasoningBudgets maps OpenAI's reasoning_effort onto thinking budgets.
+var reasoningBudgets = map[string]int32{
+	"minimal": 0,
+	"low":     1024,
+	"medium":  8192,
+	"high":    24576,
+}
+
+// thinkingConfig returns the thinking settings of a request, or nil when
+// it sets none and the model's default applies. A budget of -1 lets the
+// model decide and 0 turns thinking off, where the model allows it.
+// includeThoughts asks for summaries of the model's thoughts.
+func thinkingConfig(budget *int32, includeThoughts bool) (*genai.ThinkingConfig, error) {
+	if budget == nil && !includeThoughts {
+		return nil, nil
+	}
+	if budget != nil && *budget < -1 {
+		return nil, fmt.Errorf("invalid thinking_budget %d: want -1 (dynamic), 0 (off) or a token count", *budget)
+	}
+	return &genai.ThinkingConfig{ThinkingBudget: budget, IncludeThoughts: includeThoughts}, nil
+}
+
+// openAIThinking resolves the thinking settings of an OpenAI request.
+// reasoning_effort asks for thoughts, which come back as reasoning_content;
+// the thinking_budget extension sets the budget directly and wins.
+func openAIThinking(req *OpenAIChatRequest) (*genai.ThinkingConfig, error) {
+	budget := req.ThinkingBudget
+	include := budget != nil && *budget != 0
+	if req.ReasoningEffort != "" {
+		b, ok := reasoningBudgets[req.ReasoningEffort]
+		if !ok {
+			return nil, fmt.Errorf("invalid reasoning_effort %q: want minimal, low, medium or high", req.ReasoningEffort)
+		}
+		if budget == nil {
+			budget = &b
+		}
+		include = *budget != 0
+	}
+	return thinkingConfig(budget, include)
+}
+
+// thoughtText joins the thought summaries of a response, which Text leaves
+// out.
+func thoughtText(res *genai.GenerateContentResponse) string {
+	if res == nil || len(res.Candidates) == 0 || res.Candidates[0].Content == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, p := range res.Candidates[0].Content.Parts {
+		if p != nil && p.Thought && p.Text != "" {
+			b.WriteString(p.Text)
+		}
+	}
+	return b.String()
+}
+
+// thinkingTokens returns the tokens a response spent thinking.
+func thinkingTokens(res *genai.GenerateContentResponse) int {
+	if res == nil || res.UsageMetadata == nil {
+		return 0
+	}
+	return int(res.UsageMetadata.ThoughtsTokenCount)
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// statusClientClosedRequest is the de facto status for requests the client
+// abandoned before a response was written.
+const statusClientClosedRequest = 499
+
+// endpointContext derives the context for a request's upstream calls and
+// tool loop from the request itself, bounded by the endpoint's timeout.
+// Closing the browser tab or IDE request cancels generation, and so does
+// POST /generations/<id>/cancel while the returned cancel has not been
+// called.
+func (s *Server) endpointContext(parent context.Context, endpoint string) (context.Context, context.CancelFunc) {
+	parent = context.WithValue(parent, endpointKey, endpoint)
+	ctx, cancelCause := context.WithCancelCause(parent)
+	remove := s.generations.add(&generation{ID: requestIDFrom(parent), Endpoint: endpoint, Started: time.Now().UTC(), cancel: cancelCause, workspace: workspaceName(parent)})
+	stop := context.CancelFunc(func() {})
+	if d := s.cfg.Timeout(endpoint); d > 0 {
+		ctx, stop = context.WithTimeout(ctx, d)
+	}
+	return ctx, func() {
+		remove()
+		stop()
+		cancelCause(context.Canceled)
+	}
+}
+
+// upstreamStatus picks the HTTP status for a failed upstream call,
+// distinguishing timeouts and client disconnects from upstream errors.
+func upstreamStatus(ctx context.Context, err error) int {
+	var open *circuitOpenError
+	switch {
+	case errors.As(err, &open):
+		return http.StatusServiceUnavailable
+	case contextTooLong(err):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		return statusClientClosedRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// abortError returns the error to report for a request that stopped
+// early: err, unless the request was cancelled through /generations.
+func abortError(ctx context.Context, err error) error {
+	if errors.Is(context.Cause(ctx), errGenerationCancelled) {
+		return errGenerationCancelled
+	}
+	return err
+}
+
+// logAbort records why a request stopped early, if it did, with any attrs
+// describing what it had produced by then.
+func (s *Server) logAbort(ctx context.Context, stage string, attrs ...any) {
+	attrs = append([]any{"stage", stage}, attrs...)
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		s.requestLogger(ctx).Warn("request timed out", attrs...)
+	case context.Canceled:
+		if errors.Is(context.Cause(ctx), errGenerationCancelled) {
+			s.requestLogger(ctx).Info("generation cancelled", attrs...)
+			return
+		}
+		s.requestLogger(ctx).Info("client disconnected", attrs...)
+	}
+}
+
+// addAbortedCost adds the cost of a request that stopped early to the
+// running total. Tokens generated before the abort are billed all the same,
+// so the store is updated even though the request's context is done.
+func (s *Server) addAbortedCost(ctx context.Context, cost float64) {
+	if cost == 0 {
+		return
+	}
+	if _, err := s.sessions(ctx).AddCost(context.WithoutCancel(ctx), cost); err != nil {
+		s.requestLogger(ctx).Error("recording cost", "error", err)
+	}
+}
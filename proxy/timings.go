@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Timings breaks a request's latency down so slow responses can be
+// diagnosed from the client side.
+type Timings struct {
+	QueueMs         int64 `json:"queue_ms"`                // Arrival until the first upstream call
+	FirstTokenMs    int64 `json:"upstream_first_token_ms"` // First upstream call until its response
+	UpstreamMs      int64 `json:"upstream_total_ms"`       // All upstream calls, including tool-loop turns
+	ToolsMs         int64 `json:"tool_execution_ms"`       // All tool executions
+	SerializationMs int64 `json:"serialization_ms"`        // Last upstream response until the reply is built
+	TotalMs         int64 `json:"total_ms"`
+	Retries         int   `json:"upstream_retries"` // Upstream attempts repeated after a transient failure
+}
+
+// requestTimer accumulates the phases of one request. It is stored in the
+// request context by withRequestID; all methods are safe on a nil timer.
+type requestTimer struct {
+	mu            sync.Mutex
+	received      time.Time
+	firstUpstream time.Time
+	firstToken    time.Time
+	lastUpstream  time.Time
+	upstream      time.Duration
+	tools         time.Duration
+	calls         int
+	retries       int
+}
+
+func timerFrom(ctx context.Context) *requestTimer {
+	t, _ := ctx.Value(requestTimerKey).(*requestTimer)
+	return t
+}
+
+// upstreamStart marks the beginning of an upstream call and returns its
+// start time for upstreamDone.
+func (t *requestTimer) upstreamStart() time.Time {
+	now := time.Now()
+	if t == nil {
+		return now
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.firstUpstream.IsZero() {
+		t.firstUpstream = now
+	}
+	return now
+}
+
+// upstreamDone records the end of an upstream call and returns how many
+// calls the request has made so far.
+func (t *requestTimer) upstreamDone(start time.Time) int {
+	if t == nil {
+		return 0
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.firstToken.IsZero() {
+		t.firstToken = now
+	}
+	t.upstream += now.Sub(start)
+	t.lastUpstream = now
+	t.calls++
+	return t.calls
+}
+
+// firstChunk marks the arrival of the first streamed chunk, so streamed
+// calls report time to first token rather than time to completion.
+func (t *requestTimer) firstChunk() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.firstToken.IsZero() {
+		t.firstToken = time.Now()
+	}
+}
+
+func (t *requestTimer) toolDone(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tools += d
+}
+
+func (t *requestTimer) retried() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.retries++
+}
+
+// Timings snapshots the phases measured so far.
+func (t *requestTimer) Timings() *Timings {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tm := &Timings{
+		UpstreamMs: t.upstream.Milliseconds(),
+		ToolsMs:    t.tools.Milliseconds(),
+		TotalMs:    now.Sub(t.received).Milliseconds(),
+		Retries:    t.retries,
+	}
+	if !t.firstUpstream.IsZero() {
+		tm.QueueMs = t.firstUpstream.Sub(t.received).Milliseconds()
+		tm.FirstTokenMs = t.firstToken.Sub(t.firstUpstream).Milliseconds()
+		tm.SerializationMs = now.Sub(t.lastUpstream).Milliseconds()
+	}
+	return tm
+}
+
+// setServerTiming mirrors tm in a Server-Timing header so browser devtools
+// show the breakdown too.
+func setServerTiming(w http.ResponseWriter, tm *Timings) {
+	if tm == nil {
+		return
+	}
+	w.Header().Set("Server-Timing", fmt.Sprintf(
+		"queue;dur=%d, first-token;dur=%d, upstream;dur=%d, tools;dur=%d, serialization;dur=%d, total;dur=%d",
+		tm.QueueMs, tm.FirstTokenMs, tm.UpstreamMs, tm.ToolsMs, tm.SerializationMs, tm.TotalMs))
+}
@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/genai"
+)
+
+// maxTokenModels caps the models one count is made for.
+const maxTokenModels = 8
+
+// TokenCountRequest is the body of POST /tokens/count. It names one
+// target: raw text, a file or directory in the project, or a session.
+type TokenCountRequest struct {
+	Text      string   `json:"text,omitempty"`
+	Path      string   `json:"path,omitempty"`       // Directories count the files the corpus filter selects
+	SessionID string   `json:"session_id,omitempty"` // The session's whole history
+	Models    []string `json:"models,omitempty"`     // Default: the configured model
+}
+
+// ModelTokenCount is the size of the target for one model. With the
+// active context cache built for the model, WithCache adds the cached
+// corpus, which every request carries. Fits is left out when the model's
+// context window is unknown.
+type ModelTokenCount struct {
+	Model         string  `json:"model"`
+	Tokens        int32   `json:"tokens"`
+	WithCache     int32   `json:"with_cache,omitempty"`
+	ContextWindow int32   `json:"context_window,omitempty"` // Input tokens the model accepts
+	Fits          *bool   `json:"fits,omitempty"`
+	InputCost     float64 `json:"input_cost"` // USD to send the target once, uncached
+	Error         string  `json:"error,omitempty"`
+}
+
+// TokenCountResponse is the token count of a target for each model asked.
+type TokenCountResponse struct {
+	Target    string            `json:"target"` // "text", the project path or "session <id>"
+	Files     int               `json:"files,omitempty"`
+	Bytes     int               `json:"bytes"`
+	Truncated bool              `json:"truncated,omitempty"` // A directory stopped at the corpus size cap
+	Counts    []ModelTokenCount `json:"counts"`
+}
+
+func (s *Server) handleTokenCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req TokenCountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, status, err := s.countTokens(r.Context(), req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// countTokens counts the tokens of req's target with the API's tokenizer
+// for each model, which is free, so users can see what fits in a context
+// window before sending it. A model the count fails for reports its error
+// alone. On failure it also returns the HTTP status to report.
+func (s *Server) countTokens(ctx context.Context, req TokenCountRequest) (*TokenCountResponse, int, error) {
+	targets := 0
+	for _, set := range []bool{req.Text != "", req.Path != "", req.SessionID != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return nil, http.StatusBadRequest, errors.New("send one of text, path or session_id")
+	}
+	models := req.Models
+	if len(models) == 0 {
+		models = []string{s.cfg.Model}
+	}
+	if len(models) > maxTokenModels {
+		return nil, http.StatusBadRequest, fmt.Errorf("at most %d models", maxTokenModels)
+	}
+
+	resp := &TokenCountResponse{Counts: []ModelTokenCount{}}
+	var contents []*genai.Content
+	switch {
+	case req.Text != "":
+		if len(req.Text) > MaxTotalChars {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("text is over %d bytes", MaxTotalChars)
+		}
+		resp.Target, resp.Bytes = "text", len(req.Text)
+		contents = genai.Text(req.Text)
+	case req.Path != "":
+		text, status, err := s.tokenTargetPath(ctx, req.Path, resp)
+		if err != nil {
+			return nil, status, err
+		}
+		contents = genai.Text(text)
+	default:
+		history, err := s.sessions(ctx).History(ctx, req.SessionID)
+		if err != nil {
+			return nil, http.StatusServiceUnavailable, fmt.Errorf("loading session: %w", err)
+		}
+		if len(history) == 0 {
+			return nil, http.StatusNotFound, errors.New("session not found or empty")
+		}
+		resp.Target = "session " + req.SessionID
+		data, _ := json.Marshal(history)
+		resp.Bytes = len(data)
+		// The API counts text parts; thoughts are not sent back upstream
+		for _, c := range history {
+			if c == nil {
+				continue
+			}
+			kept := &genai.Content{Role: c.Role}
+			for _, p := range c.Parts {
+				if p != nil && !p.Thought {
+					kept.Parts = append(kept.Parts, p)
+				}
+			}
+			if len(kept.Parts) > 0 {
+				contents = append(contents, kept)
+			}
+		}
+	}
+
+	cacheName, cacheModel := s.cacheFor(ctx)
+	var cacheTokens int32
+	if cacheName != "" {
+		if m, err := s.sessions(ctx).CacheManifest(ctx); err == nil && m != nil {
+			cacheTokens = m.Tokens
+		}
+	}
+	for _, model := range models {
+		mc := ModelTokenCount{Model: model}
+		res, err := s.client.Models.CountTokens(ctx, model, contents, nil)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, upstreamStatus(ctx, err), abortError(ctx, err)
+			}
+			mc.Error = err.Error()
+			resp.Counts = append(resp.Counts, mc)
+			continue
+		}
+		mc.Tokens = res.TotalTokens
+		used := mc.Tokens
+		if cacheTokens > 0 && strings.TrimPrefix(model, "models/") == cacheModel {
+			mc.WithCache = mc.Tokens + cacheTokens
+			used = mc.WithCache
+		}
+		if rateIn, _, ok := modelRates(model); ok {
+			mc.InputCost = float64(mc.Tokens) / 1000000.0 * rateIn
+		}
+		if info, err := s.client.Models.Get(ctx, model, nil); err == nil && info.InputTokenLimit > 0 {
+			mc.ContextWindow = info.InputTokenLimit
+			fits := used <= info.InputTokenLimit
+			mc.Fits = &fits
+		}
+		resp.Counts = append(resp.Counts, mc)
+	}
+	s.requestLogger(ctx).Debug("counted tokens", "target", resp.Target, "bytes", resp.Bytes, "models", len(models))
+	return resp, http.StatusOK, nil
+}
+
+// tokenTargetPath reads a project file, or the files of a project
+// directory that the corpus filter selects, laid out as the context cache
+// lays them out, and fills in the target's size in resp.
+func (s *Server) tokenTargetPath(ctx context.Context, p string, resp *TokenCountResponse) (string, int, error) {
+	abs, rel, ok := s.projectPath(ctx, p)
+	if !ok {
+		return "", http.StatusBadRequest, errors.New("path must be in the project")
+	}
+	info, err := os.Stat(abs)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", http.StatusNotFound, fmt.Errorf("%s not found", rel)
+	} else if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	resp.Target = rel
+	if !info.IsDir() {
+		if info.Size() > MaxTotalChars {
+			return "", http.StatusRequestEntityTooLarge, fmt.Errorf("%s is over %d bytes", rel, MaxTotalChars)
+		}
+		data, err := os.ReadFile(abs)
+		if err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+		if isBinary(data) {
+			return "", http.StatusBadRequest, fmt.Errorf("%s is a binary file", rel)
+		}
+		resp.Files, resp.Bytes = 1, len(data)
+		return string(data), http.StatusOK, nil
+	}
+
+	root := s.root(ctx)
+	filter := s.cfg.Corpus.Filter()
+	var b strings.Builder
+	err = filepath.WalkDir(abs, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		r, _ := filepath.Rel(root, path)
+		r = filepath.ToSlash(r)
+		if d.IsDir() {
+			if path != abs && !corpusDir(filter, r) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil || !corpusFile(filter, r, fi.Size()) {
+			return nil
+		}
+		if b.Len()+int(fi.Size()) > MaxTotalChars {
+			resp.Truncated = true
+			return filepath.SkipAll
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || isBinary(data) {
+			return nil
+		}
+		fmt.Fprintf(&b, "\n\n--- FILE: %s ---\n", r)
+		b.Write(data)
+		resp.Files++
+		return nil
+	})
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+	if resp.Files == 0 {
+		return "", http.StatusBadRequest, fmt.Errorf("no files under %s are selected for the corpus", rel)
+	}
+	resp.Bytes = b.Len()
+	return b.String(), http.StatusOK, nil
+}
@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genai"
+)
+
+// fileToolDeclarations returns the agentic file tools permitted by the
+// tool policy of the request's workspace. Workspaces get no search tools,
+// since the indexes cover the server's own project and sessions.
+func (s *Server) fileToolDeclarations(ctx context.Context) []*genai.FunctionDeclaration {
+	policy := s.toolPolicy(ctx)
+	if policy == config.ToolPolicyNone {
+		return nil
+	}
+	decls := []*genai.FunctionDeclaration{
+		{
+			Name:        "list_files",
+			Description: "List files in the current directory or subdirectory",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"path": {Type: genai.TypeString, Description: "Relative path to list (use '.' for current)"},
+				},
+			},
+		},
+		{
+			Name:        "read_file",
+			Description: "Read the contents of a specific file",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"path": {Type: genai.TypeString, Description: "Relative path to the file"},
+				},
+				Required: []string{"path"},
+			},
+		},
+		{
+			Name:        "read_pdf",
+			Description: "Extract the text of a PDF in the project, such as a design doc, page by page. Long documents are returned in chunks; call again with next_chunk to continue",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"path":   {Type: genai.TypeString, Description: "Relative path to the PDF"},
+					"pages":  {Type: genai.TypeString, Description: "Page or range to read, such as '3' or '2-5'; all pages when omitted"},
+					"chunk":  {Type: genai.TypeInteger, Description: "Chunk of the extracted text to return, starting at 1"},
+					"images": {Type: genai.TypeBoolean, Description: "Also attach the PDF so its figures and scanned pages can be seen"},
+				},
+				Required: []string{"path"},
+			},
+		},
+	}
+	ws := workspaceFrom(ctx)
+	if ws == nil && (s.cfg.Index.BuildOnStart || indexedChunks(s.indexes()) > 0) {
+		search := &genai.FunctionDeclaration{
+			Name:        "semantic_search",
+			Description: "Find the parts of the project most related to a question or concept, even when they share no keywords with it. Returns matching chunks of files with their paths and line ranges",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"query": {Type: genai.TypeString, Description: "What to look for, in plain language"},
+					"k":     {Type: genai.TypeInteger, Description: "Number of results to return; 8 when omitted"},
+				},
+				Required: []string{"query"},
+			},
+		}
+		if len(s.federated) > 0 {
+			search.Description += ". Related projects are indexed too; results from them carry their project name and cannot be opened with the file tools"
+			search.Parameters.Properties["scope"] = &genai.Schema{
+				Type:        genai.TypeString,
+				Description: "Projects to search: 'main' (this project, the default), 'all', or names separated by commas from: " + strings.Join(s.projectNames(), ", "),
+			}
+		}
+		decls = append(decls, search)
+	}
+	if ws == nil && s.conversations != nil {
+		decls = append(decls, &genai.FunctionDeclaration{
+			Name:        "search_conversations",
+			Description: "Search earlier chat sessions with this proxy for what was discussed or decided, by meaning. Returns matching exchanges with their session ID, turns and when the session was last updated",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"query": {Type: genai.TypeString, Description: "What to look for, in plain language"},
+					"k":     {Type: genai.TypeInteger, Description: "Number of results to return; 8 when omitted"},
+				},
+				Required: []string{"query"},
+			},
+		})
+	}
+	if policy == config.ToolPolicyFull {
+		decls = append([]*genai.FunctionDeclaration{{
+			Name:        "write_file",
+			Description: "Write or create a file with the specified content",
+			Parameters: &genai.Schema{
+				Type: genai.TypeObject,
+				Properties: map[string]*genai.Schema{
+					"path":    {Type: genai.TypeString, Description: "Relative path to the file"},
+					"content": {Type: genai.TypeString, Description: "Content to write to the file"},
+				},
+				Required: []string{"path", "content"},
+			},
+		}}, decls...)
+	}
+	return decls
+}
+
+// ToolWarning reports a tool call that failed. The model is sent the error
+// as that call's result and the loop carries on, so the reply may still
+// stand on the calls that succeeded.
+type ToolWarning struct {
+	Tool  string `json:"tool"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error"`
+}
+
+// toolWarning returns the warning for a tool call's result, if it failed.
+func toolWarning(name string, args map[string]any, result map[string]any) (ToolWarning, bool) {
+	e, ok := result["error"]
+	if !ok {
+		return ToolWarning{}, false
+	}
+	w := ToolWarning{Tool: name, Error: fmt.Sprint(e)}
+	w.Path, _ = args["path"].(string)
+	return w, true
+}
+
+// maxLoggedArgs caps the tool arguments logged with log_tool_args, so a
+// large write_file stays readable in the log.
+const maxLoggedArgs = 4000
+
+// executeTool runs a single model-requested tool call and returns the
+// response payload sent back to the model. A tool that panics fails on its
+// own, with the panic as its error, rather than taking the request down.
+func (s *Server) executeTool(ctx context.Context, name string, args map[string]any) map[string]any {
+	_, span := tracer.Start(ctx, "tool."+name, trace.WithAttributes(attribute.String("tool.name", name)))
+	defer span.End()
+	start := time.Now()
+	var result map[string]any
+	if err := ctx.Err(); err != nil {
+		result = map[string]any{"error": "request aborted: " + err.Error()}
+	} else {
+		i := s.toolStarted(ctx, name, args)
+		result = s.runToolSafely(ctx, name, args)
+		s.toolFinished(ctx, i, result)
+	}
+	elapsed := time.Since(start)
+	timerFrom(ctx).toolDone(elapsed)
+	attrs := []any{"tool", name, "latency_ms", elapsed.Milliseconds()}
+	if p, ok := args["path"].(string); ok {
+		attrs = append(attrs, "path", p)
+	}
+	if s.debug.logToolArgs.Load() {
+		data, _ := json.Marshal(args)
+		attrs = append(attrs, "args", preview(string(data), maxLoggedArgs))
+	}
+	if n, ok := result["bytes_written"]; ok {
+		attrs = append(attrs, "bytes", n)
+	}
+	if e, ok := result["error"]; ok {
+		attrs = append(attrs, "error", e)
+		span.SetStatus(codes.Error, fmt.Sprint(e))
+	}
+	s.requestLogger(ctx).Info("tool executed", attrs...)
+
+	a := ToolActivity{Tool: name, LatencyMs: elapsed.Milliseconds()}
+	a.Path, _ = args["path"].(string)
+	if c, ok := result["content"].(string); ok {
+		a.Bytes = len(c)
+	}
+	if n, ok := result["bytes_written"].(int); ok {
+		a.Bytes = n
+	}
+	a.Diff, _ = result["diff"].(*DiffSummary)
+	if e, ok := result["error"]; ok {
+		a.Error = fmt.Sprint(e)
+	}
+	s.recordActivity(ctx, a)
+	return result
+}
+
+// runToolSafely runs a tool, turning a panic into an error result.
+func (s *Server) runToolSafely(ctx context.Context, name string, args map[string]any) (result map[string]any) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.requestLogger(ctx).Error("tool panicked", "tool", name, "panic", r)
+			result = map[string]any{"error": fmt.Sprintf("tool %s failed: %v", name, r)}
+		}
+	}()
+	return s.runTool(ctx, name, args)
+}
+
+// functionResponse builds the reply to a tool call, carrying the call's ID
+// so that the model can tell the results of parallel calls apart. Media a
+// tool attached under "media" is sent as parts of the reply, which only
+// Gemini 3 models accept; other models get a note in its place.
+func functionResponse(model string, call *genai.FunctionCall, result map[string]any) *genai.FunctionResponse {
+	resp := &genai.FunctionResponse{ID: call.ID, Name: call.Name, Response: result}
+	media, ok := result["media"].([]*genai.FunctionResponsePart)
+	if !ok {
+		return resp
+	}
+	delete(result, "media")
+	if strings.HasPrefix(model, "gemini-3") {
+		resp.Parts = media
+	} else {
+		result["media_note"] = "attachments in tool results need a Gemini 3 model; " + model + " only gets the text"
+	}
+	return resp
+}
+
+func (s *Server) runTool(ctx context.Context, name string, args map[string]any) map[string]any {
+	policy := s.toolPolicy(ctx)
+	if policy == config.ToolPolicyNone {
+		return map[string]any{"error": "tools are disabled by the server's tool policy"}
+	}
+	if workspaceFrom(ctx) != nil && (name == "semantic_search" || name == "search_conversations") {
+		return map[string]any{"error": name + " is not available in a workspace"}
+	}
+	switch name {
+	case "list_files":
+		p, ok := args["path"].(string)
+		if !ok {
+			return map[string]any{"error": "invalid 'path' argument for list_files"}
+		}
+		return s.toolListFiles(ctx, p)
+	case "read_file":
+		p, ok := args["path"].(string)
+		if !ok {
+			return map[string]any{"error": "invalid 'path' argument for read_file"}
+		}
+		return s.toolReadFile(ctx, p)
+	case "read_pdf":
+		p, ok := args["path"].(string)
+		if !ok {
+			return map[string]any{"error": "invalid 'path' argument for read_pdf"}
+		}
+		pages, _ := args["pages"].(string)
+		chunk := 1
+		if n, ok := args["chunk"].(float64); ok {
+			chunk = int(n)
+		}
+		images, _ := args["images"].(bool)
+		return s.toolReadPDF(ctx, p, pages, chunk, images)
+	case "semantic_search":
+		q, ok := args["query"].(string)
+		if !ok || strings.TrimSpace(q) == "" {
+			return map[string]any{"error": "invalid 'query' argument for semantic_search"}
+		}
+		k, _ := args["k"].(float64)
+		scope, _ := args["scope"].(string)
+		return s.toolSemanticSearch(ctx, q, int(k), scope)
+	case "search_conversations":
+		if s.conversations == nil {
+			return map[string]any{"error": "conversation search is disabled"}
+		}
+		q, ok := args["query"].(string)
+		if !ok || strings.TrimSpace(q) == "" {
+			return map[string]any{"error": "invalid 'query' argument for search_conversations"}
+		}
+		k, _ := args["k"].(float64)
+		return s.toolSearchConversations(ctx, q, int(k))
+	case "write_file":
+		if policy != config.ToolPolicyFull {
+			return map[string]any{"error": "write_file is disabled by the server's tool policy"}
+		}
+		p, okP := args["path"].(string)
+		c, okC := args["content"].(string)
+		if !okP {
+			return map[string]any{"error": "invalid 'path' argument for write_file"}
+		}
+		if !okC {
+			return map[string]any{"error": "invalid 'content' argument for write_file"}
+		}
+		return s.toolWriteFile(ctx, p, c)
+	}
+	return map[string]any{"error": "unknown tool"}
+}
+
+func (s *Server) toolListFiles(ctx context.Context, relPath string) map[string]any {
+	if relPath == "" {
+		relPath = "."
+	}
+	// Always stay within projectRoot
+	root := s.root(ctx)
+	cleanPath := filepath.Join(root, filepath.Clean(relPath))
+	if abs, _, ok := s.projectPath(ctx, relPath); !ok || abs != cleanPath {
+		return map[string]any{"error": "Access denied: outside project root"}
+	}
+
+	entries, err := os.ReadDir(cleanPath)
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		files = append(files, name)
+	}
+	return map[string]any{"files": files}
+}
+
+func (s *Server) toolReadFile(ctx context.Context, relPath string) map[string]any {
+	// Always stay within projectRoot
+	root := s.root(ctx)
+	cleanPath := filepath.Join(root, filepath.Clean(relPath))
+	if abs, _, ok := s.projectPath(ctx, relPath); !ok || abs != cleanPath {
+		return map[string]any{"error": "Access denied: outside project root"}
+	}
+
+	info, err := os.Stat(cleanPath)
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	if info.Size() > 1000000 { // 1MB limit for tools
+		return map[string]any{"error": "File too large"}
+	}
+	content, err := os.ReadFile(cleanPath)
+	if err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+	return map[string]any{"content": string(content)}
+}
+
+func (s *Server) toolWriteFile(ctx context.Context, relPath, content string) map[string]any {
+	// Always stay within projectRoot
+	root := s.root(ctx)
+	cleanPath := filepath.Join(root, filepath.Clean(relPath))
+	if abs, _, ok := s.projectPath(ctx, relPath); !ok || abs != cleanPath {
+		return map[string]any{"error": "Access denied: outside project root"}
+	}
+
+	// Create parent directories if needed
+	dir := filepath.Dir(cleanPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return map[string]any{"error": "Failed to create directory: " + err.Error()}
+	}
+
+	old, err := os.ReadFile(cleanPath)
+	created := errors.Is(err, fs.ErrNotExist)
+	if err := os.WriteFile(cleanPath, []byte(content), 0644); err != nil {
+		return map[string]any{"error": err.Error()}
+	}
+
+	return map[string]any{"status": "OK", "path": relPath, "bytes_written": len(content), "diff": diffSummary(string(old), content, created)}
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"iter"
+	"net/http"
+	"time"
+
+	"customgemini/config"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genai"
+)
+
+// tracer delegates to the global provider, so spans are exported once
+// InitTracing has installed one and dropped otherwise.
+var tracer = otel.Tracer("customgemini")
+
+// InitTracing installs a batching OTLP/HTTP exporter as the global tracer
+// provider when an endpoint is configured. The returned function flushes
+// pending spans on shutdown.
+func InitTracing(ctx context.Context, cfg config.TracingConfig) (func(context.Context) error, error) {
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(cfg.Endpoint)}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res := sdkresource.NewSchemaless(
+		semconv.ServiceName(cfg.ServiceName),
+		semconv.ServiceVersion(Version),
+	)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// withTracing extracts incoming trace context and opens a server span per
+// request.
+func (s *Server) withTracing(next http.Handler) http.Handler {
+	if s.cfg.Tracing.Endpoint == "" {
+		return next
+	}
+	return otelhttp.NewHandler(next, "proxy", otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return r.Method + " " + r.URL.Path
+	}))
+}
+
+// upstreamHTTPClient returns the HTTP client used for Gemini API calls. It
+// notes whether calls reuse a connection, records or replays exchanges in
+// replay mode, captures them in debug
+// mode, retries transient failures, fails fast while the circuit breaker
+// is open, answers
+// repeated requests from the response cache when enabled and, with tracing
+// on, records each round trip as a client span.
+func (s *Server) upstreamHTTPClient() (*http.Client, error) {
+	base, err := UpstreamTransport(s.cfg.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = &connTraceTransport{s: s, base: base}
+	if s.cfg.Replay.Mode != "" {
+		transport = &recordTransport{cfg: s.cfg.Replay, dir: s.recordingsDir(), base: transport}
+	}
+	transport = &captureTransport{s: s, base: transport}
+	transport = &quotaTransport{s: s, base: transport}
+	transport = &retryTransport{s: s, base: transport}
+	if s.breaker != nil {
+		transport = &breakerTransport{s: s, base: transport}
+	}
+	if s.respCache != nil {
+		transport = &cacheTransport{cache: s.respCache, base: transport}
+	}
+	if s.cfg.Tracing.Endpoint != "" {
+		transport = otelhttp.NewTransport(transport)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// sendMessage sends parts on chat inside a span recording model time and
+// token usage.
+func (s *Server) sendMessage(ctx context.Context, chat *genai.Chat, model string, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	ctx, span := tracer.Start(ctx, "gemini.SendMessage", trace.WithAttributes(
+		attribute.String("gen_ai.request.model", model),
+		attribute.Int("gen_ai.request.parts", len(parts)),
+	))
+	defer span.End()
+	timer := timerFrom(ctx)
+	ctx, conn := withUpstreamConn(ctx)
+	start := timer.upstreamStart()
+	res, err := chat.SendMessage(ctx, parts...)
+	calls := timer.upstreamDone(start)
+	if err == nil && !servedFromCache(res) {
+		s.observeFirstToken(conn, time.Since(start))
+	}
+	s.checkUpstreamAnomalies(ctx, model, calls, res)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return res, err
+	}
+	s.recordUsage(ctx, model, res)
+	if servedFromCache(res) {
+		span.SetAttributes(attribute.Bool("proxy.response_cache_hit", true))
+		s.requestLogger(ctx).Debug("response cache hit", "model", model)
+	}
+	if res.UsageMetadata != nil {
+		span.SetAttributes(
+			attribute.Int("gen_ai.usage.input_tokens", int(res.UsageMetadata.PromptTokenCount)),
+			attribute.Int("gen_ai.usage.output_tokens", int(res.UsageMetadata.CandidatesTokenCount)),
+			attribute.Int("gen_ai.usage.cached_tokens", int(res.UsageMetadata.CachedContentTokenCount)),
+		)
+	}
+	return res, nil
+}
+
+// sendMessageStream is sendMessage for streamed replies. The span ends and
+// usage is recorded once the stream is exhausted or abandoned; the final
+// chunk carries the usage metadata. Once ctx is done, as when the client
+// disconnects, the stream ends at the next chunk with ctx's error, which
+// closes the upstream connection; the usage reported so far is recorded.
+func (s *Server) sendMessageStream(ctx context.Context, chat *genai.Chat, model string, parts ...genai.Part) iter.Seq2[*genai.GenerateContentResponse, error] {
+	return func(yield func(*genai.GenerateContentResponse, error) bool) {
+		ctx, span := tracer.Start(ctx, "gemini.SendMessageStream", trace.WithAttributes(
+			attribute.String("gen_ai.request.model", model),
+			attribute.Int("gen_ai.request.parts", len(parts)),
+		))
+		defer span.End()
+		timer := timerFrom(ctx)
+		ctx, conn := withUpstreamConn(ctx)
+		start := timer.upstreamStart()
+		var last *genai.GenerateContentResponse
+		defer func() {
+			calls := timer.upstreamDone(start)
+			s.checkUpstreamAnomalies(ctx, model, calls, last)
+			s.recordUsage(ctx, model, last)
+			if last != nil && last.UsageMetadata != nil {
+				span.SetAttributes(
+					attribute.Int("gen_ai.usage.input_tokens", int(last.UsageMetadata.PromptTokenCount)),
+					attribute.Int("gen_ai.usage.output_tokens", int(last.UsageMetadata.CandidatesTokenCount)),
+					attribute.Int("gen_ai.usage.cached_tokens", int(last.UsageMetadata.CachedContentTokenCount)),
+				)
+			}
+		}()
+		for res, err := range chat.SendMessageStream(ctx, parts...) {
+			if err == nil && ctx.Err() != nil {
+				res, err = nil, ctx.Err()
+			}
+			if err != nil {
+				span.RecordError(err)
+				span.SetStatus(codes.Error, err.Error())
+			} else {
+				if last == nil {
+					timer.firstChunk()
+					s.observeFirstToken(conn, time.Since(start))
+				}
+				last = res
+			}
+			if !yield(res, err) || ctx.Err() != nil {
+				return
+			}
+		}
+		// The SDK can end a cut-off stream without reporting an error
+		if ctx.Err() != nil {
+			span.SetStatus(codes.Error, ctx.Err().Error())
+			yield(nil, ctx.Err())
+		}
+	}
+}
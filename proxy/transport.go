@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"customgemini/config"
+)
+
+// UpstreamTransport builds the pooled transport used for Gemini API calls
+// from the upstream settings. Without an explicit proxy URL it honours
+// HTTPS_PROXY and NO_PROXY from the environment.
+func UpstreamTransport(cfg config.UpstreamConfig) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("upstream proxy_url: %w", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+	t := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   time.Duration(cfg.DialTimeoutSeconds) * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeoutSeconds) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(cfg.TLSHandshakeTimeoutSeconds) * time.Second,
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeoutSeconds) * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if cfg.DisableHTTP2 {
+		// A non-nil empty map turns off the transport's automatic HTTP/2
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t, nil
+}
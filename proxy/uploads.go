@@ -0,0 +1,356 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/genai"
+)
+
+// uploadTypes are the attachment types Gemini accepts inline, as detected
+// from the file contents.
+var uploadTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"audio/wav":       true,
+	"audio/mp3":       true,
+	"audio/aiff":      true,
+	"audio/aac":       true,
+	"audio/ogg":       true,
+	"audio/flac":      true,
+}
+
+// Attachment describes an uploaded file. Chat requests reference it by ID.
+type Attachment struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	MimeType string    `json:"mime_type"`
+	Size     int       `json:"size"`
+	Expires  time.Time `json:"expires"`
+}
+
+type upload struct {
+	Attachment
+	data    []byte
+	fileURI string // Set instead of data for videos held by the Files API
+}
+
+// uploadStore holds attachments in memory, keyed by session and ID, until
+// they expire.
+type uploadStore struct {
+	mu       sync.Mutex
+	sessions map[string]map[string]*upload
+}
+
+func newUploadStore() *uploadStore {
+	return &uploadStore{sessions: make(map[string]map[string]*upload)}
+}
+
+// sweep drops expired uploads. The caller holds mu.
+func (u *uploadStore) sweep(now time.Time) {
+	for session, files := range u.sessions {
+		for id, f := range files {
+			if now.After(f.Expires) {
+				delete(files, id)
+			}
+		}
+		if len(files) == 0 {
+			delete(u.sessions, session)
+		}
+	}
+}
+
+var errTooManyUploads = errors.New("too many attachments for this session")
+
+func (u *uploadStore) put(session string, files []*upload, max int) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sweep(time.Now())
+	held := u.sessions[session]
+	if len(held)+len(files) > max {
+		return errTooManyUploads
+	}
+	if held == nil {
+		held = make(map[string]*upload)
+		u.sessions[session] = held
+	}
+	for _, f := range files {
+		held[f.ID] = f
+	}
+	return nil
+}
+
+// get returns an unexpired upload of session, or nil.
+func (u *uploadStore) get(session, id string) *upload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.sweep(time.Now())
+	return u.sessions[session][id]
+}
+
+// drop forgets every upload of session.
+func (u *uploadStore) drop(session string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.sessions, session)
+}
+
+// ChatAttachment is one entry of a chat request's attachments: the ID of a
+// file sent to /upload, given as a plain string, or a file for this turn
+// only, named by its project path or sent as base64 data with its type.
+type ChatAttachment struct {
+	ID       string `json:"id,omitempty"`
+	Path     string `json:"path,omitempty"`      // Relative to the project root
+	Data     string `json:"data,omitempty"`      // Base64
+	MimeType string `json:"mime_type,omitempty"` // Required with Data
+	Name     string `json:"name,omitempty"`      // Shown in the history; defaults to the path
+}
+
+func (a *ChatAttachment) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &a.ID); err == nil {
+		return nil
+	}
+	type plain ChatAttachment
+	return json.Unmarshal(data, (*plain)(a))
+}
+
+// attachmentParts resolves a chat request's attachments into parts. Parts
+// of turn-only files are also returned in turnOnly, keyed by their data,
+// with the name to note in their place when the history is saved.
+func (s *Server) attachmentParts(ctx context.Context, session string, list []ChatAttachment) (parts []genai.Part, turnOnly map[*genai.Blob]string, err error) {
+	for _, a := range list {
+		if a.ID != "" {
+			f := s.uploads.get(scopedSession(ctx, session), a.ID)
+			if f == nil {
+				return nil, nil, fmt.Errorf("attachment %s not found or expired", a.ID)
+			}
+			if f.fileURI != "" {
+				parts = append(parts, genai.Part{FileData: &genai.FileData{FileURI: f.fileURI, MIMEType: f.MimeType}})
+				continue
+			}
+			parts = append(parts, genai.Part{InlineData: &genai.Blob{MIMEType: f.MimeType, Data: f.data}})
+			continue
+		}
+
+		blob, name, err := s.turnOnlyBlob(ctx, a)
+		if err != nil {
+			return nil, nil, err
+		}
+		if turnOnly == nil {
+			turnOnly = make(map[*genai.Blob]string)
+		}
+		turnOnly[blob] = name
+		parts = append(parts, genai.Part{InlineData: blob})
+	}
+	return parts, turnOnly, nil
+}
+
+// turnOnlyBlob reads a turn-only attachment from the project or decodes it.
+// Text files are sent as text/plain, headed by their path. Videos need the
+// Files API and must go through /upload.
+func (s *Server) turnOnlyBlob(ctx context.Context, a ChatAttachment) (*genai.Blob, string, error) {
+	maxBytes := s.cfg.Uploads.MaxFileMB << 20
+	var data []byte
+	mimeType, name := a.MimeType, a.Name
+	switch {
+	case a.Path != "":
+		abs, rel, ok := s.projectPath(ctx, a.Path)
+		if !ok {
+			return nil, "", fmt.Errorf("attachment %s: outside the project", a.Path)
+		}
+		info, err := os.Stat(abs)
+		if err != nil || info.IsDir() {
+			return nil, "", fmt.Errorf("attachment %s: not a file in the project", a.Path)
+		}
+		if info.Size() > int64(maxBytes) {
+			return nil, "", fmt.Errorf("attachment %s is larger than %d MB", a.Path, s.cfg.Uploads.MaxFileMB)
+		}
+		if data, err = os.ReadFile(abs); err != nil {
+			return nil, "", fmt.Errorf("attachment %s: %w", a.Path, err)
+		}
+		if name == "" {
+			name = rel
+		}
+		mimeType = sniffAudio(data)
+		if mimeType == "" {
+			mimeType = http.DetectContentType(data)
+		}
+		if !uploadTypes[mimeType] && !isBinary(data) && utf8.Valid(data) {
+			mimeType = "text/plain"
+			data = append([]byte("File: "+rel+"\n\n"), data...)
+		}
+	case a.Data != "":
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(a.Data); err != nil {
+			return nil, "", fmt.Errorf("attachment %s: data is not valid base64", a.Name)
+		}
+		if len(data) > maxBytes {
+			return nil, "", fmt.Errorf("attachment %s is larger than %d MB", a.Name, s.cfg.Uploads.MaxFileMB)
+		}
+		if name == "" {
+			name = "inline " + mimeType
+		}
+	default:
+		return nil, "", fmt.Errorf("attachment needs an id, a path or data")
+	}
+
+	switch {
+	case sniffVideo(data) != "":
+		return nil, "", fmt.Errorf("attachment %s: send videos through /upload", name)
+	case !uploadTypes[mimeType] && !strings.HasPrefix(mimeType, "text/"):
+		return nil, "", fmt.Errorf("attachment %s: unsupported type %q", name, mimeType)
+	}
+	return &genai.Blob{MIMEType: mimeType, Data: data}, name, nil
+}
+
+// withoutTurnOnly returns history with turn-only attachments replaced by a
+// note naming them, so they are not resent with every later turn.
+func withoutTurnOnly(history []*genai.Content, turnOnly map[*genai.Blob]string) []*genai.Content {
+	if len(turnOnly) == 0 {
+		return history
+	}
+	out := make([]*genai.Content, len(history))
+	for i, c := range history {
+		out[i] = c
+		if c == nil {
+			continue
+		}
+		parts := make([]*genai.Part, len(c.Parts))
+		changed := false
+		for j, p := range c.Parts {
+			parts[j] = p
+			if p == nil || p.InlineData == nil {
+				continue
+			}
+			if name, ok := turnOnly[p.InlineData]; ok {
+				parts[j] = &genai.Part{Text: "[Attached for this turn only: " + name + "]"}
+				changed = true
+			}
+		}
+		if changed {
+			cp := *c
+			cp.Parts = parts
+			out[i] = &cp
+		}
+	}
+	return out
+}
+
+// handleUpload accepts images, PDFs, audio and video as multipart "file"
+// fields and holds them for the session given by ?session_id= or a
+// session_id field sent before the files. The type is detected from the
+// content, not the name. Videos are passed on to the Files API and held
+// there.
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	limits := s.cfg.Uploads
+	maxBytes := int64(limits.MaxFileMB) << 20
+	session := r.URL.Query().Get("session_id")
+	expires := time.Now().Add(time.Duration(limits.TTLMinutes) * time.Minute).UTC()
+	var files []*upload
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Reading upload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch part.FormName() {
+		case "session_id":
+			v, _ := io.ReadAll(io.LimitReader(part, 128))
+			session = string(v)
+		case "file":
+			f, status, err := s.readUpload(r.Context(), part, maxBytes)
+			if err != nil {
+				http.Error(w, err.Error(), status)
+				return
+			}
+			f.Expires = expires
+			files = append(files, f)
+			if len(files) > limits.MaxPerSession {
+				http.Error(w, errTooManyUploads.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		part.Close()
+	}
+	if session == "" {
+		session = "default"
+	}
+	if len(files) == 0 {
+		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		return
+	}
+	if err := s.uploads.put(scopedSession(r.Context(), session), files, limits.MaxPerSession); err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	list := make([]Attachment, len(files))
+	for i, f := range files {
+		list[i] = f.Attachment
+	}
+	s.requestLogger(r.Context()).Info("attachments uploaded", "session", session, "files", len(files))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"attachments": list})
+}
+
+// readUpload reads one file part, enforcing the size cap and allowed types.
+// On failure it returns the HTTP status to report.
+func (s *Server) readUpload(ctx context.Context, part *multipart.Part, maxBytes int64) (*upload, int, error) {
+	br := bufio.NewReaderSize(part, 512)
+	head, _ := br.Peek(512)
+	if mimeType := sniffVideo(head); mimeType != "" {
+		return s.uploadVideo(ctx, part.FileName(), mimeType, br)
+	}
+	data, err := io.ReadAll(io.LimitReader(br, maxBytes+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("reading %s: %w", part.FileName(), err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("%s is larger than %d MB", part.FileName(), maxBytes>>20)
+	}
+	mimeType := sniffAudio(data)
+	if mimeType == "" {
+		mimeType = http.DetectContentType(data)
+	}
+	if !uploadTypes[mimeType] {
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("%s: unsupported type %s (want an image, PDF, audio or video file)", part.FileName(), mimeType)
+	}
+	return &upload{
+		Attachment: Attachment{
+			ID:       newRequestID(),
+			Name:     part.FileName(),
+			MimeType: mimeType,
+			Size:     len(data),
+		},
+		data: data,
+	}, 0, nil
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// UsageRetentionDays is how long stores keep daily usage totals.
+const UsageRetentionDays = 35
+
+// dayLayout formats the UTC day keys usage is bucketed by.
+const dayLayout = "2006-01-02"
+
+// UsageTotals aggregates upstream calls. Costs are in USD.
+type UsageTotals struct {
+	Requests       int64   `json:"requests"`
+	PromptTokens   int64   `json:"prompt_tokens"`
+	ResponseTokens int64   `json:"response_tokens"`
+	ThinkingTokens int64   `json:"thinking_tokens"` // Billed as output, apart from ResponseTokens
+	CachedTokens   int64   `json:"cached_tokens"`
+	Cost           float64 `json:"cost"`
+	CacheSavings   float64 `json:"cache_savings"`
+}
+
+func (u *UsageTotals) add(o UsageTotals) {
+	u.Requests += o.Requests
+	u.PromptTokens += o.PromptTokens
+	u.ResponseTokens += o.ResponseTokens
+	u.ThinkingTokens += o.ThinkingTokens
+	u.CachedTokens += o.CachedTokens
+	u.Cost += o.Cost
+	u.CacheSavings += o.CacheSavings
+}
+
+// DailyUsage is one UTC day of usage by model, and cost by chat session.
+type DailyUsage struct {
+	Day      string                 `json:"day"`
+	Models   map[string]UsageTotals `json:"models"`
+	Sessions map[string]float64     `json:"sessions"`
+}
+
+// withSession marks ctx as belonging to a web chat session, so usage
+// recorded under it is attributed to the session.
+func withSession(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionIDKey, id)
+}
+
+func sessionFrom(ctx context.Context) string {
+	id, _ := ctx.Value(sessionIDKey).(string)
+	return id
+}
+
+// recordUsage adds one upstream response to today's usage totals. A store
+// failure is logged and otherwise ignored. Usage is recorded after the
+// client has gone too, as for a stream abandoned partway through.
+func (s *Server) recordUsage(ctx context.Context, model string, res *genai.GenerateContentResponse) {
+	if res == nil || res.UsageMetadata == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	cost, savings := usageCost(model, res)
+	u := UsageTotals{
+		Requests:       1,
+		PromptTokens:   int64(res.UsageMetadata.PromptTokenCount),
+		ResponseTokens: int64(res.UsageMetadata.CandidatesTokenCount),
+		ThinkingTokens: int64(res.UsageMetadata.ThoughtsTokenCount),
+		CachedTokens:   int64(res.UsageMetadata.CachedContentTokenCount),
+		Cost:           cost,
+		CacheSavings:   savings,
+	}
+	day := time.Now().UTC().Format(dayLayout)
+	if err := s.sessions(ctx).RecordUsage(ctx, day, model, sessionFrom(ctx), u); err != nil {
+		s.requestLogger(ctx).Warn("recording usage", "error", err)
+	}
+}
+
+// ModelUsage is a model's share of the dashboard period.
+type ModelUsage struct {
+	Model string `json:"model"`
+	UsageTotals
+}
+
+// SessionCost is a session's spend over the dashboard period.
+type SessionCost struct {
+	ID    string  `json:"id"`
+	Title string  `json:"title,omitempty"`
+	Cost  float64 `json:"cost"`
+}
+
+// DaySummary is one point of the daily spend chart.
+type DaySummary struct {
+	Day string `json:"day"`
+	UsageTotals
+}
+
+// DashboardSummary is the /dashboard/summary response. Week covers the
+// last seven UTC days, today included.
+type DashboardSummary struct {
+	Today       UsageTotals   `json:"today"`
+	Week        UsageTotals   `json:"week"`
+	Daily       []DaySummary  `json:"daily"`  // Oldest first
+	Models      []ModelUsage  `json:"models"` // This week, by cost
+	TopSessions []SessionCost `json:"top_sessions"`
+	TotalCost   float64       `json:"total_cost"` // Since the store was created
+}
+
+// maxTopSessions bounds the top_sessions list.
+const maxTopSessions = 10
+
+func (s *Server) handleDashboardSummary(w http.ResponseWriter, r *http.Request) {
+	sum, err := s.UsageSummary(r.Context())
+	if err != nil {
+		http.Error(w, "Loading usage: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sum)
+}
+
+// UsageSummary totals the usage of the last seven UTC days from the
+// session store.
+func (s *Server) UsageSummary(ctx context.Context) (DashboardSummary, error) {
+	now := time.Now().UTC()
+	days := make([]string, 7)
+	for i := range days {
+		days[i] = now.AddDate(0, 0, i-6).Format(dayLayout)
+	}
+	usage, err := s.store.Usage(ctx, days)
+	if err != nil {
+		return DashboardSummary{}, err
+	}
+	byDay := make(map[string]DailyUsage, len(usage))
+	for _, d := range usage {
+		byDay[d.Day] = d
+	}
+
+	sum := DashboardSummary{Daily: make([]DaySummary, 0, len(days))}
+	models := make(map[string]*ModelUsage)
+	sessions := make(map[string]float64)
+	for _, day := range days {
+		point := DaySummary{Day: day}
+		for model, u := range byDay[day].Models {
+			point.add(u)
+			m := models[model]
+			if m == nil {
+				m = &ModelUsage{Model: model}
+				models[model] = m
+			}
+			m.add(u)
+		}
+		for id, cost := range byDay[day].Sessions {
+			sessions[id] += cost
+		}
+		sum.Week.add(point.UsageTotals)
+		sum.Daily = append(sum.Daily, point)
+	}
+	sum.Today = sum.Daily[len(sum.Daily)-1].UsageTotals
+
+	sum.Models = make([]ModelUsage, 0, len(models))
+	for _, m := range models {
+		sum.Models = append(sum.Models, *m)
+	}
+	sort.Slice(sum.Models, func(i, j int) bool { return sum.Models[i].Cost > sum.Models[j].Cost })
+
+	sum.TopSessions = make([]SessionCost, 0, len(sessions))
+	for id, cost := range sessions {
+		sum.TopSessions = append(sum.TopSessions, SessionCost{ID: id, Cost: cost})
+	}
+	sort.Slice(sum.TopSessions, func(i, j int) bool { return sum.TopSessions[i].Cost > sum.TopSessions[j].Cost })
+	if len(sum.TopSessions) > maxTopSessions {
+		sum.TopSessions = sum.TopSessions[:maxTopSessions]
+	}
+	for i := range sum.TopSessions {
+		if info, err := s.store.SessionInfo(ctx, sum.TopSessions[i].ID); err == nil && info != nil {
+			sum.TopSessions[i].Title = info.Title
+		}
+	}
+
+	if sum.TotalCost, err = s.store.TotalCost(ctx); err != nil {
+		s.requestLogger(ctx).Warn("reading total cost", "error", err)
+	}
+	return sum, nil
+}
+
+// Usage report groupings.
+const (
+	GroupByDay     = "day"
+	GroupByModel   = "model"
+	GroupBySession = "session" // Sessions only have a cost
+)
+
+// UsageRow is one group of a usage report.
+type UsageRow struct {
+	Key   string `json:"key"`             // The day, model or session ID
+	Title string `json:"title,omitempty"` // Session title
+	UsageTotals
+}
+
+// UsageReport totals usage between two UTC days, inclusive.
+type UsageReport struct {
+	Since   string      `json:"since"`
+	Until   string      `json:"until"`
+	GroupBy string      `json:"group_by"`
+	Rows    []UsageRow  `json:"rows"` // Days in order, models and sessions by cost
+	Total   UsageTotals `json:"total"`
+}
+
+// UsageReport totals the usage recorded from since to until, grouped by
+// day, model or session. Days older than UsageRetentionDays have been
+// dropped by the store and are skipped.
+func (s *Server) UsageReport(ctx context.Context, since, until time.Time, groupBy string) (UsageReport, error) {
+	report := UsageReport{Since: since.Format(dayLayout), Until: until.Format(dayLayout), GroupBy: groupBy, Rows: []UsageRow{}}
+	switch groupBy {
+	case GroupByDay, GroupByModel, GroupBySession:
+	default:
+		return report, fmt.Errorf("invalid grouping %q: want day, model or session", groupBy)
+	}
+	if until.Before(since) {
+		return report, fmt.Errorf("the range ends (%s) before it starts (%s)", report.Until, report.Since)
+	}
+	// Older days are gone, so there is no point asking the store for them
+	if oldest := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -UsageRetentionDays); since.Before(oldest) {
+		since = oldest
+	}
+	var days []string
+	for d := since; !d.After(until); d = d.AddDate(0, 0, 1) {
+		days = append(days, d.Format(dayLayout))
+	}
+	usage, err := s.store.Usage(ctx, days)
+	if err != nil {
+		return report, err
+	}
+
+	groups := map[string]*UsageRow{}
+	row := func(key string) *UsageRow {
+		if groups[key] == nil {
+			groups[key] = &UsageRow{Key: key}
+		}
+		return groups[key]
+	}
+	for _, d := range usage {
+		for model, u := range d.Models {
+			report.Total.add(u)
+			switch groupBy {
+			case GroupByDay:
+				row(d.Day).add(u)
+			case GroupByModel:
+				row(model).add(u)
+			}
+		}
+		if groupBy == GroupBySession {
+			for id, cost := range d.Sessions {
+				row(id).Cost += cost
+			}
+		}
+	}
+	for _, r := range groups {
+		report.Rows = append(report.Rows, *r)
+	}
+	if groupBy == GroupByDay {
+		sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Key < report.Rows[j].Key })
+	} else {
+		sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Cost > report.Rows[j].Cost })
+	}
+	if groupBy == GroupBySession {
+		for i := range report.Rows {
+			if info, err := s.store.SessionInfo(ctx, report.Rows[i].Key); err == nil && info != nil {
+				report.Rows[i].Title = info.Title
+			}
+		}
+	}
+	return report, nil
+}
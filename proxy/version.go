@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+)
+
+// Version, Commit and BuildDate describe the build. Release builds set
+// them at link time:
+//
+//	go build -ldflags "-X customgemini/proxy.Version=1.3.0 \
+//	  -X customgemini/proxy.Commit=$(git rev-parse HEAD) \
+//	  -X customgemini/proxy.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" .
+//
+// Left unset, Commit comes from the version control details the Go
+// toolchain records when building from a git checkout, and BuildDate is
+// that commit's time.
+var (
+	Version   = "1.2.1"
+	Commit    = ""
+	BuildDate = "" // RFC 3339, UTC
+)
+
+// BuildInfo identifies the build of the running server, as GET /version
+// reports it.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	Modified  bool   `json:"modified,omitempty"` // Built from a tree with uncommitted changes
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Build returns the build information of the running binary.
+var Build = sync.OnceValue(func() BuildInfo {
+	b := BuildInfo{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return b
+	}
+	vcs := map[string]string{}
+	for _, s := range info.Settings {
+		vcs[s.Key] = s.Value
+	}
+	if b.Commit == "" {
+		b.Commit = vcs["vcs.revision"]
+	}
+	if b.BuildDate == "" {
+		b.BuildDate = vcs["vcs.time"]
+	}
+	// The tree state only describes the commit the toolchain saw
+	b.Modified = b.Commit == vcs["vcs.revision"] && vcs["vcs.modified"] == "true"
+	return b
+})
+
+// String gives the build in one line for banners and bug reports, such as
+// "1.2.1 (3f9a1c0b2d4e, 2025-06-01T09:00:00Z, go1.24.1)".
+func (b BuildInfo) String() string {
+	details := []string{}
+	if c := b.ShortCommit(); c != "" {
+		if b.Modified {
+			c += "+dirty"
+		}
+		details = append(details, c)
+	}
+	if b.BuildDate != "" {
+		details = append(details, b.BuildDate)
+	}
+	details = append(details, b.GoVersion)
+	return b.Version + " (" + strings.Join(details, ", ") + ")"
+}
+
+// ShortCommit is the first 12 characters of the commit, or "" when it is
+// unknown.
+func (b BuildInfo) ShortCommit() string {
+	return b.Commit[:min(len(b.Commit), 12)]
+}
+
+// modelOwner is the owned_by of the models /v1/models lists, naming the
+// build that serves them, such as "gemini-proxy/1.2.1-3f9a1c0b2d4e".
+func modelOwner() string {
+	b := Build()
+	if c := b.ShortCommit(); c != "" {
+		return "gemini-proxy/" + b.Version + "-" + c
+	}
+	return "gemini-proxy/" + b.Version
+}
+
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Build())
+}
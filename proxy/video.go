@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// videoPrompt is sent with a video that arrives without a message, such as
+// a screen recording of a bug.
+const videoPrompt = "Watch this recording. Describe what happens, and if it shows a bug, say which part of the project is most likely responsible."
+
+const (
+	videoPollInterval   = 2 * time.Second
+	videoProcessTimeout = 5 * time.Minute
+)
+
+// sniffVideo detects the video formats Gemini accepts from their headers,
+// using the MIME types Gemini expects. It returns "" for anything else.
+func sniffVideo(data []byte) string {
+	switch {
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		switch string(data[8:12]) {
+		case "qt  ":
+			return "video/mov"
+		case "3gp4", "3gp5", "3gp6", "3g2a":
+			return "video/3gpp"
+		case "M4A ", "M4B ":
+			return "" // AAC audio in an MP4 container
+		}
+		return "video/mp4"
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		return "video/webm"
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "AVI ":
+		return "video/avi"
+	case bytes.HasPrefix(data, []byte("FLV")):
+		return "video/x-flv"
+	case bytes.HasPrefix(data, []byte{0x00, 0x00, 0x01, 0xBA}) || bytes.HasPrefix(data, []byte{0x00, 0x00, 0x01, 0xB3}):
+		return "video/mpeg"
+	case bytes.HasPrefix(data, []byte{0x30, 0x26, 0xB2, 0x75, 0x8E, 0x66, 0xCF, 0x11}):
+		return "video/wmv"
+	}
+	return ""
+}
+
+// hasVideo reports whether any part is a video.
+func hasVideo(parts []genai.Part) bool {
+	for _, p := range parts {
+		if p.FileData != nil && strings.HasPrefix(p.FileData.MIMEType, "video/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cappedReader fails once more than max bytes have been read.
+type cappedReader struct {
+	r      io.Reader
+	n, max int64
+	over   bool
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.n > c.max {
+		c.over = true
+		return n, fmt.Errorf("file is larger than %d MB", c.max>>20)
+	}
+	return n, err
+}
+
+// uploadVideo streams a video to the Gemini Files API, which takes files
+// too large to send inline, and waits until it has been processed and can
+// be referenced in a chat turn. On failure it also returns the HTTP status
+// to report.
+func (s *Server) uploadVideo(ctx context.Context, name, mimeType string, r io.Reader) (*upload, int, error) {
+	lg := s.requestLogger(ctx)
+	body := &cappedReader{r: r, max: int64(s.cfg.Uploads.MaxVideoMB) << 20}
+	file, err := s.client.Files.Upload(ctx, body, &genai.UploadFileConfig{MIMEType: mimeType, DisplayName: name})
+	if body.over {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("%s is larger than %d MB", name, s.cfg.Uploads.MaxVideoMB)
+	}
+	if err != nil {
+		return nil, http.StatusBadGateway, fmt.Errorf("uploading %s to the Files API: %w", name, err)
+	}
+	lg.Info("video uploaded", "name", name, "file", file.Name, "bytes", body.n)
+
+	deadline := time.Now().Add(videoProcessTimeout)
+	for file.State == genai.FileStateProcessing {
+		if time.Now().After(deadline) {
+			return nil, http.StatusGatewayTimeout, fmt.Errorf("%s is still being processed after %s", name, videoProcessTimeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, http.StatusRequestTimeout, ctx.Err()
+		case <-time.After(videoPollInterval):
+		}
+		if file, err = s.client.Files.Get(ctx, file.Name, nil); err != nil {
+			return nil, http.StatusBadGateway, fmt.Errorf("checking %s: %w", name, err)
+		}
+	}
+	if file.State == genai.FileStateFailed {
+		msg := "processing failed"
+		if file.Error != nil && file.Error.Message != "" {
+			msg = file.Error.Message
+		}
+		return nil, http.StatusUnprocessableEntity, fmt.Errorf("%s: %s", name, msg)
+	}
+
+	return &upload{
+		Attachment: Attachment{
+			ID:       newRequestID(),
+			Name:     name,
+			MimeType: mimeType,
+			Size:     int(body.n),
+		},
+		fileURI: file.URI,
+	}, 0, nil
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+// warmupTimeout bounds the warm-up request and each keep-warm lookup.
+const warmupTimeout = 30 * time.Second
+
+// FirstTokenLatency sums up the time to first token of the upstream calls
+// of one kind.
+type FirstTokenLatency struct {
+	Count  int64 `json:"count"`
+	AvgMs  int64 `json:"avg_ms"`
+	LastMs int64 `json:"last_ms"`
+	MaxMs  int64 `json:"max_ms"`
+}
+
+// WarmupStatus is how the startup warm-up went and how often the
+// connection has been kept warm since.
+type WarmupStatus struct {
+	At           time.Time `json:"at"`
+	Model        string    `json:"model"`
+	FirstTokenMs int64     `json:"first_token_ms"`
+	Error        string    `json:"error,omitempty"`
+	Pings        int64     `json:"pings"`
+	LastPing     time.Time `json:"last_ping,omitzero"`
+}
+
+// FirstTokenStatus is the first_token section of /status. Cold calls had
+// to open a new connection to the Gemini API; warm ones reused an open
+// one. Calls answered from the response cache or a recording are left out.
+type FirstTokenStatus struct {
+	Cold   FirstTokenLatency `json:"cold"`
+	Warm   FirstTokenLatency `json:"warm"`
+	Warmup *WarmupStatus     `json:"warmup,omitempty"`
+}
+
+type latencyTotals struct {
+	count           int64
+	sum, last, most time.Duration
+}
+
+func (t *latencyTotals) add(d time.Duration) {
+	t.count++
+	t.sum += d
+	t.last = d
+	t.most = max(t.most, d)
+}
+
+func (t latencyTotals) report() FirstTokenLatency {
+	l := FirstTokenLatency{Count: t.count, LastMs: t.last.Milliseconds(), MaxMs: t.most.Milliseconds()}
+	if t.count > 0 {
+		l.AvgMs = (t.sum / time.Duration(t.count)).Milliseconds()
+	}
+	return l
+}
+
+// upstreamLatency tracks first-token latency by connection state for
+// /status, and when the last call went upstream, for the keep-warm loop.
+type upstreamLatency struct {
+	lastCall atomic.Int64 // Unix nanoseconds
+
+	mu         sync.Mutex
+	cold, warm latencyTotals
+	warmup     *WarmupStatus
+}
+
+func (l *upstreamLatency) status() FirstTokenStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st := FirstTokenStatus{Cold: l.cold.report(), Warm: l.warm.report()}
+	if l.warmup != nil {
+		w := *l.warmup
+		st.Warmup = &w
+	}
+	return st
+}
+
+// Connection states of an upstream call
+const (
+	connUnknown int32 = iota
+	connCold
+	connWarm
+)
+
+// upstreamConn is where connTraceTransport notes whether an upstream call
+// found a connection open. Retries keep the state of the first attempt.
+type upstreamConn struct {
+	state atomic.Int32
+}
+
+// withUpstreamConn prepares ctx to learn the connection state of the
+// upstream call made with it.
+func withUpstreamConn(ctx context.Context) (context.Context, *upstreamConn) {
+	c := &upstreamConn{}
+	return context.WithValue(ctx, upstreamConnKey, c), c
+}
+
+// observeFirstToken records the time to first token of an upstream call
+// under the state of its connection. Calls that never reached the network
+// are not recorded.
+func (s *Server) observeFirstToken(c *upstreamConn, d time.Duration) {
+	state := c.state.Load()
+	if state == connUnknown {
+		return
+	}
+	s.latency.mu.Lock()
+	defer s.latency.mu.Unlock()
+	if state == connCold {
+		s.latency.cold.add(d)
+	} else {
+		s.latency.warm.add(d)
+	}
+}
+
+// connTraceTransport notes when calls go upstream and, for calls made
+// with withUpstreamConn, whether they reused an open connection.
+type connTraceTransport struct {
+	s    *Server
+	base http.RoundTripper
+}
+
+func (t *connTraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.s.latency.lastCall.Store(time.Now().UnixNano())
+	if c, ok := req.Context().Value(upstreamConnKey).(*upstreamConn); ok {
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+			state := connCold
+			if info.Reused {
+				state = connWarm
+			}
+			c.state.CompareAndSwap(connUnknown, state)
+		}}
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	}
+	return t.base.RoundTrip(req)
+}
+
+// KeepWarm sends a one-token request to the default model, so the first
+// real request finds the connection open and the model ready, then keeps
+// the connection open until ctx is done by looking up the model whenever
+// no call has gone upstream for warmup.interval_seconds. It does nothing
+// unless warmup is enabled, or in record and replay mode.
+func (s *Server) KeepWarm(ctx context.Context) {
+	if !s.cfg.Warmup.Enabled || s.cfg.Replay.Mode != "" {
+		return
+	}
+	model := s.cfg.Model
+	st := &WarmupStatus{At: time.Now().UTC(), Model: model}
+	wctx, cancel := context.WithTimeout(ctx, warmupTimeout)
+	start := time.Now()
+	res, err := s.client.Models.GenerateContent(wctx, model, genai.Text("Hi"), &genai.GenerateContentConfig{MaxOutputTokens: 1})
+	cancel()
+	st.FirstTokenMs = time.Since(start).Milliseconds()
+	if err != nil {
+		st.Error = err.Error()
+		s.logger.Warn("model warm-up failed", "model", model, "error", err)
+	} else {
+		s.recordUsage(ctx, model, res)
+		if _, err := s.store.AddCost(ctx, calculateCost(model, res)); err != nil {
+			s.logger.Warn("recording cost", "error", err)
+		}
+		s.logger.Info("model warmed up", "model", model, "first_token_ms", st.FirstTokenMs)
+	}
+	s.latency.mu.Lock()
+	s.latency.warmup = st
+	s.latency.mu.Unlock()
+	s.latency.lastCall.Store(time.Now().UnixNano())
+
+	interval := time.Duration(s.cfg.Warmup.IntervalSeconds) * time.Second
+	if interval <= 0 {
+		return
+	}
+	for {
+		timer := time.NewTimer(interval - time.Since(time.Unix(0, s.latency.lastCall.Load())))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if time.Since(time.Unix(0, s.latency.lastCall.Load())) < interval {
+			continue
+		}
+		s.latency.lastCall.Store(time.Now().UnixNano())
+		pctx, cancel := context.WithTimeout(ctx, warmupTimeout)
+		_, err := s.client.Models.Get(pctx, model, nil)
+		cancel()
+		if err != nil {
+			s.logger.Debug("keep-warm lookup failed", "model", model, "error", err)
+			continue
+		}
+		s.latency.mu.Lock()
+		s.latency.warmup.Pings++
+		s.latency.warmup.LastPing = time.Now().UTC()
+		s.latency.mu.Unlock()
+	}
+}
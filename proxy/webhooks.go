@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"customgemini/config"
+)
+
+// webhookTimeout bounds each webhook call.
+const webhookTimeout = 10 * time.Second
+
+// postJSON POSTs body to url, signed with secret when it is set, and fails
+// on any status but 2xx.
+func postJSON(ctx context.Context, url string, body []byte, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// FileWrite is a file written during a turn, with the lines its writes
+// changed in total.
+type FileWrite struct {
+	Path string `json:"path"`
+	DiffSummary
+}
+
+// Diffstat totals the files a turn wrote.
+type Diffstat struct {
+	Files   int `json:"files"`
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+}
+
+// FileWriteEvent is what write hooks are sent, in the json format, after a
+// turn whose tools wrote files.
+type FileWriteEvent struct {
+	Event     string      `json:"event"` // "files_written"
+	Time      time.Time   `json:"time"`
+	RequestID string      `json:"request_id"`
+	Endpoint  string      `json:"endpoint,omitempty"`
+	Workspace string      `json:"workspace,omitempty"`
+	Session   string      `json:"session,omitempty"`
+	Message   string      `json:"message"` // The turn's message, shortened
+	Files     []FileWrite `json:"files"`
+	Diffstat  Diffstat    `json:"diffstat"`
+}
+
+// writeEvent describes the files the turn wrote, or returns nil when it
+// wrote none. Files written more than once are reported once, in the
+// order they were first written.
+func (j *turnJournal) writeEvent() *FileWriteEvent {
+	var files []FileWrite
+	index := map[string]int{}
+	for _, e := range j.Tools {
+		if e.Tool != "write_file" || e.Status != journalDone || e.Diff == nil {
+			continue
+		}
+		i, seen := index[e.Path]
+		if !seen {
+			i = len(files)
+			index[e.Path] = i
+			files = append(files, FileWrite{Path: e.Path, DiffSummary: DiffSummary{Created: e.Diff.Created}})
+		}
+		files[i].Added += e.Diff.Added
+		files[i].Removed += e.Diff.Removed
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	ev := &FileWriteEvent{
+		Event:     "files_written",
+		Time:      time.Now().UTC(),
+		RequestID: j.RequestID,
+		Endpoint:  j.Endpoint,
+		Workspace: j.Workspace,
+		Session:   j.Session,
+		Message:   preview(j.Message, 200),
+		Files:     files,
+	}
+	for _, f := range files {
+		ev.Diffstat.Files++
+		ev.Diffstat.Added += f.Added
+		ev.Diffstat.Removed += f.Removed
+	}
+	return ev
+}
+
+// slackText renders the event as a Slack message.
+func (ev *FileWriteEvent) slackText() string {
+	var b strings.Builder
+	who := "A request"
+	if ev.Session != "" {
+		who = "Session `" + ev.Session + "`"
+	}
+	if ev.Workspace != "" {
+		who += " in workspace `" + ev.Workspace + "`"
+	}
+	fmt.Fprintf(&b, "%s wrote %d file(s) (+%d -%d)", who, ev.Diffstat.Files, ev.Diffstat.Added, ev.Diffstat.Removed)
+	if ev.Message != "" {
+		fmt.Fprintf(&b, " for: _%s_", ev.Message)
+	}
+	for _, f := range ev.Files {
+		fmt.Fprintf(&b, "\n• `%s` +%d -%d", f.Path, f.Added, f.Removed)
+		if f.Created {
+			b.WriteString(" (new)")
+		}
+	}
+	return b.String()
+}
+
+// notifyWrites sends the files a turn wrote to every write hook, in the
+// background. Failures are logged.
+func (s *Server) notifyWrites(ctx context.Context, j *turnJournal) {
+	if len(s.cfg.WriteHooks) == 0 {
+		return
+	}
+	ev := j.writeEvent()
+	if ev == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	for _, hook := range s.cfg.WriteHooks {
+		go func() {
+			var v any = ev
+			if hook.Format == config.WriteHookSlack {
+				v = map[string]string{"text": ev.slackText()}
+			}
+			body, err := json.Marshal(v)
+			if err == nil {
+				err = postJSON(ctx, hook.URL, body, hook.Secret)
+			}
+			if err != nil {
+				s.requestLogger(ctx).Warn("write hook failed", "files", ev.Diffstat.Files, "error", err)
+			}
+		}()
+	}
+}
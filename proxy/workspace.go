@@ -0,0 +1,328 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"customgemini/config"
+
+	"google.golang.org/genai"
+)
+
+// workspace is a tenant of the proxy, configured under workspaces and
+// selected by the API key a request presents. Requests without one run
+// against the server's own project, cache and sessions.
+type workspace struct {
+	name        string
+	cfg         config.WorkspaceConfig
+	projectRoot string       // Absolute
+	store       SessionStore // The server's store, scoped to the workspace
+	prompts     *promptLibrary
+}
+
+// serverWideEndpoints are the endpoints that see every workspace at once:
+// logs, tool activity, captures, scheduled jobs, spend by model, the
+// semantic indexes of the server's project and sessions, the context
+// caches of the API key and the administration of the server. They are
+// refused to workspace keys.
+var serverWideEndpoints = []string{"/logs/", "/activity", "/debug/", "/jobs", "/dashboard/", "/index", "/caches", "/admin/"}
+
+// loadWorkspaces resolves the configured workspaces, indexed by their keys.
+func (s *Server) loadWorkspaces() error {
+	for name, wc := range s.cfg.Workspaces {
+		root, err := filepath.Abs(wc.ProjectRoot)
+		if err != nil {
+			return fmt.Errorf("workspace %s: %w", name, err)
+		}
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			return fmt.Errorf("workspace %s: project_root %s is not a directory", name, root)
+		}
+		ws := &workspace{name: name, cfg: wc, projectRoot: root}
+		ws.store = &workspaceStore{SessionStore: s.store, ws: ws}
+		ws.prompts = &promptLibrary{dir: filepath.Join(s.home, "workspaces", name, "prompts")}
+		if s.workspaces == nil {
+			s.workspaces = make(map[string]*workspace)
+		}
+		for _, key := range wc.Keys {
+			s.workspaces[key] = ws
+		}
+	}
+	return nil
+}
+
+// withWorkspace runs each request in the workspace its API key selects.
+// Once workspaces are configured, every request needs a workspace key,
+// except those for the web UI's page and assets and for /metrics.
+func (s *Server) withWorkspace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(s.workspaces) == 0 || r.URL.Path == "/" || r.URL.Path == "/metrics" || strings.HasPrefix(r.URL.Path, "/assets/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ws := s.workspaces[requestAPIKey(r)]
+		if ws == nil {
+			http.Error(w, "A workspace API key is required", http.StatusUnauthorized)
+			return
+		}
+		for _, prefix := range serverWideEndpoints {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				http.Error(w, "Not available to workspaces", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), workspaceKey, ws)))
+	})
+}
+
+// workspaceNamed returns the workspace configured under name, or nil.
+func (s *Server) workspaceNamed(name string) *workspace {
+	for _, ws := range s.workspaces {
+		if ws.name == name {
+			return ws
+		}
+	}
+	return nil
+}
+
+func workspaceFrom(ctx context.Context) *workspace {
+	ws, _ := ctx.Value(workspaceKey).(*workspace)
+	return ws
+}
+
+// sessions returns the session store as the request's workspace sees it.
+func (s *Server) sessions(ctx context.Context) SessionStore {
+	if ws := workspaceFrom(ctx); ws != nil {
+		return ws.store
+	}
+	return s.store
+}
+
+// promptLibrary returns the prompt library of the request's workspace.
+// Each workspace keeps its own under <home>/workspaces/<name>/prompts.
+func (s *Server) promptLibrary(ctx context.Context) *promptLibrary {
+	if ws := workspaceFrom(ctx); ws != nil {
+		return ws.prompts
+	}
+	return s.prompts
+}
+
+// root returns the project directory the request's file tools work in.
+func (s *Server) root(ctx context.Context) string {
+	if ws := workspaceFrom(ctx); ws != nil {
+		return ws.projectRoot
+	}
+	return s.projectRoot
+}
+
+// toolPolicy returns the tool policy of the request's workspace.
+func (s *Server) toolPolicy(ctx context.Context) string {
+	if ws := workspaceFrom(ctx); ws != nil && ws.cfg.ToolPolicy != "" {
+		return ws.cfg.ToolPolicy
+	}
+	return s.cfg.ToolPolicy
+}
+
+// scopedSession qualifies a session ID with the request's workspace, for
+// state kept outside the session store, such as uploads.
+func scopedSession(ctx context.Context, id string) string {
+	if ws := workspaceFrom(ctx); ws != nil {
+		return ws.name + ":" + id
+	}
+	return id
+}
+
+// checkCacheID refuses a cache named by a workspace request other than
+// the workspace's own, since every cache is readable with the server's key.
+func checkCacheID(ctx context.Context, name string) error {
+	if ws := workspaceFrom(ctx); ws != nil && name != "" && name != ws.cfg.CacheID {
+		return fmt.Errorf("cache %s does not belong to workspace %s", name, ws.name)
+	}
+	return nil
+}
+
+// spentToday returns what the workspace has spent since midnight UTC.
+func (ws *workspace) spentToday(ctx context.Context) (float64, error) {
+	usage, err := ws.store.Usage(ctx, []string{time.Now().UTC().Format(dayLayout)})
+	if err != nil {
+		return 0, err
+	}
+	spent := 0.0
+	for _, d := range usage {
+		for _, cost := range d.Sessions {
+			spent += cost
+		}
+	}
+	return spent, nil
+}
+
+// checkBudget refuses a generation request once the request's workspace
+// has spent its daily budget. A store failure lets the request through.
+func (s *Server) checkBudget(ctx context.Context) error {
+	ws := workspaceFrom(ctx)
+	if ws == nil || ws.cfg.DailyBudgetUSD <= 0 {
+		return nil
+	}
+	spent, err := ws.spentToday(ctx)
+	if err != nil {
+		s.requestLogger(ctx).Warn("reading workspace spend", "workspace", ws.name, "error", err)
+		return nil
+	}
+	if spent >= ws.cfg.DailyBudgetUSD {
+		return fmt.Errorf("workspace %s has spent its daily budget of $%.2f", ws.name, ws.cfg.DailyBudgetUSD)
+	}
+	return nil
+}
+
+// WorkspaceStatus is the /status report of the request's workspace.
+type WorkspaceStatus struct {
+	Name           string  `json:"name"`
+	DailyBudgetUSD float64 `json:"daily_budget_usd,omitempty"`
+	SpentToday     float64 `json:"spent_today"`
+}
+
+// workspaceStore is the session store as a workspace sees it. Its
+// sessions are stored under IDs prefixed with the workspace name and a
+// colon, and its usage is recorded under the same prefix, with calls
+// outside a session under the bare prefix. Session IDs from /chat are not
+// checked and may hold colons; the prefixes still keep workspaces apart
+// because workspace names cannot contain one (see validWorkspaceName).
+// The active cache is the workspace's configured one. The cost total is
+// the workspace's spend over the usage retention period.
+type workspaceStore struct {
+	SessionStore
+	ws *workspace
+}
+
+func (st *workspaceStore) id(id string) string {
+	return st.ws.name + ":" + id
+}
+
+// own strips the workspace prefix from id, reporting whether it had one.
+func (st *workspaceStore) own(id string) (string, bool) {
+	return strings.CutPrefix(id, st.ws.name+":")
+}
+
+func (st *workspaceStore) History(ctx context.Context, id string) ([]*genai.Content, error) {
+	return st.SessionStore.History(ctx, st.id(id))
+}
+
+func (st *workspaceStore) SetHistory(ctx context.Context, id string, history []*genai.Content) error {
+	return st.SessionStore.SetHistory(ctx, st.id(id), history)
+}
+
+// Reset drops the workspace's sessions only.
+func (st *workspaceStore) Reset(ctx context.Context) error {
+	list, err := st.ListSessions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, info := range list {
+		if err := st.DeleteSession(ctx, info.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *workspaceStore) Sessions(ctx context.Context) (int, error) {
+	list, err := st.ListSessions(ctx)
+	return len(list), err
+}
+
+func (st *workspaceStore) ListSessions(ctx context.Context) ([]SessionInfo, error) {
+	all, err := st.SessionStore.ListSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list []SessionInfo
+	for _, info := range all {
+		if id, ok := st.own(info.ID); ok {
+			info.ID = id
+			list = append(list, info)
+		}
+	}
+	return list, nil
+}
+
+func (st *workspaceStore) SessionInfo(ctx context.Context, id string) (*SessionInfo, error) {
+	info, err := st.SessionStore.SessionInfo(ctx, st.id(id))
+	if info != nil {
+		info.ID = id
+	}
+	return info, err
+}
+
+func (st *workspaceStore) CreateSession(ctx context.Context, id, title string) error {
+	return st.SessionStore.CreateSession(ctx, st.id(id), title)
+}
+
+func (st *workspaceStore) DeleteSession(ctx context.Context, id string) error {
+	return st.SessionStore.DeleteSession(ctx, st.id(id))
+}
+
+func (st *workspaceStore) SetSessionSummary(ctx context.Context, id string, sum SessionSummary) error {
+	return st.SessionStore.SetSessionSummary(ctx, st.id(id), sum)
+}
+
+// AddCost adds to the server's total and returns the workspace's.
+func (st *workspaceStore) AddCost(ctx context.Context, cost float64) (float64, error) {
+	if _, err := st.SessionStore.AddCost(ctx, cost); err != nil {
+		return 0, err
+	}
+	return st.TotalCost(ctx)
+}
+
+func (st *workspaceStore) TotalCost(ctx context.Context) (float64, error) {
+	now := time.Now().UTC()
+	days := make([]string, UsageRetentionDays)
+	for i := range days {
+		days[i] = now.AddDate(0, 0, -i).Format(dayLayout)
+	}
+	usage, err := st.Usage(ctx, days)
+	if err != nil {
+		return 0, err
+	}
+	total := 0.0
+	for _, d := range usage {
+		for _, cost := range d.Sessions {
+			total += cost
+		}
+	}
+	return total, nil
+}
+
+func (st *workspaceStore) RecordUsage(ctx context.Context, day, model, session string, u UsageTotals) error {
+	return st.SessionStore.RecordUsage(ctx, day, model, st.id(session), u)
+}
+
+// Usage returns the workspace's cost by session. The totals by model are
+// the server's, as they are not kept by workspace.
+func (st *workspaceStore) Usage(ctx context.Context, days []string) ([]DailyUsage, error) {
+	all, err := st.SessionStore.Usage(ctx, days)
+	if err != nil {
+		return nil, err
+	}
+	for i := range all {
+		sessions := make(map[string]float64)
+		for id, cost := range all[i].Sessions {
+			if id, ok := st.own(id); ok {
+				sessions[id] += cost
+			}
+		}
+		all[i].Sessions = sessions
+	}
+	return all, nil
+}
+
+func (st *workspaceStore) ActiveCache(context.Context) (string, string, error) {
+	return st.ws.cfg.CacheID, "", nil
+}
+
+func (st *workspaceStore) SetActiveCache(context.Context, string, string) error {
+	return fmt.Errorf("the cache of workspace %s is set in the configuration", st.ws.name)
+}
@@ -0,0 +1,14 @@
+// Package web embeds the browser UI served by the proxy.
+package web
+
+import "embed"
+
+// IndexHTML is the html/template for the single-page UI.
+//
+//go:embed index.html
+var IndexHTML string
+
+// Assets holds the vendored scripts and styles under assets/.
+//
+//go:embed assets/*
+var Assets embed.FS